@@ -0,0 +1,268 @@
+// Package crdt implements a replicated text sequence (RGA) that can be edited offline
+// and merged in any order.
+//
+// Every character is an Item with a globally unique ID made of the replica (client) that
+// created it and a Lamport clock. An item is placed right after its origin (the character
+// to its left when it was typed); items sharing an origin are ordered by descending ID.
+// Deleted characters stay in the sequence as tombstones so later inserts can still find them.
+//
+// Replicas exchange state vectors (highest clock seen per client) and reply with an Update
+// holding whatever the other side is missing, in the spirit of Yjs' sync protocol.
+package crdt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ClientID identifies a replica. 0 is reserved for the server.
+type ClientID uint32
+
+// ServerClientID is used for items the server creates itself (e.g. when converting existing content)
+const ServerClientID ClientID = 0
+
+// MaxPending caps how many items, and separately how many deletions, a replica keeps waiting
+// for what they refer to. Anything past it would only grow the stored state of a document.
+const MaxPending = 10000
+
+// ErrOutOfRange is returned when a local edit addresses a position outside the document
+var ErrOutOfRange = errors.New("crdt: position out of range")
+
+// ErrInvalidItem is returned when an update holds an item no replica could have created
+var ErrInvalidItem = errors.New("crdt: invalid item")
+
+// ID uniquely identifies an item across all replicas
+type ID struct {
+	Client ClientID `json:"client"`
+	Clock  uint64   `json:"clock"`
+}
+
+// after reports whether id sorts after other; concurrent siblings are ordered by descending ID
+func (id ID) after(other ID) bool {
+	if id.Clock != other.Clock {
+		return id.Clock > other.Clock
+	}
+	return id.Client > other.Client
+}
+
+// Item is a single character in the sequence
+type Item struct {
+	ID      ID     `json:"id"`
+	Origin  *ID    `json:"origin,omitempty"` // item to the left when inserted; nil = start of document
+	Value   string `json:"value"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// check reports whether the item could have been created by Insert: it holds one character and
+// its origin was known to its replica, so has a lower clock. Anything else (an item naming itself
+// or a later item as its origin) could never be integrated.
+func (item Item) check() error {
+	if utf8.RuneCountInString(item.Value) != 1 {
+		return fmt.Errorf("%w: %d:%d must hold exactly one character", ErrInvalidItem, item.ID.Client, item.ID.Clock)
+	}
+	if item.Origin != nil && item.Origin.Clock >= item.ID.Clock {
+		return fmt.Errorf("%w: %d:%d can't follow %d:%d", ErrInvalidItem, item.ID.Client, item.ID.Clock, item.Origin.Client, item.Origin.Clock)
+	}
+	return nil
+}
+
+// StateVector records the highest clock seen from each client
+type StateVector map[ClientID]uint64
+
+// Doc is one replica of a text document
+type Doc struct {
+	client ClientID
+	clock  uint64 // Lamport clock: greater than every clock seen so far
+	items  []*Item
+	index  map[ID]*Item
+	sv     StateVector
+
+	// Updates that arrived before the items they depend on
+	pendingItems   []Item
+	pendingDeletes []ID
+}
+
+// NewDoc returns an empty document for the given replica
+func NewDoc(client ClientID) *Doc {
+	return &Doc{
+		client: client,
+		index:  make(map[ID]*Item),
+		sv:     make(StateVector),
+	}
+}
+
+// FromText returns a document whose initial content was typed by the given replica
+func FromText(client ClientID, text string) *Doc {
+	d := NewDoc(client)
+	d.Insert(0, text)
+	return d
+}
+
+// Text returns the visible content of the document
+func (d *Doc) Text() string {
+	var b strings.Builder
+	for _, item := range d.items {
+		if !item.Deleted {
+			b.WriteString(item.Value)
+		}
+	}
+	return b.String()
+}
+
+// Len returns the number of visible characters
+func (d *Doc) Len() int {
+	n := 0
+	for _, item := range d.items {
+		if !item.Deleted {
+			n++
+		}
+	}
+	return n
+}
+
+// StateVector returns a copy of the document's state vector
+func (d *Doc) StateVector() StateVector {
+	sv := make(StateVector, len(d.sv))
+	for client, clock := range d.sv {
+		sv[client] = clock
+	}
+	return sv
+}
+
+// visibleItem returns the index in d.items of the pos-th visible character
+func (d *Doc) visibleItem(pos int) int {
+	seen := 0
+	for i, item := range d.items {
+		if item.Deleted {
+			continue
+		}
+		if seen == pos {
+			return i
+		}
+		seen++
+	}
+	return -1
+}
+
+// Insert types text at a visible position and returns the update to send to other replicas
+func (d *Doc) Insert(pos int, text string) (Update, error) {
+	if pos < 0 || pos > d.Len() {
+		return Update{}, ErrOutOfRange
+	}
+
+	var origin *ID
+	if pos > 0 {
+		left := d.items[d.visibleItem(pos-1)].ID
+		origin = &left
+	}
+
+	var update Update
+	for _, r := range text {
+		d.clock++
+		item := Item{ID: ID{Client: d.client, Clock: d.clock}, Origin: origin, Value: string(r)}
+		d.integrate(item)
+		update.Items = append(update.Items, item)
+
+		id := item.ID
+		origin = &id
+	}
+	return update, nil
+}
+
+// Delete removes n visible characters starting at pos and returns the update to send
+func (d *Doc) Delete(pos, n int) (Update, error) {
+	if pos < 0 || n < 0 || pos+n > d.Len() {
+		return Update{}, ErrOutOfRange
+	}
+
+	var update Update
+	for ; n > 0; n-- {
+		item := d.items[d.visibleItem(pos)]
+		item.Deleted = true
+		update.Deletes = append(update.Deletes, item.ID)
+	}
+	return update, nil
+}
+
+// integrate places a new item into the sequence. The caller guarantees its origin is known.
+func (d *Doc) integrate(item Item) {
+	i := 0
+	if item.Origin != nil {
+		i = d.position(*item.Origin) + 1
+	}
+
+	// Skip over siblings (and their descendants) with a greater ID. Descendants always have
+	// a greater clock than their ancestor, so the first smaller ID marks the insertion point.
+	for i < len(d.items) && d.items[i].ID.after(item.ID) {
+		i++
+	}
+
+	stored := item
+	d.items = append(d.items, nil)
+	copy(d.items[i+1:], d.items[i:])
+	d.items[i] = &stored
+	d.index[item.ID] = &stored
+
+	if item.ID.Clock > d.clock {
+		d.clock = item.ID.Clock
+	}
+	if item.ID.Clock > d.sv[item.ID.Client] {
+		d.sv[item.ID.Client] = item.ID.Clock
+	}
+}
+
+// position returns the index of a known item in d.items
+func (d *Doc) position(id ID) int {
+	for i, item := range d.items {
+		if item.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// snapshot is the persisted form of a document
+type snapshot struct {
+	Client         ClientID `json:"client"`
+	Items          []*Item  `json:"items"`
+	PendingItems   []Item   `json:"pendingItems,omitempty"`
+	PendingDeletes []ID     `json:"pendingDeletes,omitempty"`
+}
+
+// MarshalJSON encodes the full replica state (including tombstones) for storage
+func (d *Doc) MarshalJSON() ([]byte, error) {
+	return json.Marshal(snapshot{
+		Client:         d.client,
+		Items:          d.items,
+		PendingItems:   d.pendingItems,
+		PendingDeletes: d.pendingDeletes,
+	})
+}
+
+// UnmarshalJSON restores a replica saved with MarshalJSON
+func (d *Doc) UnmarshalJSON(data []byte) error {
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+
+	restored := NewDoc(snap.Client)
+	for _, item := range snap.Items {
+		restored.items = append(restored.items, item)
+		restored.index[item.ID] = item
+		if item.ID.Clock > restored.clock {
+			restored.clock = item.ID.Clock
+		}
+		if item.ID.Clock > restored.sv[item.ID.Client] {
+			restored.sv[item.ID.Client] = item.ID.Clock
+		}
+	}
+	restored.pendingItems = snap.PendingItems
+	restored.pendingDeletes = snap.PendingDeletes
+
+	*d = *restored
+	return nil
+}
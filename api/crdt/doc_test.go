@@ -0,0 +1,108 @@
+package crdt
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func mustInsert(t *testing.T, d *Doc, pos int, text string) Update {
+	t.Helper()
+	update, err := d.Insert(pos, text)
+	if err != nil {
+		t.Fatalf("insert %q at %d into %q: %v", text, pos, d.Text(), err)
+	}
+	return update
+}
+
+func mustDelete(t *testing.T, d *Doc, pos, n int) Update {
+	t.Helper()
+	update, err := d.Delete(pos, n)
+	if err != nil {
+		t.Fatalf("delete %d at %d from %q: %v", n, pos, d.Text(), err)
+	}
+	return update
+}
+
+func TestLocalEdits(t *testing.T) {
+	d := FromText(1, "héllo")
+	mustInsert(t, d, 5, " world")
+	mustInsert(t, d, 0, ">")
+	mustDelete(t, d, 1, 1)
+
+	if got := d.Text(); got != ">éllo world" {
+		t.Fatalf("got %q, want %q", got, ">éllo world")
+	}
+	if got := d.Len(); got != 11 {
+		t.Fatalf("got length %d, want 11", got)
+	}
+	if sv := d.StateVector(); sv[1] != 12 {
+		t.Fatalf("got clock %d for client 1, want 12", sv[1])
+	}
+}
+
+func TestLocalEditsRejectPositionsOutOfRange(t *testing.T) {
+	d := FromText(1, "abc")
+
+	if _, err := d.Insert(4, "x"); !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("insert past the end: got %v, want ErrOutOfRange", err)
+	}
+	if _, err := d.Delete(2, 2); !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("delete past the end: got %v, want ErrOutOfRange", err)
+	}
+	if got := d.Text(); got != "abc" {
+		t.Fatalf("document changed to %q", got)
+	}
+}
+
+func TestInsertsCountPositionsPastTombstones(t *testing.T) {
+	d := FromText(1, "abcd")
+	mustDelete(t, d, 1, 2)
+	mustInsert(t, d, 1, "x")
+
+	if got := d.Text(); got != "axd" {
+		t.Fatalf("got %q, want %q", got, "axd")
+	}
+}
+
+func TestJSONRoundTripKeepsTombstonesAndPendingChanges(t *testing.T) {
+	d := FromText(1, "abc")
+	mustDelete(t, d, 1, 1)
+
+	// An item and a deletion whose targets never arrived
+	lost := ID{Client: 2, Clock: 50}
+	if _, err := d.Apply(Update{
+		Items:   []Item{{ID: ID{Client: 2, Clock: 51}, Origin: &lost, Value: "z"}},
+		Deletes: []ID{{Client: 2, Clock: 40}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &Doc{}
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := restored.Text(); got != "ac" {
+		t.Fatalf("got %q, want %q", got, "ac")
+	}
+	if got := restored.Diff(StateVector{}); len(got.Deletes) != 1 {
+		t.Fatalf("tombstone lost: got deletes %v", got.Deletes)
+	}
+
+	// The restored replica keeps numbering after its own items and still waits for the lost ones
+	update := mustInsert(t, restored, 2, "d")
+	if got := update.Items[0].ID; got != (ID{Client: 1, Clock: 4}) {
+		t.Fatalf("new item got ID %v, want 1:4", got)
+	}
+	if _, err := restored.Apply(Update{Items: []Item{{ID: lost, Value: "y"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.Text(); got != "yzacd" {
+		t.Fatalf("got %q, want %q", got, "yzacd")
+	}
+}
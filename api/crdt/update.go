@@ -0,0 +1,112 @@
+package crdt
+
+import "sort"
+
+// Update carries inserted items and deleted IDs between replicas.
+// Applying the same update twice, or updates in a different order, gives the same result.
+type Update struct {
+	Items   []Item `json:"items,omitempty"`
+	Deletes []ID   `json:"deletes,omitempty"`
+}
+
+// IsEmpty reports whether the update carries no changes
+func (u Update) IsEmpty() bool {
+	return len(u.Items) == 0 && len(u.Deletes) == 0
+}
+
+// Diff returns everything a replica with the given state vector is missing: all items with
+// a higher clock than it has seen from their client, plus the full set of deletions.
+func (d *Doc) Diff(sv StateVector) Update {
+	var update Update
+	for _, item := range d.items {
+		if item.ID.Clock > sv[item.ID.Client] {
+			missing := *item
+			missing.Deleted = false // deletions travel in Deletes
+			update.Items = append(update.Items, missing)
+		}
+		if item.Deleted {
+			update.Deletes = append(update.Deletes, item.ID)
+		}
+	}
+
+	// Origins always have a lower clock than the items that reference them,
+	// so sorting by clock lets the receiver integrate the items in one pass
+	sort.Slice(update.Items, func(i, j int) bool {
+		return update.Items[j].ID.after(update.Items[i].ID)
+	})
+	return update
+}
+
+// Apply merges a remote update into the document and returns the part of it that was new,
+// which is what needs relaying to other replicas. Items whose origin hasn't arrived yet
+// are kept aside and integrated once it does; beyond MaxPending of them the newest are dropped.
+// They aren't in the state vector, so the sender offers them again on its next sync.
+// An update holding a malformed item is rejected as a whole and leaves the document unchanged.
+func (d *Doc) Apply(update Update) (Update, error) {
+	for _, item := range update.Items {
+		if err := item.check(); err != nil {
+			return Update{}, err
+		}
+	}
+
+	var applied Update
+
+	items := append(d.pendingItems, update.Items...)
+	d.pendingItems = nil
+	sort.Slice(items, func(i, j int) bool {
+		return items[j].ID.after(items[i].ID)
+	})
+	// Drop copies of items already waiting, so resending an update doesn't grow the queue
+	unique := items[:0]
+	for i, item := range items {
+		if i == 0 || item.ID != items[i-1].ID {
+			unique = append(unique, item)
+		}
+	}
+	items = unique
+
+	for progress := true; progress; {
+		progress = false
+		var waiting []Item
+		for _, item := range items {
+			if _, known := d.index[item.ID]; known {
+				continue
+			}
+			if item.Origin != nil {
+				if _, known := d.index[*item.Origin]; !known {
+					waiting = append(waiting, item)
+					continue
+				}
+			}
+			item.Deleted = false
+			d.integrate(item)
+			applied.Items = append(applied.Items, item)
+			progress = true
+		}
+		items = waiting
+	}
+	if len(items) > MaxPending {
+		items = items[:MaxPending]
+	}
+	d.pendingItems = items
+
+	deletes := append(d.pendingDeletes, update.Deletes...)
+	d.pendingDeletes = nil
+	queued := make(map[ID]bool)
+	for _, id := range deletes {
+		item, known := d.index[id]
+		if !known {
+			if !queued[id] && len(d.pendingDeletes) < MaxPending {
+				queued[id] = true
+				d.pendingDeletes = append(d.pendingDeletes, id)
+			}
+			continue
+		}
+		if !item.Deleted {
+			item.Deleted = true
+			applied.Deletes = append(applied.Deletes, id)
+		}
+	}
+
+	return applied, nil
+}
@@ -0,0 +1,224 @@
+package crdt
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// propertyRuns is how many random cases each property is checked against
+const propertyRuns = 2000
+
+// alphabet mixes one-, two- and three-byte runes so positions are checked in runes, not bytes
+var alphabet = []rune("abcxyz é日\n")
+
+func randomText(rng *rand.Rand, maxLen int) string {
+	n := rng.Intn(maxLen) + 1
+	runes := make([]rune, n)
+	for i := range runes {
+		runes[i] = alphabet[rng.Intn(len(alphabet))]
+	}
+	return string(runes)
+}
+
+// randomEdit makes a random local insert or delete and returns the update it produced
+func randomEdit(t *testing.T, rng *rand.Rand, d *Doc) Update {
+	t.Helper()
+	if n := d.Len(); n > 0 && rng.Intn(3) == 0 {
+		pos := rng.Intn(n)
+		return mustDelete(t, d, pos, rng.Intn(n-pos)+1)
+	}
+	return mustInsert(t, d, rng.Intn(d.Len()+1), randomText(rng, 4))
+}
+
+func mustApply(t *testing.T, d *Doc, update Update) Update {
+	t.Helper()
+	applied, err := d.Apply(update)
+	if err != nil {
+		t.Fatalf("apply %+v: %v", update, err)
+	}
+	return applied
+}
+
+// split breaks an update into one update per item and per deletion
+func split(update Update) []Update {
+	var parts []Update
+	for _, item := range update.Items {
+		parts = append(parts, Update{Items: []Item{item}})
+	}
+	for _, id := range update.Deletes {
+		parts = append(parts, Update{Deletes: []ID{id}})
+	}
+	return parts
+}
+
+func TestConcurrentEditsConverge(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < propertyRuns; i++ {
+		base := FromText(ServerClientID, randomText(rng, 8))
+		replicas := []*Doc{NewDoc(1), NewDoc(2), NewDoc(3)}
+		var updates []Update
+		for _, r := range replicas {
+			mustApply(t, r, base.Diff(StateVector{}))
+		}
+
+		// Every replica edits without seeing the others
+		for _, r := range replicas {
+			for n := rng.Intn(4) + 1; n > 0; n-- {
+				updates = append(updates, split(randomEdit(t, rng, r))...)
+			}
+		}
+
+		// Then each receives every piece, in its own random order and some of them twice
+		for _, r := range replicas {
+			for _, j := range rng.Perm(len(updates)) {
+				mustApply(t, r, updates[j])
+				if rng.Intn(4) == 0 {
+					mustApply(t, r, updates[rng.Intn(len(updates))])
+				}
+			}
+		}
+
+		for _, r := range replicas[1:] {
+			if r.Text() != replicas[0].Text() {
+				t.Fatalf("diverged from %q: replica 1 has %q, replica %d has %q", base.Text(), replicas[0].Text(), r.client, r.Text())
+			}
+		}
+	}
+}
+
+func TestConcurrentInsertsAtTheSamePositionDontInterleave(t *testing.T) {
+	a, b := FromText(1, "ab"), NewDoc(2)
+	mustApply(t, b, a.Diff(StateVector{}))
+
+	fromA := mustInsert(t, a, 1, "xx")
+	fromB := mustInsert(t, b, 1, "yy")
+	mustApply(t, a, fromB)
+	mustApply(t, b, fromA)
+
+	if a.Text() != b.Text() {
+		t.Fatalf("diverged: %q and %q", a.Text(), b.Text())
+	}
+	if got := a.Text(); got != "ayyxxb" && got != "axxyyb" {
+		t.Fatalf("got %q, want the two insertions kept whole", got)
+	}
+}
+
+func TestOutOfOrderDelivery(t *testing.T) {
+	a, b := NewDoc(1), NewDoc(2)
+	first := mustInsert(t, a, 0, "ab")
+	second := mustInsert(t, a, 2, "cd")
+	removal := mustDelete(t, a, 1, 2)
+
+	// Everything arrives backwards: the deletion before the items, the last item first
+	parts := append(split(first), split(second)...)
+	mustApply(t, b, removal)
+	for i := len(parts) - 1; i > 0; i-- {
+		if applied := mustApply(t, b, parts[i]); !applied.IsEmpty() {
+			t.Fatalf("part %d applied before its origin arrived: %+v", i, applied)
+		}
+	}
+	if got := b.Text(); got != "" {
+		t.Fatalf("got %q before the first item arrived, want nothing", got)
+	}
+
+	applied := mustApply(t, b, parts[0])
+	if len(applied.Items) != 4 || len(applied.Deletes) != 2 {
+		t.Fatalf("got %d items and %d deletes applied, want everything waiting: 4 and 2", len(applied.Items), len(applied.Deletes))
+	}
+	if got, want := b.Text(), a.Text(); got != want || got != "ad" {
+		t.Fatalf("got %q, want %q", got, "ad")
+	}
+}
+
+func TestTombstonesAnchorConcurrentInserts(t *testing.T) {
+	a, b := FromText(1, "abc"), NewDoc(2)
+	mustApply(t, b, a.Diff(StateVector{}))
+
+	// a deletes "b" while b types right after it
+	removal := mustDelete(t, a, 1, 1)
+	typed := mustInsert(t, b, 2, "X")
+	mustApply(t, a, typed)
+	mustApply(t, b, removal)
+
+	for _, d := range []*Doc{a, b} {
+		if got := d.Text(); got != "aXc" {
+			t.Fatalf("replica %d has %q, want %q", d.client, got, "aXc")
+		}
+	}
+
+	// A deletion applied twice is only reported once
+	if applied := mustApply(t, b, removal); !applied.IsEmpty() {
+		t.Fatalf("repeated deletion applied again: %+v", applied)
+	}
+}
+
+func TestDiffSendsOnlyWhatIsMissing(t *testing.T) {
+	a, b := FromText(1, "abc"), NewDoc(2)
+	mustApply(t, b, a.Diff(b.StateVector()))
+	mustInsert(t, a, 3, "d")
+	mustDelete(t, a, 0, 1)
+	mustInsert(t, b, 0, "z")
+
+	// Each side sends the other what its state vector lacks, as after a reconnect
+	toB := a.Diff(b.StateVector())
+	toA := b.Diff(a.StateVector())
+	if len(toB.Items) != 1 || toB.Items[0].Value != "d" {
+		t.Fatalf("got items %+v for b, want only %q", toB.Items, "d")
+	}
+	if len(toA.Items) != 1 || toA.Items[0].Value != "z" {
+		t.Fatalf("got items %+v for a, want only %q", toA.Items, "z")
+	}
+	mustApply(t, a, toA)
+	mustApply(t, b, toB)
+
+	if a.Text() != b.Text() || a.Text() != "zbcd" {
+		t.Fatalf("got %q and %q, want %q", a.Text(), b.Text(), "zbcd")
+	}
+}
+
+func TestApplyRejectsInvalidItems(t *testing.T) {
+	self := ID{Client: 2, Clock: 7}
+	later := ID{Client: 1, Clock: 9}
+	tests := map[string]Item{
+		"own origin":   {ID: self, Origin: &self, Value: "x"},
+		"later origin": {ID: self, Origin: &later, Value: "x"},
+		"empty":        {ID: self, Value: ""},
+		"two runes":    {ID: self, Value: "xy"},
+	}
+
+	for name, item := range tests {
+		d := FromText(1, "abc")
+		valid := Item{ID: ID{Client: 2, Clock: 1}, Value: "v"}
+		if _, err := d.Apply(Update{Items: []Item{valid, item}}); !errors.Is(err, ErrInvalidItem) {
+			t.Errorf("%s: got %v, want ErrInvalidItem", name, err)
+		}
+		if got := d.Text(); got != "abc" || len(d.pendingItems) != 0 {
+			t.Errorf("%s: document changed to %q with %d pending items", name, got, len(d.pendingItems))
+		}
+	}
+}
+
+func TestPendingChangesAreBounded(t *testing.T) {
+	d := NewDoc(1)
+	missing := ID{Client: 2, Clock: 1}
+
+	var update Update
+	for clock := uint64(2); clock < MaxPending+12; clock++ {
+		update.Items = append(update.Items, Item{ID: ID{Client: 2, Clock: clock}, Origin: &missing, Value: "x"})
+		update.Deletes = append(update.Deletes, ID{Client: 3, Clock: clock})
+	}
+	mustApply(t, d, update)
+	mustApply(t, d, update)
+
+	if len(d.pendingItems) != MaxPending || len(d.pendingDeletes) != MaxPending {
+		t.Fatalf("got %d pending items and %d pending deletes, want at most %d", len(d.pendingItems), len(d.pendingDeletes), MaxPending)
+	}
+
+	// The oldest are kept, so they still integrate once their origin arrives
+	applied := mustApply(t, d, Update{Items: []Item{{ID: missing, Value: "o"}}})
+	if len(applied.Items) != MaxPending+1 {
+		t.Fatalf("got %d items integrated, want %d", len(applied.Items), MaxPending+1)
+	}
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"minidocs/api/models"
+)
+
+// accessLevel describes what a user is allowed to do with a document.
+// Levels are ordered, so a higher level implies every lower one.
+type accessLevel int
+
+const (
+	accessNone         accessLevel = iota // no access at all
+	accessCollaborator                    // document has been shared with the user (view + edit)
+	accessOwner                           // user owns the document (delete, invite, revoke)
+)
+
+// closeAccessDenied is the WebSocket close code sent when a user loses access to a document
+// mid-session. 4000-4999 is reserved for applications, 4403 mirrors HTTP 403.
+const closeAccessDenied = 4403
+
+// errAccessDenied is returned when the user doesn't have the required access level
+var errAccessDenied = errors.New("access denied")
+
+// accessRecheckInterval is how often an open connection's access is re-verified before it changes the document
+const accessRecheckInterval = 30 * time.Second
+
+// documentAccess loads a document and works out the access level the given user has on it.
+// This is the single place that decides who can see a document, shared by REST and WebSocket handlers.
+func documentAccess(documentID, userID int) (*models.Document, accessLevel, error) {
+	doc, err := stores.Documents.GetDocumentByID(documentID)
+	if err != nil {
+		return nil, accessNone, err
+	}
+
+	if doc.OwnerID == userID {
+		return doc, accessOwner, nil
+	}
+
+	isShared, err := stores.Shares.IsDocumentSharedWithUser(documentID, userID)
+	if err != nil {
+		return nil, accessNone, err
+	}
+	if isShared {
+		return doc, accessCollaborator, nil
+	}
+
+	return doc, accessNone, nil
+}
+
+// checkDocumentAccess returns the document if the user has at least the required access level.
+// It returns models.ErrDocumentNotFound, errAccessDenied or a database error otherwise.
+func checkDocumentAccess(documentID, userID int, required accessLevel) (*models.Document, error) {
+	doc, level, err := documentAccess(documentID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if level < required {
+		return nil, errAccessDenied
+	}
+	return doc, nil
+}
+
+// authorizeDocument runs checkDocumentAccess for a REST handler and writes the matching
+// JSON error response on failure. It returns nil when the request should stop.
+func authorizeDocument(w http.ResponseWriter, documentID, userID int, required accessLevel, deniedMessage string) *models.Document {
+	doc, err := checkDocumentAccess(documentID, userID, required)
+	if err == nil {
+		return doc
+	}
+
+	switch {
+	case errors.Is(err, models.ErrDocumentNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Document not found"})
+	case errors.Is(err, errAccessDenied):
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: deniedMessage})
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Database error"})
+	}
+	return nil
+}
+
+// canStillEdit re-checks, at most every accessRecheckInterval, that a connected client may still edit
+// its document. Revoking a share closes sessions straight away; this catches anything that slipped
+// past that, e.g. a share removed directly in the database. Only called from the client's read pump.
+func canStillEdit(client *Client) bool {
+	if time.Since(client.accessCheckedAt) < accessRecheckInterval {
+		return true
+	}
+
+	_, err := checkDocumentAccess(client.documentID, client.userID, accessCollaborator)
+	if errors.Is(err, errAccessDenied) || errors.Is(err, models.ErrDocumentNotFound) {
+		return false
+	}
+	if err == nil {
+		client.accessCheckedAt = time.Now()
+	}
+	return true // a database error shouldn't cost the user their session
+}
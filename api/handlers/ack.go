@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"log"
+)
+
+// Reasons a message can be rejected with a "nack"
+const (
+	nackPatchFailed      = "patch-failed"      // the operation does not fit the document
+	nackStaleRevision    = "stale-revision"    // the base revision is too old (or unknown) to transform from
+	nackPermissionDenied = "permission-denied" // the user may no longer edit this document
+	nackBusy             = "busy"              // another server kept the document locked for too long
+	nackUnsupported      = "unsupported"       // the message type doesn't apply to this document (e.g. sync mode)
+	nackInternal         = "internal-error"    // the server failed to process it (e.g. a database error); retrying may work
+	nackRateLimited      = "rate-limited"      // the client is sending too fast (see ratelimit.go); retry after retryAfter
+)
+
+// nackPayload tells a client one of its messages was rejected. For edits it also carries the
+// authoritative state, so the client can drop its pending changes and carry on from there.
+type nackPayload struct {
+	Reason      string  `json:"reason"`
+	Message     string  `json:"message,omitempty"` // human-readable detail
+	Revision    int64   `json:"revision,omitempty"`
+	FullContent *string `json:"fullContent,omitempty"`
+	RetryAfter  int64   `json:"retryAfter,omitempty"` // milliseconds to wait before retrying, for rate-limited
+}
+
+// Client message IDs a document has already processed are kept in the content cache, so messages
+// retransmitted after a reconnect are acknowledged again instead of being applied twice. Edits record
+// theirs along with the edit itself (see saveDocumentState).
+
+// appliedEditRevision returns the revision an edit with this message ID produced, if it was applied
+func appliedEditRevision(documentID, userID int, messageID string) (int64, bool) {
+	return stores.Cache.EditRevision(documentID, userID, messageID)
+}
+
+// firstDelivery records a non-edit message ID and reports whether this is the first time it was seen
+func firstDelivery(documentID, userID int, messageID string) bool {
+	added, err := stores.Cache.FirstDelivery(documentID, userID, messageID)
+	if err != nil {
+		return true // can't tell; delivering twice beats losing the message
+	}
+	return added
+}
+
+// forgetDelivery removes a message ID recorded by firstDelivery, for a message that couldn't be processed
+func forgetDelivery(documentID, userID int, messageID string) {
+	stores.Cache.ForgetDelivery(documentID, userID, messageID)
+}
+
+// sendAck confirms a client message was processed
+func sendAck(client *Client, messageID string, payload interface{}) {
+	sendToClient(client, Message{
+		Type:       "ack",
+		ID:         messageID,
+		DocumentID: client.documentID,
+		UserID:     client.userID,
+		Username:   client.username,
+		Payload:    mustMarshal(payload),
+	})
+}
+
+// sendNack tells a client a message was rejected and why
+func sendNack(client *Client, messageID string, payload nackPayload) {
+	log.Printf("Rejected message %q from user %s: %s %s", messageID, client.username, payload.Reason, payload.Message)
+	sendToClient(client, Message{
+		Type:       "nack",
+		ID:         messageID,
+		DocumentID: client.documentID,
+		UserID:     client.userID,
+		Username:   client.username,
+		Payload:    mustMarshal(payload),
+	})
+}
+
+// sendEditNack rejects an edit and hands the client the current state of the document
+func sendEditNack(client *Client, messageID, reason, detail string, revision int64, content string) {
+	sendNack(client, messageID, nackPayload{
+		Reason:      reason,
+		Message:     detail,
+		Revision:    revision,
+		FullContent: &content,
+	})
+}
@@ -4,8 +4,6 @@ import (
 	"encoding/json"
 	"net/http"
 
-	"minidocs/api/config"
-	"minidocs/api/models"
 	"minidocs/api/utils"
 )
 
@@ -55,7 +53,7 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	existingUser, err := models.GetUserByUsername(config.DB, req.Username)
+	existingUser, err := stores.Users.GetUserByUsername(req.Username)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Database error"})
@@ -68,7 +66,7 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if email already exists (you might already have this)
-	existingEmail, err := models.GetUserByEmail(config.DB, req.Email)
+	existingEmail, err := stores.Users.GetUserByEmail(req.Email)
 	if err == nil && existingEmail != nil {
 		w.WriteHeader(http.StatusConflict)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Email already registered"})
@@ -76,7 +74,7 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create user in database by calling the function and capturing any error
-	err = models.CreateUser(config.DB, req.Username, req.Email, req.Password)
+	err = stores.Users.CreateUser(req.Username, req.Email, req.Password)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to create user"})
@@ -112,7 +110,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get user from database
-	user, err := models.GetUserByEmail(config.DB, req.Email)
+	user, err := stores.Users.GetUserByEmail(req.Email)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid credentials"})
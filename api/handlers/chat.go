@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"minidocs/api/middleware"
+	"minidocs/api/models"
+	"minidocs/api/utils"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// chatHistoryOnJoin is how many recent chat messages a client gets when it joins
+	chatHistoryOnJoin = 20
+	// defaultMessagePageSize and maxMessagePageSize bound a page of the REST message history
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 100
+)
+
+// UpdateMessageRequest is the body of a chat message edit
+type UpdateMessageRequest struct {
+	Text string `json:"text"`
+}
+
+// chatDeletePayload tells clients a chat message was removed
+type chatDeletePayload struct {
+	ID int `json:"id"`
+}
+
+// handleChat stores a chat message and rewrites msg.Payload into the stored message for broadcasting.
+// The author gets the stored message in its ack, so it learns the ID needed to edit or delete it.
+// It returns false when the message must not be broadcast.
+func handleChat(client *Client, msg *Message, payload *chatPayload) bool {
+	// A retransmission of a message we already stored (e.g. resent after a reconnect)
+	if msg.ID != "" && !firstDelivery(msg.DocumentID, client.userID, msg.ID) {
+		sendAck(client, msg.ID, map[string]bool{"duplicate": true})
+		return false
+	}
+
+	stored, err := stores.Messages.CreateDocumentMessage(msg.DocumentID, client.userID, payload.Text)
+	if err != nil {
+		log.Printf("[Chat] Failed to store message from %s in document %d: %v", client.username, msg.DocumentID, err)
+		if msg.ID != "" {
+			forgetDelivery(msg.DocumentID, client.userID, msg.ID) // let the client retry
+		}
+		sendNack(client, msg.ID, nackPayload{Reason: nackInternal, Message: "failed to save chat message"})
+		return false
+	}
+
+	msg.Payload = mustMarshal(stored)
+	if msg.ID != "" {
+		sendAck(client, msg.ID, stored)
+	}
+	return true
+}
+
+// sendChatHistory sends a newly joined client the latest chat messages, oldest first
+func sendChatHistory(client *Client, room *Room) {
+	messages, err := stores.Messages.GetDocumentMessages(client.documentID, 0, chatHistoryOnJoin)
+	if err != nil {
+		log.Printf("[Chat] Failed to load history of document %d: %v", client.documentID, err)
+		return
+	}
+
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	data, _ := json.Marshal(Message{
+		Type:       "chat-history",
+		DocumentID: client.documentID,
+		UserID:     client.userID,
+		Username:   client.username,
+		Payload:    json.RawMessage(mustMarshal(messages)),
+	})
+	room.sendTo(client, data)
+}
+
+// getOwnMessageOrError loads a chat message and checks it was written by the user,
+// writing the matching error response on failure
+func getOwnMessageOrError(w http.ResponseWriter, documentID, userID int, messageIDStr string) *models.DocumentMessage {
+	messageID, err := strconv.Atoi(messageIDStr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid message ID"})
+		return nil
+	}
+
+	message, err := stores.Messages.GetDocumentMessage(documentID, messageID)
+	if err != nil {
+		if errors.Is(err, models.ErrMessageNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Message not found"})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Database error"})
+		}
+		return nil
+	}
+
+	if message.UserID != userID {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "You can only change your own messages"})
+		return nil
+	}
+
+	return message
+}
+
+// GetDocumentMessages returns a page of a document's chat history, newest first:
+// ?before={messageId} to page back from a message, ?limit={n} (default 50, at most 100)
+func GetDocumentMessages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
+
+	id, ok := parseDocumentID(w, r)
+	if !ok {
+		return
+	}
+
+	if authorizeDocument(w, id, claims.UserID, accessCollaborator, "You don't have permission to view this document") == nil {
+		return
+	}
+
+	before, _ := strconv.Atoi(r.URL.Query().Get("before"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = defaultMessagePageSize
+	}
+	if limit > maxMessagePageSize {
+		limit = maxMessagePageSize
+	}
+
+	messages, err := stores.Messages.GetDocumentMessages(id, before, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to retrieve messages"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(messages)
+}
+
+// UpdateDocumentMessage edits one of the user's own chat messages and updates open editors
+func UpdateDocumentMessage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
+
+	id, ok := parseDocumentID(w, r)
+	if !ok {
+		return
+	}
+
+	if authorizeDocument(w, id, claims.UserID, accessCollaborator, "You don't have permission to edit this document") == nil {
+		return
+	}
+
+	var req UpdateMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	// Same rules as a chat message sent over the WebSocket
+	payload := chatPayload{Text: req.Text}
+	if err := payload.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	message := getOwnMessageOrError(w, id, claims.UserID, mux.Vars(r)["messageId"])
+	if message == nil {
+		return
+	}
+
+	updated, err := stores.Messages.UpdateDocumentMessage(id, message.ID, payload.Text)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to update message"})
+		return
+	}
+
+	broadcastToDocument(id, Message{
+		Type:       "chat-update",
+		DocumentID: id,
+		UserID:     claims.UserID,
+		Username:   claims.Username,
+		Payload:    mustMarshal(updated),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(updated)
+}
+
+// DeleteDocumentMessage deletes one of the user's own chat messages and removes it from open editors
+func DeleteDocumentMessage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
+
+	id, ok := parseDocumentID(w, r)
+	if !ok {
+		return
+	}
+
+	if authorizeDocument(w, id, claims.UserID, accessCollaborator, "You don't have permission to edit this document") == nil {
+		return
+	}
+
+	message := getOwnMessageOrError(w, id, claims.UserID, mux.Vars(r)["messageId"])
+	if message == nil {
+		return
+	}
+
+	if err := stores.Messages.DeleteDocumentMessage(id, message.ID); err != nil && !errors.Is(err, models.ErrMessageNotFound) {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to delete message"})
+		return
+	}
+
+	broadcastToDocument(id, Message{
+		Type:       "chat-delete",
+		DocumentID: id,
+		UserID:     claims.UserID,
+		Username:   claims.Username,
+		Payload:    mustMarshal(chatDeletePayload{ID: message.ID}),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Message deleted successfully",
+	})
+}
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"minidocs/api/store"
+)
+
+// Several API replicas can serve the same document. Each keeps its own in-process rooms and they are
+// stitched together through Redis: room broadcasts are fanned out over a pub/sub channel per document,
+// presence is kept in a shared sorted set, and content changes are made under a short write lease
+// so only one node mutates a document at a time.
+
+const (
+	// presenceTTL is how long a presence entry lives without being refreshed (e.g. after a node crash)
+	presenceTTL = 30 * time.Second
+	// presenceRefreshInterval is how often a node re-announces its connected clients
+	presenceRefreshInterval = 10 * time.Second
+
+	// writeLeaseTTL bounds how long a crashed node can block writes to a document
+	writeLeaseTTL = 5 * time.Second
+	// writeLeaseWait is how long a node waits for another node's lease before giving up
+	writeLeaseWait = 2 * time.Second
+	// writeLeaseRetry is the delay between attempts to take a lease
+	writeLeaseRetry = 10 * time.Millisecond
+)
+
+// Kinds of cluster events
+const (
+	clusterEventBroadcast = "broadcast" // deliver Data to every local client in the room
+	clusterEventRecheck   = "recheck"   // re-check UserID's access and close revoked sessions
+	clusterEventDeleted   = "deleted"   // the document was moved to the trash, close every session
+)
+
+// errWriteLeaseBusy is returned when another node keeps a document's write lease for too long
+var errWriteLeaseBusy = errors.New("document is being written by another server")
+
+// nodeID identifies this process among the API replicas
+var nodeID = newNodeID()
+
+// clientSeq numbers connections on this node, to give each a unique presence entry
+var clientSeq atomic.Int64
+
+// leaseSeq makes every write lease token unique, so a node only ever releases its own lease
+var leaseSeq atomic.Int64
+
+// clusterEvent is published on a document's channel to reach clients connected to other nodes
+type clusterEvent struct {
+	Node   string          `json:"node"`
+	Kind   string          `json:"kind"`
+	UserID int             `json:"userId,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+func newNodeID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// StartCluster subscribes this node to room events from other replicas and keeps its presence
+// entries fresh. It must be called after UseStore.
+func StartCluster() {
+	go func() {
+		for event := range stores.Cluster.Events() {
+			handleClusterEvent(event)
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(presenceRefreshInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			refreshPresence()
+			refreshStatuses()
+		}
+	}()
+
+	log.Printf("[Cluster] Node %s started", nodeID)
+}
+
+// subscribeDocument starts receiving events for a document once a room for it opens on this node
+func subscribeDocument(documentID int) {
+	if err := stores.Cluster.Subscribe(documentID); err != nil {
+		log.Printf("[Cluster] Failed to subscribe to document %d: %v", documentID, err)
+	}
+}
+
+// unsubscribeDocument stops receiving events for a document once its room here closes
+func unsubscribeDocument(documentID int) {
+	if err := stores.Cluster.Unsubscribe(documentID); err != nil {
+		log.Printf("[Cluster] Failed to unsubscribe from document %d: %v", documentID, err)
+	}
+}
+
+// publishEvent sends an event to the other nodes with the document open
+func publishEvent(documentID int, event clusterEvent) {
+	event.Node = nodeID
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[Cluster] Failed to encode %s event: %v", event.Kind, err)
+		return
+	}
+	if err := stores.Cluster.Publish(documentID, data); err != nil {
+		log.Printf("[Cluster] Failed to publish %s event for document %d: %v", event.Kind, documentID, err)
+	}
+}
+
+// handleClusterEvent applies an event published by another node to the local room
+func handleClusterEvent(published store.ClusterEvent) {
+	documentID := published.DocumentID
+
+	var event clusterEvent
+	if err := json.Unmarshal(published.Data, &event); err != nil {
+		log.Printf("[Cluster] Ignoring malformed event for document %d: %v", documentID, err)
+		return
+	}
+	if event.Node == nodeID {
+		return // we already delivered it locally
+	}
+
+	switch event.Kind {
+	case clusterEventBroadcast:
+		roomManager.mu.RLock()
+		room, exists := roomManager.rooms[documentID]
+		roomManager.mu.RUnlock()
+		if exists {
+			observeClusterMessage(room, event.Data)
+			broadcastLocal(room, nil, event.Data)
+		}
+	case clusterEventRecheck:
+		recheckLocalSessions(documentID, event.UserID)
+	case clusterEventDeleted:
+		closeLocalSessions(documentID)
+	}
+}
+
+// presenceEntry is the presence entry of a connection
+func presenceEntry(client *Client) store.PresenceEntry {
+	return store.PresenceEntry{Node: nodeID, ConnID: client.connID, UserID: client.userID, Username: client.username}
+}
+
+// addPresence announces a new connection to every node and returns how many connections the user
+// now has to the document, on any node
+func addPresence(client *Client) (int, error) {
+	count, err := stores.Cluster.AddPresence(client.documentID, presenceEntry(client), client.currentStatus(), presenceTTL)
+	if err != nil {
+		log.Printf("[Cluster] Failed to add presence for user %d: %v", client.userID, err)
+	}
+	return count, err
+}
+
+// removePresence withdraws a closed connection and returns how many connections the user has left
+func removePresence(client *Client) (int, error) {
+	count, err := stores.Cluster.RemovePresence(client.documentID, presenceEntry(client))
+	if err != nil {
+		log.Printf("[Cluster] Failed to remove presence for user %d: %v", client.userID, err)
+	}
+	return count, err
+}
+
+// refreshPresence extends the presence entries of every client connected to this node
+func refreshPresence() {
+	roomManager.mu.RLock()
+	rooms := make([]*Room, 0, len(roomManager.rooms))
+	for _, room := range roomManager.rooms {
+		rooms = append(rooms, room)
+	}
+	roomManager.mu.RUnlock()
+
+	entries := make(map[int][]store.PresenceEntry, len(rooms))
+	for _, room := range rooms {
+		room.mu.RLock()
+		for client := range room.clients {
+			entries[room.documentID] = append(entries[room.documentID], presenceEntry(client))
+		}
+		room.mu.RUnlock()
+	}
+
+	if err := stores.Cluster.RefreshPresence(entries, presenceTTL); err != nil {
+		log.Printf("[Cluster] Failed to refresh presence: %v", err)
+	}
+}
+
+// clusterSessions returns every connection to a document on any node
+func clusterSessions(documentID int) ([]store.PresenceEntry, error) {
+	return stores.Cluster.Presence(documentID)
+}
+
+// acquireWriteLease takes the cluster-wide write lease of a document, waiting briefly if another
+// node holds it. Callers must hold room.editMu, so a node only ever asks for a lease once at a time
+// per document, and must call the returned release func when done.
+func acquireWriteLease(documentID int) (func(), error) {
+	token := fmt.Sprintf("%s:%d", nodeID, leaseSeq.Add(1))
+	deadline := time.Now().Add(writeLeaseWait)
+
+	for {
+		ok, err := stores.Cluster.AcquireLease(documentID, token, writeLeaseTTL)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, errWriteLeaseBusy
+		}
+		time.Sleep(writeLeaseRetry)
+	}
+
+	release := func() {
+		if err := stores.Cluster.ReleaseLease(documentID, token); err != nil {
+			log.Printf("[Cluster] Failed to release write lease of document %d: %v", documentID, err)
+		}
+	}
+	return release, nil
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"minidocs/api/models"
+	"minidocs/api/ot"
+	"minidocs/api/store"
+)
+
+// historyLimit is how many revisions behind the server a client may fall before its edits are rejected
+const historyLimit = store.HistoryLimit
+
+// errHistoryUnavailable is returned when the operations needed to catch up have already been trimmed
+var errHistoryUnavailable = errors.New("revision history no longer available")
+
+// historyEntry is one accepted operation, stored as JSON in the document's cached history and
+// pending operations
+type historyEntry struct {
+	Revision int64         `json:"revision"`
+	UserID   int           `json:"userId"`
+	ID       string        `json:"id,omitempty"` // client message ID of the edit, if it had one
+	Ops      *ot.Operation `json:"ops"`
+	At       time.Time     `json:"at"` // when the edit was accepted, set on saving
+}
+
+// cachedEdit encodes an accepted operation for the cache, stamping it with the current time
+func cachedEdit(entry *historyEntry) (*store.CachedEdit, error) {
+	entry.At = time.Now()
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	return &store.CachedEdit{
+		UserID:    entry.UserID,
+		MessageID: entry.ID,
+		Revision:  entry.Revision,
+		Entry:     entryJSON,
+	}, nil
+}
+
+// getDocumentState gets content and revision from Redis if available, falls back to PostgreSQL
+func getDocumentState(documentID int) (string, int64, error) {
+	// Try Redis first
+	content, revision, found, err := stores.Cache.GetContent(documentID)
+	if err == nil && found {
+		log.Printf("[Redis] Cache hit for document %d (rev %d)", documentID, revision)
+		return content, revision, nil
+	}
+
+	// Redis miss - load from PostgreSQL (and the operation log, if Redis lost unflushed edits)
+	log.Printf("[Redis] Cache miss for document %d, loading from PostgreSQL", documentID)
+	content, revision, err = recoverDocumentState(documentID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Store in Redis for next time. Nothing here holds the write lease, so if another server cached the
+	// document in the meantime its copy (and the history edits are transformed against) wins.
+	stored, err := stores.Cache.FillContent(documentID, content, revision)
+	if err == nil && !stored {
+		if cached, cachedRevision, found, err := stores.Cache.GetContent(documentID); err == nil && found {
+			return cached, cachedRevision, nil
+		}
+	}
+	return content, revision, nil
+}
+
+// saveDocumentState saves content, its revision and (if given) the operation that produced it
+// to Redis in one transaction
+func saveDocumentState(documentID int, content string, revision int64, entry *historyEntry) error {
+	// Only write to Redis during active editing
+	if entry == nil {
+		return stores.Cache.SaveContent(documentID, content, revision, nil)
+	}
+
+	edit, err := cachedEdit(entry)
+	if err != nil {
+		return err
+	}
+	// Marks the document dirty and records the edit's message ID, so a retransmission is acked instead of applied again
+	err = stores.Cache.SaveContent(documentID, content, revision, edit)
+	if err != nil {
+		return err
+	}
+	writeThrough(documentID)
+	return nil
+}
+
+// getHistorySince returns the operations accepted after revision `since`, up to `current`, oldest first
+func getHistorySince(documentID int, since, current int64) ([]historyEntry, error) {
+	count := current - since
+	if count <= 0 {
+		return nil, nil
+	}
+	if count > historyLimit {
+		return nil, errHistoryUnavailable
+	}
+
+	raw, err := stores.Cache.History(documentID, count)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(raw)) < count {
+		// History was lost (e.g. the document was reloaded from PostgreSQL)
+		return nil, errHistoryUnavailable
+	}
+
+	entries := make([]historyEntry, 0, len(raw))
+	for _, item := range raw {
+		var entry historyEntry
+		if err := json.Unmarshal(item, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	// Sanity check: the list must hold exactly the revisions we asked for
+	if entries[0].Revision != since+1 {
+		return nil, errHistoryUnavailable
+	}
+
+	return entries, nil
+}
+
+// persistDocument writes the pending operations, then the cached content (and CRDT replica) of a
+// document to PostgreSQL without evicting it from Redis, optionally keeping a version of it. It returns
+// the revision written and false if nothing was cached or a write failed, which leaves the document dirty.
+func persistDocument(documentID int, snapshot bool) (int64, bool) {
+	// Get latest content and revision from Redis
+	content, revision, found, err := stores.Cache.GetContent(documentID)
+	if err != nil || !found {
+		log.Printf("[Redis] Nothing to flush for document %d", documentID)
+		return 0, false
+	}
+
+	// The operation log goes first, so it is never behind the content it explains
+	if err := logPendingOperations(documentID); err != nil {
+		log.Printf("[OpLog] Failed to log the operations of document %d: %v", documentID, err)
+		return 0, false
+	}
+
+	// Save to PostgreSQL. Only the content: the title may have been renamed since it was cached.
+	err = stores.Documents.SaveDocumentContent(documentID, content)
+	if err != nil {
+		log.Printf("[Redis] Failed to flush document %d to PostgreSQL: %v", documentID, err)
+		return 0, false
+	}
+
+	// Keep a version of what was just written, so earlier states can be recovered
+	if snapshot {
+		doc, err := stores.Documents.GetDocumentByID(documentID)
+		if err == nil {
+			_, err = snapshotDocument(documentID, revision, doc.Title, content, nil, models.VersionReasonFlush)
+		}
+		if err != nil {
+			log.Printf("[Versions] Failed to snapshot document %d on flush: %v", documentID, err)
+		}
+	}
+
+	// Documents in CRDT mode also keep their replica, so offline clients can still merge later
+	state, _, found, err := stores.Cache.GetCRDT(documentID)
+	if err == nil && found {
+		err = stores.Documents.SaveCRDTState(documentID, state)
+		if err != nil {
+			log.Printf("[Redis] Failed to flush CRDT state of document %d: %v", documentID, err)
+			return 0, false
+		}
+	}
+
+	return revision, true
+}
+
+// flushDocumentToPostgres writes a document back to PostgreSQL and evicts it from Redis,
+// once nobody is editing it any more
+func flushDocumentToPostgres(documentID int) {
+	// Hold the write lease so no server can change the document between saving and evicting it
+	release, err := acquireWriteLease(documentID)
+	if err != nil {
+		log.Printf("[Redis] Skipping flush of document %d: %v", documentID, err)
+		return
+	}
+	defer release()
+
+	revision, ok := persistDocument(documentID, true)
+	if !ok {
+		clearDirty(documentID, 0) // clears the flag only if the cache is gone
+		return
+	}
+
+	// Delete from Redis now that it's saved to PostgreSQL
+	stores.Cache.Evict(documentID)
+	clearDirty(documentID, revision)
+	log.Printf("[Redis] Flushed and cleared document %d from Redis", documentID)
+}
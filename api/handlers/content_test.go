@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"testing"
+
+	"minidocs/api/models"
+	"minidocs/api/ot"
+	"minidocs/api/store"
+)
+
+// renamingDocuments renames a document right after it is read, as a REST rename racing a flush would
+type renamingDocuments struct {
+	store.DocumentStore
+}
+
+func (s renamingDocuments) GetDocumentByID(id int) (*models.Document, error) {
+	doc, err := s.DocumentStore.GetDocumentByID(id)
+	if err == nil {
+		_, err = s.DocumentStore.UpdateDocument(id, "Renamed", doc.Content)
+	}
+	return doc, err
+}
+
+func TestFlushKeepsConcurrentRename(t *testing.T) {
+	documentID := useHubTestStore(t)
+	documents := stores.Documents
+	stores.Documents = renamingDocuments{documents}
+
+	err := saveDocumentState(documentID, "x", 1, &historyEntry{Revision: 1, UserID: 1, Ops: ot.New().Insert("x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := persistDocument(documentID, true); !ok {
+		t.Fatal("flush failed")
+	}
+
+	doc, err := documents.GetDocumentByID(documentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Title != "Renamed" || doc.Content != "x" {
+		t.Fatalf("got title %q and content %q, want the rename kept and %q flushed", doc.Title, doc.Content, "x")
+	}
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"minidocs/api/crdt"
+	"minidocs/api/models"
+	"minidocs/api/store"
+)
+
+// crdtSyncPayload is sent by a client (usually right after connecting) with what it has seen.
+// Replica is a random token the client keeps for as long as it keeps its replica, across reconnects.
+type crdtSyncPayload struct {
+	StateVector crdt.StateVector `json:"stateVector"`
+	Replica     string           `json:"replica"`
+}
+
+// crdtSyncReplyPayload answers a crdt-sync: what the client is missing, and the server's own
+// state vector so the client can send back anything it made while offline
+type crdtSyncReplyPayload struct {
+	Update      crdt.Update      `json:"update"`
+	StateVector crdt.StateVector `json:"stateVector"`
+	Revision    int64            `json:"revision"`
+	Client      crdt.ClientID    `json:"client"` // the replica ID the connection must create its items with
+}
+
+// crdtUpdatePayload carries an update in either direction
+type crdtUpdatePayload struct {
+	Update   crdt.Update `json:"update"`
+	Revision int64       `json:"revision,omitempty"` // set by the server
+}
+
+// crdtReplicaID returns the replica ID a user's replica of a document creates its items with.
+// It is derived from the replica token with a server secret, so a reconnecting client gets the
+// ID its offline edits were made with back, and nobody can claim another user's ID. 0 belongs to the server.
+func crdtReplicaID(documentID, userID int, replica string) crdt.ClientID {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("JWT_SECRET")))
+	fmt.Fprintf(mac, "crdt-replica:%d:%d:%s", documentID, userID, replica)
+	id := crdt.ClientID(binary.BigEndian.Uint32(mac.Sum(nil)))
+	if id == crdt.ServerClientID {
+		id = 1 // one chance in four billion; any other value will do
+	}
+	return id
+}
+
+// checkCRDTAuthor makes sure every item in an update was created by the replica the connection
+// synced with, so a client can't forge (or collide with) another replica's or the server's items
+func checkCRDTAuthor(client *Client, update crdt.Update) error {
+	if client.crdtClient == crdt.ServerClientID {
+		return errors.New("send a crdt-sync before any crdt-update")
+	}
+	for _, item := range update.Items {
+		if item.ID.Client != client.crdtClient {
+			return fmt.Errorf("item %d:%d was not created by this replica (client %d)", item.ID.Client, item.ID.Clock, client.crdtClient)
+		}
+	}
+	return nil
+}
+
+// loadCRDTDoc returns the replica from Redis, then PostgreSQL, and finally builds one from the plain content
+func loadCRDTDoc(documentID int) (*crdt.Doc, int64, error) {
+	raw, cachedRevision, found, err := stores.Cache.GetCRDT(documentID)
+	if err == nil && found {
+		doc := &crdt.Doc{}
+		if err := json.Unmarshal(raw, doc); err != nil {
+			return nil, 0, err
+		}
+		return doc, cachedRevision, nil
+	}
+
+	doc := &crdt.Doc{}
+	var revision int64
+	state, err := stores.Documents.GetCRDTState(documentID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if state != nil {
+		if err := json.Unmarshal(state, doc); err != nil {
+			return nil, 0, err
+		}
+		// Carry on numbering from the operation log so revisions never repeat
+		revision, err = stores.Operations.GetLatestOperationRevision(documentID)
+		if err != nil {
+			return nil, 0, err
+		}
+	} else {
+		var content string
+		content, revision, err = getDocumentState(documentID)
+		if err != nil {
+			return nil, 0, err
+		}
+		doc = crdt.FromText(crdt.ServerClientID, content)
+	}
+
+	if err := saveCRDTDoc(documentID, doc, revision, nil); err != nil {
+		return nil, 0, err
+	}
+	return doc, revision, nil
+}
+
+// saveCRDTDoc writes the replica, its visible text, the revision and, for an edit, its entry in the
+// operation log to Redis in one transaction. The visible text is cached as the document's content so
+// flushing and REST reads work unchanged.
+func saveCRDTDoc(documentID int, doc *crdt.Doc, revision int64, entry *historyEntry) error {
+	state, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	var edit *store.CachedEdit
+	if entry != nil {
+		if edit, err = cachedEdit(entry); err != nil {
+			return err
+		}
+	}
+	return stores.Cache.SaveCRDT(documentID, state, doc.Text(), revision, edit)
+}
+
+// roomCRDT returns the room's cached replica, reloading it if Redis has moved on (another node wrote it).
+// The caller must hold room.editMu.
+func roomCRDT(room *Room, documentID int) (*crdt.Doc, error) {
+	if room.crdtDoc != nil {
+		revision, found, err := stores.Cache.GetRevision(documentID)
+		if err == nil && found && revision == room.crdtRev {
+			return room.crdtDoc, nil
+		}
+	}
+
+	doc, revision, err := loadCRDTDoc(documentID)
+	if err != nil {
+		return nil, err
+	}
+	room.crdtDoc = doc
+	room.crdtRev = revision
+	return doc, nil
+}
+
+// handleCRDTMessage processes crdt-sync and crdt-update messages for documents in "crdt" sync mode.
+// It returns true when msg (rewritten to carry only the new changes) should be broadcast.
+func handleCRDTMessage(client *Client, room *Room, msg *Message, payload payloadValidator) bool {
+	room.editMu.Lock()
+	defer room.editMu.Unlock()
+
+	// Only one server may change the document at a time; a crdt-sync only reads it
+	if msg.Type == "crdt-update" {
+		release, err := acquireWriteLease(msg.DocumentID)
+		if err != nil {
+			sendNack(client, msg.ID, nackPayload{Reason: nackBusy, Message: err.Error()})
+			return false
+		}
+		defer release()
+	}
+
+	doc, err := roomCRDT(room, msg.DocumentID)
+	if err != nil {
+		log.Printf("[CRDT] Failed to load document %d: %v", msg.DocumentID, err)
+		return false
+	}
+
+	switch msg.Type {
+	case "crdt-sync":
+		payload := payload.(*crdtSyncPayload)
+		client.crdtClient = crdtReplicaID(msg.DocumentID, client.userID, payload.Replica)
+		sendToClient(client, Message{
+			Type:       "crdt-sync-reply",
+			DocumentID: msg.DocumentID,
+			UserID:     client.userID,
+			Username:   client.username,
+			Payload: mustMarshal(crdtSyncReplyPayload{
+				Update:      doc.Diff(payload.StateVector),
+				StateVector: doc.StateVector(),
+				Revision:    room.crdtRev,
+				Client:      client.crdtClient,
+			}),
+		})
+		return false
+
+	case "crdt-update":
+		payload := payload.(*crdtUpdatePayload)
+		if err := checkCRDTAuthor(client, payload.Update); err != nil {
+			sendNack(client, msg.ID, nackPayload{Reason: nackPatchFailed, Message: err.Error()})
+			return false
+		}
+		// Only relay what was actually new; replays of offline edits are common after a reconnect
+		oldText := doc.Text()
+		applied, err := doc.Apply(payload.Update)
+		if err != nil {
+			sendNack(client, msg.ID, nackPayload{Reason: nackPatchFailed, Message: err.Error()})
+			return false
+		}
+		if applied.IsEmpty() {
+			sendAck(client, msg.ID, map[string]interface{}{"revision": room.crdtRev, "duplicate": true})
+			return false
+		}
+
+		revision := room.crdtRev + 1
+		op := diffOperation(oldText, doc.Text())
+		err = saveCRDTDoc(msg.DocumentID, doc, revision, &historyEntry{Revision: revision, UserID: client.userID, Ops: op})
+		if err != nil {
+			log.Printf("[CRDT] Failed to save document %d: %v", msg.DocumentID, err)
+			room.crdtDoc = nil // force a reload from Redis next time
+			return false
+		}
+		room.crdtRev = revision
+		markDocumentDirty(msg.DocumentID)
+		room.transformCursors(op)
+
+		log.Printf("[CRDT] Merged update from %s: %d inserts, %d deletes (rev %d)",
+			client.username, len(applied.Items), len(applied.Deletes), revision)
+
+		sendAck(client, msg.ID, map[string]int64{"revision": revision})
+
+		msg.Payload = mustMarshal(crdtUpdatePayload{Update: applied, Revision: revision})
+		return true
+	}
+
+	return false
+}
+
+// convertSyncMode migrates the stored state of an idle document between sync modes.
+// Any cached content is flushed first so nothing in Redis is lost.
+func convertSyncMode(documentID int, mode string) error {
+	flushDocumentToPostgres(documentID)
+
+	doc, err := stores.Documents.GetDocumentByID(documentID)
+	if err != nil {
+		return err
+	}
+
+	if mode == models.SyncModeCRDT {
+		replica := crdt.FromText(crdt.ServerClientID, doc.Content)
+		state, err := json.Marshal(replica)
+		if err != nil {
+			return err
+		}
+		if err := stores.Documents.SaveCRDTState(documentID, state); err != nil {
+			return err
+		}
+	} else {
+		// The flush already wrote the replica's visible text into documents.content
+		if err := stores.Documents.DeleteCRDTState(documentID); err != nil {
+			return err
+		}
+	}
+
+	return stores.Documents.SetDocumentSyncMode(documentID, mode)
+}
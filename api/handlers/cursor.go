@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"minidocs/api/ot"
+)
+
+// Every room remembers where each connection's cursor or selection is, so clients that join later can
+// show everyone straight away. Cursors of connections on other servers are learned from the cursor
+// messages relayed through Redis, and every edit moves them along like the clients' own cursors.
+
+const (
+	// cursorTTL is how long a cursor that hasn't moved is kept before it is considered stale
+	cursorTTL = 2 * time.Minute
+	// cursorSweepInterval is how often each room's hub drops stale cursors
+	cursorSweepInterval = 10 * time.Second
+)
+
+// cursorColors is the palette users are given colors from
+var cursorColors = []string{
+	"#e6194b", "#3cb44b", "#4363d8", "#f58231", "#911eb4", "#42d4f4",
+	"#f032e6", "#469990", "#9a6324", "#800000", "#808000", "#000075",
+}
+
+// cursorState is the latest cursor (Length 0) or selection of one connection
+type cursorState struct {
+	Session  string `json:"session"` // connection it belongs to, unique across servers
+	UserID   int    `json:"userId"`
+	Username string `json:"username"`
+	Color    string `json:"color"`
+	Position int    `json:"position"`
+	Length   int    `json:"length"`
+
+	updatedAt time.Time
+}
+
+// cursorExpirePayload tells clients to drop a cursor that went stale
+type cursorExpirePayload struct {
+	Session string `json:"session"`
+}
+
+// userColor picks a user's color; it is the same on every server and in every session
+func userColor(userID int) string {
+	return cursorColors[userID%len(cursorColors)]
+}
+
+// session identifies a connection across the cluster
+func (c *Client) session() string {
+	return nodeID + "|" + c.connID
+}
+
+// handleCursor records a client's cursor or selection and rewrites msg.Payload into the broadcast form
+func handleCursor(client *Client, room *Room, msg *Message, position, length int) {
+	cursor := cursorState{
+		Session:  client.session(),
+		UserID:   client.userID,
+		Username: client.username,
+		Color:    userColor(client.userID),
+		Position: position,
+		Length:   length,
+	}
+	room.setCursor(cursor)
+	msg.Payload = mustMarshal(cursor)
+}
+
+// setCursor stores the latest cursor of a connection
+func (r *Room) setCursor(cursor cursorState) {
+	cursor.updatedAt = time.Now()
+
+	r.cursorMu.Lock()
+	defer r.cursorMu.Unlock()
+	if r.cursors == nil {
+		r.cursors = make(map[string]*cursorState)
+	}
+	r.cursors[cursor.Session] = &cursor
+}
+
+// removeCursor forgets the cursor of a connection that closed
+func (r *Room) removeCursor(session string) {
+	r.cursorMu.Lock()
+	delete(r.cursors, session)
+	r.cursorMu.Unlock()
+}
+
+// transformCursors moves every cursor past an edit that was just applied to the document
+func (r *Room) transformCursors(op *ot.Operation) {
+	r.cursorMu.Lock()
+	defer r.cursorMu.Unlock()
+
+	for _, cursor := range r.cursors {
+		end := ot.TransformIndex(cursor.Position+cursor.Length, op)
+		cursor.Position = ot.TransformIndex(cursor.Position, op)
+		cursor.Length = max(0, end-cursor.Position)
+	}
+}
+
+// cursorSnapshot returns the cursors that aren't stale, ordered by user
+func (r *Room) cursorSnapshot() []cursorState {
+	r.cursorMu.Lock()
+	defer r.cursorMu.Unlock()
+
+	cursors := make([]cursorState, 0, len(r.cursors))
+	for _, cursor := range r.cursors {
+		if time.Since(cursor.updatedAt) < cursorTTL {
+			cursors = append(cursors, *cursor)
+		}
+	}
+
+	sort.Slice(cursors, func(i, j int) bool {
+		if cursors[i].Username != cursors[j].Username {
+			return cursors[i].Username < cursors[j].Username
+		}
+		return cursors[i].Session < cursors[j].Session
+	})
+	return cursors
+}
+
+// expireCursors drops stale cursors and returns the sessions they belonged to
+func (r *Room) expireCursors() []string {
+	r.cursorMu.Lock()
+	defer r.cursorMu.Unlock()
+
+	var expired []string
+	for session, cursor := range r.cursors {
+		if time.Since(cursor.updatedAt) >= cursorTTL {
+			delete(r.cursors, session)
+			expired = append(expired, session)
+		}
+	}
+	return expired
+}
+
+// observeClusterMessage keeps the room's cursors in step with a message another server broadcast:
+// its clients' cursor moves, the edits they made and their connections closing (with a "leave" for a
+// user's last connection, a "presence" update otherwise)
+func observeClusterMessage(room *Room, data []byte) {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return
+	}
+
+	switch msg.Type {
+	case "cursor", "selection":
+		var cursor cursorState
+		if err := json.Unmarshal(msg.Payload, &cursor); err == nil && cursor.Session != "" {
+			room.setCursor(cursor)
+		}
+	case "edit": // CRDT documents' cursors catch up with their users' next cursor move instead
+		var edit struct {
+			Ops *ot.Operation `json:"ops"`
+		}
+		if err := json.Unmarshal(msg.Payload, &edit); err == nil && edit.Ops != nil {
+			room.transformCursors(edit.Ops)
+		}
+	case "leave":
+		var leave leavePayload
+		if err := json.Unmarshal(msg.Payload, &leave); err == nil && leave.Session != "" {
+			room.removeCursor(leave.Session)
+		}
+	case "presence":
+		var update presenceUpdatePayload
+		if err := json.Unmarshal(msg.Payload, &update); err == nil && update.ClosedSession != "" {
+			room.removeCursor(update.ClosedSession)
+		}
+	}
+}
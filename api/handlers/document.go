@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,7 +10,6 @@ import (
 	"strconv"
 	"time"
 
-	"minidocs/api/config"
 	"minidocs/api/middleware"
 	"minidocs/api/models"
 	"minidocs/api/utils"
@@ -23,10 +23,11 @@ type CreateDocumentRequest struct {
 	Content string `json:"content"`
 }
 
-// UpdateDocumentRequest represents the request to update a document
+// UpdateDocumentRequest represents the request to update a document. Content is optional: live edits go
+// over the WebSocket, and content sent here is applied as one more edit.
 type UpdateDocumentRequest struct {
-	Title   string `json:"title"`
-	Content string `json:"content"`
+	Title   string  `json:"title"`
+	Content *string `json:"content,omitempty"`
 }
 
 // ShareDocumentRequest represents the invite request
@@ -34,12 +35,18 @@ type ShareDocumentRequest struct {
 	Email string `json:"email"`
 }
 
+// SyncModeRequest represents the request to switch a document's sync mode
+type SyncModeRequest struct {
+	Mode string `json:"mode"`
+}
+
 // DocumentWithShareInfo includes whether document is shared
 type DocumentWithShareInfo struct {
 	ID        int       `json:"id"`
 	Title     string    `json:"title"`
 	Content   string    `json:"content"`
 	OwnerID   int       `json:"owner_id"`
+	SyncMode  string    `json:"sync_mode"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 	IsShared  bool      `json:"is_shared"` // NEW FIELD
@@ -69,13 +76,19 @@ func CreateDocument(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create document in database
-	doc, err := models.CreateDocument(config.DB, req.Title, req.Content, claims.UserID)
+	doc, err := stores.Documents.CreateDocument(req.Title, req.Content, claims.UserID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to create document"})
 		return
 	}
 
+	// Revision 0 is the starting point for replaying the operation log
+	_, err = snapshotDocument(doc.ID, 0, doc.Title, doc.Content, &claims.UserID, models.VersionReasonCreated)
+	if err != nil {
+		log.Printf("[Versions] Failed to snapshot new document %d: %v", doc.ID, err)
+	}
+
 	// Success response
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(doc)
@@ -89,7 +102,7 @@ func GetMyDocuments(w http.ResponseWriter, r *http.Request) {
 	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
 
 	// Get owned documents
-	ownedDocs, err := models.GetDocumentsByOwner(config.DB, claims.UserID)
+	ownedDocs, err := stores.Documents.GetDocumentsByOwner(claims.UserID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to retrieve documents"})
@@ -97,7 +110,7 @@ func GetMyDocuments(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get shared documents
-	sharedDocs, err := models.GetSharedDocuments(config.DB, claims.UserID)
+	sharedDocs, err := stores.Shares.GetSharedDocuments(claims.UserID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to retrieve shared documents"})
@@ -114,6 +127,7 @@ func GetMyDocuments(w http.ResponseWriter, r *http.Request) {
 			Title:     doc.Title,
 			Content:   doc.Content,
 			OwnerID:   doc.OwnerID,
+			SyncMode:  doc.SyncMode,
 			CreatedAt: doc.CreatedAt,
 			UpdatedAt: doc.UpdatedAt,
 			IsShared:  false, // Not shared - user owns it
@@ -127,6 +141,7 @@ func GetMyDocuments(w http.ResponseWriter, r *http.Request) {
 			Title:     doc.Title,
 			Content:   doc.Content,
 			OwnerID:   doc.OwnerID,
+			SyncMode:  doc.SyncMode,
 			CreatedAt: doc.CreatedAt,
 			UpdatedAt: doc.UpdatedAt,
 			IsShared:  true, // This is a shared document
@@ -153,30 +168,12 @@ func GetDocument(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get document from database
-	doc, err := models.GetDocumentByID(config.DB, id)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Document not found"})
-		return
-	}
-
 	// Get authenticated user
 	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
 
-	// Check if user owns the document OR has it shared with them
-	isOwner := doc.OwnerID == claims.UserID
-	isShared, err := models.IsDocumentSharedWithUser(config.DB, id, claims.UserID)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Database error"})
-		return
-	}
-
 	// User must be owner OR have document shared with them
-	if !isOwner && !isShared {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "You don't have permission to view this document"})
+	doc := authorizeDocument(w, id, claims.UserID, accessCollaborator, "You don't have permission to view this document")
+	if doc == nil {
 		return
 	}
 
@@ -202,27 +199,9 @@ func UpdateDocument(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if document exists
-	existingDoc, err := models.GetDocumentByID(config.DB, id)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Document not found"})
-		return
-	}
-
-	// Check if user owns the document OR has it shared with them
-	isOwner := existingDoc.OwnerID == claims.UserID
-	isShared, err := models.IsDocumentSharedWithUser(config.DB, id, claims.UserID)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Database error"})
-		return
-	}
-
 	// User must be owner OR have document shared with them to edit
-	if !isOwner && !isShared {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "You don't have permission to edit this document"})
+	doc := authorizeDocument(w, id, claims.UserID, accessCollaborator, "You don't have permission to edit this document")
+	if doc == nil {
 		return
 	}
 
@@ -242,8 +221,26 @@ func UpdateDocument(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The live copy wins over what is in the database, if the document is being edited
+	content := doc.Content
+	if cached, _, found, err := stores.Cache.GetContent(id); err == nil && found {
+		content = cached
+	}
+
+	// New content goes through the live edit path, so it gets a revision, is logged and reaches open editors
+	if req.Content != nil && *req.Content != content {
+		err = applyServerEdit(id, doc.SyncMode, *req.Content, claims.UserID, claims.Username)
+		if err != nil {
+			log.Printf("Failed to apply content update to document %d: %v", id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to update document"})
+			return
+		}
+		content = *req.Content
+	}
+
 	// Update document in database
-	updatedDoc, err := models.UpdateDocument(config.DB, id, req.Title, req.Content)
+	updatedDoc, err := stores.Documents.UpdateDocument(id, req.Title, content)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to update document"})
@@ -273,23 +270,14 @@ func DeleteDocument(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if document exists and user owns it
-	existingDoc, err := models.GetDocumentByID(config.DB, id)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Document not found"})
-		return
-	}
-
-	// Check ownership
-	if existingDoc.OwnerID != claims.UserID {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "You don't have permission to delete this document"})
+	if authorizeDocument(w, id, claims.UserID, accessOwner, "You don't have permission to delete this document") == nil {
 		return
 	}
 
-	// Delete document from database
-	err = models.DeleteDocument(config.DB, id)
+	// Move document to the trash, closing its editing sessions
+	err = trashDocument(id)
 	if err != nil {
+		log.Printf("[Trash] Failed to delete document %d: %v", id, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to delete document"})
 		return
@@ -298,7 +286,7 @@ func DeleteDocument(w http.ResponseWriter, r *http.Request) {
 	// Success response
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Document deleted successfully",
+		"message": "Document moved to trash",
 	})
 }
 
@@ -319,18 +307,9 @@ func InviteUserToDocument(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if document exists and user owns it
-	doc, err := models.GetDocumentByID(config.DB, id)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Document not found"})
-		return
-	}
-
 	// Only owner can invite
-	if doc.OwnerID != claims.UserID {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Only the document owner can invite users"})
+	doc := authorizeDocument(w, id, claims.UserID, accessOwner, "Only the document owner can invite users")
+	if doc == nil {
 		return
 	}
 
@@ -350,7 +329,7 @@ func InviteUserToDocument(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if user with this email exists
-	invitedUser, err := models.GetUserByEmail(config.DB, req.Email)
+	invitedUser, err := stores.Users.GetUserByEmail(req.Email)
 	if err != nil || invitedUser == nil {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "No user found with that email address"})
@@ -365,7 +344,7 @@ func InviteUserToDocument(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Share the document with the invited user
-	err = models.ShareDocument(config.DB, id, invitedUser.ID)
+	err = stores.Shares.ShareDocument(id, invitedUser.ID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to share document"})
@@ -403,3 +382,118 @@ func InviteUserToDocument(w http.ResponseWriter, r *http.Request) {
 		"message": "Invitation sent successfully",
 	})
 }
+
+// RevokeDocumentShare removes a collaborator from a document and disconnects any of their open sessions
+func RevokeDocumentShare(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get authenticated user
+	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
+
+	// Get document and user IDs from URL
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid document ID"})
+		return
+	}
+	userID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid user ID"})
+		return
+	}
+
+	// Only owner can revoke access
+	if authorizeDocument(w, id, claims.UserID, accessOwner, "Only the document owner can revoke access") == nil {
+		return
+	}
+
+	err = stores.Shares.UnshareDocument(id, userID)
+	if errors.Is(err, models.ErrShareNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Document is not shared with that user"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Database error"})
+		return
+	}
+
+	// Kick the user out of any live editing session for this document
+	recheckDocumentSessions(id, userID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Access revoked successfully",
+	})
+}
+
+// SetDocumentSyncMode switches a document between OT and CRDT sync. Only allowed while nobody has it open.
+func SetDocumentSyncMode(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get authenticated user
+	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
+
+	// Get document ID from URL
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid document ID"})
+		return
+	}
+
+	// Only owner can change how the document syncs
+	doc := authorizeDocument(w, id, claims.UserID, accessOwner, "Only the document owner can change the sync mode")
+	if doc == nil {
+		return
+	}
+
+	// Parse request body
+	var req SyncModeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	if req.Mode != models.SyncModeOT && req.Mode != models.SyncModeCRDT {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Mode must be \"ot\" or \"crdt\""})
+		return
+	}
+
+	if req.Mode == doc.SyncMode {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(doc)
+		return
+	}
+
+	// Switching under live editors would leave their clients speaking the wrong protocol
+	if isRoomActive(id) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Document is open in an editing session, try again once everyone has left"})
+		return
+	}
+
+	if err := convertSyncMode(id, req.Mode); err != nil {
+		log.Printf("Failed to switch document %d to %s: %v", id, req.Mode, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to change sync mode"})
+		return
+	}
+
+	updatedDoc, err := stores.Documents.GetDocumentByID(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Database error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(updatedDoc)
+}
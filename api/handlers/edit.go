@@ -0,0 +1,321 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"minidocs/api/crdt"
+	"minidocs/api/models"
+	"minidocs/api/ot"
+
+	dmp "github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// editPayload is the payload of an "edit" message sent by a client
+type editPayload struct {
+	Ops          *ot.Operation `json:"ops"`          // the change, made against BaseRevision
+	BaseRevision *int64        `json:"baseRevision"` // revision the client's operation was made against
+	SentAt       interface{}   `json:"sentAt"`
+}
+
+// ackPayload is sent back to the author of an accepted edit
+type ackPayload struct {
+	Revision     int64 `json:"revision"`            // new server revision after applying the edit
+	BaseRevision int64 `json:"baseRevision"`        // revision the client sent
+	Rebased      bool  `json:"rebased"`             // true if the operation was transformed over newer edits
+	Duplicate    bool  `json:"duplicate,omitempty"` // the edit had already been applied; Revision is when
+}
+
+// Reasons transformAgainstHistory can fail
+var (
+	errStaleRevision = errors.New("stale revision")
+	errPatchFailed   = errors.New("operation does not match document")
+)
+
+// handleEdit applies an edit message to the document and rewrites msg.Payload into the broadcast form.
+// Edits are serialised per room so every accepted edit gets exactly one new revision; edits made
+// against an older revision are transformed over everything accepted since, so no keystrokes are lost.
+// It returns false when the edit was rejected and must not be broadcast.
+func handleEdit(client *Client, room *Room, msg *Message, payload *editPayload) bool {
+	room.editMu.Lock()
+	defer room.editMu.Unlock()
+
+	// Only one server may change the document at a time
+	release, err := acquireWriteLease(msg.DocumentID)
+	if err != nil {
+		if content, revision, err := getDocumentState(msg.DocumentID); err == nil {
+			sendEditNack(client, msg.ID, nackBusy, "document is busy, try again", revision, content)
+		}
+		return false
+	}
+	defer release()
+
+	// Get current document content and revision (Redis first, PostgreSQL fallback)
+	currentContent, revision, err := getDocumentState(msg.DocumentID)
+	if err != nil {
+		log.Printf("Error getting document: %v", err)
+		return false
+	}
+
+	// A retransmission of an edit we already applied (e.g. resent after a reconnect): just ack it again
+	if msg.ID != "" {
+		if applied, ok := appliedEditRevision(msg.DocumentID, client.userID, msg.ID); ok {
+			log.Printf("[OT] Duplicate edit %q from %s, already applied at rev %d", msg.ID, client.username, applied)
+			sendAck(client, msg.ID, ackPayload{Revision: applied, BaseRevision: applied - 1, Duplicate: true})
+			return false
+		}
+	}
+
+	// Clients that don't send a base revision are assumed to be up to date
+	baseRevision := revision
+	if payload.BaseRevision != nil {
+		baseRevision = *payload.BaseRevision
+	}
+
+	if baseRevision > revision {
+		// The client claims a revision we never issued - its state can't be trusted
+		sendEditNack(client, msg.ID, nackStaleRevision, "unknown revision", revision, currentContent)
+		return false
+	}
+
+	op, concurrent, err := transformAgainstHistory(msg.DocumentID, payload.Ops, baseRevision, revision)
+	if err != nil {
+		reason := nackPatchFailed
+		if errors.Is(err, errStaleRevision) {
+			reason = nackStaleRevision
+		}
+		detail := fmt.Sprintf("%v (base %d, current %d)", err, baseRevision, revision)
+		sendEditNack(client, msg.ID, reason, detail, revision, currentContent)
+		return false
+	}
+
+	start := time.Now()
+	newContent, err := op.Apply(currentContent)
+	if err != nil {
+		sendEditNack(client, msg.ID, nackPatchFailed, err.Error(), revision, currentContent)
+		return false
+	}
+	log.Printf("[OT] Applied edit from %s in %v | rebased over %d ops | old length: %d, new length: %d",
+		client.username, time.Since(start), concurrent, len(currentContent), len(newContent))
+
+	newRevision := revision + 1
+	err = saveDocumentState(msg.DocumentID, newContent, newRevision, &historyEntry{
+		Revision: newRevision,
+		UserID:   client.userID,
+		ID:       msg.ID,
+		Ops:      op,
+	})
+	if err != nil {
+		log.Printf("Error saving document: %v", err)
+		return false
+	}
+	room.transformCursors(op)
+
+	sendAck(client, msg.ID, ackPayload{
+		Revision:     newRevision,
+		BaseRevision: baseRevision,
+		Rebased:      concurrent > 0,
+	})
+
+	// Create new payload with the transformed operation and the updated content
+	msg.Payload = mustMarshal(map[string]interface{}{
+		"ops":         op,
+		"fullContent": newContent, // left out for clients that can do without (see deliverEdit)
+		"checksum":    contentChecksum(newContent),
+		"revision":    newRevision,
+		"sentAt":      payload.SentAt,
+	})
+	return true
+}
+
+// transformAgainstHistory rebases an operation made at baseRevision onto the current revision
+// by transforming it over every operation accepted in between. It also returns how many there were.
+func transformAgainstHistory(documentID int, op *ot.Operation, baseRevision, revision int64) (*ot.Operation, int, error) {
+	entries, err := getHistorySince(documentID, baseRevision, revision)
+	if err != nil {
+		if errors.Is(err, errHistoryUnavailable) {
+			return nil, 0, errStaleRevision
+		}
+		return nil, 0, err
+	}
+
+	for _, entry := range entries {
+		// The incoming operation goes first on ties, matching the client's transform(outstanding, received)
+		op, _, err = ot.Transform(op, entry.Ops)
+		if err != nil {
+			return nil, 0, errPatchFailed
+		}
+	}
+
+	return op, len(entries), nil
+}
+
+// contentChecksum is the CRC-32 (IEEE) of a document's content encoded as UTF-8. Edits carry the
+// checksum of the content they produce so clients can tell when their copy has gone wrong.
+func contentChecksum(content string) uint32 {
+	return crc32.ChecksumIEEE([]byte(content))
+}
+
+// diffOperation builds the operation turning oldContent into newContent
+func diffOperation(oldContent, newContent string) *ot.Operation {
+	dmpInstance := dmp.New()
+	diffs := dmpInstance.DiffMain(oldContent, newContent, false)
+	dmpInstance.DiffCleanupEfficiency(diffs)
+
+	op := ot.New()
+	for _, d := range diffs {
+		switch d.Type {
+		case dmp.DiffEqual:
+			op.Retain(utf8.RuneCountInString(d.Text))
+		case dmp.DiffInsert:
+			op.Insert(d.Text)
+		case dmp.DiffDelete:
+			op.Delete(utf8.RuneCountInString(d.Text))
+		}
+	}
+	return op
+}
+
+// applyOperationToCRDT replays an operation on a CRDT replica and returns the resulting update
+func applyOperationToCRDT(doc *crdt.Doc, op *ot.Operation) (crdt.Update, error) {
+	var update crdt.Update
+	pos := 0
+	for _, component := range op.Ops {
+		switch {
+		case component.IsRetain():
+			pos += component.Retain
+		case component.IsInsert():
+			u, err := doc.Insert(pos, component.Insert)
+			if err != nil {
+				return update, err
+			}
+			update.Items = append(update.Items, u.Items...)
+			pos += utf8.RuneCountInString(component.Insert)
+		case component.IsDelete():
+			u, err := doc.Delete(pos, component.Delete)
+			if err != nil {
+				return update, err
+			}
+			update.Deletes = append(update.Deletes, u.Deletes...)
+		}
+	}
+	return update, nil
+}
+
+// applyServerEdit replaces the live content of a document on behalf of a user (e.g. restoring a version).
+// It goes through the same revision, history and broadcast path as client edits, so open editors
+// (on any server) receive it as a normal remote change. Documents nobody has open are flushed straight
+// to PostgreSQL.
+func applyServerEdit(documentID int, syncMode, newContent string, userID int, username string) error {
+	roomManager.mu.RLock()
+	room, active := roomManager.rooms[documentID]
+	roomManager.mu.RUnlock()
+
+	if !active {
+		// Nobody is connected here; a throwaway room still gives us the same code path
+		room = &Room{documentID: documentID, clients: make(map[*Client]bool), syncMode: syncMode}
+	}
+
+	msg := Message{DocumentID: documentID, UserID: userID, Username: username}
+
+	room.editMu.Lock()
+	release, err := acquireWriteLease(documentID)
+	if err == nil {
+		err = replaceContent(room, newContent, &msg)
+		release()
+	}
+	room.editMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if active {
+		broadcast(room, nil, data) // nil sender: everyone, including the user's own tabs, gets it
+		return nil
+	}
+
+	// Editors may still have the document open on another server
+	publishEvent(documentID, clusterEvent{Kind: clusterEventBroadcast, Data: data})
+	if !isRoomActive(documentID) {
+		flushDocumentToPostgres(documentID)
+	}
+	return nil
+}
+
+// replaceContent does the work of applyServerEdit and fills in msg with the change to broadcast.
+// The caller must hold room.editMu and the document's write lease.
+func replaceContent(room *Room, newContent string, msg *Message) error {
+	documentID := room.documentID
+
+	if room.syncMode == models.SyncModeCRDT {
+		doc, err := roomCRDT(room, documentID)
+		if err != nil {
+			return err
+		}
+
+		op := diffOperation(doc.Text(), newContent)
+		update, err := applyOperationToCRDT(doc, op)
+		revision := room.crdtRev + 1
+		if err == nil {
+			err = saveCRDTDoc(documentID, doc, revision, &historyEntry{Revision: revision, UserID: msg.UserID, Ops: op})
+		}
+		if err != nil {
+			room.crdtDoc = nil // force a reload from Redis next time
+			return err
+		}
+
+		room.crdtRev = revision
+		markDocumentDirty(documentID)
+		room.transformCursors(op)
+		msg.Type = "crdt-update"
+		msg.Payload = mustMarshal(crdtUpdatePayload{Update: update, Revision: revision})
+		return nil
+	}
+
+	currentContent, revision, err := getDocumentState(documentID)
+	if err != nil {
+		return err
+	}
+
+	op := diffOperation(currentContent, newContent)
+	newRevision := revision + 1
+	err = saveDocumentState(documentID, newContent, newRevision, &historyEntry{
+		Revision: newRevision,
+		UserID:   msg.UserID,
+		Ops:      op,
+	})
+	if err != nil {
+		return err
+	}
+	room.transformCursors(op)
+
+	msg.Type = "edit"
+	msg.Payload = mustMarshal(map[string]interface{}{
+		"ops":         op,
+		"fullContent": newContent,
+		"checksum":    contentChecksum(newContent),
+		"revision":    newRevision,
+	})
+	return nil
+}
+
+// sendToClient queues a message for a single client through its room's hub
+func sendToClient(client *Client, msg Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to marshal message: %v", err)
+		return
+	}
+
+	client.room.sendTo(client, data)
+}
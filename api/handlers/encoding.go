@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Messages are JSON everywhere on the server: in rooms, through Redis and in the handlers. Clients may
+// ask for MessagePack instead by offering the subprotocol below; their messages are converted at the
+// edge of the connection, in readPump and writePump. Either way the connection is compressed with
+// permessage-deflate when the browser supports it.
+
+// WebSocket subprotocols, in order of preference
+const (
+	subprotocolMsgpack = "cowrite.msgpack" // binary frames holding MessagePack
+	subprotocolJSON    = "cowrite.json"    // text frames holding JSON, as when no subprotocol is asked for
+)
+
+// compressionThreshold is the smallest message worth compressing; cursor moves and acks aren't
+const compressionThreshold = 512
+
+// binaryEncoding reports whether a connection speaks MessagePack
+func (c *Client) binaryEncoding() bool {
+	return c.conn.Subprotocol() == subprotocolMsgpack
+}
+
+// encodeOutgoing turns a JSON message into the frame type and bytes the client expects
+func encodeOutgoing(client *Client, message []byte) (int, []byte, error) {
+	if !client.binaryEncoding() {
+		return websocket.TextMessage, message, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber() // keep integers integers, so they get MessagePack's compact forms
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return 0, nil, err
+	}
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.UseCompactInts(true)
+	encoder.UseCompactFloats(true)
+	if err := encoder.Encode(fromJSONNumbers(value)); err != nil {
+		return 0, nil, err
+	}
+	return websocket.BinaryMessage, buf.Bytes(), nil
+}
+
+// decodeIncoming turns a frame read from a client into JSON
+func decodeIncoming(client *Client, messageType int, data []byte) ([]byte, error) {
+	if messageType != websocket.BinaryMessage {
+		return data, nil
+	}
+	if !client.binaryEncoding() {
+		return nil, fmt.Errorf("binary frames need the %s subprotocol", subprotocolMsgpack)
+	}
+
+	var value interface{}
+	if err := msgpack.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// fromJSONNumbers replaces the json.Numbers in a decoded JSON value with int64s, or float64s
+// for numbers that aren't integers
+func fromJSONNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = fromJSONNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = fromJSONNumbers(item)
+		}
+	}
+	return value
+}
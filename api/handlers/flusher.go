@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	// defaultFlushDebounce is how long a document must go without edits before it is flushed
+	defaultFlushDebounce = 5 * time.Second
+	// defaultFlushMaxDelay bounds how long a continuously edited document can stay unflushed
+	defaultFlushMaxDelay = time.Minute
+	// flushCheckInterval is how often the flusher looks at the dirty set
+	flushCheckInterval = time.Second
+)
+
+// markDocumentDirty flags a document as having unflushed edits. The flags are kept in Redis, so a
+// restarted server still knows what to flush.
+func markDocumentDirty(documentID int) {
+	if err := stores.Cache.MarkDirty(documentID); err != nil {
+		log.Printf("[Flusher] Failed to mark document %d dirty: %v", documentID, err)
+	}
+	writeThrough(documentID)
+}
+
+// writeThrough writes a just-edited document straight to PostgreSQL while Redis is unreachable: the
+// edit then only lives in this process, where neither a crash recovery nor another server can find it
+func writeThrough(documentID int) {
+	if !stores.Cache.Degraded() {
+		return
+	}
+	if revision, ok := persistDocument(documentID, false); ok {
+		clearDirty(documentID, revision)
+	}
+}
+
+// clearDirty marks a document clean after the given revision was written to PostgreSQL, unless an
+// edit landed in the meantime (or its cache is already gone), so a concurrent edit is never marked clean
+func clearDirty(documentID int, revision int64) {
+	if err := stores.Cache.ClearDirty(documentID, revision); err != nil {
+		log.Printf("[Flusher] Failed to clear dirty flag of document %d: %v", documentID, err)
+	}
+}
+
+// durationFromEnv reads a duration such as "30s" from the environment, falling back to def
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %v", name, value, def)
+		return def
+	}
+	return parsed
+}
+
+// StartFlusher periodically writes dirty documents back to PostgreSQL while they are still being
+// edited, so a crash loses at most a few seconds of work. A document is flushed once it has been
+// idle for FLUSH_DEBOUNCE (default 5s), or after FLUSH_MAX_DELAY (default 1m) of continuous editing.
+func StartFlusher() {
+	debounce := durationFromEnv("FLUSH_DEBOUNCE", defaultFlushDebounce)
+	maxDelay := durationFromEnv("FLUSH_MAX_DELAY", defaultFlushMaxDelay)
+
+	go func() {
+		ticker := time.NewTicker(flushCheckInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			now := time.Now()
+			due, err := stores.Cache.DueDocuments(now.Add(-debounce), now.Add(-maxDelay))
+			if err != nil {
+				log.Printf("[Flusher] Failed to read dirty documents: %v", err)
+				continue
+			}
+			for _, documentID := range due {
+				flushDirtyDocument(documentID)
+			}
+		}
+	}()
+}
+
+// flushDirtyDocument writes a dirty document to PostgreSQL. Documents with an open session stay
+// cached so editing carries on; ones nobody has open are evicted like on a normal last-user flush.
+func flushDirtyDocument(documentID int) {
+	if !isRoomActive(documentID) {
+		flushDocumentToPostgres(documentID)
+		return
+	}
+
+	if revision, ok := persistDocument(documentID, false); ok {
+		clearDirty(documentID, revision)
+		log.Printf("[Flusher] Flushed document %d at rev %d", documentID, revision)
+	}
+}
+
+// FlushAllRooms writes every open document to PostgreSQL, for graceful shutdown. The Redis copies are
+// kept so clients reconnecting to another server carry on from the same revision.
+func FlushAllRooms() {
+	roomManager.mu.RLock()
+	documentIDs := make([]int, 0, len(roomManager.rooms))
+	for documentID := range roomManager.rooms {
+		documentIDs = append(documentIDs, documentID)
+	}
+	roomManager.mu.RUnlock()
+
+	for _, documentID := range documentIDs {
+		if revision, ok := persistDocument(documentID, true); ok {
+			clearDirty(documentID, revision)
+		}
+	}
+	log.Printf("[Flusher] Flushed %d open documents", len(documentIDs))
+}
+
+// RecoverUnflushedDocuments runs at startup and writes back anything a previous process left in
+// Redis without flushing (e.g. after a crash): everything in the dirty set, plus cached content
+// from before the dirty set existed.
+func RecoverUnflushedDocuments() {
+	pending, err := stores.Cache.UnflushedDocuments()
+	if err != nil {
+		log.Printf("[Flusher] Failed to read dirty documents: %v", err)
+		return
+	}
+
+	for _, documentID := range pending {
+		flushDirtyDocument(documentID) // documents still open on other servers stay cached
+	}
+	if len(pending) > 0 {
+		log.Printf("[Flusher] Recovered %d unflushed documents", len(pending))
+	}
+}
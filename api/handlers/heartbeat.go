@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// closeIdleTimeout is the WebSocket close code sent to a client that stopped sending anything
+// for longer than the idle timeout (mirrors HTTP 408)
+const closeIdleTimeout = 4408
+
+// Reasons attached to the "leave" message when a client didn't disconnect by itself
+const (
+	leaveReasonTimeout = "timeout" // no pong within the pong timeout: the connection is dead
+	leaveReasonIdle    = "idle"    // the connection is alive but the user stopped doing anything
+)
+
+// heartbeatConfig controls the WebSocket keepalive
+type heartbeatConfig struct {
+	pingInterval time.Duration // how often the server pings each client
+	pongTimeout  time.Duration // how long to wait for any frame (pong or message) before giving up
+	writeTimeout time.Duration // how long a single write may block
+	idleTimeout  time.Duration // how long a client may send no messages before it is evicted; 0 disables
+}
+
+var (
+	heartbeat     heartbeatConfig
+	heartbeatOnce sync.Once
+)
+
+// heartbeatSettings reads the keepalive settings from the environment the first time it is called:
+// WS_PING_INTERVAL (default 25s), WS_PONG_TIMEOUT (60s), WS_WRITE_TIMEOUT (10s) and WS_IDLE_TIMEOUT (30m).
+func heartbeatSettings() heartbeatConfig {
+	heartbeatOnce.Do(func() {
+		heartbeat = heartbeatConfig{
+			pingInterval: durationFromEnv("WS_PING_INTERVAL", 25*time.Second),
+			pongTimeout:  durationFromEnv("WS_PONG_TIMEOUT", 60*time.Second),
+			writeTimeout: durationFromEnv("WS_WRITE_TIMEOUT", 10*time.Second),
+			idleTimeout:  durationFromEnv("WS_IDLE_TIMEOUT", 30*time.Minute),
+		}
+
+		// A client must get at least one ping inside every pong timeout or healthy connections get dropped
+		if heartbeat.pingInterval <= 0 || heartbeat.pingInterval >= heartbeat.pongTimeout {
+			heartbeat.pingInterval = heartbeat.pongTimeout * 9 / 10
+			log.Printf("WS_PING_INTERVAL must be shorter than WS_PONG_TIMEOUT, using %v", heartbeat.pingInterval)
+		}
+	})
+	return heartbeat
+}
+
+// touch records that the client just sent a message
+func (c *Client) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// idleFor reports how long ago the client last sent a message
+func (c *Client) idleFor() time.Duration {
+	return time.Since(time.Unix(0, c.lastActive.Load()))
+}
+
+// setLeaveReason records why the server is about to drop the client, for the "leave" message
+func (c *Client) setLeaveReason(reason string) {
+	c.leaveReason.Store(reason)
+}
@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Every Room runs a hub goroutine that owns its clients: it alone registers and unregisters them,
+// writes to their send channels and closes those channels. Everything else talks to it over
+// channels, so a slow or departing client can never cause a send on a closed channel.
+
+// Policies for a client whose send buffer is full, set with WS_SLOW_CLIENT_POLICY
+const (
+	slowClientDrop       = "drop"       // skip the message for that client
+	slowClientCoalesce   = "coalesce"   // keep only the latest edit until the client catches up (default)
+	slowClientDisconnect = "disconnect" // close the connection so the client reconnects with fresh state
+)
+
+// closeSlowClient is the WebSocket close code sent to a client that couldn't keep up
+const closeSlowClient = 4000
+
+// pendingRetryInterval is how often the hub retries delivering coalesced edits to backed-up clients
+const pendingRetryInterval = 50 * time.Millisecond
+
+// outboundCapacity is how many messages can queue for a hub before senders block
+const outboundCapacity = 256
+
+var (
+	slowClientPolicy     string
+	slowClientPolicyOnce sync.Once
+)
+
+// slowClientPolicySetting reads WS_SLOW_CLIENT_POLICY the first time it is called
+func slowClientPolicySetting() string {
+	slowClientPolicyOnce.Do(func() {
+		slowClientPolicy = os.Getenv("WS_SLOW_CLIENT_POLICY")
+		switch slowClientPolicy {
+		case slowClientDrop, slowClientCoalesce, slowClientDisconnect:
+		case "":
+			slowClientPolicy = slowClientCoalesce
+		default:
+			log.Printf("Invalid WS_SLOW_CLIENT_POLICY %q, using %q", slowClientPolicy, slowClientCoalesce)
+			slowClientPolicy = slowClientCoalesce
+		}
+	})
+	return slowClientPolicy
+}
+
+// outboundMessage is a message for the hub to deliver: to one client if only is set,
+// otherwise to every client except the sender
+type outboundMessage struct {
+	data   []byte
+	sender *Client
+	only   *Client
+}
+
+// newRoom creates a room; the caller starts its hub with go room.run()
+func newRoom(documentID int, syncMode string) *Room {
+	return &Room{
+		documentID: documentID,
+		clients:    make(map[*Client]bool),
+		syncMode:   syncMode,
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		outbound:   make(chan outboundMessage, outboundCapacity),
+		done:       make(chan struct{}),
+	}
+}
+
+// broadcastLocal sends a raw message to the room's clients connected to this server, except the sender.
+func broadcastLocal(room *Room, sender *Client, message []byte) {
+	select {
+	case room.outbound <- outboundMessage{data: message, sender: sender}:
+	case <-room.done:
+	}
+}
+
+// sendTo queues a raw message for a single client of the room
+func (r *Room) sendTo(client *Client, message []byte) {
+	select {
+	case r.outbound <- outboundMessage{data: message, only: client}:
+	case <-r.done:
+	}
+}
+
+// run is the room's hub. It returns once the room is closed.
+func (r *Room) run() {
+	ticker := time.NewTicker(pendingRetryInterval)
+	defer ticker.Stop()
+	sweep := time.NewTicker(cursorSweepInterval)
+	defer sweep.Stop()
+
+	// Latest coalesced edit waiting for space in each backed-up client's buffer
+	pending := make(map[*Client][]byte)
+
+	for {
+		select {
+		case client := <-r.register:
+			r.mu.Lock()
+			r.clients[client] = true
+			r.mu.Unlock()
+
+		case client := <-r.unregister:
+			delete(pending, client)
+			r.remove(client)
+
+		case msg := <-r.outbound:
+			if msg.only != nil {
+				if r.clients[msg.only] {
+					r.deliver(msg.only, msg.data, pending)
+				}
+				continue
+			}
+			edit := parseEditBroadcast(msg.data)
+			for client := range r.clients {
+				if client == msg.sender {
+					continue
+				}
+				if edit != nil {
+					r.deliverEdit(client, edit, pending)
+				} else {
+					r.deliver(client, msg.data, pending)
+				}
+			}
+
+		case <-ticker.C:
+			for client, data := range pending {
+				select {
+				case client.send <- data:
+					delete(pending, client)
+				default:
+				}
+			}
+
+		case <-sweep.C:
+			// Tell this server's clients about cursors nobody has moved in a while
+			for _, session := range r.expireCursors() {
+				data := mustMarshal(Message{
+					Type:       "cursor-expire",
+					DocumentID: r.documentID,
+					Payload:    mustMarshal(cursorExpirePayload{Session: session}),
+				})
+				for client := range r.clients {
+					r.deliver(client, data, pending)
+				}
+			}
+
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// deliver queues a message for a client, applying the slow-client policy if its buffer is full.
+// Messages are never reordered: while a coalesced edit is pending, newer messages can't jump ahead.
+// It reports whether the message will reach the client (possibly coalesced).
+func (r *Room) deliver(client *Client, data []byte, pending map[*Client][]byte) bool {
+	if waiting, ok := pending[client]; ok {
+		select {
+		case client.send <- waiting:
+			delete(pending, client)
+		default:
+		}
+	}
+
+	if _, backedUp := pending[client]; !backedUp {
+		select {
+		case client.send <- data:
+			return true
+		default:
+		}
+	}
+
+	switch slowClientPolicySetting() {
+	case slowClientDrop:
+		log.Printf("Send buffer full for user %d, dropping message", client.userID)
+		return false
+
+	case slowClientCoalesce:
+		// An edit carries the full content, so the newest one supersedes any pending one.
+		// Anything else (acks, joins...) can't be skipped safely, so the client is disconnected.
+		if isCoalescable(data) {
+			pending[client] = data
+			return true
+		}
+	}
+
+	log.Printf("Send buffer full for user %d, disconnecting", client.userID)
+	delete(pending, client)
+	r.remove(client)
+	go client.closeWithCode(closeSlowClient, "Connection too slow")
+	return false
+}
+
+// deliverEdit queues an edit for a client as just the operation and the checksum of the result.
+// Clients check it and ask for a snapshot if they went wrong (see sync.go). The full content only
+// goes to clients older than protocol 3 and to backed-up clients, whose pending edits are coalesced.
+func (r *Room) deliverEdit(client *Client, edit *editBroadcast, pending map[*Client][]byte) {
+	_, backedUp := pending[client]
+	if !backedUp && client.protocol >= 3 {
+		select {
+		case client.send <- edit.patch:
+			return
+		default:
+		}
+	}
+	r.deliver(client, edit.full, pending)
+}
+
+// remove unregisters a client and closes its send channel, which stops its write pump
+func (r *Room) remove(client *Client) {
+	if !r.clients[client] {
+		return
+	}
+
+	r.mu.Lock()
+	delete(r.clients, client)
+	r.mu.Unlock()
+	close(client.send)
+}
+
+// editBroadcast is an edit being broadcast, with and without the full document content
+type editBroadcast struct {
+	full  []byte
+	patch []byte
+}
+
+// parseEditBroadcast returns the two forms of an edit carrying the full content, or nil for any other message
+func parseEditBroadcast(data []byte) *editBroadcast {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "edit" {
+		return nil
+	}
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload["fullContent"] == nil {
+		return nil
+	}
+
+	delete(payload, "fullContent")
+	msg.Payload = mustMarshal(payload)
+	return &editBroadcast{full: data, patch: mustMarshal(msg)}
+}
+
+// isCoalescable reports whether a message is an edit carrying the full document content
+func isCoalescable(data []byte) bool {
+	var msg struct {
+		Type    string `json:"type"`
+		Payload struct {
+			FullContent *string `json:"fullContent"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return false
+	}
+	return msg.Type == "edit" && msg.Payload.FullContent != nil
+}
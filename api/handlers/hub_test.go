@@ -0,0 +1,448 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"minidocs/api/ot"
+	"minidocs/api/store"
+
+	"github.com/gorilla/websocket"
+)
+
+// These tests drive a room's hub with hundreds of fake clients. Each fake client has a real
+// (server-side) WebSocket connection, so the hub can close it, but its send channel is drained by
+// a goroutine standing in for the write pump, which can stall to play a slow consumer.
+// Run them with -race.
+
+const (
+	hubTestClients       = 300
+	hubTestEditsEach     = 2
+	hubTestStallEvery    = 10 // every 10th client stops reading
+	hubTestLeaveEarlyMod = 3  // every 3rd client that keeps up leaves once it has edited
+)
+
+// fakeClient is a joined client and what its stand-in write pump has read
+type fakeClient struct {
+	*Client
+	peer *websocket.Conn // the browser's end of the connection
+
+	stalled bool          // stops reading until resume is closed
+	resume  chan struct{} //
+	closed  chan struct{} // closed once the hub has closed the send channel and everything was read
+	edits   int           // accepted edits made by this client (only touched by its own goroutine)
+
+	mu       sync.Mutex
+	received [][]byte
+}
+
+// startFakeClients opens n connections to a throwaway WebSocket server and wraps the server ends in clients.
+// Every hubTestStallEvery-th client stalls; the others get a buffer big enough to never fill up.
+func startFakeClients(t *testing.T, documentID, n int) []*fakeClient {
+	t.Helper()
+
+	conns := make(chan *websocket.Conn, n)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	clients := make([]*fakeClient, n)
+	for i := range clients {
+		peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("dial fake client %d: %v", i, err)
+		}
+		t.Cleanup(func() { peer.Close() })
+
+		stalled := i%hubTestStallEvery == 0
+		buffer := 64 // as in WebSocketHandler
+		if !stalled {
+			buffer = 4 * hubTestClients * hubTestEditsEach
+		}
+		clients[i] = &fakeClient{
+			Client: &Client{
+				conn:       <-conns,
+				send:       make(chan []byte, buffer),
+				connID:     strconv.Itoa(i),
+				documentID: documentID,
+				userID:     i + 1,
+				username:   "user" + strconv.Itoa(i+1),
+				protocol:   protocolVersion,
+			},
+			peer:    peer,
+			stalled: stalled,
+			resume:  make(chan struct{}),
+			closed:  make(chan struct{}),
+		}
+	}
+	return clients
+}
+
+// pump reads the client's send channel until the hub closes it, waiting for resume first if stalled
+func (c *fakeClient) pump() {
+	if c.stalled {
+		<-c.resume
+	}
+	for data := range c.send {
+		c.mu.Lock()
+		c.received = append(c.received, data)
+		c.mu.Unlock()
+	}
+	close(c.closed)
+}
+
+func (c *fakeClient) messages() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]byte(nil), c.received...)
+}
+
+// edit inserts one character at the start of the document as the client currently sees it, and
+// broadcasts it the way the read pump does. Other clients' edits usually land in between, so most
+// have to be rebased.
+func (c *fakeClient) edit(t *testing.T) {
+	content, revision, err := getDocumentState(c.documentID)
+	if err != nil {
+		t.Errorf("read document: %v", err)
+		return
+	}
+	msg := Message{Type: "edit", DocumentID: c.documentID, UserID: c.userID, Username: c.username}
+	payload := &editPayload{
+		Ops:          ot.New().Insert("x").Retain(utf8.RuneCountInString(content)),
+		BaseRevision: &revision,
+	}
+	if !handleEdit(c.Client, c.room, &msg, payload) {
+		return
+	}
+	c.edits++
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Errorf("marshal edit: %v", err)
+		return
+	}
+	broadcast(c.room, c.Client, data)
+}
+
+// useHubTestStore gives the test a fresh memory store with one empty document, and keeps the log quiet
+func useHubTestStore(t *testing.T) int {
+	t.Helper()
+
+	UseStore(store.NewMemory())
+	if err := stores.Users.CreateUser("owner", "owner@example.com", "hash"); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	owner, err := stores.Users.GetUserByEmail("owner@example.com")
+	if err != nil {
+		t.Fatalf("get user: %v", err)
+	}
+	doc, err := stores.Documents.CreateDocument("Stress", "", owner.ID)
+	if err != nil {
+		t.Fatalf("create document: %v", err)
+	}
+
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return doc.ID
+}
+
+// useSlowClientPolicy overrides WS_SLOW_CLIENT_POLICY for one test. Rooms from earlier tests must be gone.
+func useSlowClientPolicy(t *testing.T, policy string) {
+	t.Helper()
+
+	previous := slowClientPolicySetting()
+	slowClientPolicy = policy
+	t.Cleanup(func() { slowClientPolicy = previous })
+}
+
+// waitForGoroutines fails the test unless the goroutine count drops back to baseline
+func waitForGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines still running, expected at most %d:\n%s",
+				runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitClosed waits for a channel to be closed
+func waitClosed(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// hubRun is the outcome of runHub
+type hubRun struct {
+	room     *Room
+	clients  []*fakeClient
+	accepted int    // edits accepted in total
+	content  string // the document once they were all applied
+}
+
+// runHub joins every client, has them all edit concurrently while the stalled ones stop reading and
+// some of the others leave early, then makes one last edit on its own so it is the last broadcast.
+// It returns once the hub has handled every broadcast, with the clients that didn't leave early
+// still in the room.
+func runHub(t *testing.T, clients []*fakeClient) *hubRun {
+	t.Helper()
+
+	var joined sync.WaitGroup
+	for _, client := range clients {
+		joined.Add(1)
+		go func() {
+			defer joined.Done()
+			joinRoom(client.documentID, "ot", client.Client)
+			go client.pump()
+		}()
+	}
+	joined.Wait()
+
+	var edited sync.WaitGroup
+	for i, client := range clients {
+		if client.stalled {
+			continue // stalled clients only receive
+		}
+		edited.Add(1)
+		go func() {
+			defer edited.Done()
+			for j := 0; j < hubTestEditsEach; j++ {
+				client.edit(t)
+			}
+			if leavesEarly(i) {
+				removeClientFromRoom(client.Client)
+			}
+		}()
+	}
+	edited.Wait()
+
+	last := clients[len(clients)-1]
+	last.edit(t)
+
+	// The hub handles its queue in order, so once this reaches the client every edit before it has been delivered
+	marker := mustMarshal(Message{Type: "test-marker"})
+	last.room.sendTo(last.Client, marker)
+	deadline := time.Now().Add(5 * time.Second)
+	for !hasMessage(last.messages(), marker) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the hub to deliver the queued edits")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	run := &hubRun{room: last.room, clients: clients}
+	for _, client := range clients {
+		run.accepted += client.edits
+	}
+	content, _, err := getDocumentState(last.documentID)
+	if err != nil {
+		t.Fatalf("read document: %v", err)
+	}
+	run.content = content
+	return run
+}
+
+// hasMessage reports whether messages include data
+func hasMessage(messages [][]byte, data []byte) bool {
+	for _, message := range messages {
+		if string(message) == string(data) {
+			return true
+		}
+	}
+	return false
+}
+
+// leavesEarly reports whether the i-th client leaves the room as soon as it has made its edits
+func leavesEarly(i int) bool {
+	return i%hubTestStallEvery != 0 && i%hubTestLeaveEarlyMod == 0
+}
+
+// leaveAll removes every client still in the room (except those skip picks) and checks the hub
+// closed every send channel and the room is gone
+func (run *hubRun) leaveAll(t *testing.T, skip func(i int) bool) {
+	t.Helper()
+
+	for i, client := range run.clients {
+		if leavesEarly(i) || (skip != nil && skip(i)) {
+			continue
+		}
+		removeClientFromRoom(client.Client)
+	}
+
+	waitClosed(t, run.room.done, "the room to close")
+	if isRoomActive(run.room.documentID) {
+		t.Fatal("room is still registered after every client left")
+	}
+	for i, client := range run.clients {
+		if client.stalled {
+			select {
+			case <-client.resume:
+			default:
+				close(client.resume)
+			}
+		}
+		waitClosed(t, client.closed, fmt.Sprintf("client %d's send channel to be closed", i))
+	}
+}
+
+// lastEditContent returns the fullContent of the last message if it is an edit carrying it
+func lastEditContent(messages [][]byte) (string, bool) {
+	if len(messages) == 0 {
+		return "", false
+	}
+	var msg struct {
+		Type    string `json:"type"`
+		Payload struct {
+			FullContent *string `json:"fullContent"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(messages[len(messages)-1], &msg); err != nil || msg.Type != "edit" || msg.Payload.FullContent == nil {
+		return "", false
+	}
+	return *msg.Payload.FullContent, true
+}
+
+// editCount counts the edits among messages
+func editCount(messages [][]byte) int {
+	count := 0
+	for _, data := range messages {
+		var msg Message
+		if json.Unmarshal(data, &msg) == nil && msg.Type == "edit" {
+			count++
+		}
+	}
+	return count
+}
+
+func TestHubCoalescesForStalledClients(t *testing.T) {
+	documentID := useHubTestStore(t)
+	useSlowClientPolicy(t, slowClientCoalesce)
+	clients := startFakeClients(t, documentID, hubTestClients)
+	baseline := runtime.NumGoroutine()
+
+	run := runHub(t, clients)
+	if run.accepted == 0 {
+		t.Fatal("no edit was accepted")
+	}
+	if got := utf8.RuneCountInString(run.content); got != run.accepted {
+		t.Fatalf("document has %d characters after %d accepted edits", got, run.accepted)
+	}
+
+	// Stalled clients are still connected, and once they read again the coalesced edit brings them up to date
+	deadline := time.Now().Add(5 * time.Second)
+	for i, client := range run.clients {
+		if !client.stalled {
+			continue
+		}
+		close(client.resume)
+		for {
+			content, ok := lastEditContent(client.messages())
+			if ok && content == run.content {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("stalled client %d never caught up: last edit had %q, document is %q", i, content, run.content)
+			}
+			time.Sleep(pendingRetryInterval)
+		}
+		if got := editCount(client.messages()); got != cap(client.send)+1 {
+			t.Fatalf("stalled client %d got %d edits, expected its buffer and one coalesced edit", i, got)
+		}
+		select {
+		case <-client.closed:
+			t.Fatalf("stalled client %d was disconnected under the coalesce policy", i)
+		default:
+		}
+	}
+
+	run.leaveAll(t, nil)
+	waitForGoroutines(t, baseline)
+}
+
+func TestHubDropsForStalledClients(t *testing.T) {
+	documentID := useHubTestStore(t)
+	useSlowClientPolicy(t, slowClientDrop)
+	clients := startFakeClients(t, documentID, hubTestClients)
+	baseline := runtime.NumGoroutine()
+
+	run := runHub(t, clients)
+
+	// A stalled client keeps exactly what fitted in its buffer; everything after that was dropped
+	for i, client := range run.clients {
+		if client.stalled && len(client.send) != cap(client.send) {
+			t.Fatalf("stalled client %d has %d queued messages, expected a full buffer of %d", i, len(client.send), cap(client.send))
+		}
+	}
+
+	// ... while a client that kept up got every edit but its own
+	last := run.clients[len(run.clients)-1]
+	if got, want := editCount(last.messages()), run.accepted-last.edits; got != want {
+		t.Fatalf("client that kept up got %d edits, expected %d", got, want)
+	}
+
+	run.leaveAll(t, nil)
+	for i, client := range run.clients {
+		if client.stalled && len(client.messages()) != cap(client.send) {
+			t.Fatalf("stalled client %d read %d messages after resuming, expected %d", i, len(client.messages()), cap(client.send))
+		}
+	}
+	waitForGoroutines(t, baseline)
+}
+
+func TestHubDisconnectsStalledClients(t *testing.T) {
+	documentID := useHubTestStore(t)
+	useSlowClientPolicy(t, slowClientDisconnect)
+	clients := startFakeClients(t, documentID, hubTestClients)
+	baseline := runtime.NumGoroutine()
+
+	run := runHub(t, clients)
+
+	// The hub removed every stalled client and told its browser why
+	for i, client := range run.clients {
+		if !client.stalled {
+			continue
+		}
+		close(client.resume)
+		waitClosed(t, client.closed, fmt.Sprintf("stalled client %d to be removed", i))
+
+		client.peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := client.peer.ReadMessage()
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != closeSlowClient {
+			t.Fatalf("stalled client %d: expected close code %d, got %v", i, closeSlowClient, err)
+		}
+
+		// Its read pump would now leave the room
+		removeClientFromRoom(client.Client)
+	}
+
+	run.leaveAll(t, func(i int) bool { return run.clients[i].stalled })
+	waitForGoroutines(t, baseline)
+}
@@ -0,0 +1,327 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"minidocs/api/middleware"
+	"minidocs/api/models"
+	"minidocs/api/ot"
+	"minidocs/api/utils"
+)
+
+// errHistoryIncomplete is returned when the operation log can't reproduce a revision
+var errHistoryIncomplete = errors.New("edit history is incomplete")
+
+// ReplayResponse is the state of a document at a past revision
+type ReplayResponse struct {
+	DocumentID int    `json:"document_id"`
+	Revision   int64  `json:"revision"`
+	Content    string `json:"content"`
+}
+
+// BlameSpan attributes a run of characters of the current content to a user
+type BlameSpan struct {
+	ot.Span
+	Username string `json:"username"`
+}
+
+// BlameResponse attributes every character of a document to the user who typed it
+type BlameResponse struct {
+	DocumentID int         `json:"document_id"`
+	Revision   int64       `json:"revision"`
+	Content    string      `json:"content"`
+	Spans      []BlameSpan `json:"spans"`
+}
+
+// logPendingOperations writes the edits queued in the cache to the persistent operation log, then
+// drops them from the queue. Revisions already logged are skipped, so a flush that failed halfway is
+// simply retried. Edits lost along with the cache leave a gap in the log, which replay refuses to cross.
+func logPendingOperations(documentID int) error {
+	raw, err := stores.Cache.PendingOperations(documentID)
+	if err != nil || len(raw) == 0 {
+		return err
+	}
+
+	operations := make([]models.DocumentOperation, 0, len(raw))
+	for _, item := range raw {
+		var entry historyEntry
+		if err := json.Unmarshal(item, &entry); err != nil {
+			return err
+		}
+		data, err := json.Marshal(entry.Ops)
+		if err != nil {
+			return err
+		}
+		operations = append(operations, models.DocumentOperation{
+			Revision:  entry.Revision,
+			UserID:    entry.UserID,
+			Operation: string(data),
+			CreatedAt: entry.At,
+		})
+	}
+
+	if err := stores.Operations.AppendDocumentOperations(documentID, operations); err != nil {
+		return err
+	}
+	return stores.Cache.ForgetOperations(documentID, operations[len(operations)-1].Revision)
+}
+
+// replayOperations applies logged operations to content in order, checking there are no gaps
+func replayOperations(content string, fromRevision int64, operations []models.DocumentOperation) (string, error) {
+	expected := fromRevision + 1
+	for _, logged := range operations {
+		if logged.Revision != expected {
+			return "", errHistoryIncomplete
+		}
+
+		var op ot.Operation
+		if err := json.Unmarshal([]byte(logged.Operation), &op); err != nil {
+			return "", err
+		}
+
+		next, err := op.Apply(content)
+		if err != nil {
+			return "", fmt.Errorf("%w: revision %d: %v", errHistoryIncomplete, logged.Revision, err)
+		}
+		content = next
+		expected++
+	}
+	return content, nil
+}
+
+// replayDocument rebuilds a document as it was at a revision, starting from the closest
+// snapshot at or before it and replaying the logged operations from there
+func replayDocument(documentID int, revision int64) (string, error) {
+	version, err := stores.Versions.GetDocumentVersionAtRevision(documentID, revision)
+	if err != nil {
+		if errors.Is(err, models.ErrVersionNotFound) {
+			return "", errHistoryIncomplete
+		}
+		return "", err
+	}
+
+	operations, err := stores.Operations.GetDocumentOperations(documentID, version.Revision, revision)
+	if err != nil {
+		return "", err
+	}
+
+	return replayOperations(version.Content, version.Revision, operations)
+}
+
+// recoverDocumentState loads a document that isn't cached in Redis. PostgreSQL normally holds the
+// latest content, but a flush writes the operation log first, so if it failed after that the log has
+// edits beyond the last snapshot; those are replayed so nothing is lost. Revisions carry on from the
+// highest one persisted.
+func recoverDocumentState(documentID int) (string, int64, error) {
+	doc, err := stores.Documents.GetDocumentByID(documentID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	loggedRevision, err := stores.Operations.GetLatestOperationRevision(documentID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	version, err := stores.Versions.GetLatestDocumentVersion(documentID)
+	if err != nil {
+		if errors.Is(err, models.ErrVersionNotFound) {
+			return doc.Content, loggedRevision, nil
+		}
+		return "", 0, err
+	}
+
+	if loggedRevision <= version.Revision {
+		// Everything logged made it into the last snapshot
+		return doc.Content, version.Revision, nil
+	}
+
+	content, err := replayDocument(documentID, loggedRevision)
+	if err != nil {
+		log.Printf("[OpLog] Could not rebuild document %d past rev %d: %v", documentID, version.Revision, err)
+		return doc.Content, loggedRevision, nil
+	}
+
+	log.Printf("[OpLog] Rebuilt document %d from rev %d to rev %d", documentID, version.Revision, loggedRevision)
+	return content, loggedRevision, nil
+}
+
+// GetDocumentOperations lists logged edits: ?after={revision}&until={revision}
+func GetDocumentOperations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
+
+	id, ok := parseDocumentID(w, r)
+	if !ok {
+		return
+	}
+
+	if authorizeDocument(w, id, claims.UserID, accessCollaborator, "You don't have permission to view this document") == nil {
+		return
+	}
+
+	after, _ := strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+	until, _ := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
+
+	operations, err := stores.Operations.GetDocumentOperations(id, after, until)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to retrieve operations"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(operations)
+}
+
+// ReplayDocument returns the content of a document at a past point: ?revision={n} or ?at={RFC 3339 time}
+func ReplayDocument(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
+
+	id, ok := parseDocumentID(w, r)
+	if !ok {
+		return
+	}
+
+	if authorizeDocument(w, id, claims.UserID, accessCollaborator, "You don't have permission to view this document") == nil {
+		return
+	}
+
+	var revision int64
+	var err error
+	if at := r.URL.Query().Get("at"); at != "" {
+		var t time.Time
+		t, err = time.Parse(time.RFC3339, at)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid time, use RFC 3339"})
+			return
+		}
+		revision, err = stores.Operations.GetOperationRevisionAt(id, t)
+	} else {
+		revision, err = strconv.ParseInt(r.URL.Query().Get("revision"), 10, 64)
+		if err != nil || revision < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid revision"})
+			return
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Database error"})
+		return
+	}
+
+	content, err := replayDocument(id, revision)
+	if err != nil {
+		if errors.Is(err, errHistoryIncomplete) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "No history available for that revision"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to replay document"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ReplayResponse{DocumentID: id, Revision: revision, Content: content})
+}
+
+// BlameDocument attributes each character of the document to the user who typed it by replaying
+// the whole operation log from the first snapshot. Text from that snapshot belongs to its creator,
+// or to the owner for automatic snapshots.
+func BlameDocument(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
+
+	id, ok := parseDocumentID(w, r)
+	if !ok {
+		return
+	}
+
+	doc := authorizeDocument(w, id, claims.UserID, accessCollaborator, "You don't have permission to view this document")
+	if doc == nil {
+		return
+	}
+
+	first, err := stores.Versions.GetEarliestDocumentVersion(id)
+	if err != nil {
+		if errors.Is(err, models.ErrVersionNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "No history available for this document"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Database error"})
+		return
+	}
+
+	operations, err := stores.Operations.GetDocumentOperations(id, first.Revision, 0)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to retrieve operations"})
+		return
+	}
+
+	initialAuthor := doc.OwnerID
+	if first.CreatedBy != nil {
+		initialAuthor = *first.CreatedBy
+	}
+
+	content := first.Content
+	revision := first.Revision
+	authors := ot.NewAuthors(len([]rune(content)), initialAuthor)
+
+	for _, logged := range operations {
+		var op ot.Operation
+		err := json.Unmarshal([]byte(logged.Operation), &op)
+		if err == nil && logged.Revision == revision+1 {
+			content, err = op.Apply(content)
+			if err == nil {
+				authors, err = authors.Apply(&op, logged.UserID)
+			}
+		} else if err == nil {
+			err = errHistoryIncomplete
+		}
+		if err != nil {
+			log.Printf("[OpLog] Blame of document %d stopped at rev %d: %v", id, revision, err)
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Edit history is incomplete, blame is unavailable"})
+			return
+		}
+		revision = logged.Revision
+	}
+
+	// Resolve usernames once per author
+	usernames := make(map[int]string)
+	spans := make([]BlameSpan, 0)
+	for _, span := range authors.Spans() {
+		username, seen := usernames[span.Author]
+		if !seen {
+			if user, err := stores.Users.GetUserByID(span.Author); err == nil {
+				username = user.Username
+			}
+			usernames[span.Author] = username
+		}
+		spans = append(spans, BlameSpan{Span: span, Username: username})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(BlameResponse{
+		DocumentID: id,
+		Revision:   revision,
+		Content:    content,
+		Spans:      spans,
+	})
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"errors"
+	"testing"
+
+	"minidocs/api/models"
+	"minidocs/api/ot"
+	"minidocs/api/store"
+)
+
+// failingOperations is an operation log that refuses appends while fail is set
+type failingOperations struct {
+	store.OperationStore
+	fail bool
+}
+
+func (s *failingOperations) AppendDocumentOperations(documentID int, operations []models.DocumentOperation) error {
+	if s.fail {
+		return errors.New("database unavailable")
+	}
+	return s.OperationStore.AppendDocumentOperations(documentID, operations)
+}
+
+func TestFlushKeepsOperationsUntilLogged(t *testing.T) {
+	documentID := useHubTestStore(t)
+	operations := &failingOperations{OperationStore: stores.Operations, fail: true}
+	stores.Operations = operations
+
+	content := ""
+	for revision := int64(1); revision <= 2; revision++ {
+		op := ot.New().Retain(len(content)).Insert("x")
+		content += "x"
+		if err := saveDocumentState(documentID, content, revision, &historyEntry{Revision: revision, UserID: 1, Ops: op}); err != nil {
+			t.Fatalf("save revision %d: %v", revision, err)
+		}
+	}
+
+	// Nothing is written while the log can't be, so the content is never ahead of it
+	if _, ok := persistDocument(documentID, false); ok {
+		t.Fatal("flush succeeded although the operations could not be logged")
+	}
+	if doc, _ := stores.Documents.GetDocumentByID(documentID); doc.Content != "" {
+		t.Fatalf("content %q was written before its operations", doc.Content)
+	}
+
+	// Once it can, every queued operation is logged once, even if the flush runs again
+	operations.fail = false
+	for i := 0; i < 2; i++ {
+		if revision, ok := persistDocument(documentID, false); !ok || revision != 2 {
+			t.Fatalf("flush %d: got revision %d, ok %v; want revision 2", i, revision, ok)
+		}
+	}
+	logged, err := stores.Operations.GetDocumentOperations(documentID, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logged) != 2 || logged[0].Revision != 1 || logged[1].Revision != 2 || logged[1].Operation != `[1,"x"]` {
+		t.Fatalf("operation log is %+v, want revisions 1 and 2", logged)
+	}
+	if pending, _ := stores.Cache.PendingOperations(documentID); len(pending) != 0 {
+		t.Fatalf("%d operations still pending after they were logged", len(pending))
+	}
+}
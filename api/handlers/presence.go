@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"minidocs/api/middleware"
+	"minidocs/api/utils"
+)
+
+// A user can have a document open in several tabs, on several servers. Presence is tracked per
+// connection (see cluster.go) and reported per user: "join" goes out with their first connection,
+// "leave" with their last, and everything in between is a "presence" update with their connection
+// count and status.
+
+// Statuses of a connection, and of a user (the most present of their connections)
+const (
+	presenceActive = "active" // the user is doing something in this tab
+	presenceIdle   = "idle"   // the tab is visible but nothing happened for presenceIdleAfter
+	presenceAway   = "away"   // the tab is hidden (reported by the client)
+)
+
+// presenceIdleAfter is how long a connection may send nothing before its user shows as idle
+const presenceIdleAfter = 5 * time.Minute
+
+// presenceUpdatePayload tells the room a user's connections or status changed
+type presenceUpdatePayload struct {
+	memberInfo
+	ClosedSession string `json:"closedSession,omitempty"` // set when one of the user's connections closed
+}
+
+// PresenceResponse lists who has a document open, for the dashboard
+type PresenceResponse struct {
+	DocumentID int          `json:"document_id"`
+	Users      []memberInfo `json:"users"`
+}
+
+// currentStatus works out a connection's status from what its client reported and when it was last heard from
+func (c *Client) currentStatus() string {
+	if c.away.Load() {
+		return presenceAway
+	}
+	if c.idleFor() > presenceIdleAfter {
+		return presenceIdle
+	}
+	return presenceActive
+}
+
+// statusRank orders statuses from most to least present
+var statusRank = map[string]int{presenceActive: 0, presenceIdle: 1, presenceAway: 2}
+
+// documentPresence returns every user with the document open on any server, with their
+// connection count and status
+func documentPresence(documentID int) ([]memberInfo, error) {
+	sessions, err := clusterSessions(documentID)
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := stores.Cluster.Statuses(documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]memberInfo, 0, len(sessions))
+	index := make(map[int]int) // user ID -> position in members
+
+	for _, session := range sessions {
+		status := statuses[session.Session()]
+		if status == "" {
+			status = presenceActive
+		}
+
+		i, seen := index[session.UserID]
+		if !seen {
+			index[session.UserID] = len(members)
+			members = append(members, memberInfo{
+				UserID:   session.UserID,
+				Username: session.Username,
+				Color:    userColor(session.UserID),
+				Status:   status,
+			})
+			i = len(members) - 1
+		}
+
+		members[i].Connections++
+		if statusRank[status] < statusRank[members[i].Status] {
+			members[i].Status = status
+		}
+	}
+
+	return members, nil
+}
+
+// publishUserPresence tells the room about a user's current connections and status.
+// closedSession is the connection that just closed, if that is what changed.
+func publishUserPresence(room *Room, userID int, username, closedSession string) {
+	members, err := documentPresence(room.documentID)
+	if err != nil {
+		log.Printf("[Cluster] Failed to read presence of document %d: %v", room.documentID, err)
+		return
+	}
+
+	update := presenceUpdatePayload{
+		memberInfo:    memberInfo{UserID: userID, Username: username, Color: userColor(userID), Status: presenceActive},
+		ClosedSession: closedSession,
+	}
+	for _, member := range members {
+		if member.UserID == userID {
+			update.memberInfo = member
+		}
+	}
+
+	data, _ := json.Marshal(Message{
+		Type:       "presence",
+		DocumentID: room.documentID,
+		UserID:     userID,
+		Username:   username,
+		Payload:    json.RawMessage(mustMarshal(update)),
+	})
+	broadcast(room, nil, data) // nil sender: the user's other tabs want to know too
+}
+
+// handlePresence records a client reporting whether its tab is visible
+func handlePresence(client *Client, room *Room, payload *presencePayload) {
+	client.away.Store(payload.Status == presenceAway)
+	updateClientStatus(client, room)
+}
+
+// updateClientStatus stores a connection's status and announces its user's if it changed
+func updateClientStatus(client *Client, room *Room) {
+	status := client.currentStatus()
+	if previous, _ := client.lastStatus.Swap(status).(string); previous == status {
+		return
+	}
+
+	if err := stores.Cluster.SetStatus(client.documentID, client.session(), status); err != nil {
+		log.Printf("[Cluster] Failed to store status of user %d: %v", client.userID, err)
+		return
+	}
+	publishUserPresence(room, client.userID, client.username, "")
+}
+
+// refreshStatuses notices connections on this server that went idle (or came back)
+func refreshStatuses() {
+	roomManager.mu.RLock()
+	rooms := make([]*Room, 0, len(roomManager.rooms))
+	for _, room := range roomManager.rooms {
+		rooms = append(rooms, room)
+	}
+	roomManager.mu.RUnlock()
+
+	for _, room := range rooms {
+		room.mu.RLock()
+		clients := make([]*Client, 0, len(room.clients))
+		for client := range room.clients {
+			clients = append(clients, client)
+		}
+		room.mu.RUnlock()
+
+		for _, client := range clients {
+			updateClientStatus(client, room)
+		}
+	}
+}
+
+// GetDocumentPresence lists the users who have a document open, with how many tabs and their status
+func GetDocumentPresence(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
+
+	id, ok := parseDocumentID(w, r)
+	if !ok {
+		return
+	}
+
+	if authorizeDocument(w, id, claims.UserID, accessCollaborator, "You don't have permission to view this document") == nil {
+		return
+	}
+
+	users, err := documentPresence(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to retrieve presence"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(PresenceResponse{DocumentID: id, Users: users})
+}
@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"minidocs/api/ot"
+)
+
+// Every message a client sends is checked against a schema before anything else looks at it: its type
+// must be known, it must fit that type's size limit and its payload must decode into the type's struct
+// (no unknown fields) and pass validation. Anything else is answered with an "error" message and dropped.
+
+// Protocol versions this server speaks. Clients ask for one with ?protocol=N when connecting.
+const (
+	protocolVersion    = 3 // newest version, used when a client asks for a later one (2: members carry colors and cursors, 3: edits come without fullContent)
+	minProtocolVersion = 2 // oldest version still accepted (1 sent diff-match-patch patches rather than operations)
+	legacyProtocol     = 1 // assumed when a client doesn't say, as it predates versioning
+)
+
+// maxMessageSize is the read limit of a connection, the largest size any message type allows
+const maxMessageSize = 1024 * 1024
+
+// Limits on individual fields
+const (
+	maxMessageIDLength = 64   // client message IDs (UUIDs in practice)
+	maxReplicaLength   = 64   // CRDT replica tokens (UUIDs in practice)
+	maxChatLength      = 2000 // characters in a chat message
+)
+
+// Codes carried by an "error" message
+const (
+	errorMalformedMessage = "malformed-message" // not a JSON message envelope
+	errorUnknownType      = "unknown-type"      // no schema for the message type
+	errorMessageTooLarge  = "message-too-large" // over the size limit of its type
+	errorInvalidPayload   = "invalid-payload"   // the payload doesn't match the type's schema
+)
+
+// errorPayload is sent back to a client whose message was malformed. The envelope's ID is the
+// offending message's ID, when it had one.
+type errorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// cursorPayload is where a user's caret is, in characters from the start of the document
+type cursorPayload struct {
+	Position int `json:"position"`
+	Length   int `json:"length,omitempty"` // sent by older clients for selections; prefer "selection"
+}
+
+// selectionPayload is the range of text a user has selected
+type selectionPayload struct {
+	Position int `json:"position"`
+	Length   int `json:"length"`
+}
+
+// chatPayload is a chat message
+type chatPayload struct {
+	Text string `json:"text"`
+}
+
+// presencePayload tells the server whether the user is looking at the document (see presence.go)
+type presencePayload struct {
+	Status string `json:"status"`
+}
+
+// typingPayload is sent while the user writes a chat message; typing in the document is worked out
+// from edits instead (see typing.go)
+type typingPayload struct {
+	Target string `json:"target"`
+}
+
+// payloadValidator is implemented by the payload struct of every message type clients may send
+type payloadValidator interface {
+	validate() error
+}
+
+// messageSchema describes one message type clients may send
+type messageSchema struct {
+	maxSize    int                     // largest accepted message, envelope included, in bytes
+	newPayload func() payloadValidator // empty payload struct to decode into
+}
+
+// messageSchemas lists every message type clients may send
+var messageSchemas = map[string]messageSchema{
+	"sync":        {1024, func() payloadValidator { return &syncPayload{} }},
+	"edit":        {maxMessageSize, func() payloadValidator { return &editPayload{} }},
+	"crdt-sync":   {64 * 1024, func() payloadValidator { return &crdtSyncPayload{} }},
+	"crdt-update": {maxMessageSize, func() payloadValidator { return &crdtUpdatePayload{} }},
+	"cursor":      {1024, func() payloadValidator { return &cursorPayload{} }},
+	"selection":   {1024, func() payloadValidator { return &selectionPayload{} }},
+	"chat":        {16 * 1024, func() payloadValidator { return &chatPayload{} }},
+	"presence":    {1024, func() payloadValidator { return &presencePayload{} }},
+	"typing":      {1024, func() payloadValidator { return &typingPayload{} }},
+}
+
+func (p *syncPayload) validate() error {
+	if p.Revision != nil && *p.Revision < 0 {
+		return errors.New("revision can't be negative")
+	}
+	if len(p.PendingID) > maxMessageIDLength {
+		return errors.New("pendingId is too long")
+	}
+	if p.Reason != "" && p.Reason != syncReasonChecksumMismatch {
+		return fmt.Errorf("unknown reason %q", p.Reason)
+	}
+	return nil
+}
+
+func (p *editPayload) validate() error {
+	if p.Ops == nil {
+		return errors.New("missing operation")
+	}
+	if p.Ops.BaseLen > ot.MaxLength || p.Ops.TargetLen > ot.MaxLength {
+		return ot.ErrTooLong
+	}
+	if p.BaseRevision != nil && *p.BaseRevision < 0 {
+		return errors.New("baseRevision can't be negative")
+	}
+	return nil
+}
+
+func (p *crdtSyncPayload) validate() error {
+	if p.Replica == "" || len(p.Replica) > maxReplicaLength {
+		return fmt.Errorf("replica must be 1 to %d characters", maxReplicaLength)
+	}
+	return nil
+}
+
+func (p *crdtUpdatePayload) validate() error {
+	if p.Revision != 0 {
+		return errors.New("revision is set by the server")
+	}
+	// Positions count items, so each one must be exactly one character
+	for _, item := range p.Update.Items {
+		if utf8.RuneCountInString(item.Value) != 1 {
+			return fmt.Errorf("item %d:%d must hold exactly one character", item.ID.Client, item.ID.Clock)
+		}
+	}
+	return nil
+}
+
+func (p *cursorPayload) validate() error {
+	if p.Position < 0 || p.Length < 0 {
+		return errors.New("position and length can't be negative")
+	}
+	return nil
+}
+
+func (p *selectionPayload) validate() error {
+	if p.Position < 0 || p.Length < 0 {
+		return errors.New("position and length can't be negative")
+	}
+	return nil
+}
+
+func (p *chatPayload) validate() error {
+	p.Text = strings.TrimSpace(p.Text)
+	if p.Text == "" {
+		return errors.New("empty chat message")
+	}
+	if utf8.RuneCountInString(p.Text) > maxChatLength {
+		return fmt.Errorf("chat messages are limited to %d characters", maxChatLength)
+	}
+	return nil
+}
+
+func (p *presencePayload) validate() error {
+	if p.Status != presenceActive && p.Status != presenceAway {
+		return fmt.Errorf("unknown status %q", p.Status)
+	}
+	return nil
+}
+
+func (p *typingPayload) validate() error {
+	if p.Target != typingTargetChat {
+		return fmt.Errorf("clients only report typing in %q", typingTargetChat)
+	}
+	return nil
+}
+
+// protocolError describes why a client message was rejected
+type protocolError struct {
+	code   string
+	detail string
+}
+
+func (e *protocolError) Error() string {
+	return e.code + ": " + e.detail
+}
+
+// parseClientMessage decodes and validates a message read from a client. On error the returned
+// Message still carries whatever ID could be read, so the error can refer to it.
+func parseClientMessage(raw []byte) (Message, payloadValidator, *protocolError) {
+	var msg Message
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return msg, nil, &protocolError{errorMalformedMessage, "message is not valid JSON"}
+	}
+	if len(msg.ID) > maxMessageIDLength {
+		msg.ID = ""
+		return msg, nil, &protocolError{errorMalformedMessage, "message ID is too long"}
+	}
+
+	schema, known := messageSchemas[msg.Type]
+	if !known {
+		return msg, nil, &protocolError{errorUnknownType, fmt.Sprintf("unknown message type %q", msg.Type)}
+	}
+	if len(raw) > schema.maxSize {
+		return msg, nil, &protocolError{errorMessageTooLarge, fmt.Sprintf("%s messages are limited to %d bytes", msg.Type, schema.maxSize)}
+	}
+
+	payload := schema.newPayload()
+	if len(msg.Payload) == 0 {
+		return msg, nil, &protocolError{errorInvalidPayload, "missing payload"}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(msg.Payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(payload); err != nil {
+		return msg, nil, &protocolError{errorInvalidPayload, err.Error()}
+	}
+	if err := payload.validate(); err != nil {
+		return msg, nil, &protocolError{errorInvalidPayload, err.Error()}
+	}
+	return msg, payload, nil
+}
+
+// sendError tells a client one of its messages was malformed and has been dropped
+func sendError(client *Client, messageID string, perr *protocolError) {
+	log.Printf("Invalid message %q from user %s: %v", messageID, client.username, perr)
+	sendToClient(client, Message{
+		Type:       "error",
+		ID:         messageID,
+		DocumentID: client.documentID,
+		UserID:     client.userID,
+		Username:   client.username,
+		Payload:    mustMarshal(errorPayload{Code: perr.code, Message: perr.detail}),
+	})
+}
+
+// negotiateProtocol picks the protocol version for a connection from the ?protocol= query parameter:
+// the version the client asked for, capped at the newest one we speak. Clients older than
+// minProtocolVersion are refused before the upgrade, with an error telling them to update.
+func negotiateProtocol(r *http.Request) (int, error) {
+	requested := r.URL.Query().Get("protocol")
+	version := legacyProtocol
+	if requested != "" {
+		var err error
+		version, err = strconv.Atoi(requested)
+		if err != nil {
+			return 0, fmt.Errorf("invalid protocol version %q", requested)
+		}
+	}
+	if version < minProtocolVersion {
+		return 0, fmt.Errorf("protocol version %d is no longer supported, the oldest is %d: reload the page to update the editor", version, minProtocolVersion)
+	}
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+	return version, nil
+}
@@ -0,0 +1,14 @@
+package handlers
+
+import (
+	"testing"
+)
+
+func TestParseClientMessageRejectsOverflowingEdit(t *testing.T) {
+	raw := `{"type":"edit","id":"1","payload":{"ops":[9223372036854774784,9223372036854774784,-9223372036854774784,-9223372036854774784,4096],"baseRevision":0}}`
+
+	_, _, perr := parseClientMessage([]byte(raw))
+	if perr == nil || perr.code != errorInvalidPayload {
+		t.Fatalf("expected an %s error, got %v", errorInvalidPayload, perr)
+	}
+}
@@ -0,0 +1,290 @@
+package handlers
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Every message a client sends spends tokens from token buckets, both the connection's own and ones
+// shared by all of its user's connections to this server: one for messages of its class (edits, cursor
+// moves, chat...) and ones for messages and bytes of any kind. Edits and chat
+// messages that find their bucket empty are refused with a "rate-limited" nack; cursor moves are
+// throttled instead, only their latest position being broadcast once the bucket refills. A connection
+// that keeps being refused is closed with closeRateLimited.
+
+// closeRateLimited is the WebSocket close code sent to a client that ignored rate limiting (mirrors HTTP 429)
+const closeRateLimited = 4429
+
+// leaveReasonRateLimited is set on the "leave" of a client closed for sending too much
+const leaveReasonRateLimited = "rate-limited"
+
+// Rate limit classes
+const (
+	rateClassMessages = "messages" // every message, whatever its type
+	rateClassBytes    = "bytes"    // size of every message
+	rateClassEdit     = "edit"     // edits and CRDT updates
+	rateClassCursor   = "cursor"   // cursor moves, selections and chat typing
+	rateClassChat     = "chat"     // chat messages
+)
+
+// rateClasses maps the message types that have their own limit to their class
+var rateClasses = map[string]string{
+	"edit":        rateClassEdit,
+	"crdt-update": rateClassEdit,
+	"cursor":      rateClassCursor,
+	"selection":   rateClassCursor,
+	"typing":      rateClassCursor,
+	"chat":        rateClassChat,
+}
+
+// rateLimit is the rate a bucket refills at and how many tokens it holds when full
+type rateLimit struct {
+	perSecond float64
+	burst     float64
+}
+
+// connectionLimits apply to each connection
+var connectionLimits = map[string]rateLimit{
+	rateClassMessages: {100, 200},
+	rateClassBytes:    {1 << 20, 4 << 20}, // a few full-size edits at once, a megabyte a second after that
+	rateClassEdit:     {20, 50},
+	rateClassCursor:   {20, 20},
+	rateClassChat:     {2, 5},
+}
+
+// userLimits apply to all connections of a user to this server together
+var userLimits = map[string]rateLimit{
+	rateClassBytes:  {2 << 20, 8 << 20},
+	rateClassEdit:   {40, 100},
+	rateClassCursor: {40, 40},
+	rateClassChat:   {3, 10},
+}
+
+// strikeLimit is how many refused messages a connection may send (a burst, then one a second)
+// before it is closed
+var strikeLimit = rateLimit{1, 20}
+
+// tokenBucket holds up to limit.burst tokens and refills at limit.perSecond
+type tokenBucket struct {
+	limit  rateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit rateLimit) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: limit.burst, last: time.Now()}
+}
+
+// take spends cost tokens if the bucket has them
+func (b *tokenBucket) take(cost float64) bool {
+	b.refill()
+	if b.tokens < cost {
+		return false
+	}
+	b.tokens -= cost
+	return true
+}
+
+// wait reports how long until the bucket has cost tokens
+func (b *tokenBucket) wait(cost float64) time.Duration {
+	b.refill()
+	if b.tokens >= cost {
+		return 0
+	}
+	return time.Duration(math.Ceil((cost - b.tokens) / b.limit.perSecond * float64(time.Second)))
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = math.Min(b.limit.burst, b.tokens+now.Sub(b.last).Seconds()*b.limit.perSecond)
+	b.last = now
+}
+
+// rateLimiter is a set of token buckets, one per class it has limits for
+type rateLimiter struct {
+	mu      sync.Mutex
+	limits  map[string]rateLimit
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(limits map[string]rateLimit) *rateLimiter {
+	return &rateLimiter{limits: limits, buckets: make(map[string]*tokenBucket)}
+}
+
+// take spends cost tokens of a class. Classes without a limit are free.
+func (l *rateLimiter) take(class string, cost float64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket := l.bucket(class)
+	return bucket == nil || bucket.take(cost)
+}
+
+// wait reports how long until a message of a class could be sent
+func (l *rateLimiter) wait(class string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if bucket := l.bucket(class); bucket != nil {
+		return bucket.wait(1)
+	}
+	return 0
+}
+
+func (l *rateLimiter) bucket(class string) *tokenBucket {
+	bucket, ok := l.buckets[class]
+	if !ok {
+		limit, limited := l.limits[class]
+		if !limited {
+			return nil
+		}
+		bucket = newTokenBucket(limit)
+		l.buckets[class] = bucket
+	}
+	return bucket
+}
+
+// userRateLimiters holds the limiters shared by each user's connections to this server
+var userRateLimiters = struct {
+	sync.Mutex
+	limiters map[int]*userRateLimiter
+}{limiters: make(map[int]*userRateLimiter)}
+
+type userRateLimiter struct {
+	*rateLimiter
+	refs int // connections using it
+}
+
+// acquireUserRateLimiter returns the limiter shared by a user's connections; release it when the connection closes
+func acquireUserRateLimiter(userID int) *rateLimiter {
+	userRateLimiters.Lock()
+	defer userRateLimiters.Unlock()
+
+	limiter, ok := userRateLimiters.limiters[userID]
+	if !ok {
+		limiter = &userRateLimiter{rateLimiter: newRateLimiter(userLimits)}
+		userRateLimiters.limiters[userID] = limiter
+	}
+	limiter.refs++
+	return limiter.rateLimiter
+}
+
+// releaseUserRateLimiter forgets a user's limiter once their last connection to this server closed
+func releaseUserRateLimiter(userID int) {
+	userRateLimiters.Lock()
+	defer userRateLimiters.Unlock()
+
+	limiter, ok := userRateLimiters.limiters[userID]
+	if !ok {
+		return
+	}
+	if limiter.refs--; limiter.refs == 0 {
+		delete(userRateLimiters.limiters, userID)
+	}
+}
+
+// Outcome of checking a message against the rate limits
+type rateDecision int
+
+const (
+	rateAllowed   rateDecision = iota
+	rateThrottled              // a cursor move over the limit: keep it, broadcast it later
+	rateRefused                // anything else over the limit: drop it
+)
+
+// checkRateLimits spends the tokens for a message of the given type and size
+func checkRateLimits(client *Client, msgType string, size int) rateDecision {
+	if !client.limiter.take(rateClassMessages, 1) ||
+		!client.limiter.take(rateClassBytes, float64(size)) ||
+		!client.userLimiter.take(rateClassBytes, float64(size)) {
+		return rateRefused
+	}
+
+	class, limited := rateClasses[msgType]
+	if !limited {
+		return rateAllowed
+	}
+	if client.limiter.take(class, 1) && client.userLimiter.take(class, 1) {
+		return rateAllowed
+	}
+	if class == rateClassCursor {
+		return rateThrottled
+	}
+	return rateRefused
+}
+
+// refuseRateLimited nacks a message sent over the limit, closing the connection if the client
+// doesn't slow down. It reports whether the connection was closed.
+func refuseRateLimited(client *Client, msg *Message) bool {
+	if !client.strikes.take(1) {
+		client.setLeaveReason(leaveReasonRateLimited)
+		client.closeWithCode(closeRateLimited, "Too many messages")
+		return true
+	}
+
+	if msg.ID != "" {
+		class, limited := rateClasses[msg.Type]
+		if !limited {
+			class = rateClassMessages
+		}
+		retryAfter := max(client.limiter.wait(class), client.userLimiter.wait(class))
+		sendNack(client, msg.ID, nackPayload{Reason: nackRateLimited, Message: "too many messages, slow down", RetryAfter: retryAfter.Milliseconds()})
+	}
+	return false
+}
+
+// cursorThrottle holds the latest cursor move of a connection that is over its cursor limit
+type cursorThrottle struct {
+	mu      sync.Mutex
+	pending []byte      // latest message not broadcast yet
+	timer   *time.Timer // broadcasts it once the bucket has refilled
+}
+
+// active reports whether a cursor move is waiting to be broadcast; newer ones must wait behind it
+func (t *cursorThrottle) active() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.timer != nil
+}
+
+// throttleCursor keeps a cursor move that can't be broadcast yet, replacing any older one, and
+// schedules its broadcast for when the connection may send cursor moves again
+func throttleCursor(client *Client, room *Room, data []byte) {
+	throttle := &client.cursorThrottle
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+
+	throttle.pending = data
+	if throttle.timer != nil {
+		return // already scheduled
+	}
+
+	delay := max(client.limiter.wait(rateClassCursor), client.userLimiter.wait(rateClassCursor))
+	throttle.timer = time.AfterFunc(delay, func() {
+		throttle.mu.Lock()
+		pending := throttle.pending
+		throttle.pending = nil
+		throttle.timer = nil
+		throttle.mu.Unlock()
+
+		if pending != nil {
+			client.limiter.take(rateClassCursor, 1)
+			client.userLimiter.take(rateClassCursor, 1)
+			broadcast(room, client, pending)
+		}
+	})
+}
+
+// stopCursorThrottle drops a closing connection's pending cursor move
+func stopCursorThrottle(client *Client) {
+	throttle := &client.cursorThrottle
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+
+	if throttle.timer != nil {
+		throttle.timer.Stop()
+		throttle.timer = nil
+	}
+	throttle.pending = nil
+}
@@ -0,0 +1,11 @@
+package handlers
+
+import "minidocs/api/store"
+
+// stores is where the handlers read and write everything; set it with UseStore before serving
+var stores *store.Store
+
+// UseStore sets the store the handlers use: store.New in production, store.NewMemory in tests
+func UseStore(s *store.Store) {
+	stores = s
+}
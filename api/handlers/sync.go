@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"log"
+
+	"minidocs/api/models"
+	"minidocs/api/ot"
+)
+
+// syncReasonChecksumMismatch is the reason of a sync sent by a client whose content no longer
+// matches the checksum of an edit: it gets a full snapshot whatever its revision
+const syncReasonChecksumMismatch = "checksum-mismatch"
+
+// syncPayload is sent by a client right after it (re)connects, with the last revision it knows about,
+// or when it finds out its copy of the document went wrong
+type syncPayload struct {
+	Revision  *int64 `json:"revision"`            // nil for a client with no state yet (first connect)
+	PendingID string `json:"pendingId,omitempty"` // ID of an edit it sent but never saw acknowledged
+	Reason    string `json:"reason,omitempty"`    // syncReasonChecksumMismatch, or empty for a (re)connect
+}
+
+// syncOp is one operation the client missed
+type syncOp struct {
+	Revision int64         `json:"revision"`
+	UserID   int           `json:"userId"`
+	ID       string        `json:"id,omitempty"`
+	Ops      *ot.Operation `json:"ops"`
+}
+
+// syncReplyPayload answers a sync with either the missing operations (from the Redis history,
+// bounded by historyLimit) or, when those are gone, a full snapshot of the document
+type syncReplyPayload struct {
+	Revision       int64    `json:"revision"`
+	Ops            []syncOp `json:"ops,omitempty"`
+	FullContent    *string  `json:"fullContent,omitempty"`
+	Checksum       uint32   `json:"checksum"`       // of the content at Revision (see contentChecksum)
+	PendingApplied bool     `json:"pendingApplied"` // the edit named by PendingID was accepted
+}
+
+// handleSync brings a reconnecting client up to date. It holds the room's edit lock so no edit is
+// accepted in between: everything after the reply's revision reaches the client as a normal broadcast.
+func handleSync(client *Client, room *Room, msg *Message, payload *syncPayload) {
+	room.editMu.Lock()
+	defer room.editMu.Unlock()
+
+	var reply syncReplyPayload
+	if room.syncMode == models.SyncModeCRDT {
+		// CRDT clients catch up with crdt-sync; this just hands over the current text
+		doc, err := roomCRDT(room, msg.DocumentID)
+		if err != nil {
+			log.Printf("[CRDT] Failed to load document %d: %v", msg.DocumentID, err)
+			return
+		}
+		content := doc.Text()
+		reply = syncReplyPayload{Revision: room.crdtRev, FullContent: &content, Checksum: contentChecksum(content)}
+	} else {
+		content, revision, err := getDocumentState(msg.DocumentID)
+		if err != nil {
+			log.Printf("Error getting document: %v", err)
+			return
+		}
+		reply = buildSyncReply(msg.DocumentID, client.userID, *payload, content, revision)
+	}
+
+	if payload.Reason == syncReasonChecksumMismatch {
+		log.Printf("[Sync] %s reported a checksum mismatch in document %d, sending a snapshot", client.username, msg.DocumentID)
+	}
+	if reply.FullContent != nil {
+		log.Printf("[Sync] Sent snapshot of document %d at rev %d to %s", msg.DocumentID, reply.Revision, client.username)
+	} else {
+		log.Printf("[Sync] Sent %d missed ops of document %d to %s", len(reply.Ops), msg.DocumentID, client.username)
+	}
+
+	sendToClient(client, Message{
+		Type:       "sync-reply",
+		DocumentID: msg.DocumentID,
+		UserID:     client.userID,
+		Username:   client.username,
+		Payload:    mustMarshal(reply),
+	})
+}
+
+// buildSyncReply works out what a client at payload.Revision is missing from a document in OT mode
+func buildSyncReply(documentID, userID int, payload syncPayload, content string, revision int64) syncReplyPayload {
+	reply := syncReplyPayload{Revision: revision, Checksum: contentChecksum(content)}
+
+	// A client whose copy went wrong can't be helped by more operations
+	if payload.Reason != syncReasonChecksumMismatch && payload.Revision != nil && *payload.Revision <= revision {
+		entries, err := getHistorySince(documentID, *payload.Revision, revision)
+		if err == nil {
+			reply.Ops = make([]syncOp, 0, len(entries))
+			for _, entry := range entries {
+				reply.Ops = append(reply.Ops, syncOp{
+					Revision: entry.Revision,
+					UserID:   entry.UserID,
+					ID:       entry.ID,
+					Ops:      entry.Ops,
+				})
+				if payload.PendingID != "" && entry.ID == payload.PendingID {
+					reply.PendingApplied = true
+				}
+			}
+			return reply
+		}
+	}
+
+	// Too far behind (or no state at all): send everything
+	reply.FullContent = &content
+	if payload.PendingID != "" {
+		_, reply.PendingApplied = appliedEditRevision(documentID, userID, payload.PendingID)
+	}
+	return reply
+}
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"minidocs/api/middleware"
+	"minidocs/api/models"
+	"minidocs/api/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// Deleting a document moves it to its owner's trash: it disappears for everyone, open sessions are
+// closed, and it can be restored or deleted for good until it is purged after TRASH_RETENTION.
+
+const (
+	// defaultTrashRetention is how long a document stays in the trash before it is purged
+	defaultTrashRetention = 30 * 24 * time.Hour
+	// trashPurgeInterval is how often the trash is checked for documents past their retention
+	trashPurgeInterval = time.Hour
+)
+
+// closeDocumentDeleted is the WebSocket close code sent when the document is moved to the trash
+// mid-session. It mirrors HTTP 410 Gone.
+const closeDocumentDeleted = 4410
+
+// trashDocument moves a document to the trash. The cached content is written back first, so what was
+// last typed is what gets restored. Open sessions are closed on every server only once the document is
+// in the trash: a client reconnecting before then would otherwise be let back in and stay attached.
+func trashDocument(documentID int) error {
+	if err := moveToTrash(documentID); err != nil {
+		return err
+	}
+
+	closeDocumentSessions(documentID)
+	return nil
+}
+
+// moveToTrash saves and soft-deletes a document while holding its write lease, so no server can change
+// it in between. The cache is only dropped once the document is in the trash, so a failed deletion
+// leaves the live copy in place. Edits arriving afterwards find no document and are refused.
+func moveToTrash(documentID int) error {
+	release, err := acquireWriteLease(documentID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	revision, persisted := persistDocument(documentID, true)
+	if err := stores.Documents.DeleteDocument(documentID); err != nil {
+		return err
+	}
+
+	if persisted {
+		stores.Cache.Evict(documentID)
+		clearDirty(documentID, revision)
+	}
+	return nil
+}
+
+// closeDocumentSessions closes every connection to a document, on every server
+func closeDocumentSessions(documentID int) {
+	publishEvent(documentID, clusterEvent{Kind: clusterEventDeleted})
+	closeLocalSessions(documentID)
+}
+
+// closeLocalSessions does the work of closeDocumentSessions for the connections on this server.
+// It doesn't wait for the room's hub to drain: the document is already in the trash, so edits still
+// queued there are refused when their turn comes, and everything acknowledged before was saved with it.
+func closeLocalSessions(documentID int) {
+	roomManager.mu.RLock()
+	room, exists := roomManager.rooms[documentID]
+	roomManager.mu.RUnlock()
+
+	if !exists {
+		return
+	}
+
+	room.mu.RLock()
+	var sessions []*Client
+	for client := range room.clients {
+		sessions = append(sessions, client)
+	}
+	room.mu.RUnlock()
+
+	for _, client := range sessions {
+		client.closeWithCode(closeDocumentDeleted, "This document was moved to the trash")
+	}
+	if len(sessions) > 0 {
+		log.Printf("[Trash] Closed %d sessions of deleted document %d", len(sessions), documentID)
+	}
+}
+
+// forgetDocument drops whatever is still cached for a document that no longer exists
+func forgetDocument(documentID int) {
+	stores.Cache.Evict(documentID)
+	clearDirty(documentID, 0)
+}
+
+// authorizeDeletedDocument loads a document in the trash for its owner and writes the matching JSON
+// error response on failure. It returns nil when the request should stop.
+func authorizeDeletedDocument(w http.ResponseWriter, documentID, userID int) *models.Document {
+	doc, err := stores.Documents.GetDeletedDocumentByID(documentID)
+	switch {
+	case errors.Is(err, models.ErrDocumentNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Document not found in trash"})
+		return nil
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Database error"})
+		return nil
+	case doc.OwnerID != userID:
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "You don't have permission to manage this document"})
+		return nil
+	}
+	return doc
+}
+
+// GetTrash returns the documents the authenticated user has in the trash, most recently deleted first
+func GetTrash(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get user from context
+	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
+
+	docs, err := stores.Documents.GetDeletedDocuments(claims.UserID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to retrieve trash"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(docs)
+}
+
+// RestoreDocument takes a document out of the trash
+func RestoreDocument(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get user from context
+	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
+
+	// Get document ID from URL
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid document ID"})
+		return
+	}
+
+	if authorizeDeletedDocument(w, id, claims.UserID) == nil {
+		return
+	}
+
+	doc, err := stores.Documents.RestoreDocument(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to restore document"})
+		return
+	}
+
+	log.Printf("[Trash] Document %d restored by user %d", id, claims.UserID)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(doc)
+}
+
+// PurgeDocument permanently deletes a document from the trash
+func PurgeDocument(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Get user from context
+	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
+
+	// Get document ID from URL
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid document ID"})
+		return
+	}
+
+	if authorizeDeletedDocument(w, id, claims.UserID) == nil {
+		return
+	}
+
+	if err := stores.Documents.PurgeDocument(id); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to delete document"})
+		return
+	}
+	forgetDocument(id)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Document permanently deleted",
+	})
+}
+
+// StartTrashPurger periodically deletes for good the documents that have been in the trash for longer
+// than TRASH_RETENTION (default 30 days, e.g. "720h"), starting with a pass at startup.
+func StartTrashPurger() {
+	retention := durationFromEnv("TRASH_RETENTION", defaultTrashRetention)
+	purgeTrash(retention)
+
+	go func() {
+		ticker := time.NewTicker(trashPurgeInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			purgeTrash(retention)
+		}
+	}()
+}
+
+// purgeTrash deletes for good the documents deleted more than retention ago
+func purgeTrash(retention time.Duration) {
+	purged, err := stores.Documents.PurgeDeletedDocuments(time.Now().Add(-retention))
+	if err != nil {
+		log.Printf("[Trash] Failed to purge deleted documents: %v", err)
+		return
+	}
+	for _, documentID := range purged {
+		forgetDocument(documentID)
+	}
+	if len(purged) > 0 {
+		log.Printf("[Trash] Purged %d documents deleted more than %v ago", len(purged), retention)
+	}
+}
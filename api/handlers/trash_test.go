@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"errors"
+	"testing"
+
+	"minidocs/api/ot"
+	"minidocs/api/store"
+)
+
+// undeletableDocuments is a document store whose deletions fail
+type undeletableDocuments struct {
+	store.DocumentStore
+}
+
+func (undeletableDocuments) DeleteDocument(int) error {
+	return errors.New("database unavailable")
+}
+
+func TestFailedTrashKeepsLiveCopy(t *testing.T) {
+	documentID := useHubTestStore(t)
+	stores.Documents = undeletableDocuments{stores.Documents}
+
+	err := saveDocumentState(documentID, "x", 1, &historyEntry{Revision: 1, UserID: 1, Ops: ot.New().Insert("x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := moveToTrash(documentID); err == nil {
+		t.Fatal("moving to the trash succeeded although the document could not be deleted")
+	}
+
+	// The document is still live, so the session editing it carries on from the same revision
+	content, revision, found, err := stores.Cache.GetContent(documentID)
+	if err != nil || !found || content != "x" || revision != 1 {
+		t.Fatalf("cache holds %q at rev %d (found %v, err %v), want %q at rev 1", content, revision, found, err, "x")
+	}
+}
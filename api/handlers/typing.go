@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Who is typing is worked out here rather than by every client: accepted edits (and "typing" messages
+// from the chat box) mark a connection as typing, announced with a "typing" message at most once per
+// typingThrottle, and an "idle" message follows once it has been quiet for typingIdleAfter.
+
+// Where a user is typing
+const (
+	typingTargetDocument = "document" // editing the document itself
+	typingTargetChat     = "chat"     // writing a chat message
+)
+
+const (
+	// typingThrottle is how often a connection that keeps typing is announced again, so users who
+	// join in the middle of it (or miss a message) still see it within that time
+	typingThrottle = 2 * time.Second
+	// typingIdleAfter is how long a connection must stop typing before "idle" is sent
+	typingIdleAfter = 4 * time.Second
+)
+
+// typingStatePayload is the payload of the "typing" and "idle" messages the server sends
+type typingStatePayload struct {
+	Session string `json:"session"`
+	Target  string `json:"target"`
+}
+
+// typingState tracks one connection typing in one place
+type typingState struct {
+	lastActivity time.Time   // last keystroke we heard of
+	lastSent     time.Time   // last "typing" message sent for it
+	timer        *time.Timer // sends "idle" once the connection has been quiet for typingIdleAfter
+}
+
+// typingTracker holds a connection's typing states, by target
+type typingTracker struct {
+	mu     sync.Mutex
+	states map[string]*typingState
+}
+
+// noteTyping records that a client is typing, announcing it unless it was announced recently
+func noteTyping(client *Client, room *Room, target string) {
+	tracker := &client.typing
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if tracker.states == nil {
+		tracker.states = make(map[string]*typingState)
+	}
+	state := tracker.states[target]
+	if state == nil {
+		state = &typingState{}
+		state.timer = time.AfterFunc(typingIdleAfter, func() { stopTyping(client, room, target, false) })
+		tracker.states[target] = state
+	} else {
+		state.timer.Reset(typingIdleAfter)
+	}
+
+	now := time.Now()
+	state.lastActivity = now
+	if now.Sub(state.lastSent) >= typingThrottle {
+		state.lastSent = now
+		publishTyping(client, room, "typing", target)
+	}
+}
+
+// stopTyping announces that a client stopped typing. Unless immediately is set (the chat message was
+// sent, say) it only does so if nothing was typed in the meantime.
+func stopTyping(client *Client, room *Room, target string, immediately bool) {
+	tracker := &client.typing
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	state := tracker.states[target]
+	if state == nil {
+		return
+	}
+	if !immediately && time.Since(state.lastActivity) < typingIdleAfter {
+		return // typed again while the timer fired
+	}
+
+	state.timer.Stop()
+	delete(tracker.states, target)
+	publishTyping(client, room, "idle", target)
+}
+
+// stopTypingTimers cancels a closing connection's pending "idle" messages; its "leave" (or the
+// "presence" update naming its session) already tells clients it stopped typing
+func stopTypingTimers(client *Client) {
+	tracker := &client.typing
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	for target, state := range tracker.states {
+		state.timer.Stop()
+		delete(tracker.states, target)
+	}
+}
+
+// publishTyping sends a "typing" or "idle" message about a client to everyone else with the document open
+func publishTyping(client *Client, room *Room, kind, target string) {
+	data, _ := json.Marshal(Message{
+		Type:       kind,
+		DocumentID: client.documentID,
+		UserID:     client.userID,
+		Username:   client.username,
+		Payload:    json.RawMessage(mustMarshal(typingStatePayload{Session: client.session(), Target: target})),
+	})
+	broadcast(room, client, data)
+}
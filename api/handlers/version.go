@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"minidocs/api/middleware"
+	"minidocs/api/models"
+	"minidocs/api/utils"
+
+	"github.com/gorilla/mux"
+	dmp "github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// defaultSnapshotInterval is used when SNAPSHOT_INTERVAL is not set
+const defaultSnapshotInterval = 10 * time.Minute
+
+// DiffChunk is one piece of a diff between two versions
+type DiffChunk struct {
+	Type string `json:"type"` // "equal", "insert" or "delete"
+	Text string `json:"text"`
+}
+
+// VersionDiffResponse is returned by the version diff endpoint
+type VersionDiffResponse struct {
+	From  *models.DocumentVersion `json:"from"`
+	To    *models.DocumentVersion `json:"to"` // revision/content of the live document when diffing against "current"
+	Diffs []DiffChunk             `json:"diffs"`
+	Patch string                  `json:"patch"` // diff-match-patch patch text turning From into To
+}
+
+// snapshotDocument stores a version of the document unless the latest one is identical
+func snapshotDocument(documentID int, revision int64, title, content string, createdBy *int, reason string) (*models.DocumentVersion, error) {
+	latest, err := stores.Versions.GetLatestDocumentVersion(documentID)
+	if err == nil && latest.Title == title && latest.Content == content {
+		return latest, nil
+	}
+	if err != nil && !errors.Is(err, models.ErrVersionNotFound) {
+		return nil, err
+	}
+
+	version, err := stores.Versions.CreateDocumentVersion(documentID, revision, title, content, createdBy, reason)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[Versions] Snapshot %d of document %d at rev %d (%s)", version.ID, documentID, revision, reason)
+	return version, nil
+}
+
+// StartSnapshotScheduler periodically snapshots every document with an open editing session,
+// so long sessions don't only get a version when the last user leaves.
+// The interval is read from SNAPSHOT_INTERVAL (e.g. "5m"); "0" disables it.
+func StartSnapshotScheduler() {
+	interval := durationFromEnv("SNAPSHOT_INTERVAL", defaultSnapshotInterval)
+	if interval <= 0 {
+		log.Println("[Versions] Interval snapshots disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			roomManager.mu.RLock()
+			documentIDs := make([]int, 0, len(roomManager.rooms))
+			for documentID := range roomManager.rooms {
+				documentIDs = append(documentIDs, documentID)
+			}
+			roomManager.mu.RUnlock()
+
+			for _, documentID := range documentIDs {
+				snapshotLiveDocument(documentID)
+			}
+		}
+	}()
+}
+
+// snapshotLiveDocument snapshots the current (possibly unflushed) content of a document
+func snapshotLiveDocument(documentID int) {
+	content, revision, err := getDocumentState(documentID)
+	if err != nil {
+		log.Printf("[Versions] Failed to read document %d: %v", documentID, err)
+		return
+	}
+
+	doc, err := stores.Documents.GetDocumentByID(documentID)
+	if err != nil {
+		log.Printf("[Versions] Failed to get document %d: %v", documentID, err)
+		return
+	}
+
+	_, err = snapshotDocument(documentID, revision, doc.Title, content, nil, models.VersionReasonInterval)
+	if err != nil {
+		log.Printf("[Versions] Failed to snapshot document %d: %v", documentID, err)
+	}
+}
+
+// parseDocumentID reads the {id} URL variable, writing a 400 response if it is invalid
+func parseDocumentID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid document ID"})
+		return 0, false
+	}
+	return id, true
+}
+
+// getVersionOrError loads a version of a document, writing the matching error response on failure
+func getVersionOrError(w http.ResponseWriter, documentID int, versionIDStr string) *models.DocumentVersion {
+	versionID, err := strconv.Atoi(versionIDStr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid version ID"})
+		return nil
+	}
+
+	version, err := stores.Versions.GetDocumentVersion(documentID, versionID)
+	if err != nil {
+		if errors.Is(err, models.ErrVersionNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Version not found"})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Database error"})
+		}
+		return nil
+	}
+
+	return version
+}
+
+// GetDocumentVersions lists the saved versions of a document
+func GetDocumentVersions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
+
+	id, ok := parseDocumentID(w, r)
+	if !ok {
+		return
+	}
+
+	if authorizeDocument(w, id, claims.UserID, accessCollaborator, "You don't have permission to view this document") == nil {
+		return
+	}
+
+	versions, err := stores.Versions.GetDocumentVersions(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to retrieve versions"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(versions)
+}
+
+// GetDocumentVersion returns a single version including its content
+func GetDocumentVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
+
+	id, ok := parseDocumentID(w, r)
+	if !ok {
+		return
+	}
+
+	if authorizeDocument(w, id, claims.UserID, accessCollaborator, "You don't have permission to view this document") == nil {
+		return
+	}
+
+	version := getVersionOrError(w, id, mux.Vars(r)["versionId"])
+	if version == nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(version)
+}
+
+// DiffDocumentVersions compares two versions: ?from={versionId}&to={versionId|current}.
+// "to" defaults to the live content of the document.
+func DiffDocumentVersions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
+
+	id, ok := parseDocumentID(w, r)
+	if !ok {
+		return
+	}
+
+	doc := authorizeDocument(w, id, claims.UserID, accessCollaborator, "You don't have permission to view this document")
+	if doc == nil {
+		return
+	}
+
+	from := getVersionOrError(w, id, r.URL.Query().Get("from"))
+	if from == nil {
+		return
+	}
+
+	var to *models.DocumentVersion
+	if toStr := r.URL.Query().Get("to"); toStr != "" && toStr != "current" {
+		to = getVersionOrError(w, id, toStr)
+		if to == nil {
+			return
+		}
+	} else {
+		content, revision, err := getDocumentState(id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load current content"})
+			return
+		}
+		to = &models.DocumentVersion{
+			DocumentID: id,
+			Revision:   revision,
+			Title:      doc.Title,
+			Content:    content,
+			CreatedAt:  time.Now(),
+		}
+	}
+
+	dmpInstance := dmp.New()
+	diffs := dmpInstance.DiffMain(from.Content, to.Content, false)
+	dmpInstance.DiffCleanupSemantic(diffs)
+
+	chunks := make([]DiffChunk, 0, len(diffs))
+	for _, d := range diffs {
+		chunk := DiffChunk{Type: "equal", Text: d.Text}
+		switch d.Type {
+		case dmp.DiffInsert:
+			chunk.Type = "insert"
+		case dmp.DiffDelete:
+			chunk.Type = "delete"
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(VersionDiffResponse{
+		From:  from,
+		To:    to,
+		Diffs: chunks,
+		Patch: dmpInstance.PatchToText(dmpInstance.PatchMake(from.Content, diffs)),
+	})
+}
+
+// RestoreDocumentVersion makes an older version the current content of the document.
+// The state being replaced is snapshotted first, so a restore can itself be undone.
+func RestoreDocumentVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims := r.Context().Value(middleware.UserContextKey).(*utils.Claims)
+
+	id, ok := parseDocumentID(w, r)
+	if !ok {
+		return
+	}
+
+	doc := authorizeDocument(w, id, claims.UserID, accessCollaborator, "You don't have permission to edit this document")
+	if doc == nil {
+		return
+	}
+
+	version := getVersionOrError(w, id, mux.Vars(r)["versionId"])
+	if version == nil {
+		return
+	}
+
+	// Keep the state we are about to replace
+	content, revision, err := getDocumentState(id)
+	if err == nil {
+		_, err = snapshotDocument(id, revision, doc.Title, content, &claims.UserID, models.VersionReasonRestore)
+	}
+	if err != nil {
+		log.Printf("[Versions] Failed to snapshot document %d before restore: %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to save current version"})
+		return
+	}
+
+	// Push the restored content through the live edit path so open editors follow along
+	err = applyServerEdit(id, doc.SyncMode, version.Content, claims.UserID, claims.Username)
+	if err != nil {
+		log.Printf("[Versions] Failed to restore version %d of document %d: %v", version.ID, id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to restore version"})
+		return
+	}
+
+	updatedDoc, err := stores.Documents.UpdateDocument(id, version.Title, version.Content)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to restore version"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(updatedDoc)
+}
@@ -2,27 +2,31 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"minidocs/api/config"
+	"minidocs/api/crdt"
 	"minidocs/api/models"
 	"minidocs/api/utils"
 
-	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	dmp "github.com/sergi/go-diff/diffmatchpatch"
 )
 
 // upgrader upgrades an HTTP connection to a WebSocket connection.
 // CheckOrigin allows connections from the React dev server.
+// Compression and the message encoding are negotiated here (see encoding.go).
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+	ReadBufferSize:    1024,
+	WriteBufferSize:   1024,
+	EnableCompression: true,
+	Subprotocols:      []string{subprotocolMsgpack, subprotocolJSON},
 	CheckOrigin: func(r *http.Request) bool {
 		origin := r.Header.Get("Origin")
 		return origin == "http://localhost:5173" ||
@@ -32,35 +36,95 @@ var upgrader = websocket.Upgrader{
 
 // Client represents a single WebSocket connection (one user in one document).
 type Client struct {
-	conn        *websocket.Conn
-	send        chan []byte // buffered channel of outgoing messages
-	documentID  int
-	userID      int
-	username    string
-	lastContent string
-	lastDBSave  time.Time // tracks last time we saved to DB for this client
+	conn            *websocket.Conn
+	send            chan []byte // buffered channel of outgoing messages, closed only by the room's hub
+	connID          string      // unique per connection on this node, used for presence
+	room            *Room       // the room the client joined
+	documentID      int
+	userID          int
+	username        string
+	protocol        int           // protocol version negotiated at connect (see protocol.go)
+	crdtClient      crdt.ClientID // replica ID of the connection's CRDT items, set by its crdt-sync (see crdt.go)
+	lastContent     string
+	lastDBSave      time.Time     // tracks last time we saved to DB for this client
+	lastActive      atomic.Int64  // unix nanoseconds of the last message received, for idle eviction
+	accessCheckedAt time.Time     // when the user's access was last verified (read pump only)
+	leaveReason     atomic.Value  // string set when the server drops the client (see heartbeat.go)
+	away            atomic.Bool   // the client reported its tab is hidden
+	lastStatus      atomic.Value  // status last stored for this connection (see presence.go)
+	typing          typingTracker // where the client is typing (see typing.go)
+	limiter         *rateLimiter  // the connection's rate limits (see ratelimit.go)
+	userLimiter     *rateLimiter  // rate limits shared with the user's other connections to this server
+	strikes         *tokenBucket  // messages refused for rate limiting (read pump only)
+	cursorThrottle  cursorThrottle
 }
 
 // Room represents all clients currently editing the same document.
+// Its clients map is only changed by the room's hub goroutine (see hub.go).
 type Room struct {
-	clients map[*Client]bool
-	mu      sync.RWMutex // protects the clients map
+	documentID int
+	clients    map[*Client]bool
+	mu         sync.RWMutex // lets other goroutines read the clients map while the hub changes it
+	editMu     sync.Mutex   // serialises edits on this node; acquireWriteLease does so across nodes
+
+	syncMode string    // models.SyncModeOT or models.SyncModeCRDT, fixed while the room is open
+	crdtDoc  *crdt.Doc // cached replica in CRDT mode (guarded by editMu)
+	crdtRev  int64     // revision crdtDoc corresponds to
+
+	cursorMu sync.Mutex              // guards cursors
+	cursors  map[string]*cursorState // latest cursor of each connection, on any server, by session (see cursor.go)
+
+	refs       int                  // clients that joined and haven't left yet (guarded by roomManager.mu)
+	register   chan *Client         // hub inputs
+	unregister chan *Client         //
+	outbound   chan outboundMessage //
+	done       chan struct{}        // closed once the last client has left and the hub has stopped
 }
 
-// getMembers returns a list of all unique usernames currently in the room.
-func (r *Room) getMembers() []string {
+// memberInfo describes a user in the room
+type memberInfo struct {
+	UserID      int    `json:"userId"`
+	Username    string `json:"username"`
+	Color       string `json:"color"`       // stable per user, for their cursor and avatar
+	Connections int    `json:"connections"` // tabs the user has the document open in, on any server
+	Status      string `json:"status"`      // "active", "idle" or "away", the most present of their tabs
+}
+
+// membersPayload is the snapshot of the room sent to a client when it joins
+type membersPayload struct {
+	Members []memberInfo  `json:"members"`
+	Cursors []cursorState `json:"cursors"`
+}
+
+// getMembers returns every user currently in the room, on any server, once each.
+// If Redis is unavailable only the clients connected to this server are listed.
+func (r *Room) getMembers() []memberInfo {
+	members, err := documentPresence(r.documentID)
+	if err == nil {
+		return members
+	}
+
+	log.Printf("[Cluster] Falling back to local members of document %d: %v", r.documentID, err)
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	members := make([]string, 0, len(r.clients))
-	seen := make(map[string]bool)
+	members = make([]memberInfo, 0, len(r.clients))
+	index := make(map[int]int)
 
 	for client := range r.clients {
-		// Avoid duplicates if same user has multiple connections
-		if !seen[client.username] {
-			members = append(members, client.username)
-			seen[client.username] = true
+		// One entry per user, however many connections they have
+		i, seen := index[client.userID]
+		if !seen {
+			index[client.userID] = len(members)
+			members = append(members, memberInfo{
+				UserID:   client.userID,
+				Username: client.username,
+				Color:    userColor(client.userID),
+				Status:   client.currentStatus(),
+			})
+			i = len(members) - 1
 		}
+		members[i].Connections++
 	}
 
 	return members
@@ -69,15 +133,22 @@ func (r *Room) getMembers() []string {
 // Message is the generic envelope for everything we send/receive over the WebSocket.
 // The "type" field lets us distinguish between edit operations, cursor moves, join/leave events, etc.
 type Message struct {
-	Type       string          `json:"type"` // e.g. "edit", "join", "leave", "cursor"
+	Type       string          `json:"type"`         // e.g. "edit", "join", "leave", "cursor"
+	ID         string          `json:"id,omitempty"` // chosen by the client to recognise its own messages later
 	DocumentID int             `json:"documentId"`
 	UserID     int             `json:"userId"`
 	Username   string          `json:"username"`
-	Payload    json.RawMessage `json:"payload,omitempty"` // type-specific data (kept raw so we can forward it without re-parsing)
+	Payload    json.RawMessage `json:"payload,omitempty"` // type-specific data, decoded and validated per type (see protocol.go)
+}
+
+// leavePayload says which connection left and, if the server dropped it, why
+type leavePayload struct {
+	Reason  string `json:"reason,omitempty"`
+	Session string `json:"session"`
 }
 
 // roomManager holds all active rooms and guards the map with a mutex.
-// It is a singleton
+// It is a singleton per server; rooms on different servers are joined up in cluster.go
 var roomManager = struct {
 	rooms map[int]*Room // keyed by document ID
 	mu    sync.RWMutex
@@ -85,64 +156,138 @@ var roomManager = struct {
 	rooms: make(map[int]*Room),
 }
 
-// getOrCreateRoom returns the Room for a document, creating it if it doesn't exist yet.
-func getOrCreateRoom(documentID int) *Room {
+// joinRoom adds a client to the Room for a document, creating the room (and its hub) if needed.
+func joinRoom(documentID int, syncMode string, client *Client) *Room {
 	roomManager.mu.Lock()
-	defer roomManager.mu.Unlock()
-
 	room, exists := roomManager.rooms[documentID]
 	if !exists {
-		room = &Room{
-			clients: make(map[*Client]bool),
-		}
+		room = newRoom(documentID, syncMode)
 		roomManager.rooms[documentID] = room
+		go room.run()
+
+		// Start hearing about clients of this document on other servers
+		subscribeDocument(documentID)
 	}
+	room.refs++ // keeps the room open until this client leaves
+	roomManager.mu.Unlock()
+
+	client.room = room
+	room.register <- client
 	return room
 }
 
 // removeClientFromRoom removes the client and, if the room is now empty, deletes the room entirely.
 func removeClientFromRoom(client *Client) {
-	roomManager.mu.Lock()
-	room, exists := roomManager.rooms[client.documentID]
-	roomManager.mu.Unlock()
-
-	if !exists {
+	room := client.room
+	if room == nil {
 		return
 	}
 
-	room.mu.Lock()
-	delete(room.clients, client)
-	empty := len(room.clients) == 0
-	room.mu.Unlock()
+	room.unregister <- client
 
+	roomManager.mu.Lock()
+	room.refs--
+	empty := room.refs == 0
 	if empty {
-		roomManager.mu.Lock()
 		delete(roomManager.rooms, client.documentID)
-		roomManager.mu.Unlock()
+		close(room.done)
+		unsubscribeDocument(client.documentID)
+	}
+	roomManager.mu.Unlock()
 
-		// Last user left - flush to PostgreSQL
+	// Last user left (on every server) - flush to PostgreSQL
+	if empty && !isRoomActive(client.documentID) {
 		flushDocumentToPostgres(client.documentID)
 	}
 }
 
-// broadcast sends a raw message to every client in the room EXCEPT the sender.
+// broadcast sends a raw message to every client in the room EXCEPT the sender,
+// including clients connected to other servers.
 func broadcast(room *Room, sender *Client, message []byte) {
-	room.mu.RLock()
-	defer room.mu.RUnlock()
+	broadcastLocal(room, sender, message)
+	publishEvent(room.documentID, clusterEvent{Kind: clusterEventBroadcast, Data: message})
+}
+
+// broadcastToDocument sends a message to everyone with a document open, on any server.
+// It is used by REST handlers, which have no room or sender of their own.
+func broadcastToDocument(documentID int, msg Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to marshal message: %v", err)
+		return
+	}
+
+	roomManager.mu.RLock()
+	room, exists := roomManager.rooms[documentID]
+	roomManager.mu.RUnlock()
+
+	if exists {
+		broadcastLocal(room, nil, data)
+	}
+	publishEvent(documentID, clusterEvent{Kind: clusterEventBroadcast, Data: data})
+}
+
+// isRoomActive reports whether anyone currently has the document open, on this server or another one
+func isRoomActive(documentID int) bool {
+	roomManager.mu.RLock()
+	_, exists := roomManager.rooms[documentID]
+	roomManager.mu.RUnlock()
+
+	if exists {
+		return true
+	}
+	sessions, err := clusterSessions(documentID)
+	return err == nil && len(sessions) > 0
+}
 
+// recheckDocumentSessions re-evaluates access for every open connection a user has to a document
+// (e.g. after their share was revoked) and closes the ones that are no longer allowed, on every server.
+func recheckDocumentSessions(documentID, userID int) {
+	publishEvent(documentID, clusterEvent{Kind: clusterEventRecheck, UserID: userID})
+	recheckLocalSessions(documentID, userID)
+}
+
+// recheckLocalSessions does the work of recheckDocumentSessions for the connections on this server
+func recheckLocalSessions(documentID, userID int) {
+	roomManager.mu.RLock()
+	room, exists := roomManager.rooms[documentID]
+	roomManager.mu.RUnlock()
+
+	if !exists {
+		return
+	}
+
+	room.mu.RLock()
+	var sessions []*Client
 	for client := range room.clients {
-		if client == sender {
-			continue // don't echo back to the sender
-		}
-		select {
-		case client.send <- message:
-			// message queued
-		default:
-			// client's send buffer is full — they're too slow; close them out
-			close(client.send)
-			delete(room.clients, client)
+		if client.userID == userID {
+			sessions = append(sessions, client)
 		}
 	}
+	room.mu.RUnlock()
+
+	if len(sessions) == 0 {
+		return
+	}
+
+	_, err := checkDocumentAccess(documentID, userID, accessCollaborator)
+	if err == nil {
+		return // still allowed (e.g. the owner, or the share was re-added)
+	}
+
+	for _, client := range sessions {
+		log.Printf("Closing session of user %d on document %d: %v", userID, documentID, err)
+		client.closeWithCode(closeAccessDenied, "Access to this document was revoked")
+	}
+}
+
+// closeWithCode sends a close frame with the given code and closes the connection.
+// The read pump then fails and runs its usual cleanup (leave broadcast, room removal).
+func (c *Client) closeWithCode(code int, reason string) {
+	closeMsg := websocket.FormatCloseMessage(code, reason)
+	// WriteControl is safe to call concurrently with the write pump
+	c.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+	c.conn.Close()
 }
 
 // URL pattern: /ws/{documentId}?token=<jwt>
@@ -170,54 +315,109 @@ func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//  3. Upgrade HTTP to WebSocket
+	// 3. Make sure the user may open this document before we upgrade the connection
+	doc, err := checkDocumentAccess(documentID, claims.UserID, accessCollaborator)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrDocumentNotFound):
+			http.Error(w, "Document not found", http.StatusNotFound)
+		case errors.Is(err, errAccessDenied):
+			http.Error(w, "You don't have permission to access this document", http.StatusForbidden)
+		default:
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// 4. Agree on a protocol version
+	protocol, err := negotiateProtocol(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUpgradeRequired)
+		return
+	}
+
+	// 5. Upgrade HTTP to WebSocket
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
 		return // upgrader already wrote the HTTP error
 	}
 
-	// 4. Create the Client and register it in the room
+	// 6. Create the Client and register it in the room
 	client := &Client{
 		conn:        conn,
 		send:        make(chan []byte, 64), // 64-message buffer before we consider the client stalled
+		connID:      strconv.FormatInt(clientSeq.Add(1), 10),
 		documentID:  documentID,
 		userID:      claims.UserID,
 		username:    claims.Username,
+		protocol:    protocol,
 		lastContent: "",
 		lastDBSave:  time.Now(),
-	}
 
-	room := getOrCreateRoom(documentID)
-	room.mu.Lock()
-	room.clients[client] = true
-	room.mu.Unlock()
+		accessCheckedAt: time.Now(), // checked just above
+
+		limiter:     newRateLimiter(connectionLimits),
+		userLimiter: acquireUserRateLimiter(claims.UserID),
+		strikes:     newTokenBucket(strikeLimit),
+	}
+	client.touch()
+	client.lastStatus.Store(presenceActive)
+
+	room := joinRoom(documentID, doc.SyncMode, client)
+	connections, err := addPresence(client)
+
+	// 7. Notify everyone in the room that this user joined, or opened another tab
+	if err != nil || connections == 1 {
+		joinMsg, _ := json.Marshal(Message{
+			Type:       "join",
+			DocumentID: documentID,
+			UserID:     claims.UserID,
+			Username:   claims.Username,
+			Payload:    json.RawMessage(mustMarshal(map[string]string{"color": userColor(claims.UserID)})),
+		})
+		// Broadcast join to others
+		broadcast(room, client, joinMsg)
+	} else {
+		publishUserPresence(room, claims.UserID, claims.Username, "")
+	}
 
-	// 5. Notify everyone in the room that this user joined
-	joinMsg, _ := json.Marshal(Message{
+	// Also send the join message back to the new client so they know their own connection is live,
+	// along with the current revision it should base its edits on and the protocol version in use
+	var revision int64
+	if _, rev, err := getDocumentState(documentID); err == nil {
+		revision = rev
+	}
+	selfJoinMsg, _ := json.Marshal(Message{
 		Type:       "join",
 		DocumentID: documentID,
 		UserID:     claims.UserID,
 		Username:   claims.Username,
+		Payload: json.RawMessage(mustMarshal(map[string]interface{}{
+			"revision": revision,
+			"protocol": protocol,
+			"color":    userColor(claims.UserID),
+			"session":  client.session(),
+		})),
 	})
-	// Broadcast join to others
-	broadcast(room, client, joinMsg)
-	// Also send the join message back to the new client so they know their own connection is live
-	client.send <- joinMsg
+	room.sendTo(client, selfJoinMsg)
 
-	// Send current room members to the new client
-	members := room.getMembers()
+	// Send current room members, and where their cursors are, to the new client
+	membersData := mustMarshal(membersPayload{Members: room.getMembers(), Cursors: room.cursorSnapshot()})
 	memberListMsg, _ := json.Marshal(Message{
 		Type:       "members",
 		DocumentID: documentID,
 		UserID:     claims.UserID,
 		Username:   claims.Username,
-		Payload:    json.RawMessage(mustMarshal(members)),
+		Payload:    json.RawMessage(membersData),
 	})
-	client.send <- memberListMsg
+	room.sendTo(client, memberListMsg)
+
+	// And the recent chat, so the discussion survives everyone leaving
+	sendChatHistory(client, room)
 
 	log.Printf("User %s (ID %d) joined document %d", claims.Username, claims.UserID, documentID)
-	//  6. Start the write pump (goroutine) and read pump (current goroutine)
+	// 8. Start the write pump (goroutine) and read pump (current goroutine)
 	go writePump(client)
 	readPump(client, room)
 }
@@ -226,36 +426,83 @@ func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
 // It runs on the goroutine that called WebSocketHandler and blocks until the connection closes.
 func readPump(client *Client, room *Room) {
 	defer func() {
-		// Cleanup: notify others that this user left, then close the connection
-		leaveMsg, _ := json.Marshal(Message{
-			Type:       "leave",
-			DocumentID: client.documentID,
-			UserID:     client.userID,
-			Username:   client.username,
-		})
-		broadcast(room, client, leaveMsg)
+		// Cleanup: notify others that this user left (or closed one of several tabs), then close the connection
+		room.removeCursor(client.session())
+		stopTypingTimers(client)
+		stopCursorThrottle(client)
+		releaseUserRateLimiter(client.userID)
+		remaining, err := removePresence(client)
+		if err != nil || remaining == 0 {
+			leave := Message{
+				Type:       "leave",
+				DocumentID: client.documentID,
+				UserID:     client.userID,
+				Username:   client.username,
+			}
+			reason, _ := client.leaveReason.Load().(string)
+			leave.Payload = mustMarshal(leavePayload{Reason: reason, Session: client.session()})
+			leaveMsg, _ := json.Marshal(leave)
+			broadcast(room, client, leaveMsg)
+		} else {
+			publishUserPresence(room, client.userID, client.username, client.session())
+		}
 
 		removeClientFromRoom(client)
 		client.conn.Close()
 		log.Printf("User %s (ID %d) left document %d", client.username, client.userID, client.documentID)
 	}()
 
-	// Set a max message size (1 MB) — protects against huge payloads
-	client.conn.SetReadLimit(1024 * 1024)
+	// Set a max message size (1 MB) — protects against huge payloads; each type has its own limit below
+	client.conn.SetReadLimit(maxMessageSize)
+
+	// A connection that sends nothing, not even a pong, within the pong timeout is considered dead
+	settings := heartbeatSettings()
+	client.conn.SetReadDeadline(time.Now().Add(settings.pongTimeout))
+	client.conn.SetPongHandler(func(string) error {
+		return client.conn.SetReadDeadline(time.Now().Add(settings.pongTimeout))
+	})
 
 	for {
-		_, rawMessage, err := client.conn.ReadMessage()
+		messageType, frame, err := client.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Printf("WebSocket heartbeat timeout for user %d", client.userID)
+				client.setLeaveReason(leaveReasonTimeout)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 				log.Printf("WebSocket read error for user %d: %v", client.userID, err)
 			}
 			break // exit the loop , triggers the deferred cleanup
 		}
+		client.conn.SetReadDeadline(time.Now().Add(settings.pongTimeout))
+		client.touch()
+
+		rawMessage, err := decodeIncoming(client, messageType, frame)
+		if err != nil {
+			if checkRateLimits(client, "", len(frame)) == rateRefused && refuseRateLimited(client, &Message{}) {
+				break
+			}
+			sendError(client, "", &protocolError{errorMalformedMessage, err.Error()})
+			continue
+		}
+		if status, _ := client.lastStatus.Load().(string); status == presenceIdle {
+			updateClientStatus(client, room) // back from idle
+		}
+
+		// Decode and validate the message against its type's schema (see protocol.go)
+		msg, payload, perr := parseClientMessage(rawMessage)
 
-		// Parse just enough to stamp the sender info onto the message
-		var msg Message
-		if err := json.Unmarshal(rawMessage, &msg); err != nil {
-			log.Printf("Failed to parse message from user %d: %v", client.userID, err)
+		// Spend its rate limit tokens, malformed or not (see ratelimit.go)
+		decision := checkRateLimits(client, msg.Type, len(frame))
+		if decision == rateRefused {
+			if refuseRateLimited(client, &msg) {
+				break
+			}
+			continue
+		}
+
+		if perr != nil {
+			sendError(client, msg.ID, perr)
 			continue
 		}
 
@@ -264,102 +511,76 @@ func readPump(client *Client, room *Room) {
 		msg.Username = client.username
 		msg.DocumentID = client.documentID
 
-		// DMP LOGIC
+		// Anything that changes the document needs the user to still have access to it
+		if (msg.Type == "edit" || msg.Type == "crdt-update" || msg.Type == "chat") && !canStillEdit(client) {
+			sendNack(client, msg.ID, nackPayload{Reason: nackPermissionDenied, Message: "you no longer have access to this document"})
+			client.closeWithCode(closeAccessDenied, "Access to this document was revoked")
+			continue
+		}
+
+		if msg.Type == "sync" {
+			// A (re)connecting client catching up; the reply only goes to that client
+			handleSync(client, room, &msg, payload.(*syncPayload))
+			continue
+		}
 		if msg.Type == "edit" {
-			// Get current document content (Redis first, PostgreSQL fallback)
-			currentContent, title, err := getDocumentContent(msg.DocumentID)
-			if err != nil {
-				log.Printf("Error getting document: %v", err)
+			if room.syncMode == models.SyncModeCRDT {
+				content, revision, _ := getDocumentState(msg.DocumentID)
+				sendEditNack(client, msg.ID, nackUnsupported, "document uses CRDT sync", revision, content)
 				continue
 			}
-
-			// Parse payload
-			var payload map[string]interface{}
-			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-				log.Printf("Error parsing payload: %v", err)
+			// Apply the edit against the server's revision; only accepted edits are broadcast
+			if !handleEdit(client, room, &msg, payload.(*editPayload)) {
 				continue
 			}
-
-			newContent := currentContent // Start with current content
-
-			// Try to apply patches if provided
-			if patchText, ok := payload["patches"].(string); ok && patchText != "" {
-				log.Printf("Applying patches from user %s", client.username)
-
-				dmpInstance := dmp.New()
-				patches, err := dmpInstance.PatchFromText(patchText)
-
-				if err != nil {
-					log.Printf("Error parsing patches: %v", err)
-					// Fallback to full content
-					if fullContent, ok := payload["fullContent"].(string); ok {
-						newContent = fullContent
-					}
-				} else {
-					// Apply patches to server's current content
-					result, applied := dmpInstance.PatchApply(patches, currentContent)
-					start := time.Now()
-
-					elapsed := time.Since(start)
-					log.Printf("[DMP] Patch apply took: %v | patch size: %d bytes | content size: %d bytes",
-						elapsed, len(patchText), len(currentContent))
-					// Check if all patches applied successfully
-					allApplied := true
-					for _, success := range applied {
-						if !success {
-							allApplied = false
-							break
-						}
-					}
-
-					if allApplied {
-						newContent = result
-						log.Printf(" Patches applied successfully. Old length: %d, New length: %d",
-							len(currentContent), len(newContent))
-					} else {
-						log.Printf(" Some patches failed, using fallback")
-						// Fallback to full content
-						if fullContent, ok := payload["fullContent"].(string); ok {
-							newContent = fullContent
-						}
-					}
-				}
-			} else if fullContent, ok := payload["fullContent"].(string); ok {
-				// No patches, just use full content
-				newContent = fullContent
-				log.Printf("Using full content from user %s", client.username)
+			noteTyping(client, room, typingTargetDocument)
+		}
+		if msg.Type == "crdt-sync" || msg.Type == "crdt-update" {
+			if room.syncMode != models.SyncModeCRDT {
+				log.Printf("Ignoring %s from user %d: document %d is not in CRDT mode", msg.Type, client.userID, msg.DocumentID)
+				continue
 			}
-
-			// Update document in database
-			err = saveDocumentContent(msg.DocumentID, title, newContent)
-			if err != nil {
-				log.Printf("Error saving document: %v", err)
+			// Merge the update into the server replica; only new changes are broadcast
+			if !handleCRDTMessage(client, room, &msg, payload) {
+				continue
 			}
-
-			//if shouldSaveToDatabase(client.lastDBSave) {
-			//  _, err = models.UpdateDocument(config.DB, msg.DocumentID, doc.Title, newContent)
-			//if err != nil {
-			// log.Printf("Error updating document: %v", err)
-			//  } else {
-			//  client.lastDBSave = time.Now()
-			//	  log.Printf("Document %d saved to database", msg.DocumentID)}
-			//}
-
-			// Create new payload with updated content
-			broadcastPayload := map[string]interface{}{
-				"fullContent": newContent,
-				"sentAt":      payload["sentAt"],
+			if msg.Type == "crdt-update" {
+				noteTyping(client, room, typingTargetDocument)
+			}
+		}
+		if msg.Type == "chat" {
+			// Store the message; only stored messages are broadcast
+			if !handleChat(client, &msg, payload.(*chatPayload)) {
+				continue
 			}
-			broadcastPayloadJSON, _ := json.Marshal(broadcastPayload)
-			msg.Payload = json.RawMessage(broadcastPayloadJSON)
+			stopTyping(client, room, typingTargetChat, true) // the message is out
 		}
 		if msg.Type == "cursor" {
-			// Cursor messages don't need database save
-			// Just broadcast position to other users
-			// msg already has sanitized username and userId
-			log.Printf(" Cursor update from %s: position in payload", client.username)
+			cursor := payload.(*cursorPayload)
+			handleCursor(client, room, &msg, cursor.Position, cursor.Length)
+		}
+		if msg.Type == "selection" {
+			selection := payload.(*selectionPayload)
+			handleCursor(client, room, &msg, selection.Position, selection.Length)
+		}
+		if msg.Type == "presence" {
+			// Announced per user rather than relayed, since the user may have other tabs open
+			handlePresence(client, room, payload.(*presencePayload))
+			continue
+		}
+		if msg.Type == "typing" {
+			// Announced as "typing" and "idle" by the server, throttled (see typing.go)
+			noteTyping(client, room, payload.(*typingPayload).Target)
+			continue
+		}
+
+		// Other messages carrying an ID are acknowledged once broadcast, and dropped if seen before
+		// (edits, CRDT updates and chat messages are acknowledged by their handlers)
+		acked := msg.ID != "" && msg.Type != "edit" && msg.Type != "crdt-update" && msg.Type != "chat"
+		if acked && !firstDelivery(msg.DocumentID, client.userID, msg.ID) {
+			sendAck(client, msg.ID, map[string]bool{"duplicate": true})
+			continue
 		}
-		// === END DMP LOGIC ===
 
 		// Re-marshal with the corrected fields
 		sanitised, err := json.Marshal(msg)
@@ -368,21 +589,63 @@ func readPump(client *Client, room *Room) {
 			continue
 		}
 
-		// Push to everyone else in the room
-		broadcast(room, client, sanitised)
+		// Push to everyone else in the room; cursor moves over the limit (or behind one) only go out later
+		if (msg.Type == "cursor" || msg.Type == "selection") && (decision == rateThrottled || client.cursorThrottle.active()) {
+			throttleCursor(client, room, sanitised)
+		} else {
+			broadcast(room, client, sanitised)
+		}
+
+		if acked {
+			sendAck(client, msg.ID, struct{}{})
+		}
 	}
 }
 
 // writePump drains the client's send channel and writes each message to the WebSocket.
 // It runs in its own goroutine so that slow network I/O doesn't block the read loop.
+// It also pings the client periodically and evicts it once it has been idle for too long.
 func writePump(client *Client) {
-	defer client.conn.Close()
+	settings := heartbeatSettings()
+	ticker := time.NewTicker(settings.pingInterval)
+	defer func() {
+		ticker.Stop()
+		client.conn.Close()
+	}()
 
-	for message := range client.send {
-		err := client.conn.WriteMessage(websocket.TextMessage, message)
-		if err != nil {
-			log.Printf("WebSocket write error for user %d: %v", client.userID, err)
-			break
+	for {
+		select {
+		case message, ok := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(settings.writeTimeout))
+			if !ok {
+				// The room dropped us (or we already left); tell the client before hanging up
+				client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			messageType, data, err := encodeOutgoing(client, message)
+			if err != nil {
+				log.Printf("Failed to encode message for user %d: %v", client.userID, err)
+				continue
+			}
+			client.conn.EnableWriteCompression(len(data) >= compressionThreshold)
+			err = client.conn.WriteMessage(messageType, data)
+			if err != nil {
+				log.Printf("WebSocket write error for user %d: %v", client.userID, err)
+				return
+			}
+
+		case <-ticker.C:
+			if settings.idleTimeout > 0 && client.idleFor() > settings.idleTimeout {
+				log.Printf("Closing idle connection of user %d on document %d", client.userID, client.documentID)
+				client.setLeaveReason(leaveReasonIdle)
+				client.closeWithCode(closeIdleTimeout, "Closed after inactivity")
+				return
+			}
+
+			client.conn.SetWriteDeadline(time.Now().Add(settings.writeTimeout))
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
 		}
 	}
 }
@@ -394,7 +657,7 @@ func shouldSaveToDatabase(lastSave time.Time) bool {
 }
 
 // mustMarshal is a helper that marshals data to JSON, panicking on error.
-// Safe to use here because we control the input ([]string).
+// Safe to use here because we control the input (plain structs, maps and slices).
 func mustMarshal(v interface{}) []byte {
 	data, err := json.Marshal(v)
 	if err != nil {
@@ -402,64 +665,3 @@ func mustMarshal(v interface{}) []byte {
 	}
 	return data
 }
-
-// getDocumentContent gets content from Redis if available, falls back to PostgreSQL
-func getDocumentContent(documentID int) (string, string, error) {
-	key := fmt.Sprintf("doc:%d:content", documentID)
-
-	// Try Redis first
-	content, err := config.RDB.Get(config.Ctx, key).Result()
-	if err == nil {
-		log.Printf("[Redis] Cache hit for document %d", documentID)
-		return content, "", nil
-	}
-
-	// Redis miss - load from PostgreSQL
-	log.Printf("[Redis] Cache miss for document %d, loading from PostgreSQL", documentID)
-	doc, err := models.GetDocumentByID(config.DB, documentID)
-	if err != nil {
-		return "", "", err
-	}
-
-	// Store in Redis for next time
-	config.RDB.Set(config.Ctx, key, doc.Content, 24*time.Hour)
-	return doc.Content, doc.Title, nil
-}
-
-// saveDocumentContent saves content to Redis and PostgreSQL
-func saveDocumentContent(documentID int, title, content string) error {
-	key := fmt.Sprintf("doc:%d:content", documentID)
-
-	// Only write to Redis during active editing
-	err := config.RDB.Set(config.Ctx, key, content, 24*time.Hour).Err()
-	return err
-}
-
-func flushDocumentToPostgres(documentID int) {
-	key := fmt.Sprintf("doc:%d:content", documentID)
-
-	// Get latest content from Redis
-	content, err := config.RDB.Get(config.Ctx, key).Result()
-	if err != nil {
-		log.Printf("[Redis] Nothing to flush for document %d", documentID)
-		return
-	}
-
-	// Get the document title from PostgreSQL
-	doc, err := models.GetDocumentByID(config.DB, documentID)
-	if err != nil {
-		log.Printf("[Redis] Failed to get document title for flush: %v", err)
-		return
-	}
-
-	// Save to PostgreSQL
-	_, err = models.UpdateDocument(config.DB, documentID, doc.Title, content)
-	if err != nil {
-		log.Printf("[Redis] Failed to flush document %d to PostgreSQL: %v", err)
-		return
-	}
-
-	// Delete from Redis now that it's saved to PostgreSQL
-	config.RDB.Del(config.Ctx, key)
-	log.Printf("[Redis] Flushed and cleared document %d from Redis", documentID)
-}
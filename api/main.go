@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"minidocs/api/config"
 	"minidocs/api/handlers"
 	"minidocs/api/middleware"
+	"minidocs/api/migrations"
+	"minidocs/api/store"
 	"minidocs/api/utils"
 
 	corsHandlers "github.com/gorilla/handlers"
@@ -25,14 +34,128 @@ func main() {
 		log.Println("No .env file found, using environment variables")
 	}
 
-	// Initialize database connection
-	config.InitDB()
-	defer config.DB.Close()
+	// "go run main.go -dev" runs without PostgreSQL, Redis or SMTP (see setupDevMode)
+	devMode := flag.Bool("dev", false, "keep everything in memory and write emails to disk, so no external services are needed")
+	flag.Parse()
 
-	// Initialize Redis connection
-	config.InitRedis()
+	if *devMode {
+		if flag.Arg(0) == "migrate" {
+			log.Fatal("There is no database to migrate in dev mode")
+		}
+		setupDevMode()
+	} else {
+		// Initialize database connection
+		config.InitDB()
+		defer config.DB.Close()
 
-	// Create router
+		// "go run main.go migrate up|down [n]|status" manages the schema and exits
+		if flag.Arg(0) == "migrate" {
+			runMigrateCommand(flag.Args()[1:])
+			return
+		}
+
+		// Bring the schema up to date before anything touches it
+		if os.Getenv("AUTO_MIGRATE") != "false" {
+			if err := migrations.Up(config.DB); err != nil {
+				log.Fatal("Error migrating database: ", err)
+			}
+		}
+
+		// Initialize Redis connection
+		config.InitRedis()
+
+		// Keep records in PostgreSQL and live editing state in Redis
+		handlers.UseStore(store.New(config.DB, config.RDB))
+	}
+
+	// Share rooms, presence and write leases with other API replicas (through Redis, unless in dev mode)
+	handlers.StartCluster()
+
+	// Write back anything a crashed process left in Redis, then keep flushing edits as they happen
+	handlers.RecoverUnflushedDocuments()
+	handlers.StartFlusher()
+
+	// Take periodic version snapshots of documents being edited
+	handlers.StartSnapshotScheduler()
+
+	// Purge documents that have been in the trash past the retention period
+	handlers.StartTrashPurger()
+
+	router := newRouter()
+
+	// Get port from environment or use default
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	corsHandler := corsHandlers.CORS(
+		corsHandlers.AllowedOrigins([]string{
+			"http://localhost:5173",
+			"https://cowrite-api.up.railway.app",
+			"https://cowrite.up.railway.app",
+		}),
+		corsHandlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
+		corsHandlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
+	)(router)
+
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: corsHandler,
+	}
+
+	// Stop on Ctrl+C or when Railway/Docker sends SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Start server
+	go func() {
+		log.Printf(" Server starting on port %s...", port)
+		fmt.Println("Shayanny here! :)")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down...")
+
+	// Stop accepting requests, then make sure every open document is saved
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Server shutdown error: %v", err)
+	}
+	handlers.FlushAllRooms()
+}
+
+// devJWTSecret signs tokens in dev mode when JWT_SECRET isn't set
+const devJWTSecret = "cowrite-dev-secret"
+
+// defaultDevMailDir is where dev mode writes emails when DEV_MAIL_DIR isn't set
+const defaultDevMailDir = "dev-mail"
+
+// setupDevMode lets the whole API run on a laptop with no external services: users, documents and
+// everything else are kept in memory (and lost on restart), the in-process content cache and
+// cluster stand in for Redis, and invitation emails are written to DEV_MAIL_DIR as .eml files.
+func setupDevMode() {
+	if os.Getenv("JWT_SECRET") == "" {
+		os.Setenv("JWT_SECRET", devJWTSecret)
+	}
+
+	mailDir := os.Getenv("DEV_MAIL_DIR")
+	if mailDir == "" {
+		mailDir = defaultDevMailDir
+	}
+	utils.UseEmailSink(mailDir)
+
+	handlers.UseStore(store.NewMemory())
+
+	log.Printf("[Dev] Running in dev mode: data is kept in memory, emails are written to %s/", mailDir)
+}
+
+// newRouter registers every route of the API. The handlers must have a store (see handlers.UseStore).
+func newRouter() *mux.Router {
 	router := mux.NewRouter()
 
 	// Testing route
@@ -71,6 +194,19 @@ func main() {
 		http.HandlerFunc(handlers.GetMyDocuments),
 	)).Methods("GET")
 
+	// Trash routes ("trash" must be registered before "{id}")
+	router.Handle("/api/documents/trash", middleware.AuthMiddleware(
+		http.HandlerFunc(handlers.GetTrash),
+	)).Methods("GET")
+
+	router.Handle("/api/documents/{id}/restore", middleware.AuthMiddleware(
+		http.HandlerFunc(handlers.RestoreDocument),
+	)).Methods("POST")
+
+	router.Handle("/api/documents/{id}/permanent", middleware.AuthMiddleware(
+		http.HandlerFunc(handlers.PurgeDocument),
+	)).Methods("DELETE")
+
 	router.Handle("/api/documents/{id}", middleware.AuthMiddleware(
 		http.HandlerFunc(handlers.GetDocument),
 	)).Methods("GET")
@@ -87,27 +223,108 @@ func main() {
 		http.HandlerFunc(handlers.InviteUserToDocument),
 	)).Methods("POST")
 
+	// Version history routes ("diff" must be registered before "{versionId}")
+	router.Handle("/api/documents/{id}/versions", middleware.AuthMiddleware(
+		http.HandlerFunc(handlers.GetDocumentVersions),
+	)).Methods("GET")
+
+	router.Handle("/api/documents/{id}/versions/diff", middleware.AuthMiddleware(
+		http.HandlerFunc(handlers.DiffDocumentVersions),
+	)).Methods("GET")
+
+	router.Handle("/api/documents/{id}/versions/{versionId}", middleware.AuthMiddleware(
+		http.HandlerFunc(handlers.GetDocumentVersion),
+	)).Methods("GET")
+
+	router.Handle("/api/documents/{id}/versions/{versionId}/restore", middleware.AuthMiddleware(
+		http.HandlerFunc(handlers.RestoreDocumentVersion),
+	)).Methods("POST")
+
+	// Operation log routes
+	router.Handle("/api/documents/{id}/operations", middleware.AuthMiddleware(
+		http.HandlerFunc(handlers.GetDocumentOperations),
+	)).Methods("GET")
+
+	router.Handle("/api/documents/{id}/replay", middleware.AuthMiddleware(
+		http.HandlerFunc(handlers.ReplayDocument),
+	)).Methods("GET")
+
+	router.Handle("/api/documents/{id}/blame", middleware.AuthMiddleware(
+		http.HandlerFunc(handlers.BlameDocument),
+	)).Methods("GET")
+
+	router.Handle("/api/documents/{id}/presence", middleware.AuthMiddleware(
+		http.HandlerFunc(handlers.GetDocumentPresence),
+	)).Methods("GET")
+
+	// Chat history routes
+	router.Handle("/api/documents/{id}/messages", middleware.AuthMiddleware(
+		http.HandlerFunc(handlers.GetDocumentMessages),
+	)).Methods("GET")
+
+	router.Handle("/api/documents/{id}/messages/{messageId}", middleware.AuthMiddleware(
+		http.HandlerFunc(handlers.UpdateDocumentMessage),
+	)).Methods("PUT")
+
+	router.Handle("/api/documents/{id}/messages/{messageId}", middleware.AuthMiddleware(
+		http.HandlerFunc(handlers.DeleteDocumentMessage),
+	)).Methods("DELETE")
+
+	router.Handle("/api/documents/{id}/sync-mode", middleware.AuthMiddleware(
+		http.HandlerFunc(handlers.SetDocumentSyncMode),
+	)).Methods("PUT")
+
+	router.Handle("/api/documents/{id}/shares/{userId}", middleware.AuthMiddleware(
+		http.HandlerFunc(handlers.RevokeDocumentShare),
+	)).Methods("DELETE")
+
 	// WebSocket route (auth is handled inside the handler via query param token)
 	router.HandleFunc("/ws/{documentId}", handlers.WebSocketHandler)
 
-	// Get port from environment or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	return router
+}
+
+// runMigrateCommand runs the "migrate" subcommand
+func runMigrateCommand(args []string) {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
 	}
 
-	corsHandler := corsHandlers.CORS(
-		corsHandlers.AllowedOrigins([]string{
-			"http://localhost:5173",
-			"https://cowrite-api.up.railway.app",
-			"https://cowrite.up.railway.app",
-		}),
-		corsHandlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
-		corsHandlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
-	)(router)
+	switch command {
+	case "up":
+		if err := migrations.Up(config.DB); err != nil {
+			log.Fatal("Error migrating database: ", err)
+		}
+		log.Println("Database is up to date")
 
-	// Start server
-	log.Printf(" Server starting on port %s...", port)
-	fmt.Println("Shayanny here! :)")
-	log.Fatal(http.ListenAndServe(":"+port, corsHandler))
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				log.Fatalf("Invalid number of migrations to revert: %s", args[1])
+			}
+			steps = n
+		}
+		if err := migrations.Down(config.DB, steps); err != nil {
+			log.Fatal("Error reverting migrations: ", err)
+		}
+
+	case "status":
+		statuses, err := migrations.Statuses(config.DB)
+		if err != nil {
+			log.Fatal("Error reading migration status: ", err)
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, applied)
+		}
+
+	default:
+		log.Fatalf("Unknown migrate command %q (use up, down [n] or status)", command)
+	}
 }
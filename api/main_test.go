@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"minidocs/api/crdt"
+	"minidocs/api/handlers"
+	"minidocs/api/models"
+	"minidocs/api/store"
+	"minidocs/api/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+// These tests run the whole API, routes and middleware included, against the in-memory store
+
+// testAPI is a running API and the base URL to reach it
+type testAPI struct {
+	t   *testing.T
+	url string
+}
+
+// newTestAPI starts the API on a fresh memory store, with emails written to a temporary directory
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+
+	os.Setenv("JWT_SECRET", "test-secret")
+	utils.UseEmailSink(t.TempDir())
+	handlers.UseStore(store.NewMemory())
+
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	// Closing the server doesn't wait for WebSocket sessions, which flush the document as they end.
+	// Wait for every handler to return so none is still using the store the next test replaces.
+	var running sync.WaitGroup
+	router := newRouter()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		running.Add(1)
+		defer running.Done()
+		router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		server.Close()
+		running.Wait()
+	})
+	return &testAPI{t: t, url: server.URL}
+}
+
+// do sends a JSON request with an optional bearer token and decodes the response into out, if given.
+// It returns the status code.
+func (api *testAPI) do(method, path, token string, body, out interface{}) int {
+	api.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			api.t.Fatalf("marshal request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, api.url+path, reader)
+	if err != nil {
+		api.t.Fatalf("build request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		api.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			api.t.Fatalf("decode %s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// expect fails the test unless a request returns the given status
+func (api *testAPI) expect(status int, method, path, token string, body, out interface{}) {
+	api.t.Helper()
+
+	if got := api.do(method, path, token, body, out); got != status {
+		api.t.Fatalf("%s %s: got status %d, expected %d", method, path, got, status)
+	}
+}
+
+// signUp registers a user and logs them in, returning their token
+func (api *testAPI) signUp(username string) string {
+	api.t.Helper()
+
+	email := username + "@example.com"
+	api.expect(http.StatusCreated, "POST", "/api/register", "", handlers.RegisterRequest{
+		Username: username,
+		Email:    email,
+		Password: "password123",
+	}, nil)
+
+	var auth handlers.AuthResponse
+	api.expect(http.StatusOK, "POST", "/api/login", "", handlers.LoginRequest{Email: email, Password: "password123"}, &auth)
+	if auth.Token == "" {
+		api.t.Fatal("login returned no token")
+	}
+	return auth.Token
+}
+
+// createDocument creates a document owned by the token's user
+func (api *testAPI) createDocument(token, title, content string) *models.Document {
+	api.t.Helper()
+
+	var doc models.Document
+	api.expect(http.StatusCreated, "POST", "/api/documents", token, handlers.CreateDocumentRequest{Title: title, Content: content}, &doc)
+	return &doc
+}
+
+func documentPath(id int) string {
+	return "/api/documents/" + strconv.Itoa(id)
+}
+
+func TestDocumentCRUD(t *testing.T) {
+	api := newTestAPI(t)
+	token := api.signUp("alice")
+
+	doc := api.createDocument(token, "Notes", "hello")
+	if doc.Title != "Notes" || doc.Content != "hello" {
+		t.Fatalf("created document is %q / %q", doc.Title, doc.Content)
+	}
+
+	var docs []models.Document
+	api.expect(http.StatusOK, "GET", "/api/documents", token, nil, &docs)
+	if len(docs) != 1 || docs[0].ID != doc.ID {
+		t.Fatalf("document list is %+v, expected just document %d", docs, doc.ID)
+	}
+
+	var fetched models.Document
+	api.expect(http.StatusOK, "GET", documentPath(doc.ID), token, nil, &fetched)
+	if fetched.Content != "hello" {
+		t.Fatalf("fetched content is %q", fetched.Content)
+	}
+
+	// Content sent over REST goes through the live edit path like any other edit
+	content := "hello world"
+	var updated models.Document
+	api.expect(http.StatusOK, "PUT", documentPath(doc.ID), token, handlers.UpdateDocumentRequest{Title: "Renamed", Content: &content}, &updated)
+	if updated.Title != "Renamed" || updated.Content != content {
+		t.Fatalf("updated document is %q / %q", updated.Title, updated.Content)
+	}
+	api.expect(http.StatusOK, "GET", documentPath(doc.ID), token, nil, &fetched)
+	if fetched.Title != "Renamed" || fetched.Content != content {
+		t.Fatalf("document after update is %q / %q", fetched.Title, fetched.Content)
+	}
+
+	// Deleting moves it to the trash, from where it can be restored
+	api.expect(http.StatusOK, "DELETE", documentPath(doc.ID), token, nil, nil)
+	api.expect(http.StatusNotFound, "GET", documentPath(doc.ID), token, nil, nil)
+	var trash []models.Document
+	api.expect(http.StatusOK, "GET", "/api/documents/trash", token, nil, &trash)
+	if len(trash) != 1 || trash[0].ID != doc.ID {
+		t.Fatalf("trash is %+v, expected just document %d", trash, doc.ID)
+	}
+
+	api.expect(http.StatusOK, "POST", documentPath(doc.ID)+"/restore", token, nil, nil)
+	api.expect(http.StatusOK, "GET", documentPath(doc.ID), token, nil, &fetched)
+	if fetched.Content != content {
+		t.Fatalf("restored content is %q", fetched.Content)
+	}
+}
+
+func TestDocumentAccess(t *testing.T) {
+	api := newTestAPI(t)
+	owner := api.signUp("alice")
+	other := api.signUp("bob")
+	doc := api.createDocument(owner, "Private", "secret")
+	path := documentPath(doc.ID)
+
+	// No token, or a bad one
+	api.expect(http.StatusUnauthorized, "GET", path, "", nil, nil)
+	api.expect(http.StatusUnauthorized, "GET", path, "not-a-token", nil, nil)
+
+	// Someone it isn't shared with
+	api.expect(http.StatusForbidden, "GET", path, other, nil, nil)
+	api.expect(http.StatusForbidden, "PUT", path, other, handlers.UpdateDocumentRequest{Title: "Mine"}, nil)
+	api.expect(http.StatusForbidden, "DELETE", path, other, nil, nil)
+	api.expect(http.StatusForbidden, "GET", path+"/versions", other, nil, nil)
+	api.expect(http.StatusNotFound, "GET", documentPath(doc.ID+100), owner, nil, nil)
+
+	var docs []models.Document
+	api.expect(http.StatusOK, "GET", "/api/documents", other, nil, &docs)
+	if len(docs) != 0 {
+		t.Fatalf("bob sees %d documents before being invited", len(docs))
+	}
+
+	// Only the owner may invite; once invited, bob can read and edit but not delete or invite
+	api.expect(http.StatusForbidden, "POST", path+"/invite", other, handlers.ShareDocumentRequest{Email: "bob@example.com"}, nil)
+	api.expect(http.StatusOK, "POST", path+"/invite", owner, handlers.ShareDocumentRequest{Email: "bob@example.com"}, nil)
+
+	api.expect(http.StatusOK, "GET", path, other, nil, nil)
+	api.expect(http.StatusOK, "PUT", path, other, handlers.UpdateDocumentRequest{Title: "Shared"}, nil)
+	api.expect(http.StatusForbidden, "DELETE", path, other, nil, nil)
+	api.expect(http.StatusForbidden, "POST", path+"/invite", other, handlers.ShareDocumentRequest{Email: "alice@example.com"}, nil)
+
+	api.expect(http.StatusOK, "GET", "/api/documents", other, nil, &docs)
+	if len(docs) != 1 || docs[0].ID != doc.ID {
+		t.Fatalf("bob's documents are %+v, expected just document %d", docs, doc.ID)
+	}
+}
+
+// dialDocument opens a WebSocket to a document the way the editor does
+func (api *testAPI) dialDocument(documentID int, token string) (*websocket.Conn, *http.Response, error) {
+	url := "ws" + strings.TrimPrefix(api.url, "http") + "/ws/" + strconv.Itoa(documentID) +
+		"?token=" + token + "&protocol=3"
+	return websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://localhost:5173"}})
+}
+
+// wsMessage is a message read from a WebSocket
+type wsMessage struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// readMessage reads messages until one of the given type arrives
+func readMessage(t *testing.T, conn *websocket.Conn, messageType string) wsMessage {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for a %q message: %v", messageType, err)
+		}
+		if msg.Type == messageType {
+			return msg
+		}
+	}
+}
+
+func TestWebSocketEditRoundTrip(t *testing.T) {
+	api := newTestAPI(t)
+	owner := api.signUp("alice")
+	other := api.signUp("bob")
+	stranger := api.signUp("carol")
+	doc := api.createDocument(owner, "Live", "hello")
+	api.expect(http.StatusOK, "POST", documentPath(doc.ID)+"/invite", owner, handlers.ShareDocumentRequest{Email: "bob@example.com"}, nil)
+
+	// The handshake is refused for someone the document isn't shared with, and for outdated clients
+	if _, resp, err := api.dialDocument(doc.ID, stranger); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("stranger's connection: expected status 403, got %v", err)
+	}
+	legacyURL := "ws" + strings.TrimPrefix(api.url, "http") + "/ws/" + strconv.Itoa(doc.ID) + "?token=" + owner
+	if _, resp, err := websocket.DefaultDialer.Dial(legacyURL, http.Header{"Origin": {"http://localhost:5173"}}); err == nil || resp == nil || resp.StatusCode != http.StatusUpgradeRequired {
+		t.Fatalf("unversioned connection: expected status 426, got %v", err)
+	}
+
+	alice, _, err := api.dialDocument(doc.ID, owner)
+	if err != nil {
+		t.Fatalf("alice connects: %v", err)
+	}
+	defer alice.Close()
+	bob, _, err := api.dialDocument(doc.ID, other)
+	if err != nil {
+		t.Fatalf("bob connects: %v", err)
+	}
+	defer bob.Close()
+
+	var joined struct {
+		Revision int64 `json:"revision"`
+		Protocol int   `json:"protocol"`
+	}
+	json.Unmarshal(readMessage(t, alice, "join").Payload, &joined)
+	if joined.Protocol != 3 {
+		t.Fatalf("negotiated protocol %d, expected 3", joined.Protocol)
+	}
+	readMessage(t, bob, "members") // bob's join has been handled once he has the member list
+
+	// alice appends " world" to "hello"
+	err = alice.WriteJSON(map[string]interface{}{
+		"type": "edit",
+		"id":   "edit-1",
+		"payload": map[string]interface{}{
+			"ops":          []interface{}{5, " world"},
+			"baseRevision": joined.Revision,
+		},
+	})
+	if err != nil {
+		t.Fatalf("send edit: %v", err)
+	}
+
+	var ack struct {
+		Revision int64 `json:"revision"`
+	}
+	ackMsg := readMessage(t, alice, "ack")
+	json.Unmarshal(ackMsg.Payload, &ack)
+	if ackMsg.ID != "edit-1" || ack.Revision != joined.Revision+1 {
+		t.Fatalf("ack is %s for %q, expected revision %d for edit-1", ackMsg.Payload, ackMsg.ID, joined.Revision+1)
+	}
+
+	var edit struct {
+		Ops      []interface{} `json:"ops"`
+		Revision int64         `json:"revision"`
+		Checksum uint32        `json:"checksum"`
+	}
+	json.Unmarshal(readMessage(t, bob, "edit").Payload, &edit)
+	if edit.Revision != ack.Revision || len(edit.Ops) != 2 || edit.Ops[1] != " world" {
+		t.Fatalf("bob got edit %+v, expected alice's insert at revision %d", edit, ack.Revision)
+	}
+
+	// Once everyone has left, the edit is written back to the document
+	alice.Close()
+	bob.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var fetched models.Document
+		api.expect(http.StatusOK, "GET", documentPath(doc.ID), owner, nil, &fetched)
+		if fetched.Content == "hello world" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("document content is %q after the session, expected %q", fetched.Content, "hello world")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// along with the operation that produced it, in the operation log
+	var logged []models.DocumentOperation
+	api.expect(http.StatusOK, "GET", documentPath(doc.ID)+"/operations", owner, nil, &logged)
+	if len(logged) != 1 || logged[0].Revision != ack.Revision || logged[0].Operation != `[5," world"]` {
+		t.Fatalf("operation log is %+v, expected alice's insert at revision %d", logged, ack.Revision)
+	}
+}
+
+// crdtSync sends a crdt-sync for the given replica token and returns the reply
+func crdtSync(t *testing.T, conn *websocket.Conn, replica string, sv crdt.StateVector) (reply struct {
+	Update      crdt.Update      `json:"update"`
+	StateVector crdt.StateVector `json:"stateVector"`
+	Client      crdt.ClientID    `json:"client"`
+}) {
+	t.Helper()
+
+	err := conn.WriteJSON(map[string]interface{}{
+		"type":    "crdt-sync",
+		"payload": map[string]interface{}{"stateVector": sv, "replica": replica},
+	})
+	if err != nil {
+		t.Fatalf("send crdt-sync: %v", err)
+	}
+	json.Unmarshal(readMessage(t, conn, "crdt-sync-reply").Payload, &reply)
+	return reply
+}
+
+func TestWebSocketCRDTMergesOfflineEdits(t *testing.T) {
+	api := newTestAPI(t)
+	owner := api.signUp("alice")
+	doc := api.createDocument(owner, "Offline", "ab")
+
+	var switched models.Document
+	api.expect(http.StatusOK, "PUT", documentPath(doc.ID)+"/sync-mode", owner, handlers.SyncModeRequest{Mode: models.SyncModeCRDT}, &switched)
+	if switched.SyncMode != models.SyncModeCRDT {
+		t.Fatalf("sync mode is %q after switching, expected %q", switched.SyncMode, models.SyncModeCRDT)
+	}
+
+	conn, _, err := api.dialDocument(doc.ID, owner)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	readMessage(t, conn, "join")
+	first := crdtSync(t, conn, "tab-1", crdt.StateVector{})
+
+	// The connection drops and the user keeps typing into their replica
+	conn.Close()
+	replica := crdt.NewDoc(first.Client)
+	if _, err := replica.Apply(first.Update); err != nil {
+		t.Fatalf("apply the server's replica: %v", err)
+	}
+	if _, err := replica.Insert(2, "cd"); err != nil {
+		t.Fatalf("type offline: %v", err)
+	}
+
+	// Back online with the same replica token, the offline items are accepted
+	conn, _, err = api.dialDocument(doc.ID, owner)
+	if err != nil {
+		t.Fatalf("reconnect: %v", err)
+	}
+	defer conn.Close()
+	readMessage(t, conn, "join")
+	again := crdtSync(t, conn, "tab-1", replica.StateVector())
+	if again.Client != first.Client {
+		t.Fatalf("replica ID changed from %d to %d across connections", first.Client, again.Client)
+	}
+	err = conn.WriteJSON(map[string]interface{}{
+		"type":    "crdt-update",
+		"id":      "offline-1",
+		"payload": map[string]interface{}{"update": replica.Diff(again.StateVector)},
+	})
+	if err != nil {
+		t.Fatalf("send crdt-update: %v", err)
+	}
+	if ack := readMessage(t, conn, "ack"); ack.ID != "offline-1" {
+		t.Fatalf("got an ack for %q, expected offline-1", ack.ID)
+	}
+
+	// Another tab gets its own replica ID and can't send items under the first one's
+	other, _, err := api.dialDocument(doc.ID, owner)
+	if err != nil {
+		t.Fatalf("second tab connects: %v", err)
+	}
+	defer other.Close()
+	readMessage(t, other, "join")
+	if second := crdtSync(t, other, "tab-2", crdt.StateVector{}); second.Client == first.Client {
+		t.Fatalf("two replica tokens got the same ID %d", second.Client)
+	}
+	forged, _ := replica.Insert(0, "x")
+	err = other.WriteJSON(map[string]interface{}{
+		"type":    "crdt-update",
+		"id":      "forged-1",
+		"payload": map[string]interface{}{"update": forged},
+	})
+	if err != nil {
+		t.Fatalf("send forged crdt-update: %v", err)
+	}
+	if nack := readMessage(t, other, "nack"); nack.ID != "forged-1" {
+		t.Fatalf("got a nack for %q, expected forged-1", nack.ID)
+	}
+
+	conn.Close()
+	other.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var fetched models.Document
+		api.expect(http.StatusOK, "GET", documentPath(doc.ID), owner, nil, &fetched)
+		if fetched.Content == "abcd" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("document content is %q after the session, expected %q", fetched.Content, "abcd")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
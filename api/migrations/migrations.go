@@ -0,0 +1,313 @@
+// Package migrations keeps the database schema up to date. Each change to the schema is a pair of
+// SQL files in sql/, NNNN_name.up.sql and NNNN_name.down.sql, embedded in the binary and applied in
+// order of their version number. Applied migrations are recorded in schema_migrations along with a
+// checksum of their up file, so editing a migration after it ran is caught instead of silently ignored.
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// Migration is one versioned change to the schema
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string // sha256 of Up
+}
+
+// Status is a migration and whether it has been applied
+type Status struct {
+	Migration
+	AppliedAt *time.Time // nil if not applied yet
+}
+
+// Load reads the embedded migrations, ordered by version
+func Load() ([]Migration, error) {
+	return load(files)
+}
+
+// load reads the migrations in the sql directory of fsys
+func load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, "sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		base, direction, ok := cutDirection(name)
+		if !ok {
+			return nil, fmt.Errorf("migration %s: name must end in .up.sql or .down.sql", name)
+		}
+		prefix, label, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: name must start with a version number, as in 0001_name", name)
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join("sql", name))
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		} else if m.Name != label {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, label)
+		}
+		if direction == "up" {
+			m.Up = string(data)
+			sum := sha256.Sum256(data)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// cutDirection splits "0001_name.up.sql" into "0001_name" and "up"
+func cutDirection(name string) (string, string, bool) {
+	if base, ok := strings.CutSuffix(name, ".up.sql"); ok {
+		return base, "up", true
+	}
+	if base, ok := strings.CutSuffix(name, ".down.sql"); ok {
+		return base, "down", true
+	}
+	return "", "", false
+}
+
+// Up applies every migration that hasn't been applied yet, each in its own transaction
+func Up(db *sql.DB) error {
+	migrations, err := Load()
+	if err != nil {
+		return err
+	}
+
+	return withLock(db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		if err := verify(migrations, applied); err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			start := time.Now()
+			err := inTransaction(conn, func(tx *sql.Tx) error {
+				if _, err := tx.Exec(m.Up); err != nil {
+					return err
+				}
+				_, err := tx.Exec(
+					`INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES ($1, $2, $3, NOW())`,
+					m.Version, m.Name, m.Checksum,
+				)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+			}
+			log.Printf("[Migrate] Applied %04d_%s in %s", m.Version, m.Name, time.Since(start).Round(time.Millisecond))
+		}
+		return nil
+	})
+}
+
+// Down reverts the last steps applied migrations, newest first
+func Down(db *sql.DB, steps int) error {
+	migrations, err := Load()
+	if err != nil {
+		return err
+	}
+
+	return withLock(db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		if err := verify(migrations, applied); err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %04d_%s has no down file", m.Version, m.Name)
+			}
+			err := inTransaction(conn, func(tx *sql.Tx) error {
+				if _, err := tx.Exec(m.Down); err != nil {
+					return err
+				}
+				_, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("reverting migration %04d_%s: %w", m.Version, m.Name, err)
+			}
+			log.Printf("[Migrate] Reverted %04d_%s", m.Version, m.Name)
+			steps--
+		}
+		return nil
+	})
+}
+
+// Statuses lists every known migration and when it was applied
+func Statuses(db *sql.DB) ([]Status, error) {
+	migrations, err := Load()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+	err = withLock(db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		if err := verify(migrations, applied); err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			status := Status{Migration: m}
+			if record, ok := applied[m.Version]; ok {
+				appliedAt := record.appliedAt
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// appliedMigration is a row of schema_migrations
+type appliedMigration struct {
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+func appliedMigrations(conn *sql.Conn) (map[int]appliedMigration, error) {
+	rows, err := conn.QueryContext(context.Background(), `SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var version int
+		var record appliedMigration
+		if err := rows.Scan(&version, &record.name, &record.checksum, &record.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = record
+	}
+	return applied, rows.Err()
+}
+
+// verify refuses to go on if an applied migration was edited afterwards, or is missing from this
+// binary (it was applied by a newer version of the API)
+func verify(migrations []Migration, applied map[int]appliedMigration) error {
+	known := make(map[int]bool, len(migrations))
+	for _, m := range migrations {
+		known[m.Version] = true
+		if record, ok := applied[m.Version]; ok && record.checksum != m.Checksum {
+			return fmt.Errorf("migration %04d_%s was changed after it was applied (checksum %s, database has %s)",
+				m.Version, m.Name, m.Checksum[:12], record.checksum[:min(12, len(record.checksum))])
+		}
+	}
+	for version, record := range applied {
+		if !known[version] {
+			return fmt.Errorf("database has migration %04d_%s, which this build doesn't know about", version, record.name)
+		}
+	}
+	return nil
+}
+
+// migrationLockKey identifies the PostgreSQL advisory lock taken while migrating
+const migrationLockKey = 0x6d696772 // "migr"
+
+// withLock runs fn on a connection holding the migration lock, so replicas starting together don't
+// apply the same migration twice. The lock is a session-level advisory lock, taken before anything
+// else is done on the same connection fn then runs on: even creating schema_migrations is left to one
+// runner at a time, and a pool of a single connection is enough. Other runners wait for it.
+func withLock(db *sql.DB, fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("taking the migration lock: %w", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey); err != nil {
+			log.Printf("[Migrate] Failed to release the migration lock: %v", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER      PRIMARY KEY,
+			name       VARCHAR(255) NOT NULL,
+			checksum   VARCHAR(64)  NOT NULL,
+			applied_at TIMESTAMP    NOT NULL DEFAULT NOW()
+		)`)
+	if err != nil {
+		return fmt.Errorf("creating the migration table: %w", err)
+	}
+
+	return fn(conn)
+}
+
+func inTransaction(conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
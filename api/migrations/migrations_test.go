@@ -0,0 +1,96 @@
+package migrations
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// sqlFiles builds a migrations directory from file names and contents
+func sqlFiles(files map[string]string) fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for name, data := range files {
+		fsys["sql/"+name] = &fstest.MapFile{Data: []byte(data)}
+	}
+	return fsys
+}
+
+func TestLoadOrdersByVersionNumber(t *testing.T) {
+	migrations, err := load(sqlFiles(map[string]string{
+		"10_ten.up.sql":     "SELECT 10",
+		"9_nine.up.sql":     "SELECT 9",
+		"9_nine.down.sql":   "SELECT -9",
+		"0001_one.up.sql":   "SELECT 1",
+		"0001_one.down.sql": "SELECT -1",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var versions []int
+	for _, m := range migrations {
+		versions = append(versions, m.Version)
+	}
+	if len(versions) != 3 || versions[0] != 1 || versions[1] != 9 || versions[2] != 10 {
+		t.Fatalf("got versions %v, want [1 9 10]", versions)
+	}
+	if m := migrations[1]; m.Name != "nine" || m.Up != "SELECT 9" || m.Down != "SELECT -9" || m.Checksum == "" {
+		t.Fatalf("got %+v for version 9", m)
+	}
+}
+
+func TestLoadRejectsMalformedMigrations(t *testing.T) {
+	tests := map[string]struct {
+		files map[string]string
+		want  string
+	}{
+		"no up file":        {map[string]string{"0001_one.down.sql": "SELECT 1"}, "has no up file"},
+		"unknown direction": {map[string]string{"0001_one.sql": "SELECT 1"}, "must end in"},
+		"no version":        {map[string]string{"one.up.sql": "SELECT 1"}, "version number"},
+		"two names":         {map[string]string{"0001_one.up.sql": "SELECT 1", "0001_uno.down.sql": "SELECT 1"}, "two names"},
+	}
+
+	for name, test := range tests {
+		if _, err := load(sqlFiles(test.files)); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error about %q", name, err, test.want)
+		}
+	}
+}
+
+func TestVerifyRejectsChangedAndUnknownMigrations(t *testing.T) {
+	migrations, err := load(sqlFiles(map[string]string{"0001_one.up.sql": "SELECT 1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied := map[int]appliedMigration{1: {name: "one", checksum: migrations[0].Checksum}}
+	if err := verify(migrations, applied); err != nil {
+		t.Fatalf("unchanged migration: %v", err)
+	}
+
+	applied[1] = appliedMigration{name: "one", checksum: "0123456789abcdef"}
+	if err := verify(migrations, applied); err == nil || !strings.Contains(err.Error(), "was changed") {
+		t.Fatalf("changed migration: got %v, want a checksum mismatch", err)
+	}
+
+	applied = map[int]appliedMigration{1: {name: "one", checksum: migrations[0].Checksum}, 2: {name: "two"}}
+	if err := verify(migrations, applied); err == nil || !strings.Contains(err.Error(), "doesn't know about") {
+		t.Fatalf("unknown migration: got %v, want it refused", err)
+	}
+}
+
+func TestEmbeddedMigrationsCanBeReverted(t *testing.T) {
+	migrations, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %04d_%s follows version %d", m.Version, m.Name, i)
+		}
+		if strings.TrimSpace(m.Down) == "" {
+			t.Errorf("migration %04d_%s has no down file", m.Version, m.Name)
+		}
+	}
+}
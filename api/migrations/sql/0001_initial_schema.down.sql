@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS document_shares;
+DROP TABLE IF EXISTS documents;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,29 @@
+-- Tables the API started out with (models/user.go and models/document.go).
+-- IF NOT EXISTS lets databases created before migrations existed adopt this one as is.
+
+CREATE TABLE IF NOT EXISTS users (
+    id            SERIAL PRIMARY KEY,
+    username      VARCHAR(50)  NOT NULL UNIQUE,
+    email         VARCHAR(255) NOT NULL UNIQUE,
+    password_hash VARCHAR(255) NOT NULL,
+    created_at    TIMESTAMP    NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS documents (
+    id         SERIAL PRIMARY KEY,
+    title      VARCHAR(255) NOT NULL,
+    content    TEXT         NOT NULL DEFAULT '',
+    owner_id   INTEGER      NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP    NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP    NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS documents_owner_id_idx ON documents (owner_id, updated_at DESC);
+
+CREATE TABLE IF NOT EXISTS document_shares (
+    document_id         INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+    shared_with_user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    PRIMARY KEY (document_id, shared_with_user_id)
+);
+
+CREATE INDEX IF NOT EXISTS document_shares_user_idx ON document_shares (shared_with_user_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS document_crdt_states;
+ALTER TABLE documents DROP COLUMN IF EXISTS sync_mode;
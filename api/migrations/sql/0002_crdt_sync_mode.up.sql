@@ -0,0 +1,9 @@
+-- Per-document sync backend and the saved replica of CRDT documents (models/crdt.go)
+
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS sync_mode VARCHAR(10) NOT NULL DEFAULT 'ot';
+
+CREATE TABLE IF NOT EXISTS document_crdt_states (
+    document_id INTEGER   PRIMARY KEY REFERENCES documents(id) ON DELETE CASCADE,
+    state       BYTEA     NOT NULL,
+    updated_at  TIMESTAMP NOT NULL DEFAULT NOW()
+);
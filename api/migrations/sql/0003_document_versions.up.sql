@@ -0,0 +1,15 @@
+-- Version history snapshots (models/version.go)
+
+CREATE TABLE IF NOT EXISTS document_versions (
+    id          SERIAL PRIMARY KEY,
+    document_id INTEGER      NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+    revision    BIGINT       NOT NULL DEFAULT 0,
+    title       VARCHAR(255) NOT NULL,
+    content     TEXT         NOT NULL,
+    created_by  INTEGER      REFERENCES users(id) ON DELETE SET NULL, -- NULL for automatic snapshots
+    reason      VARCHAR(20)  NOT NULL,
+    created_at  TIMESTAMP    NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS document_versions_document_idx ON document_versions (document_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS document_versions_revision_idx ON document_versions (document_id, revision);
@@ -0,0 +1,13 @@
+-- Append-only log of accepted edits (models/operation.go)
+
+CREATE TABLE IF NOT EXISTS document_operations (
+    id          SERIAL PRIMARY KEY,
+    document_id INTEGER   NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+    revision    BIGINT    NOT NULL,
+    user_id     INTEGER   NOT NULL,
+    operation   TEXT      NOT NULL, -- OT operation as JSON
+    created_at  TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS document_operations_revision_idx ON document_operations (document_id, revision);
+CREATE INDEX IF NOT EXISTS document_operations_created_idx ON document_operations (document_id, created_at);
@@ -0,0 +1,12 @@
+-- Persistent document chat (models/message.go)
+
+CREATE TABLE IF NOT EXISTS document_messages (
+    id          SERIAL PRIMARY KEY,
+    document_id INTEGER   NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+    user_id     INTEGER   NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    text        TEXT      NOT NULL,
+    created_at  TIMESTAMP NOT NULL DEFAULT NOW(),
+    edited_at   TIMESTAMP -- NULL until the author edits the message
+);
+
+CREATE INDEX IF NOT EXISTS document_messages_document_idx ON document_messages (document_id, id DESC);
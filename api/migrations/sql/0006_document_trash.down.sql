@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS documents_deleted_at_idx;
+DELETE FROM documents WHERE deleted_at IS NOT NULL;
+ALTER TABLE documents DROP COLUMN IF EXISTS deleted_at;
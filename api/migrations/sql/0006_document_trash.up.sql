@@ -0,0 +1,6 @@
+-- Soft deletion (models/document.go): deleted documents keep their row, with deleted_at set, until
+-- they are restored, deleted for good from the trash or purged after the retention period
+
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS documents_deleted_at_idx ON documents (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS document_operations_revision_idx;
+CREATE INDEX IF NOT EXISTS document_operations_revision_idx ON document_operations (document_id, revision);
@@ -0,0 +1,10 @@
+-- Each revision of a document is logged once (models/operation.go), so the flusher can write the
+-- operations it buffered again after a failure without duplicating them
+
+DELETE FROM document_operations a
+    USING document_operations b
+    WHERE a.document_id = b.document_id AND a.revision = b.revision AND a.id > b.id;
+
+DROP INDEX IF EXISTS document_operations_revision_idx;
+
+CREATE UNIQUE INDEX IF NOT EXISTS document_operations_revision_idx ON document_operations (document_id, revision);
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// GetCRDTState returns the saved CRDT replica of a document, or nil if it has none
+func GetCRDTState(db *sql.DB, documentID int) ([]byte, error) {
+	var state []byte
+	query := `SELECT state FROM document_crdt_states WHERE document_id = $1`
+
+	err := db.QueryRow(query, documentID).Scan(&state)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// SaveCRDTState stores the CRDT replica of a document, replacing any previous one
+func SaveCRDTState(db *sql.DB, documentID int, state []byte) error {
+	query := `
+		INSERT INTO document_crdt_states (document_id, state, updated_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (document_id) DO UPDATE SET state = EXCLUDED.state, updated_at = EXCLUDED.updated_at
+	`
+
+	_, err := db.Exec(query, documentID, state, time.Now())
+	return err
+}
+
+// DeleteCRDTState removes the CRDT replica of a document (e.g. when it goes back to OT)
+func DeleteCRDTState(db *sql.DB, documentID int) error {
+	query := `DELETE FROM document_crdt_states WHERE document_id = $1`
+
+	_, err := db.Exec(query, documentID)
+	return err
+}
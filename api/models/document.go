@@ -6,14 +6,28 @@ import (
 	"time"
 )
 
+// Sync modes decide how live edits to a document are merged
+const (
+	SyncModeOT   = "ot"   // server-ordered operational transformation (default)
+	SyncModeCRDT = "crdt" // replicated sequence, supports offline editing
+)
+
+// ErrDocumentNotFound is returned when a document lookup matches no rows
+var ErrDocumentNotFound = errors.New("document not found")
+
+// ErrShareNotFound is returned when revoking a share that doesn't exist
+var ErrShareNotFound = errors.New("share not found")
+
 // Document represents a document strcuture in the database
 type Document struct {
-	ID        int       `json:"id"`
-	Title     string    `json:"title"`
-	Content   string    `json:"content"`
-	OwnerID   int       `json:"owner_id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        int        `json:"id"`
+	Title     string     `json:"title"`
+	Content   string     `json:"content"`
+	OwnerID   int        `json:"owner_id"`
+	SyncMode  string     `json:"sync_mode"` // "ot" (default) or "crdt"
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"` // set while the document is in the trash
 }
 
 // CreateDocument creates a new document in the database
@@ -21,7 +35,7 @@ func CreateDocument(db *sql.DB, title, content string, ownerID int) (*Document,
 	query := `
 		INSERT INTO documents (title, content, owner_id, created_at, updated_at)
 		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id, title, content, owner_id, created_at, updated_at
+		RETURNING id, title, content, owner_id, sync_mode, created_at, updated_at
 	`
 
 	doc := &Document{}
@@ -32,6 +46,7 @@ func CreateDocument(db *sql.DB, title, content string, ownerID int) (*Document,
 		&doc.Title,
 		&doc.Content,
 		&doc.OwnerID,
+		&doc.SyncMode,
 		&doc.CreatedAt,
 		&doc.UpdatedAt,
 	)
@@ -46,9 +61,9 @@ func CreateDocument(db *sql.DB, title, content string, ownerID int) (*Document,
 // GetDocumentsByOwner retrieves all documents owned by a specific user
 func GetDocumentsByOwner(db *sql.DB, ownerID int) ([]Document, error) {
 	query := `
-		SELECT id, title, content, owner_id, created_at, updated_at
+		SELECT id, title, content, owner_id, sync_mode, created_at, updated_at
 		FROM documents
-		WHERE owner_id = $1
+		WHERE owner_id = $1 AND deleted_at IS NULL
 		ORDER BY updated_at DESC
 	`
 
@@ -67,6 +82,7 @@ func GetDocumentsByOwner(db *sql.DB, ownerID int) ([]Document, error) {
 			&doc.Title,
 			&doc.Content,
 			&doc.OwnerID,
+			&doc.SyncMode,
 			&doc.CreatedAt,
 			&doc.UpdatedAt,
 		)
@@ -79,14 +95,15 @@ func GetDocumentsByOwner(db *sql.DB, ownerID int) ([]Document, error) {
 	return documents, nil
 }
 
-// GetDocumentByID retrieves a specific document by its ID , used for viewing/editing a single document
+// GetDocumentByID retrieves a specific document by its ID , used for viewing/editing a single document.
+// Documents in the trash are not found.
 func GetDocumentByID(db *sql.DB, id int) (*Document, error) {
 	doc := &Document{}
 
 	query := `
-		SELECT id, title, content, owner_id, created_at, updated_at
+		SELECT id, title, content, owner_id, sync_mode, created_at, updated_at
 		FROM documents
-		WHERE id = $1
+		WHERE id = $1 AND deleted_at IS NULL
 	`
 
 	err := db.QueryRow(query, id).Scan(
@@ -94,13 +111,14 @@ func GetDocumentByID(db *sql.DB, id int) (*Document, error) {
 		&doc.Title,
 		&doc.Content,
 		&doc.OwnerID,
+		&doc.SyncMode,
 		&doc.CreatedAt,
 		&doc.UpdatedAt,
 	)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.New("document not found")
+			return nil, ErrDocumentNotFound
 		}
 		return nil, err
 	}
@@ -113,8 +131,8 @@ func UpdateDocument(db *sql.DB, id int, title, content string) (*Document, error
 	query := `
 		UPDATE documents
 		SET title = $1, content = $2, updated_at = $3
-		WHERE id = $4
-		RETURNING id, title, content, owner_id, created_at, updated_at
+		WHERE id = $4 AND deleted_at IS NULL
+		RETURNING id, title, content, owner_id, sync_mode, created_at, updated_at
 	`
 
 	doc := &Document{}
@@ -125,13 +143,14 @@ func UpdateDocument(db *sql.DB, id int, title, content string) (*Document, error
 		&doc.Title,
 		&doc.Content,
 		&doc.OwnerID,
+		&doc.SyncMode,
 		&doc.CreatedAt,
 		&doc.UpdatedAt,
 	)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.New("document not found")
+			return nil, ErrDocumentNotFound
 		}
 		return nil, err
 	}
@@ -139,9 +158,174 @@ func UpdateDocument(db *sql.DB, id int, title, content string) (*Document, error
 	return doc, nil
 }
 
-// DeleteDocument deletes a document from the database
+// SaveDocumentContent writes back the content of a live edit. It leaves the title alone, so a rename
+// made meanwhile is kept.
+func SaveDocumentContent(db *sql.DB, id int, content string) error {
+	query := `UPDATE documents SET content = $1, updated_at = $2 WHERE id = $3 AND deleted_at IS NULL`
+
+	result, err := db.Exec(query, content, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrDocumentNotFound
+	}
+
+	return nil
+}
+
+// SetDocumentSyncMode switches how live edits to a document are merged
+func SetDocumentSyncMode(db *sql.DB, id int, mode string) error {
+	query := `UPDATE documents SET sync_mode = $1 WHERE id = $2 AND deleted_at IS NULL`
+
+	result, err := db.Exec(query, mode, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrDocumentNotFound
+	}
+
+	return nil
+}
+
+// DeleteDocument moves a document to the trash. It keeps its row, shares and history until it is
+// restored or purged.
 func DeleteDocument(db *sql.DB, id int) error {
-	query := `DELETE FROM documents WHERE id = $1`
+	query := `UPDATE documents SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL`
+
+	result, err := db.Exec(query, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrDocumentNotFound
+	}
+
+	return nil
+}
+
+// GetDeletedDocuments returns the documents a user has in the trash, most recently deleted first
+func GetDeletedDocuments(db *sql.DB, ownerID int) ([]Document, error) {
+	query := `
+		SELECT id, title, content, owner_id, sync_mode, created_at, updated_at, deleted_at
+		FROM documents
+		WHERE owner_id = $1 AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC
+	`
+
+	rows, err := db.Query(query, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	documents := []Document{}
+
+	for rows.Next() {
+		var doc Document
+		err := rows.Scan(
+			&doc.ID,
+			&doc.Title,
+			&doc.Content,
+			&doc.OwnerID,
+			&doc.SyncMode,
+			&doc.CreatedAt,
+			&doc.UpdatedAt,
+			&doc.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, doc)
+	}
+
+	return documents, nil
+}
+
+// GetDeletedDocumentByID retrieves a document that is in the trash
+func GetDeletedDocumentByID(db *sql.DB, id int) (*Document, error) {
+	doc := &Document{}
+
+	query := `
+		SELECT id, title, content, owner_id, sync_mode, created_at, updated_at, deleted_at
+		FROM documents
+		WHERE id = $1 AND deleted_at IS NOT NULL
+	`
+
+	err := db.QueryRow(query, id).Scan(
+		&doc.ID,
+		&doc.Title,
+		&doc.Content,
+		&doc.OwnerID,
+		&doc.SyncMode,
+		&doc.CreatedAt,
+		&doc.UpdatedAt,
+		&doc.DeletedAt,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrDocumentNotFound
+		}
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// RestoreDocument takes a document out of the trash
+func RestoreDocument(db *sql.DB, id int) (*Document, error) {
+	query := `
+		UPDATE documents
+		SET deleted_at = NULL
+		WHERE id = $1 AND deleted_at IS NOT NULL
+		RETURNING id, title, content, owner_id, sync_mode, created_at, updated_at
+	`
+
+	doc := &Document{}
+
+	err := db.QueryRow(query, id).Scan(
+		&doc.ID,
+		&doc.Title,
+		&doc.Content,
+		&doc.OwnerID,
+		&doc.SyncMode,
+		&doc.CreatedAt,
+		&doc.UpdatedAt,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrDocumentNotFound
+		}
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// PurgeDocument permanently deletes a document in the trash, along with its shares and history
+func PurgeDocument(db *sql.DB, id int) error {
+	query := `DELETE FROM documents WHERE id = $1 AND deleted_at IS NOT NULL`
 
 	result, err := db.Exec(query, id)
 	if err != nil {
@@ -154,12 +338,35 @@ func DeleteDocument(db *sql.DB, id int) error {
 	}
 
 	if rowsAffected == 0 {
-		return errors.New("document not found")
+		return ErrDocumentNotFound
 	}
 
 	return nil
 }
 
+// PurgeDeletedDocuments permanently deletes every document moved to the trash before the given time
+// and returns their IDs
+func PurgeDeletedDocuments(db *sql.DB, deletedBefore time.Time) ([]int, error) {
+	query := `DELETE FROM documents WHERE deleted_at < $1 RETURNING id`
+
+	rows, err := db.Query(query, deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
 // ShareDocument shares a document with another user
 func ShareDocument(db *sql.DB, documentID int, sharedWithUserID int) error {
 	query := `
@@ -172,6 +379,30 @@ func ShareDocument(db *sql.DB, documentID int, sharedWithUserID int) error {
 	return err
 }
 
+// UnshareDocument revokes a user's access to a shared document
+func UnshareDocument(db *sql.DB, documentID int, sharedWithUserID int) error {
+	query := `
+		DELETE FROM document_shares
+		WHERE document_id = $1 AND shared_with_user_id = $2
+	`
+
+	result, err := db.Exec(query, documentID, sharedWithUserID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrShareNotFound
+	}
+
+	return nil
+}
+
 // IsDocumentSharedWithUser checks if a document is shared with a specific user
 func IsDocumentSharedWithUser(db *sql.DB, documentID int, userID int) (bool, error) {
 	var exists bool
@@ -189,10 +420,10 @@ func IsDocumentSharedWithUser(db *sql.DB, documentID int, userID int) (bool, err
 // GetSharedDocuments returns all documents shared with a user
 func GetSharedDocuments(db *sql.DB, userID int) ([]Document, error) {
 	query := `
-		SELECT d.id, d.title, d.content, d.owner_id, d.created_at, d.updated_at
+		SELECT d.id, d.title, d.content, d.owner_id, d.sync_mode, d.created_at, d.updated_at
 		FROM documents d
 		INNER JOIN document_shares ds ON d.id = ds.document_id
-		WHERE ds.shared_with_user_id = $1
+		WHERE ds.shared_with_user_id = $1 AND d.deleted_at IS NULL
 		ORDER BY d.updated_at DESC
 	`
 
@@ -205,7 +436,7 @@ func GetSharedDocuments(db *sql.DB, userID int) ([]Document, error) {
 	var documents []Document
 	for rows.Next() {
 		var doc Document
-		err := rows.Scan(&doc.ID, &doc.Title, &doc.Content, &doc.OwnerID, &doc.CreatedAt, &doc.UpdatedAt)
+		err := rows.Scan(&doc.ID, &doc.Title, &doc.Content, &doc.OwnerID, &doc.SyncMode, &doc.CreatedAt, &doc.UpdatedAt)
 		if err != nil {
 			return nil, err
 		}
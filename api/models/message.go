@@ -0,0 +1,150 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrMessageNotFound is returned when a chat message lookup matches no rows
+var ErrMessageNotFound = errors.New("message not found")
+
+// DocumentMessage is a chat message posted in a document's discussion
+type DocumentMessage struct {
+	ID         int        `json:"id"`
+	DocumentID int        `json:"document_id"`
+	UserID     int        `json:"user_id"`
+	Username   string     `json:"username"`
+	Text       string     `json:"text"`
+	CreatedAt  time.Time  `json:"created_at"`
+	EditedAt   *time.Time `json:"edited_at"` // nil until the author edits the message
+}
+
+// messageColumns selects a message together with its author's username (messages aliased m, users u)
+const messageColumns = `m.id, m.document_id, m.user_id, u.username, m.text, m.created_at, m.edited_at`
+
+// scanMessage reads a row selected with messageColumns
+func scanMessage(row interface{ Scan(...interface{}) error }) (*DocumentMessage, error) {
+	message := &DocumentMessage{}
+	var editedAt sql.NullTime
+
+	err := row.Scan(
+		&message.ID,
+		&message.DocumentID,
+		&message.UserID,
+		&message.Username,
+		&message.Text,
+		&message.CreatedAt,
+		&editedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if editedAt.Valid {
+		message.EditedAt = &editedAt.Time
+	}
+	return message, nil
+}
+
+// CreateDocumentMessage stores a new chat message
+func CreateDocumentMessage(db *sql.DB, documentID, userID int, text string) (*DocumentMessage, error) {
+	query := `
+		WITH m AS (
+			INSERT INTO document_messages (document_id, user_id, text, created_at)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, document_id, user_id, text, created_at, edited_at
+		)
+		SELECT ` + messageColumns + `
+		FROM m JOIN users u ON u.id = m.user_id
+	`
+
+	return scanMessage(db.QueryRow(query, documentID, userID, text, time.Now()))
+}
+
+// GetDocumentMessages returns up to limit messages of a document older than beforeID, newest first.
+// A beforeID of 0 starts from the latest message.
+func GetDocumentMessages(db *sql.DB, documentID, beforeID, limit int) ([]DocumentMessage, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM document_messages m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.document_id = $1 AND ($2 = 0 OR m.id < $2)
+		ORDER BY m.id DESC
+		LIMIT $3
+	`
+
+	rows, err := db.Query(query, documentID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []DocumentMessage{}
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *message)
+	}
+
+	return messages, rows.Err()
+}
+
+// GetDocumentMessage returns a single message of a document
+func GetDocumentMessage(db *sql.DB, documentID, messageID int) (*DocumentMessage, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM document_messages m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.document_id = $1 AND m.id = $2
+	`
+
+	message, err := scanMessage(db.QueryRow(query, documentID, messageID))
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	}
+	return message, err
+}
+
+// UpdateDocumentMessage replaces the text of a message and marks it as edited
+func UpdateDocumentMessage(db *sql.DB, documentID, messageID int, text string) (*DocumentMessage, error) {
+	query := `
+		WITH m AS (
+			UPDATE document_messages
+			SET text = $3, edited_at = $4
+			WHERE document_id = $1 AND id = $2
+			RETURNING id, document_id, user_id, text, created_at, edited_at
+		)
+		SELECT ` + messageColumns + `
+		FROM m JOIN users u ON u.id = m.user_id
+	`
+
+	message, err := scanMessage(db.QueryRow(query, documentID, messageID, text, time.Now()))
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	}
+	return message, err
+}
+
+// DeleteDocumentMessage removes a message
+func DeleteDocumentMessage(db *sql.DB, documentID, messageID int) error {
+	query := `DELETE FROM document_messages WHERE document_id = $1 AND id = $2`
+
+	result, err := db.Exec(query, documentID, messageID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrMessageNotFound
+	}
+
+	return nil
+}
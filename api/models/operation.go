@@ -0,0 +1,92 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// DocumentOperation is one accepted edit in a document's append-only operation log
+type DocumentOperation struct {
+	ID         int       `json:"id"`
+	DocumentID int       `json:"document_id"`
+	Revision   int64     `json:"revision"` // revision the document reached by applying this edit
+	UserID     int       `json:"user_id"`
+	Operation  string    `json:"operation"` // OT operation (JSON) applied to the document at Revision-1
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// AppendDocumentOperations records accepted edits, each at its own revision and time. Revisions
+// already logged are skipped, so a batch that partly failed can simply be written again.
+func AppendDocumentOperations(db *sql.DB, documentID int, operations []DocumentOperation) error {
+	query := `
+		INSERT INTO document_operations (document_id, revision, user_id, operation, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (document_id, revision) DO NOTHING
+	`
+
+	for _, op := range operations {
+		_, err := db.Exec(query, documentID, op.Revision, op.UserID, op.Operation, op.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDocumentOperations returns the edits with afterRevision < revision <= untilRevision, oldest first.
+// An untilRevision of 0 means no upper bound.
+func GetDocumentOperations(db *sql.DB, documentID int, afterRevision, untilRevision int64) ([]DocumentOperation, error) {
+	query := `
+		SELECT id, document_id, revision, user_id, operation, created_at
+		FROM document_operations
+		WHERE document_id = $1 AND revision > $2 AND ($3 = 0 OR revision <= $3)
+		ORDER BY revision ASC
+	`
+
+	rows, err := db.Query(query, documentID, afterRevision, untilRevision)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	operations := []DocumentOperation{}
+	for rows.Next() {
+		var op DocumentOperation
+		err := rows.Scan(
+			&op.ID,
+			&op.DocumentID,
+			&op.Revision,
+			&op.UserID,
+			&op.Operation,
+			&op.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, op)
+	}
+
+	return operations, nil
+}
+
+// GetLatestOperationRevision returns the highest logged revision of a document (0 if nothing was logged)
+func GetLatestOperationRevision(db *sql.DB, documentID int) (int64, error) {
+	var revision int64
+	query := `SELECT COALESCE(MAX(revision), 0) FROM document_operations WHERE document_id = $1`
+
+	err := db.QueryRow(query, documentID).Scan(&revision)
+	return revision, err
+}
+
+// GetOperationRevisionAt returns the revision a document had at a point in time (0 if before any edit)
+func GetOperationRevisionAt(db *sql.DB, documentID int, at time.Time) (int64, error) {
+	var revision int64
+	query := `
+		SELECT COALESCE(MAX(revision), 0)
+		FROM document_operations
+		WHERE document_id = $1 AND created_at <= $2
+	`
+
+	err := db.QueryRow(query, documentID, at).Scan(&revision)
+	return revision, err
+}
@@ -17,10 +17,19 @@ type User struct {
 	CreatedAt    time.Time `json:"created_at"`
 }
 
+// HashPassword hashes a password for storing in password_hash
+func HashPassword(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashedPassword), nil
+}
+
 // CreateUser creates a new user in the database
 func CreateUser(db *sql.DB, username, email, password string) error {
 	// Hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := HashPassword(password)
 	if err != nil {
 		return err
 	}
@@ -31,7 +40,7 @@ func CreateUser(db *sql.DB, username, email, password string) error {
 		VALUES ($1, $2, $3, $4)
 	`
 
-	_, err = db.Exec(query, username, email, string(hashedPassword), time.Now())
+	_, err = db.Exec(query, username, email, hashedPassword, time.Now())
 	if err != nil {
 		return err
 	}
@@ -87,3 +96,24 @@ func GetUserByUsername(db *sql.DB, username string) (*User, error) {
 
 	return user, nil
 }
+
+// GetUserByID retrieves a user by their ID
+func GetUserByID(db *sql.DB, id int) (*User, error) {
+	user := &User{}
+
+	query := `
+		SELECT id, username, email, password_hash, created_at
+		FROM users
+		WHERE id = $1
+	`
+
+	err := db.QueryRow(query, id).Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("user not found")
+		}
+		return nil, err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,182 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrVersionNotFound is returned when a version lookup matches no rows
+var ErrVersionNotFound = errors.New("version not found")
+
+// Reasons a version snapshot was taken
+const (
+	VersionReasonCreated  = "created"  // initial content when the document was created
+	VersionReasonFlush    = "flush"    // live content was written back to PostgreSQL
+	VersionReasonInterval = "interval" // periodic snapshot during a long editing session
+	VersionReasonRestore  = "restore"  // state just before an older version was restored
+)
+
+// DocumentVersion is a point-in-time snapshot of a document
+type DocumentVersion struct {
+	ID         int       `json:"id"`
+	DocumentID int       `json:"document_id"`
+	Revision   int64     `json:"revision"` // live edit revision the snapshot was taken at
+	Title      string    `json:"title"`
+	Content    string    `json:"content,omitempty"` // left out of version listings
+	CreatedBy  *int      `json:"created_by"`        // nil for automatic snapshots
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// CreateDocumentVersion stores a new snapshot of a document
+func CreateDocumentVersion(db *sql.DB, documentID int, revision int64, title, content string, createdBy *int, reason string) (*DocumentVersion, error) {
+	query := `
+		INSERT INTO document_versions (document_id, revision, title, content, created_by, reason, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, document_id, revision, title, content, created_by, reason, created_at
+	`
+
+	version := &DocumentVersion{}
+	var creator sql.NullInt64
+
+	err := db.QueryRow(query, documentID, revision, title, content, createdBy, reason, time.Now()).Scan(
+		&version.ID,
+		&version.DocumentID,
+		&version.Revision,
+		&version.Title,
+		&version.Content,
+		&creator,
+		&version.Reason,
+		&version.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	version.CreatedBy = nullIntPtr(creator)
+	return version, nil
+}
+
+// GetDocumentVersions lists the snapshots of a document, newest first, without their content
+func GetDocumentVersions(db *sql.DB, documentID int) ([]DocumentVersion, error) {
+	query := `
+		SELECT id, document_id, revision, title, created_by, reason, created_at
+		FROM document_versions
+		WHERE document_id = $1
+		ORDER BY created_at DESC, id DESC
+	`
+
+	rows, err := db.Query(query, documentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []DocumentVersion{}
+	for rows.Next() {
+		var version DocumentVersion
+		var creator sql.NullInt64
+		err := rows.Scan(
+			&version.ID,
+			&version.DocumentID,
+			&version.Revision,
+			&version.Title,
+			&creator,
+			&version.Reason,
+			&version.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		version.CreatedBy = nullIntPtr(creator)
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
+
+// GetDocumentVersion retrieves a single snapshot of a document, including its content
+func GetDocumentVersion(db *sql.DB, documentID, versionID int) (*DocumentVersion, error) {
+	query := `
+		SELECT id, document_id, revision, title, content, created_by, reason, created_at
+		FROM document_versions
+		WHERE document_id = $1 AND id = $2
+	`
+
+	return scanVersion(db.QueryRow(query, documentID, versionID))
+}
+
+// GetLatestDocumentVersion retrieves the most recent snapshot of a document
+func GetLatestDocumentVersion(db *sql.DB, documentID int) (*DocumentVersion, error) {
+	query := `
+		SELECT id, document_id, revision, title, content, created_by, reason, created_at
+		FROM document_versions
+		WHERE document_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT 1
+	`
+
+	return scanVersion(db.QueryRow(query, documentID))
+}
+
+// GetDocumentVersionAtRevision retrieves the most recent snapshot taken at or before a revision
+func GetDocumentVersionAtRevision(db *sql.DB, documentID int, revision int64) (*DocumentVersion, error) {
+	query := `
+		SELECT id, document_id, revision, title, content, created_by, reason, created_at
+		FROM document_versions
+		WHERE document_id = $1 AND revision <= $2
+		ORDER BY revision DESC, id DESC
+		LIMIT 1
+	`
+
+	return scanVersion(db.QueryRow(query, documentID, revision))
+}
+
+// GetEarliestDocumentVersion retrieves the first snapshot of a document
+func GetEarliestDocumentVersion(db *sql.DB, documentID int) (*DocumentVersion, error) {
+	query := `
+		SELECT id, document_id, revision, title, content, created_by, reason, created_at
+		FROM document_versions
+		WHERE document_id = $1
+		ORDER BY revision ASC, id ASC
+		LIMIT 1
+	`
+
+	return scanVersion(db.QueryRow(query, documentID))
+}
+
+// scanVersion reads a full version row
+func scanVersion(row *sql.Row) (*DocumentVersion, error) {
+	version := &DocumentVersion{}
+	var creator sql.NullInt64
+
+	err := row.Scan(
+		&version.ID,
+		&version.DocumentID,
+		&version.Revision,
+		&version.Title,
+		&version.Content,
+		&creator,
+		&version.Reason,
+		&version.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrVersionNotFound
+		}
+		return nil, err
+	}
+
+	version.CreatedBy = nullIntPtr(creator)
+	return version, nil
+}
+
+// nullIntPtr converts a nullable integer column into an optional int
+func nullIntPtr(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	v := int(n.Int64)
+	return &v
+}
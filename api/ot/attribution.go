@@ -0,0 +1,60 @@
+package ot
+
+import "fmt"
+
+// Authors records who wrote each character of a document, one entry per rune.
+// Replaying a document's operations through Apply gives a "blame" view of its current text.
+type Authors []int
+
+// Span is a run of consecutive characters written by the same author
+type Span struct {
+	Start  int `json:"start"`  // rune offset
+	Length int `json:"length"` // in runes
+	Author int `json:"author"`
+}
+
+// NewAuthors attributes every character of an initial document of n runes to one author
+func NewAuthors(n, author int) Authors {
+	authors := make(Authors, n)
+	for i := range authors {
+		authors[i] = author
+	}
+	return authors
+}
+
+// Apply runs an operation over the attribution: retained characters keep their author,
+// inserted ones are credited to the given author and deleted ones disappear.
+func (a Authors) Apply(o *Operation, author int) (Authors, error) {
+	if len(a) != o.BaseLen {
+		return nil, fmt.Errorf("%w: operation expects %d, attribution has %d", ErrLengthMismatch, o.BaseLen, len(a))
+	}
+
+	result := make(Authors, 0, o.TargetLen)
+	pos := 0
+	for _, op := range o.Ops {
+		switch {
+		case op.IsRetain():
+			result = append(result, a[pos:pos+op.Retain]...)
+			pos += op.Retain
+		case op.IsInsert():
+			result = append(result, NewAuthors(len([]rune(op.Insert)), author)...)
+		case op.IsDelete():
+			pos += op.Delete
+		}
+	}
+
+	return result, nil
+}
+
+// Spans groups the attribution into runs of the same author
+func (a Authors) Spans() []Span {
+	spans := []Span{}
+	for i, author := range a {
+		if last := len(spans) - 1; last >= 0 && spans[last].Author == author {
+			spans[last].Length++
+			continue
+		}
+		spans = append(spans, Span{Start: i, Length: 1, Author: author})
+	}
+	return spans
+}
@@ -0,0 +1,216 @@
+// Package ot implements operational transformation for plain text documents.
+//
+// An Operation walks over a document from start to end and is made of three kinds of components:
+// retain (skip n characters), insert (add text) and delete (remove n characters).
+// Lengths are counted in Unicode code points (runes), not bytes.
+//
+// Operations are encoded to JSON the same way as ot.js: a flat array where a positive number
+// is a retain, a negative number is a delete and a string is an insert, e.g. [5, "abc", -2].
+package ot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+// MaxLength is the longest document, in runes, an operation may apply to or produce.
+// Decoded operations are held to it so lengths sent by clients can never overflow.
+const MaxLength = 1 << 24
+
+// ErrLengthMismatch is returned when an operation doesn't fit the document (or operation) it is applied to
+var ErrLengthMismatch = errors.New("ot: operation length does not match document length")
+
+// ErrTooLong is returned when decoding an operation longer than MaxLength
+var ErrTooLong = fmt.Errorf("ot: operation is longer than %d characters", MaxLength)
+
+// Op is a single component of an Operation. Exactly one of the fields is set.
+type Op struct {
+	Retain int
+	Insert string
+	Delete int
+}
+
+// IsRetain reports whether the component skips characters
+func (o Op) IsRetain() bool { return o.Retain > 0 }
+
+// IsInsert reports whether the component inserts text
+func (o Op) IsInsert() bool { return o.Insert != "" }
+
+// IsDelete reports whether the component removes characters
+func (o Op) IsDelete() bool { return o.Delete > 0 }
+
+// Operation is a sequence of components that transforms a document of BaseLen runes
+// into a document of TargetLen runes.
+type Operation struct {
+	Ops       []Op
+	BaseLen   int // length of the document the operation applies to
+	TargetLen int // length of the document after applying it
+}
+
+// New returns an empty operation (a no-op on the empty document)
+func New() *Operation {
+	return &Operation{}
+}
+
+// grow adds n to a length, panicking rather than wrapping around. Operations decoded from
+// clients are limited to MaxLength, so only a bug in the caller can get here.
+func grow(length *int, n int) {
+	if n > math.MaxInt-*length {
+		panic("ot: operation length overflows int")
+	}
+	*length += n
+}
+
+// Retain skips over n characters. Consecutive retains are merged.
+func (o *Operation) Retain(n int) *Operation {
+	if n <= 0 {
+		return o
+	}
+	grow(&o.BaseLen, n)
+	grow(&o.TargetLen, n)
+
+	if last := len(o.Ops) - 1; last >= 0 && o.Ops[last].IsRetain() {
+		o.Ops[last].Retain += n
+		return o
+	}
+	o.Ops = append(o.Ops, Op{Retain: n})
+	return o
+}
+
+// Insert adds text at the current position. Consecutive inserts are merged and
+// an insert is always placed before a delete at the same position, so equal
+// operations always have the same canonical form.
+func (o *Operation) Insert(s string) *Operation {
+	if s == "" {
+		return o
+	}
+	grow(&o.TargetLen, utf8.RuneCountInString(s))
+
+	last := len(o.Ops) - 1
+	switch {
+	case last >= 0 && o.Ops[last].IsInsert():
+		o.Ops[last].Insert += s
+	case last >= 0 && o.Ops[last].IsDelete():
+		// Keep inserts before deletes: "delete then insert" == "insert then delete"
+		if last > 0 && o.Ops[last-1].IsInsert() {
+			o.Ops[last-1].Insert += s
+		} else {
+			o.Ops = append(o.Ops, Op{})
+			copy(o.Ops[last+1:], o.Ops[last:])
+			o.Ops[last] = Op{Insert: s}
+		}
+	default:
+		o.Ops = append(o.Ops, Op{Insert: s})
+	}
+	return o
+}
+
+// Delete removes n characters at the current position. Consecutive deletes are merged.
+func (o *Operation) Delete(n int) *Operation {
+	if n <= 0 {
+		return o
+	}
+	grow(&o.BaseLen, n)
+
+	if last := len(o.Ops) - 1; last >= 0 && o.Ops[last].IsDelete() {
+		o.Ops[last].Delete += n
+		return o
+	}
+	o.Ops = append(o.Ops, Op{Delete: n})
+	return o
+}
+
+// IsNoop reports whether the operation leaves the document unchanged
+func (o *Operation) IsNoop() bool {
+	return len(o.Ops) == 0 || (len(o.Ops) == 1 && o.Ops[0].IsRetain())
+}
+
+// Apply runs the operation on a document and returns the resulting text
+func (o *Operation) Apply(doc string) (string, error) {
+	runes := []rune(doc)
+	if len(runes) != o.BaseLen {
+		return "", fmt.Errorf("%w: operation expects %d, document has %d", ErrLengthMismatch, o.BaseLen, len(runes))
+	}
+
+	result := make([]rune, 0, o.TargetLen)
+	pos := 0
+	for _, op := range o.Ops {
+		// BaseLen was checked above, but components built by hand may not add up to it
+		if op.Retain > len(runes)-pos || op.Delete > len(runes)-pos {
+			return "", fmt.Errorf("%w: operation runs past the end of the document", ErrLengthMismatch)
+		}
+		switch {
+		case op.IsRetain():
+			result = append(result, runes[pos:pos+op.Retain]...)
+			pos += op.Retain
+		case op.IsInsert():
+			result = append(result, []rune(op.Insert)...)
+		case op.IsDelete():
+			pos += op.Delete
+		}
+	}
+
+	return string(result), nil
+}
+
+// MarshalJSON encodes the operation as an ot.js style array
+func (o Operation) MarshalJSON() ([]byte, error) {
+	parts := make([]interface{}, 0, len(o.Ops))
+	for _, op := range o.Ops {
+		switch {
+		case op.IsRetain():
+			parts = append(parts, op.Retain)
+		case op.IsInsert():
+			parts = append(parts, op.Insert)
+		case op.IsDelete():
+			parts = append(parts, -op.Delete)
+		}
+	}
+	return json.Marshal(parts)
+}
+
+// UnmarshalJSON decodes an ot.js style array, rebuilding BaseLen and TargetLen.
+// Operations longer than MaxLength are rejected with ErrTooLong.
+func (o *Operation) UnmarshalJSON(data []byte) error {
+	var parts []interface{}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+
+	decoded := New()
+	for _, part := range parts {
+		switch v := part.(type) {
+		case float64:
+			// Checked as a float first: converting one out of int's range is undefined
+			if v > MaxLength || v < -MaxLength {
+				return ErrTooLong
+			}
+			n := int(v)
+			if float64(n) != v || n == 0 {
+				return fmt.Errorf("ot: invalid component %v", v)
+			}
+			if n > 0 {
+				decoded.Retain(n)
+			} else {
+				decoded.Delete(-n)
+			}
+		case string:
+			if v == "" {
+				return errors.New("ot: empty insert component")
+			}
+			decoded.Insert(v)
+		default:
+			return fmt.Errorf("ot: invalid component %v", v)
+		}
+		// Each component is at most MaxLength, so the totals can't overflow before this catches them
+		if decoded.BaseLen > MaxLength || decoded.TargetLen > MaxLength {
+			return ErrTooLong
+		}
+	}
+
+	*o = *decoded
+	return nil
+}
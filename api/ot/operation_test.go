@@ -0,0 +1,54 @@
+package ot
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// overflowingEdit adds up to zero when the lengths wrap around, and once crashed Apply on an empty document
+const overflowingEdit = `[9223372036854774784,9223372036854774784,-9223372036854774784,-9223372036854774784,4096]`
+
+func TestUnmarshalRejectsOverflowingLengths(t *testing.T) {
+	var o Operation
+	if err := json.Unmarshal([]byte(overflowingEdit), &o); !errors.Is(err, ErrTooLong) {
+		t.Fatalf("decoding %s: expected ErrTooLong, got %v (base %d, target %d)", overflowingEdit, err, o.BaseLen, o.TargetLen)
+	}
+}
+
+func TestUnmarshalRejectsOperationsOverMaxLength(t *testing.T) {
+	for _, input := range []string{
+		`[16777217]`, // one component too long
+		`[-16777217]`,
+		`[16777216, "x"]`,    // the result is too long
+		`[8388608, 8388609]`, // components that only add up to too much
+		`[-8388608, -8388609]`,
+	} {
+		var o Operation
+		if err := json.Unmarshal([]byte(input), &o); !errors.Is(err, ErrTooLong) {
+			t.Errorf("decoding %s: expected ErrTooLong, got %v", input, err)
+		}
+	}
+
+	var o Operation
+	if err := json.Unmarshal([]byte(`[16777215, "x"]`), &o); err != nil {
+		t.Fatalf("decoding an operation of exactly MaxLength: %v", err)
+	}
+}
+
+func TestApplyRejectsComponentsPastTheEnd(t *testing.T) {
+	// Built by hand so the components don't add up to BaseLen
+	o := &Operation{Ops: []Op{{Retain: 5}}, BaseLen: 2, TargetLen: 2}
+	if _, err := o.Apply("ab"); !errors.Is(err, ErrLengthMismatch) {
+		t.Fatalf("applying a retain past the end: expected ErrLengthMismatch, got %v", err)
+	}
+}
+
+func TestBuildersPanicOnOverflow(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("retaining past the largest int didn't panic")
+		}
+	}()
+	New().Retain(int(^uint(0) >> 1)).Retain(1)
+}
@@ -0,0 +1,194 @@
+package ot
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// iterator walks over the components of an operation, letting callers consume
+// part of the current component (needed when components of two operations don't line up).
+type iterator struct {
+	ops  []Op
+	i    int
+	cur  Op
+	done bool
+}
+
+func newIterator(o *Operation) *iterator {
+	it := &iterator{ops: o.Ops}
+	it.next()
+	return it
+}
+
+// next moves on to the following component
+func (it *iterator) next() {
+	if it.i >= len(it.ops) {
+		it.cur = Op{}
+		it.done = true
+		return
+	}
+	it.cur = it.ops[it.i]
+	it.i++
+}
+
+// length is the number of characters the current component covers
+func (it *iterator) length() int {
+	switch {
+	case it.cur.IsRetain():
+		return it.cur.Retain
+	case it.cur.IsDelete():
+		return it.cur.Delete
+	default:
+		return utf8.RuneCountInString(it.cur.Insert)
+	}
+}
+
+// take consumes n characters of the current component and returns them as a component
+func (it *iterator) take(n int) Op {
+	taken := it.cur
+	switch {
+	case it.cur.IsRetain():
+		taken.Retain = n
+		it.cur.Retain -= n
+	case it.cur.IsDelete():
+		taken.Delete = n
+		it.cur.Delete -= n
+	default:
+		runes := []rune(it.cur.Insert)
+		taken.Insert = string(runes[:n])
+		it.cur.Insert = string(runes[n:])
+	}
+
+	if it.length() == 0 {
+		it.next()
+	}
+	return taken
+}
+
+// appendOp adds a component to an operation using the merging builder methods
+func appendOp(o *Operation, op Op) {
+	switch {
+	case op.IsRetain():
+		o.Retain(op.Retain)
+	case op.IsInsert():
+		o.Insert(op.Insert)
+	case op.IsDelete():
+		o.Delete(op.Delete)
+	}
+}
+
+// Compose merges two consecutive operations into one with the same effect:
+// applying Compose(a, b) equals applying a and then b.
+func Compose(a, b *Operation) (*Operation, error) {
+	if a.TargetLen != b.BaseLen {
+		return nil, fmt.Errorf("%w: compose of %d -> %d with %d -> %d",
+			ErrLengthMismatch, a.BaseLen, a.TargetLen, b.BaseLen, b.TargetLen)
+	}
+
+	result := New()
+	it1, it2 := newIterator(a), newIterator(b)
+
+	for !it1.done || !it2.done {
+		// Deletes from a and inserts from b don't interact with the other side
+		if !it1.done && it1.cur.IsDelete() {
+			appendOp(result, it1.take(it1.length()))
+			continue
+		}
+		if !it2.done && it2.cur.IsInsert() {
+			appendOp(result, it2.take(it2.length()))
+			continue
+		}
+		if it1.done || it2.done {
+			return nil, ErrLengthMismatch
+		}
+
+		n := min(it1.length(), it2.length())
+		op1, op2 := it1.take(n), it2.take(n)
+
+		switch {
+		case op1.IsRetain() && op2.IsRetain():
+			result.Retain(n)
+		case op1.IsRetain() && op2.IsDelete():
+			result.Delete(n)
+		case op1.IsInsert() && op2.IsRetain():
+			result.Insert(op1.Insert)
+		case op1.IsInsert() && op2.IsDelete():
+			// b deletes what a inserted: both disappear
+		}
+	}
+
+	return result, nil
+}
+
+// Transform takes two operations made against the same document and returns a' and b'
+// such that applying a then b' gives the same result as applying b then a'.
+// When both insert at the same position, a's text is placed first.
+func Transform(a, b *Operation) (*Operation, *Operation, error) {
+	if a.BaseLen != b.BaseLen {
+		return nil, nil, fmt.Errorf("%w: transform of operations on %d and %d characters",
+			ErrLengthMismatch, a.BaseLen, b.BaseLen)
+	}
+
+	aPrime, bPrime := New(), New()
+	it1, it2 := newIterator(a), newIterator(b)
+
+	for !it1.done || !it2.done {
+		// Inserts go through untouched; the other side just has to skip over them
+		if !it1.done && it1.cur.IsInsert() {
+			op := it1.take(it1.length())
+			aPrime.Insert(op.Insert)
+			bPrime.Retain(utf8.RuneCountInString(op.Insert))
+			continue
+		}
+		if !it2.done && it2.cur.IsInsert() {
+			op := it2.take(it2.length())
+			aPrime.Retain(utf8.RuneCountInString(op.Insert))
+			bPrime.Insert(op.Insert)
+			continue
+		}
+		if it1.done || it2.done {
+			return nil, nil, ErrLengthMismatch
+		}
+
+		n := min(it1.length(), it2.length())
+		op1, op2 := it1.take(n), it2.take(n)
+
+		switch {
+		case op1.IsRetain() && op2.IsRetain():
+			aPrime.Retain(n)
+			bPrime.Retain(n)
+		case op1.IsDelete() && op2.IsRetain():
+			aPrime.Delete(n)
+		case op1.IsRetain() && op2.IsDelete():
+			bPrime.Delete(n)
+		case op1.IsDelete() && op2.IsDelete():
+			// Both deleted the same text: nothing left to do on either side
+		}
+	}
+
+	return aPrime, bPrime, nil
+}
+
+// TransformIndex moves a position in the document (e.g. a cursor) past an operation.
+// Text inserted exactly at the position pushes it to the right.
+func TransformIndex(index int, o *Operation) int {
+	newIndex := index
+	pos := 0
+
+	for _, op := range o.Ops {
+		if pos > index {
+			break
+		}
+		switch {
+		case op.IsRetain():
+			pos += op.Retain
+		case op.IsInsert():
+			newIndex += utf8.RuneCountInString(op.Insert)
+		case op.IsDelete():
+			newIndex -= min(op.Delete, index-pos)
+			pos += op.Delete
+		}
+	}
+
+	return newIndex
+}
@@ -0,0 +1,139 @@
+package ot
+
+import (
+	"math/rand"
+	"testing"
+	"unicode/utf8"
+)
+
+// propertyRuns is how many random cases each property is checked against
+const propertyRuns = 20000
+
+// alphabet mixes one-, two- and three-byte runes so lengths are checked in runes, not bytes
+var alphabet = []rune("abcxyz é日\n")
+
+func randomString(rng *rand.Rand, maxLen int) string {
+	n := rng.Intn(maxLen + 1)
+	runes := make([]rune, n)
+	for i := range runes {
+		runes[i] = alphabet[rng.Intn(len(alphabet))]
+	}
+	return string(runes)
+}
+
+// randomOperation returns a random operation that applies to a document of docLen runes
+func randomOperation(rng *rand.Rand, docLen int) *Operation {
+	o := New()
+	for remaining := docLen; remaining > 0; {
+		n := rng.Intn(remaining) + 1
+		switch rng.Intn(3) {
+		case 0:
+			o.Retain(n)
+			remaining -= n
+		case 1:
+			o.Delete(n)
+			remaining -= n
+		case 2:
+			o.Insert(randomString(rng, 4))
+		}
+	}
+	if rng.Intn(2) == 0 {
+		o.Insert(randomString(rng, 4))
+	}
+	return o
+}
+
+func mustApply(t *testing.T, o *Operation, doc string) string {
+	t.Helper()
+	result, err := o.Apply(doc)
+	if err != nil {
+		t.Fatalf("apply %v to %q: %v", o.Ops, doc, err)
+	}
+	return result
+}
+
+func TestTransformConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < propertyRuns; i++ {
+		doc := randomString(rng, 12)
+		docLen := utf8.RuneCountInString(doc)
+		a, b := randomOperation(rng, docLen), randomOperation(rng, docLen)
+
+		aPrime, bPrime, err := Transform(a, b)
+		if err != nil {
+			t.Fatalf("transform %v and %v: %v", a.Ops, b.Ops, err)
+		}
+
+		viaA := mustApply(t, bPrime, mustApply(t, a, doc))
+		viaB := mustApply(t, aPrime, mustApply(t, b, doc))
+		if viaA != viaB {
+			t.Fatalf("diverged on %q with a=%v b=%v: a,b' gives %q but b,a' gives %q", doc, a.Ops, b.Ops, viaA, viaB)
+		}
+	}
+}
+
+func TestComposeMatchesSequentialApply(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+
+	for i := 0; i < propertyRuns; i++ {
+		doc := randomString(rng, 12)
+		a := randomOperation(rng, utf8.RuneCountInString(doc))
+		b := randomOperation(rng, a.TargetLen)
+
+		composed, err := Compose(a, b)
+		if err != nil {
+			t.Fatalf("compose %v and %v: %v", a.Ops, b.Ops, err)
+		}
+
+		want := mustApply(t, b, mustApply(t, a, doc))
+		if got := mustApply(t, composed, doc); got != want {
+			t.Fatalf("compose of a=%v b=%v on %q gives %q, applying them in turn gives %q", a.Ops, b.Ops, doc, got, want)
+		}
+		if composed.BaseLen != a.BaseLen || composed.TargetLen != b.TargetLen {
+			t.Fatalf("compose of %d -> %d and %d -> %d is %d -> %d",
+				a.BaseLen, a.TargetLen, b.BaseLen, b.TargetLen, composed.BaseLen, composed.TargetLen)
+		}
+	}
+}
+
+// TestTransformIndexMatchesTransform checks a cursor against a one-rune insert at the same place:
+// transforming that insert over an operation must put it where TransformIndex moves the cursor.
+func TestTransformIndexMatchesTransform(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+
+	for i := 0; i < propertyRuns; i++ {
+		docLen := rng.Intn(13)
+		o := randomOperation(rng, docLen)
+		index := rng.Intn(docLen + 1)
+
+		marker := New().Retain(index).Insert("|").Retain(docLen - index)
+		// o comes first, so text it inserts at the cursor ends up before the marker
+		_, markerPrime, err := Transform(o, marker)
+		if err != nil {
+			t.Fatalf("transform %v and %v: %v", o.Ops, marker.Ops, err)
+		}
+
+		want := 0
+		for _, op := range markerPrime.Ops {
+			if op.IsInsert() {
+				break
+			}
+			want += op.Retain
+		}
+
+		if got := TransformIndex(index, o); got != want {
+			t.Fatalf("TransformIndex(%d, %v) = %d, transform puts the insert at %d", index, o.Ops, got, want)
+		}
+	}
+}
+
+func TestApplyRejectsLengthMismatch(t *testing.T) {
+	o := New().Retain(3).Insert("x")
+	if _, err := o.Apply("ab"); err == nil {
+		t.Fatal("applying a 3-rune operation to a 2-rune document succeeded")
+	}
+	if _, _, err := Transform(o, New().Retain(2)); err == nil {
+		t.Fatal("transforming operations on different lengths succeeded")
+	}
+}
@@ -0,0 +1,537 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// When Redis goes down the server carries on by itself: the content cache and the cluster fall back to
+// their in-process implementations, and handlers write edits straight to PostgreSQL (see
+// ContentCache.Degraded) since nothing else holds them. Redis is pinged until it answers again; what
+// changed in the meantime is then copied back into it before traffic returns to it.
+
+const (
+	// redisProbeInterval is how often Redis is pinged, to notice it going down or coming back
+	redisProbeInterval = 2 * time.Second
+	// redisProbeTimeout bounds a ping, so a hung Redis counts as down
+	redisProbeTimeout = time.Second
+)
+
+// redisHealth tracks whether Redis is reachable. Cache and cluster calls hold mu for reading while they
+// run, so a re-sync (which holds it for writing) never races with them.
+type redisHealth struct {
+	rdb  *redis.Client
+	up   atomic.Bool
+	mu   sync.RWMutex
+	sync []func() // run under mu when Redis comes back, before it is marked up
+}
+
+func newRedisHealth(rdb *redis.Client) *redisHealth {
+	h := &redisHealth{rdb: rdb}
+	h.up.Store(h.ping() == nil)
+	if !h.up.Load() {
+		log.Println("[Redis] Unavailable, using the in-process cache until it comes back")
+	}
+	return h
+}
+
+func (h *redisHealth) ping() error {
+	probeCtx, cancel := context.WithTimeout(ctx, redisProbeTimeout)
+	defer cancel()
+	return h.rdb.Ping(probeCtx).Err()
+}
+
+// onRecover registers a re-sync to run when Redis comes back
+func (h *redisHealth) onRecover(fn func()) {
+	h.sync = append(h.sync, fn)
+}
+
+// failed reports whether err means Redis can't be reached, marking it down if so. redis.Nil (a
+// missing key) and errors Redis itself replied with don't count.
+func (h *redisHealth) failed(err error) bool {
+	if err == nil || errors.Is(err, redis.Nil) {
+		return false
+	}
+	var replyErr redis.Error
+	if errors.As(err, &replyErr) {
+		return false
+	}
+	if h.up.CompareAndSwap(true, false) {
+		log.Printf("[Redis] Unavailable (%v), falling back to the in-process cache", err)
+	}
+	return true
+}
+
+// watch pings Redis in the background for as long as the process runs
+func (h *redisHealth) watch() {
+	go func() {
+		ticker := time.NewTicker(redisProbeInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			err := h.ping()
+			if h.up.Load() {
+				h.failed(err)
+				continue
+			}
+			if err != nil {
+				continue
+			}
+
+			h.mu.Lock()
+			for _, fn := range h.sync {
+				fn()
+			}
+			h.up.Store(true)
+			h.mu.Unlock()
+			log.Println("[Redis] Available again, re-synced and switched back from the in-process cache")
+		}
+	}()
+}
+
+// fallbackCache is the ContentCache of production: Redis while it is up, this server's memory while it isn't
+type fallbackCache struct {
+	health  *redisHealth
+	primary *redisCache
+	local   *memoryCache
+
+	mu      sync.Mutex
+	touched map[int]bool // documents written to local while Redis was down
+}
+
+func newFallbackCache(primary *redisCache, health *redisHealth) *fallbackCache {
+	c := &fallbackCache{health: health, primary: primary, local: newMemoryCache(), touched: make(map[int]bool)}
+	health.onRecover(c.resync)
+	return c
+}
+
+// usePrimary locks out re-syncs for the duration of a call and reports whether Redis should be tried.
+// The caller must call done.
+func (c *fallbackCache) usePrimary() bool {
+	c.health.mu.RLock()
+	return c.health.up.Load()
+}
+
+func (c *fallbackCache) done() {
+	c.health.mu.RUnlock()
+}
+
+// touch records that a document changed in the local cache, to copy it to Redis later
+func (c *fallbackCache) touch(documentID int) {
+	c.mu.Lock()
+	c.touched[documentID] = true
+	c.mu.Unlock()
+}
+
+func (c *fallbackCache) Degraded() bool {
+	return !c.health.up.Load()
+}
+
+func (c *fallbackCache) GetContent(documentID int) (string, int64, bool, error) {
+	defer c.done()
+	if c.usePrimary() {
+		content, revision, found, err := c.primary.GetContent(documentID)
+		if !c.health.failed(err) {
+			return content, revision, found, err
+		}
+	}
+	return c.local.GetContent(documentID)
+}
+
+func (c *fallbackCache) SaveContent(documentID int, content string, revision int64, edit *CachedEdit) error {
+	defer c.done()
+	if c.usePrimary() {
+		if err := c.primary.SaveContent(documentID, content, revision, edit); !c.health.failed(err) {
+			return err
+		}
+	}
+	c.touch(documentID)
+	return c.local.SaveContent(documentID, content, revision, edit)
+}
+
+func (c *fallbackCache) GetRevision(documentID int) (int64, bool, error) {
+	defer c.done()
+	if c.usePrimary() {
+		revision, found, err := c.primary.GetRevision(documentID)
+		if !c.health.failed(err) {
+			return revision, found, err
+		}
+	}
+	return c.local.GetRevision(documentID)
+}
+
+func (c *fallbackCache) History(documentID int, count int64) ([][]byte, error) {
+	defer c.done()
+	if c.usePrimary() {
+		entries, err := c.primary.History(documentID, count)
+		if !c.health.failed(err) {
+			return entries, err
+		}
+	}
+	return c.local.History(documentID, count)
+}
+
+func (c *fallbackCache) FillContent(documentID int, content string, revision int64) (bool, error) {
+	defer c.done()
+	if c.usePrimary() {
+		stored, err := c.primary.FillContent(documentID, content, revision)
+		if !c.health.failed(err) {
+			return stored, err
+		}
+	}
+	c.touch(documentID)
+	return c.local.FillContent(documentID, content, revision)
+}
+
+func (c *fallbackCache) GetCRDT(documentID int) ([]byte, int64, bool, error) {
+	defer c.done()
+	if c.usePrimary() {
+		state, revision, found, err := c.primary.GetCRDT(documentID)
+		if !c.health.failed(err) {
+			return state, revision, found, err
+		}
+	}
+	return c.local.GetCRDT(documentID)
+}
+
+func (c *fallbackCache) SaveCRDT(documentID int, state []byte, text string, revision int64, edit *CachedEdit) error {
+	defer c.done()
+	if c.usePrimary() {
+		if err := c.primary.SaveCRDT(documentID, state, text, revision, edit); !c.health.failed(err) {
+			return err
+		}
+	}
+	c.touch(documentID)
+	return c.local.SaveCRDT(documentID, state, text, revision, edit)
+}
+
+func (c *fallbackCache) PendingOperations(documentID int) ([][]byte, error) {
+	defer c.done()
+	if c.usePrimary() {
+		entries, err := c.primary.PendingOperations(documentID)
+		if !c.health.failed(err) {
+			return entries, err
+		}
+	}
+	return c.local.PendingOperations(documentID)
+}
+
+func (c *fallbackCache) ForgetOperations(documentID int, revision int64) error {
+	defer c.done()
+	if c.usePrimary() {
+		if err := c.primary.ForgetOperations(documentID, revision); !c.health.failed(err) {
+			return err
+		}
+	}
+	return c.local.ForgetOperations(documentID, revision)
+}
+
+func (c *fallbackCache) Evict(documentID int) error {
+	defer c.done()
+	if c.usePrimary() {
+		if err := c.primary.Evict(documentID); !c.health.failed(err) {
+			return err
+		}
+	}
+	c.touch(documentID) // Redis may still hold an older copy
+	return c.local.Evict(documentID)
+}
+
+func (c *fallbackCache) MarkDirty(documentID int) error {
+	defer c.done()
+	if c.usePrimary() {
+		if err := c.primary.MarkDirty(documentID); !c.health.failed(err) {
+			return err
+		}
+	}
+	c.touch(documentID)
+	return c.local.MarkDirty(documentID)
+}
+
+func (c *fallbackCache) ClearDirty(documentID int, revision int64) error {
+	defer c.done()
+	if c.usePrimary() {
+		if err := c.primary.ClearDirty(documentID, revision); !c.health.failed(err) {
+			return err
+		}
+	}
+	return c.local.ClearDirty(documentID, revision)
+}
+
+func (c *fallbackCache) DueDocuments(idleBefore, dirtyBefore time.Time) ([]int, error) {
+	defer c.done()
+	if c.usePrimary() {
+		due, err := c.primary.DueDocuments(idleBefore, dirtyBefore)
+		if !c.health.failed(err) {
+			return due, err
+		}
+	}
+	return c.local.DueDocuments(idleBefore, dirtyBefore)
+}
+
+func (c *fallbackCache) UnflushedDocuments() ([]int, error) {
+	defer c.done()
+	if c.usePrimary() {
+		pending, err := c.primary.UnflushedDocuments()
+		if !c.health.failed(err) {
+			return pending, err
+		}
+	}
+	return c.local.UnflushedDocuments()
+}
+
+func (c *fallbackCache) EditRevision(documentID, userID int, messageID string) (int64, bool) {
+	defer c.done()
+	if c.usePrimary() {
+		revision, err := c.primary.rdb.HGet(ctx, seenKey(documentID), seenField(userID, messageID)).Int64()
+		if !c.health.failed(err) {
+			return revision, err == nil
+		}
+	}
+	return c.local.EditRevision(documentID, userID, messageID)
+}
+
+func (c *fallbackCache) FirstDelivery(documentID, userID int, messageID string) (bool, error) {
+	defer c.done()
+	if c.usePrimary() {
+		added, err := c.primary.FirstDelivery(documentID, userID, messageID)
+		if !c.health.failed(err) {
+			return added, err
+		}
+	}
+	c.touch(documentID)
+	return c.local.FirstDelivery(documentID, userID, messageID)
+}
+
+func (c *fallbackCache) ForgetDelivery(documentID, userID int, messageID string) error {
+	defer c.done()
+	if c.usePrimary() {
+		if err := c.primary.ForgetDelivery(documentID, userID, messageID); !c.health.failed(err) {
+			return err
+		}
+	}
+	return c.local.ForgetDelivery(documentID, userID, messageID)
+}
+
+// resync copies what changed locally while Redis was down back into it, then empties the local cache
+func (c *fallbackCache) resync() {
+	c.mu.Lock()
+	touched := c.touched
+	c.touched = make(map[int]bool)
+	c.mu.Unlock()
+
+	for documentID := range touched {
+		doc, dirty, seen := c.local.snapshot(documentID)
+		if err := c.primary.restore(documentID, doc, dirty, seen); err != nil {
+			log.Printf("[Redis] Failed to re-sync document %d: %v", documentID, err)
+		}
+	}
+	c.local = newMemoryCache()
+}
+
+// fallbackCluster is the Cluster of production: shared through Redis while it is up, limited to this
+// server while it isn't. Presence written during an outage reaches Redis with the next refresh.
+type fallbackCluster struct {
+	health  *redisHealth
+	primary *redisCluster
+	local   *memoryCluster
+
+	mu         sync.Mutex
+	subscribed map[int]bool // documents this server wants events for
+	onPrimary  map[int]bool // documents subscribed to on Redis
+	events     chan ClusterEvent
+	once       sync.Once
+}
+
+func newFallbackCluster(primary *redisCluster, health *redisHealth) *fallbackCluster {
+	c := &fallbackCluster{
+		health:     health,
+		primary:    primary,
+		local:      newMemoryCluster(),
+		subscribed: make(map[int]bool),
+		onPrimary:  make(map[int]bool),
+		events:     make(chan ClusterEvent, 100),
+	}
+	health.onRecover(c.resubscribe)
+	return c
+}
+
+func (c *fallbackCluster) usePrimary() bool {
+	c.health.mu.RLock()
+	return c.health.up.Load()
+}
+
+func (c *fallbackCluster) done() {
+	c.health.mu.RUnlock()
+}
+
+func (c *fallbackCluster) Publish(documentID int, data []byte) error {
+	defer c.done()
+	if c.usePrimary() {
+		if err := c.primary.Publish(documentID, data); !c.health.failed(err) {
+			return err
+		}
+	}
+	return c.local.Publish(documentID, data)
+}
+
+func (c *fallbackCluster) Subscribe(documentID int) error {
+	defer c.done()
+	primary := c.usePrimary()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.subscribed[documentID] = true
+	c.local.Subscribe(documentID)
+	if primary {
+		err := c.primary.Subscribe(documentID)
+		if !c.health.failed(err) {
+			c.onPrimary[documentID] = err == nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *fallbackCluster) Unsubscribe(documentID int) error {
+	defer c.done()
+	primary := c.usePrimary()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.subscribed, documentID)
+	c.local.Unsubscribe(documentID)
+	if primary {
+		err := c.primary.Unsubscribe(documentID)
+		if !c.health.failed(err) {
+			if err == nil {
+				delete(c.onPrimary, documentID)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// resubscribe brings the Redis subscriptions in line with the rooms open now
+func (c *fallbackCluster) resubscribe() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for documentID := range c.subscribed {
+		if !c.onPrimary[documentID] && c.primary.Subscribe(documentID) == nil {
+			c.onPrimary[documentID] = true
+		}
+	}
+	for documentID := range c.onPrimary {
+		if !c.subscribed[documentID] && c.primary.Unsubscribe(documentID) == nil {
+			delete(c.onPrimary, documentID)
+		}
+	}
+}
+
+func (c *fallbackCluster) Events() <-chan ClusterEvent {
+	c.once.Do(func() {
+		for _, source := range []<-chan ClusterEvent{c.primary.Events(), c.local.Events()} {
+			go func(source <-chan ClusterEvent) {
+				for event := range source {
+					c.events <- event
+				}
+			}(source)
+		}
+	})
+	return c.events
+}
+
+func (c *fallbackCluster) AddPresence(documentID int, entry PresenceEntry, status string, ttl time.Duration) (int, error) {
+	defer c.done()
+	if c.usePrimary() {
+		count, err := c.primary.AddPresence(documentID, entry, status, ttl)
+		if !c.health.failed(err) {
+			return count, err
+		}
+	}
+	return c.local.AddPresence(documentID, entry, status, ttl)
+}
+
+func (c *fallbackCluster) RemovePresence(documentID int, entry PresenceEntry) (int, error) {
+	defer c.done()
+	if c.usePrimary() {
+		count, err := c.primary.RemovePresence(documentID, entry)
+		if !c.health.failed(err) {
+			return count, err
+		}
+	}
+	return c.local.RemovePresence(documentID, entry)
+}
+
+func (c *fallbackCluster) RefreshPresence(entries map[int][]PresenceEntry, ttl time.Duration) error {
+	defer c.done()
+	if c.usePrimary() {
+		if err := c.primary.RefreshPresence(entries, ttl); !c.health.failed(err) {
+			return err
+		}
+	}
+	return c.local.RefreshPresence(entries, ttl)
+}
+
+func (c *fallbackCluster) Presence(documentID int) ([]PresenceEntry, error) {
+	defer c.done()
+	if c.usePrimary() {
+		entries, err := c.primary.Presence(documentID)
+		if !c.health.failed(err) {
+			return entries, err
+		}
+	}
+	return c.local.Presence(documentID)
+}
+
+func (c *fallbackCluster) SetStatus(documentID int, session, status string) error {
+	defer c.done()
+	if c.usePrimary() {
+		if err := c.primary.SetStatus(documentID, session, status); !c.health.failed(err) {
+			return err
+		}
+	}
+	return c.local.SetStatus(documentID, session, status)
+}
+
+func (c *fallbackCluster) Statuses(documentID int) (map[string]string, error) {
+	defer c.done()
+	if c.usePrimary() {
+		statuses, err := c.primary.Statuses(documentID)
+		if !c.health.failed(err) {
+			return statuses, err
+		}
+	}
+	return c.local.Statuses(documentID)
+}
+
+func (c *fallbackCluster) AcquireLease(documentID int, token string, ttl time.Duration) (bool, error) {
+	defer c.done()
+	if c.usePrimary() {
+		ok, err := c.primary.AcquireLease(documentID, token, ttl)
+		if !c.health.failed(err) {
+			return ok, err
+		}
+	}
+	return c.local.AcquireLease(documentID, token, ttl)
+}
+
+func (c *fallbackCluster) ReleaseLease(documentID int, token string) error {
+	defer c.done()
+	if c.usePrimary() {
+		if err := c.primary.ReleaseLease(documentID, token); !c.health.failed(err) {
+			return err
+		}
+	}
+	return c.local.ReleaseLease(documentID, token)
+}
@@ -0,0 +1,642 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"minidocs/api/models"
+)
+
+// memoryStore keeps records in maps, with the same results (and errors) as the PostgreSQL queries in
+// models: foreign keys cascade, IDs count up from 1 and lists come back in the same order. Records are
+// copied in and out so callers never share them.
+type memoryStore struct {
+	mu sync.RWMutex
+
+	users      map[int]models.User
+	documents  map[int]models.Document
+	crdtStates map[int][]byte
+	shares     map[int]map[int]bool // document ID -> user IDs
+	versions   []models.DocumentVersion
+	operations []models.DocumentOperation
+	messages   []models.DocumentMessage
+
+	lastUserID      int
+	lastDocumentID  int
+	lastVersionID   int
+	lastOperationID int
+	lastMessageID   int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:      make(map[int]models.User),
+		documents:  make(map[int]models.Document),
+		crdtStates: make(map[int][]byte),
+		shares:     make(map[int]map[int]bool),
+	}
+}
+
+func (s *memoryStore) CreateUser(username, email, password string) error {
+	hashedPassword, err := models.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if user.Username == username || user.Email == email {
+			return errors.New("user already exists")
+		}
+	}
+	s.lastUserID++
+	s.users[s.lastUserID] = models.User{
+		ID:           s.lastUserID,
+		Username:     username,
+		Email:        email,
+		PasswordHash: hashedPassword,
+		CreatedAt:    time.Now(),
+	}
+	return nil
+}
+
+func (s *memoryStore) findUser(match func(models.User) bool) *models.User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if match(user) {
+			return &user
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) GetUserByEmail(email string) (*models.User, error) {
+	user := s.findUser(func(u models.User) bool { return u.Email == email })
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	return user, nil
+}
+
+func (s *memoryStore) GetUserByUsername(username string) (*models.User, error) {
+	return s.findUser(func(u models.User) bool { return u.Username == username }), nil
+}
+
+func (s *memoryStore) GetUserByID(id int) (*models.User, error) {
+	user := s.findUser(func(u models.User) bool { return u.ID == id })
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	return user, nil
+}
+
+func (s *memoryStore) CreateDocument(title, content string, ownerID int) (*models.Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[ownerID]; !ok {
+		return nil, errors.New("owner does not exist")
+	}
+	now := time.Now()
+	s.lastDocumentID++
+	doc := models.Document{
+		ID:        s.lastDocumentID,
+		Title:     title,
+		Content:   content,
+		OwnerID:   ownerID,
+		SyncMode:  models.SyncModeOT,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	s.documents[doc.ID] = doc
+	return &doc, nil
+}
+
+// sortByUpdated orders documents most recently updated first
+func sortByUpdated(documents []models.Document) {
+	sort.SliceStable(documents, func(i, j int) bool { return documents[i].UpdatedAt.After(documents[j].UpdatedAt) })
+}
+
+func (s *memoryStore) GetDocumentsByOwner(ownerID int) ([]models.Document, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	documents := []models.Document{}
+	for _, doc := range s.documents {
+		if doc.OwnerID == ownerID && doc.DeletedAt == nil {
+			documents = append(documents, doc)
+		}
+	}
+	sortByUpdated(documents)
+	return documents, nil
+}
+
+// liveDocument returns a document unless it doesn't exist or is in the trash. The caller must hold s.mu.
+func (s *memoryStore) liveDocument(id int) (models.Document, bool) {
+	doc, ok := s.documents[id]
+	return doc, ok && doc.DeletedAt == nil
+}
+
+func (s *memoryStore) GetDocumentByID(id int) (*models.Document, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	doc, ok := s.liveDocument(id)
+	if !ok {
+		return nil, models.ErrDocumentNotFound
+	}
+	return &doc, nil
+}
+
+func (s *memoryStore) UpdateDocument(id int, title, content string) (*models.Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, ok := s.liveDocument(id)
+	if !ok {
+		return nil, models.ErrDocumentNotFound
+	}
+	doc.Title = title
+	doc.Content = content
+	doc.UpdatedAt = time.Now()
+	s.documents[id] = doc
+	return &doc, nil
+}
+
+func (s *memoryStore) SaveDocumentContent(id int, content string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, ok := s.liveDocument(id)
+	if !ok {
+		return models.ErrDocumentNotFound
+	}
+	doc.Content = content
+	doc.UpdatedAt = time.Now()
+	s.documents[id] = doc
+	return nil
+}
+
+func (s *memoryStore) SetDocumentSyncMode(id int, mode string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, ok := s.liveDocument(id)
+	if !ok {
+		return models.ErrDocumentNotFound
+	}
+	doc.SyncMode = mode
+	s.documents[id] = doc
+	return nil
+}
+
+func (s *memoryStore) DeleteDocument(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, ok := s.liveDocument(id)
+	if !ok {
+		return models.ErrDocumentNotFound
+	}
+	now := time.Now()
+	doc.DeletedAt = &now
+	s.documents[id] = doc
+	return nil
+}
+
+// sortByDeleted orders documents most recently deleted first
+func sortByDeleted(documents []models.Document) {
+	sort.SliceStable(documents, func(i, j int) bool { return documents[i].DeletedAt.After(*documents[j].DeletedAt) })
+}
+
+func (s *memoryStore) GetDeletedDocuments(ownerID int) ([]models.Document, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	documents := []models.Document{}
+	for _, doc := range s.documents {
+		if doc.OwnerID == ownerID && doc.DeletedAt != nil {
+			documents = append(documents, doc)
+		}
+	}
+	sortByDeleted(documents)
+	return documents, nil
+}
+
+func (s *memoryStore) GetDeletedDocumentByID(id int) (*models.Document, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	doc, ok := s.documents[id]
+	if !ok || doc.DeletedAt == nil {
+		return nil, models.ErrDocumentNotFound
+	}
+	return &doc, nil
+}
+
+func (s *memoryStore) RestoreDocument(id int) (*models.Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, ok := s.documents[id]
+	if !ok || doc.DeletedAt == nil {
+		return nil, models.ErrDocumentNotFound
+	}
+	doc.DeletedAt = nil
+	s.documents[id] = doc
+	return &doc, nil
+}
+
+func (s *memoryStore) PurgeDocument(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, ok := s.documents[id]
+	if !ok || doc.DeletedAt == nil {
+		return models.ErrDocumentNotFound
+	}
+	s.purge(id)
+	return nil
+}
+
+func (s *memoryStore) PurgeDeletedDocuments(deletedBefore time.Time) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []int
+	for id, doc := range s.documents {
+		if doc.DeletedAt != nil && doc.DeletedAt.Before(deletedBefore) {
+			s.purge(id)
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// purge removes a document for good. The caller must hold s.mu.
+func (s *memoryStore) purge(id int) {
+	// Everything that references the document goes with it, like ON DELETE CASCADE
+	delete(s.documents, id)
+	delete(s.crdtStates, id)
+	delete(s.shares, id)
+	s.versions = removeWhere(s.versions, func(v models.DocumentVersion) bool { return v.DocumentID == id })
+	s.operations = removeWhere(s.operations, func(o models.DocumentOperation) bool { return o.DocumentID == id })
+	s.messages = removeWhere(s.messages, func(m models.DocumentMessage) bool { return m.DocumentID == id })
+}
+
+// removeWhere drops the items of a slice that match
+func removeWhere[T any](items []T, match func(T) bool) []T {
+	kept := items[:0]
+	for _, item := range items {
+		if !match(item) {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+func (s *memoryStore) GetCRDTState(documentID int) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	state, ok := s.crdtStates[documentID]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte(nil), state...), nil
+}
+
+func (s *memoryStore) SaveCRDTState(documentID int, state []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.documents[documentID]; !ok {
+		return models.ErrDocumentNotFound
+	}
+	s.crdtStates[documentID] = append([]byte(nil), state...)
+	return nil
+}
+
+func (s *memoryStore) DeleteCRDTState(documentID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.crdtStates, documentID)
+	return nil
+}
+
+func (s *memoryStore) ShareDocument(documentID, sharedWithUserID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.documents[documentID]; !ok {
+		return models.ErrDocumentNotFound
+	}
+	if _, ok := s.users[sharedWithUserID]; !ok {
+		return errors.New("user not found")
+	}
+	if s.shares[documentID] == nil {
+		s.shares[documentID] = make(map[int]bool)
+	}
+	s.shares[documentID][sharedWithUserID] = true
+	return nil
+}
+
+func (s *memoryStore) UnshareDocument(documentID, sharedWithUserID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.shares[documentID][sharedWithUserID] {
+		return models.ErrShareNotFound
+	}
+	delete(s.shares[documentID], sharedWithUserID)
+	return nil
+}
+
+func (s *memoryStore) IsDocumentSharedWithUser(documentID, userID int) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.shares[documentID][userID], nil
+}
+
+func (s *memoryStore) GetSharedDocuments(userID int) ([]models.Document, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var documents []models.Document
+	for documentID, users := range s.shares {
+		if doc, ok := s.liveDocument(documentID); ok && users[userID] {
+			documents = append(documents, doc)
+		}
+	}
+	sortByUpdated(documents)
+	return documents, nil
+}
+
+func (s *memoryStore) CreateDocumentVersion(documentID int, revision int64, title, content string, createdBy *int, reason string) (*models.DocumentVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.documents[documentID]; !ok {
+		return nil, models.ErrDocumentNotFound
+	}
+	s.lastVersionID++
+	version := models.DocumentVersion{
+		ID:         s.lastVersionID,
+		DocumentID: documentID,
+		Revision:   revision,
+		Title:      title,
+		Content:    content,
+		CreatedBy:  copyIntPtr(createdBy),
+		Reason:     reason,
+		CreatedAt:  time.Now(),
+	}
+	s.versions = append(s.versions, version)
+	return &version, nil
+}
+
+func copyIntPtr(n *int) *int {
+	if n == nil {
+		return nil
+	}
+	v := *n
+	return &v
+}
+
+// documentVersions returns copies of a document's versions, oldest first
+func (s *memoryStore) documentVersions(documentID int) []models.DocumentVersion {
+	versions := []models.DocumentVersion{}
+	for _, version := range s.versions {
+		if version.DocumentID == documentID {
+			version.CreatedBy = copyIntPtr(version.CreatedBy)
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
+
+func (s *memoryStore) GetDocumentVersions(documentID int) ([]models.DocumentVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := s.documentVersions(documentID)
+	for i := range versions {
+		versions[i].Content = ""
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].ID > versions[j].ID })
+	return versions, nil
+}
+
+// findVersion returns the first of a document's versions, ordered by less, that matches
+func (s *memoryStore) findVersion(documentID int, match func(models.DocumentVersion) bool, less func(a, b models.DocumentVersion) bool) (*models.DocumentVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := s.documentVersions(documentID)
+	sort.SliceStable(versions, func(i, j int) bool { return less(versions[i], versions[j]) })
+	for _, version := range versions {
+		if match(version) {
+			return &version, nil
+		}
+	}
+	return nil, models.ErrVersionNotFound
+}
+
+func newestFirst(a, b models.DocumentVersion) bool { return a.ID > b.ID }
+
+func (s *memoryStore) GetDocumentVersion(documentID, versionID int) (*models.DocumentVersion, error) {
+	return s.findVersion(documentID, func(v models.DocumentVersion) bool { return v.ID == versionID }, newestFirst)
+}
+
+func (s *memoryStore) GetLatestDocumentVersion(documentID int) (*models.DocumentVersion, error) {
+	return s.findVersion(documentID, func(models.DocumentVersion) bool { return true }, newestFirst)
+}
+
+func (s *memoryStore) GetDocumentVersionAtRevision(documentID int, revision int64) (*models.DocumentVersion, error) {
+	return s.findVersion(documentID,
+		func(v models.DocumentVersion) bool { return v.Revision <= revision },
+		func(a, b models.DocumentVersion) bool {
+			if a.Revision != b.Revision {
+				return a.Revision > b.Revision
+			}
+			return a.ID > b.ID
+		})
+}
+
+func (s *memoryStore) GetEarliestDocumentVersion(documentID int) (*models.DocumentVersion, error) {
+	return s.findVersion(documentID,
+		func(models.DocumentVersion) bool { return true },
+		func(a, b models.DocumentVersion) bool {
+			if a.Revision != b.Revision {
+				return a.Revision < b.Revision
+			}
+			return a.ID < b.ID
+		})
+}
+
+func (s *memoryStore) AppendDocumentOperations(documentID int, operations []models.DocumentOperation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.documents[documentID]; !ok {
+		return models.ErrDocumentNotFound
+	}
+	logged := make(map[int64]bool)
+	for _, op := range s.operations {
+		if op.DocumentID == documentID {
+			logged[op.Revision] = true
+		}
+	}
+	for _, op := range operations {
+		if logged[op.Revision] {
+			continue
+		}
+		logged[op.Revision] = true
+		s.lastOperationID++
+		op.ID = s.lastOperationID
+		op.DocumentID = documentID
+		s.operations = append(s.operations, op)
+	}
+	return nil
+}
+
+func (s *memoryStore) GetDocumentOperations(documentID int, afterRevision, untilRevision int64) ([]models.DocumentOperation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	operations := []models.DocumentOperation{}
+	for _, op := range s.operations {
+		if op.DocumentID == documentID && op.Revision > afterRevision && (untilRevision == 0 || op.Revision <= untilRevision) {
+			operations = append(operations, op)
+		}
+	}
+	sort.SliceStable(operations, func(i, j int) bool { return operations[i].Revision < operations[j].Revision })
+	return operations, nil
+}
+
+// latestRevision returns the highest logged revision of a document among the operations that match
+func (s *memoryStore) latestRevision(documentID int, match func(models.DocumentOperation) bool) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var revision int64
+	for _, op := range s.operations {
+		if op.DocumentID == documentID && match(op) {
+			revision = max(revision, op.Revision)
+		}
+	}
+	return revision
+}
+
+func (s *memoryStore) GetLatestOperationRevision(documentID int) (int64, error) {
+	return s.latestRevision(documentID, func(models.DocumentOperation) bool { return true }), nil
+}
+
+func (s *memoryStore) GetOperationRevisionAt(documentID int, at time.Time) (int64, error) {
+	return s.latestRevision(documentID, func(op models.DocumentOperation) bool { return !op.CreatedAt.After(at) }), nil
+}
+
+// withUsername returns a copy of a message carrying its author's current username
+func (s *memoryStore) withUsername(message models.DocumentMessage) models.DocumentMessage {
+	message.Username = s.users[message.UserID].Username
+	if message.EditedAt != nil {
+		editedAt := *message.EditedAt
+		message.EditedAt = &editedAt
+	}
+	return message
+}
+
+func (s *memoryStore) CreateDocumentMessage(documentID, userID int, text string) (*models.DocumentMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.documents[documentID]; !ok {
+		return nil, models.ErrDocumentNotFound
+	}
+	if _, ok := s.users[userID]; !ok {
+		return nil, errors.New("user not found")
+	}
+	s.lastMessageID++
+	message := models.DocumentMessage{
+		ID:         s.lastMessageID,
+		DocumentID: documentID,
+		UserID:     userID,
+		Text:       text,
+		CreatedAt:  time.Now(),
+	}
+	s.messages = append(s.messages, message)
+	message = s.withUsername(message)
+	return &message, nil
+}
+
+func (s *memoryStore) GetDocumentMessages(documentID, beforeID, limit int) ([]models.DocumentMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Messages are appended with increasing IDs, so walking backwards gives newest first
+	messages := []models.DocumentMessage{}
+	for i := len(s.messages) - 1; i >= 0 && len(messages) < limit; i-- {
+		message := s.messages[i]
+		if message.DocumentID == documentID && (beforeID == 0 || message.ID < beforeID) {
+			messages = append(messages, s.withUsername(message))
+		}
+	}
+	return messages, nil
+}
+
+// messageIndex returns the position of a message in s.messages, or -1
+func (s *memoryStore) messageIndex(documentID, messageID int) int {
+	for i, message := range s.messages {
+		if message.DocumentID == documentID && message.ID == messageID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryStore) GetDocumentMessage(documentID, messageID int) (*models.DocumentMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.messageIndex(documentID, messageID)
+	if i < 0 {
+		return nil, models.ErrMessageNotFound
+	}
+	message := s.withUsername(s.messages[i])
+	return &message, nil
+}
+
+func (s *memoryStore) UpdateDocumentMessage(documentID, messageID int, text string) (*models.DocumentMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.messageIndex(documentID, messageID)
+	if i < 0 {
+		return nil, models.ErrMessageNotFound
+	}
+	now := time.Now()
+	s.messages[i].Text = text
+	s.messages[i].EditedAt = &now
+	message := s.withUsername(s.messages[i])
+	return &message, nil
+}
+
+func (s *memoryStore) DeleteDocumentMessage(documentID, messageID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.messageIndex(documentID, messageID)
+	if i < 0 {
+		return models.ErrMessageNotFound
+	}
+	s.messages = append(s.messages[:i], s.messages[i+1:]...)
+	return nil
+}
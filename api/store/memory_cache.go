@@ -0,0 +1,532 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// cachedDocument is what memoryCache holds for a document being edited
+type cachedDocument struct {
+	content  string
+	revision int64
+	history  [][]byte
+	crdt     []byte // nil unless the document is in "crdt" sync mode
+	hasCRDT  bool
+	pending  []pendingOperation
+}
+
+// pendingOperation is an accepted edit not yet written to the operation log
+type pendingOperation struct {
+	revision int64
+	entry    []byte
+}
+
+// dirtyDocument is when a document first became dirty and when it was last edited
+type dirtyDocument struct {
+	since    time.Time
+	lastEdit time.Time
+}
+
+// memoryCache is a ContentCache for a single server. Nothing expires: documents leave it when they
+// are evicted after being flushed.
+type memoryCache struct {
+	mu        sync.Mutex
+	documents map[int]*cachedDocument
+	dirty     map[int]dirtyDocument
+	seen      map[int]map[string]int64 // document ID -> "{userId}:{messageId}" -> revision (pruned like the Redis hash)
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{
+		documents: make(map[int]*cachedDocument),
+		dirty:     make(map[int]dirtyDocument),
+		seen:      make(map[int]map[string]int64),
+	}
+}
+
+func (c *memoryCache) GetContent(documentID int) (string, int64, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	doc, ok := c.documents[documentID]
+	if !ok {
+		return "", 0, false, nil
+	}
+	return doc.content, doc.revision, true, nil
+}
+
+// document returns a document's entry, creating it if needed. The caller must hold c.mu.
+func (c *memoryCache) document(documentID int) *cachedDocument {
+	doc, ok := c.documents[documentID]
+	if !ok {
+		doc = &cachedDocument{}
+		c.documents[documentID] = doc
+	}
+	return doc
+}
+
+func (c *memoryCache) SaveContent(documentID int, content string, revision int64, edit *CachedEdit) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	doc := c.document(documentID)
+	doc.content = content
+	doc.revision = revision
+	if edit != nil {
+		c.markDirty(documentID)
+		if edit.MessageID != "" {
+			c.seenMessages(documentID)[seenField(edit.UserID, edit.MessageID)] = edit.Revision
+		}
+		for field, seenAt := range c.seen[documentID] {
+			if seenAt < edit.Revision-HistoryLimit {
+				delete(c.seen[documentID], field)
+			}
+		}
+		doc.history = append(doc.history, append([]byte(nil), edit.Entry...))
+		if len(doc.history) > HistoryLimit {
+			doc.history = doc.history[len(doc.history)-HistoryLimit:]
+		}
+		doc.queue(edit)
+	}
+	return nil
+}
+
+// queue adds an edit to the pending operations. Edits are saved under the write lease, so they
+// arrive in revision order.
+func (doc *cachedDocument) queue(edit *CachedEdit) {
+	doc.pending = append(doc.pending, pendingOperation{revision: edit.Revision, entry: append([]byte(nil), edit.Entry...)})
+}
+
+func (c *memoryCache) GetRevision(documentID int) (int64, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	doc, ok := c.documents[documentID]
+	if !ok {
+		return 0, false, nil
+	}
+	return doc.revision, true, nil
+}
+
+func (c *memoryCache) History(documentID int, count int64) ([][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	doc, ok := c.documents[documentID]
+	if !ok {
+		return nil, nil
+	}
+	start := max(0, len(doc.history)-int(count))
+	return append([][]byte(nil), doc.history[start:]...), nil
+}
+
+func (c *memoryCache) FillContent(documentID int, content string, revision int64) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.documents[documentID]; ok {
+		return false, nil
+	}
+	c.documents[documentID] = &cachedDocument{content: content, revision: revision}
+	return true, nil
+}
+
+func (c *memoryCache) GetCRDT(documentID int) ([]byte, int64, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	doc, ok := c.documents[documentID]
+	if !ok || !doc.hasCRDT {
+		return nil, 0, false, nil
+	}
+	return append([]byte(nil), doc.crdt...), doc.revision, true, nil
+}
+
+func (c *memoryCache) SaveCRDT(documentID int, state []byte, text string, revision int64, edit *CachedEdit) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	doc := c.document(documentID)
+	doc.crdt = append([]byte(nil), state...)
+	doc.hasCRDT = true
+	doc.content = text
+	doc.revision = revision
+	if edit != nil {
+		doc.queue(edit)
+	}
+	return nil
+}
+
+func (c *memoryCache) PendingOperations(documentID int) ([][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	doc, ok := c.documents[documentID]
+	if !ok {
+		return nil, nil
+	}
+	entries := make([][]byte, len(doc.pending))
+	for i, pending := range doc.pending {
+		entries[i] = append([]byte(nil), pending.entry...)
+	}
+	return entries, nil
+}
+
+func (c *memoryCache) ForgetOperations(documentID int, revision int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	doc, ok := c.documents[documentID]
+	if !ok {
+		return nil
+	}
+	kept := doc.pending[:0]
+	for _, pending := range doc.pending {
+		if pending.revision > revision {
+			kept = append(kept, pending)
+		}
+	}
+	doc.pending = kept
+	return nil
+}
+
+func (c *memoryCache) Evict(documentID int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.documents, documentID)
+	delete(c.seen, documentID)
+	return nil
+}
+
+// markDirty flags a document as edited now. The caller must hold c.mu.
+func (c *memoryCache) markDirty(documentID int) {
+	now := time.Now()
+	dirty, ok := c.dirty[documentID]
+	if !ok {
+		dirty.since = now
+	}
+	dirty.lastEdit = now
+	c.dirty[documentID] = dirty
+}
+
+func (c *memoryCache) MarkDirty(documentID int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.markDirty(documentID)
+	return nil
+}
+
+func (c *memoryCache) ClearDirty(documentID int, revision int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if doc, ok := c.documents[documentID]; !ok || doc.revision == revision {
+		delete(c.dirty, documentID)
+	}
+	return nil
+}
+
+func (c *memoryCache) DueDocuments(idleBefore, dirtyBefore time.Time) ([]int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var due []int
+	for documentID, dirty := range c.dirty {
+		if !dirty.lastEdit.After(idleBefore) || !dirty.since.After(dirtyBefore) {
+			due = append(due, documentID)
+		}
+	}
+	sort.Ints(due)
+	return due, nil
+}
+
+func (c *memoryCache) UnflushedDocuments() ([]int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending := make(map[int]bool)
+	for documentID := range c.dirty {
+		pending[documentID] = true
+	}
+	for documentID := range c.documents {
+		pending[documentID] = true
+	}
+	ids := make([]int, 0, len(pending))
+	for documentID := range pending {
+		ids = append(ids, documentID)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// seenMessages returns the message IDs recorded for a document. The caller must hold c.mu.
+func (c *memoryCache) seenMessages(documentID int) map[string]int64 {
+	seen, ok := c.seen[documentID]
+	if !ok {
+		seen = make(map[string]int64)
+		c.seen[documentID] = seen
+	}
+	return seen
+}
+
+func (c *memoryCache) EditRevision(documentID, userID int, messageID string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	revision, ok := c.seen[documentID][seenField(userID, messageID)]
+	return revision, ok
+}
+
+func (c *memoryCache) FirstDelivery(documentID, userID int, messageID string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seen := c.seenMessages(documentID)
+	field := seenField(userID, messageID)
+	if _, ok := seen[field]; ok {
+		return false, nil
+	}
+	var revision int64
+	if doc, ok := c.documents[documentID]; ok {
+		revision = doc.revision
+	}
+	seen[field] = revision
+	return true, nil
+}
+
+func (c *memoryCache) ForgetDelivery(documentID, userID int, messageID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.seen[documentID], seenField(userID, messageID))
+	return nil
+}
+
+func (c *memoryCache) Degraded() bool {
+	return false
+}
+
+// snapshot returns a copy of what the cache holds for a document: its cached state (nil if there is
+// none), whether it is dirty and the message IDs it has seen
+func (c *memoryCache) snapshot(documentID int) (*cachedDocument, bool, map[string]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var doc *cachedDocument
+	if cached, ok := c.documents[documentID]; ok {
+		doc = &cachedDocument{
+			content:  cached.content,
+			revision: cached.revision,
+			history:  append([][]byte(nil), cached.history...),
+			crdt:     append([]byte(nil), cached.crdt...),
+			hasCRDT:  cached.hasCRDT,
+			pending:  append([]pendingOperation(nil), cached.pending...),
+		}
+	}
+	_, dirty := c.dirty[documentID]
+	seen := make(map[string]int64, len(c.seen[documentID]))
+	for field, revision := range c.seen[documentID] {
+		seen[field] = revision
+	}
+	return doc, dirty, seen
+}
+
+// presenceRecord is a connection in memoryCluster and when it expires
+type presenceRecord struct {
+	entry   PresenceEntry
+	expires time.Time
+}
+
+// lease is a write lease held in memoryCluster
+type lease struct {
+	token   string
+	expires time.Time
+}
+
+// memoryCluster is a Cluster of one server: events published to a document it is subscribed to come
+// straight back through Events, as they would from Redis
+type memoryCluster struct {
+	mu         sync.Mutex
+	subscribed map[int]bool
+	events     chan ClusterEvent
+	presence   map[int]map[string]presenceRecord // document ID -> session -> connection
+	statuses   map[int]map[string]string         // document ID -> session -> status
+	leases     map[int]lease
+}
+
+func newMemoryCluster() *memoryCluster {
+	return &memoryCluster{
+		subscribed: make(map[int]bool),
+		events:     make(chan ClusterEvent, 100),
+		presence:   make(map[int]map[string]presenceRecord),
+		statuses:   make(map[int]map[string]string),
+		leases:     make(map[int]lease),
+	}
+}
+
+func (c *memoryCluster) Publish(documentID int, data []byte) error {
+	c.mu.Lock()
+	subscribed := c.subscribed[documentID]
+	c.mu.Unlock()
+
+	if subscribed {
+		select {
+		case c.events <- ClusterEvent{DocumentID: documentID, Data: append([]byte(nil), data...)}:
+		default: // nobody is reading; like Redis, drop it rather than block the publisher
+		}
+	}
+	return nil
+}
+
+func (c *memoryCluster) Subscribe(documentID int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.subscribed[documentID] = true
+	return nil
+}
+
+func (c *memoryCluster) Unsubscribe(documentID int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.subscribed, documentID)
+	return nil
+}
+
+func (c *memoryCluster) Events() <-chan ClusterEvent {
+	return c.events
+}
+
+// liveConnections drops a document's expired connections and returns the rest.
+// The caller must hold c.mu.
+func (c *memoryCluster) liveConnections(documentID int) map[string]presenceRecord {
+	connections, ok := c.presence[documentID]
+	if !ok {
+		connections = make(map[string]presenceRecord)
+		c.presence[documentID] = connections
+	}
+	now := time.Now()
+	for session, record := range connections {
+		if record.expires.Before(now) {
+			delete(connections, session)
+		}
+	}
+	return connections
+}
+
+// userConnections counts a user's live connections to a document. The caller must hold c.mu.
+func (c *memoryCluster) userConnections(documentID, userID int) int {
+	count := 0
+	for _, record := range c.liveConnections(documentID) {
+		if record.entry.UserID == userID {
+			count++
+		}
+	}
+	return count
+}
+
+func (c *memoryCluster) AddPresence(documentID int, entry PresenceEntry, status string, ttl time.Duration) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.liveConnections(documentID)[entry.Session()] = presenceRecord{entry: entry, expires: time.Now().Add(ttl)}
+	if c.statuses[documentID] == nil {
+		c.statuses[documentID] = make(map[string]string)
+	}
+	c.statuses[documentID][entry.Session()] = status
+	return c.userConnections(documentID, entry.UserID), nil
+}
+
+func (c *memoryCluster) RemovePresence(documentID int, entry PresenceEntry) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.liveConnections(documentID), entry.Session())
+	delete(c.statuses[documentID], entry.Session())
+	return c.userConnections(documentID, entry.UserID), nil
+}
+
+func (c *memoryCluster) RefreshPresence(entries map[int][]PresenceEntry, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(ttl)
+	for documentID, documentEntries := range entries {
+		connections := c.liveConnections(documentID)
+		for _, entry := range documentEntries {
+			connections[entry.Session()] = presenceRecord{entry: entry, expires: expires}
+		}
+	}
+	return nil
+}
+
+func (c *memoryCluster) Presence(documentID int) ([]PresenceEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	records := make([]presenceRecord, 0)
+	for _, record := range c.liveConnections(documentID) {
+		records = append(records, record)
+	}
+	// Same order as the Redis sorted set: by expiry, then member
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].expires.Equal(records[j].expires) {
+			return records[i].expires.Before(records[j].expires)
+		}
+		return presenceMember(records[i].entry) < presenceMember(records[j].entry)
+	})
+
+	entries := make([]PresenceEntry, len(records))
+	for i, record := range records {
+		entries[i] = record.entry
+	}
+	return entries, nil
+}
+
+func (c *memoryCluster) SetStatus(documentID int, session, status string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.statuses[documentID] == nil {
+		c.statuses[documentID] = make(map[string]string)
+	}
+	c.statuses[documentID][session] = status
+	return nil
+}
+
+func (c *memoryCluster) Statuses(documentID int) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	statuses := make(map[string]string, len(c.statuses[documentID]))
+	for session, status := range c.statuses[documentID] {
+		statuses[session] = status
+	}
+	return statuses, nil
+}
+
+func (c *memoryCluster) AcquireLease(documentID int, token string, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if held, ok := c.leases[documentID]; ok && held.expires.After(now) {
+		return false, nil
+	}
+	c.leases[documentID] = lease{token: token, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (c *memoryCluster) ReleaseLease(documentID int, token string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.leases[documentID].token == token {
+		delete(c.leases, documentID)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"minidocs/api/models"
+)
+
+// postgresStore keeps records in PostgreSQL through the functions in models
+type postgresStore struct {
+	db *sql.DB
+}
+
+func (s *postgresStore) CreateUser(username, email, password string) error {
+	return models.CreateUser(s.db, username, email, password)
+}
+
+func (s *postgresStore) GetUserByEmail(email string) (*models.User, error) {
+	return models.GetUserByEmail(s.db, email)
+}
+
+func (s *postgresStore) GetUserByUsername(username string) (*models.User, error) {
+	return models.GetUserByUsername(s.db, username)
+}
+
+func (s *postgresStore) GetUserByID(id int) (*models.User, error) {
+	return models.GetUserByID(s.db, id)
+}
+
+func (s *postgresStore) CreateDocument(title, content string, ownerID int) (*models.Document, error) {
+	return models.CreateDocument(s.db, title, content, ownerID)
+}
+
+func (s *postgresStore) GetDocumentsByOwner(ownerID int) ([]models.Document, error) {
+	return models.GetDocumentsByOwner(s.db, ownerID)
+}
+
+func (s *postgresStore) GetDocumentByID(id int) (*models.Document, error) {
+	return models.GetDocumentByID(s.db, id)
+}
+
+func (s *postgresStore) UpdateDocument(id int, title, content string) (*models.Document, error) {
+	return models.UpdateDocument(s.db, id, title, content)
+}
+
+func (s *postgresStore) SaveDocumentContent(id int, content string) error {
+	return models.SaveDocumentContent(s.db, id, content)
+}
+
+func (s *postgresStore) SetDocumentSyncMode(id int, mode string) error {
+	return models.SetDocumentSyncMode(s.db, id, mode)
+}
+
+func (s *postgresStore) DeleteDocument(id int) error {
+	return models.DeleteDocument(s.db, id)
+}
+
+func (s *postgresStore) GetDeletedDocuments(ownerID int) ([]models.Document, error) {
+	return models.GetDeletedDocuments(s.db, ownerID)
+}
+
+func (s *postgresStore) GetDeletedDocumentByID(id int) (*models.Document, error) {
+	return models.GetDeletedDocumentByID(s.db, id)
+}
+
+func (s *postgresStore) RestoreDocument(id int) (*models.Document, error) {
+	return models.RestoreDocument(s.db, id)
+}
+
+func (s *postgresStore) PurgeDocument(id int) error {
+	return models.PurgeDocument(s.db, id)
+}
+
+func (s *postgresStore) PurgeDeletedDocuments(deletedBefore time.Time) ([]int, error) {
+	return models.PurgeDeletedDocuments(s.db, deletedBefore)
+}
+
+func (s *postgresStore) GetCRDTState(documentID int) ([]byte, error) {
+	return models.GetCRDTState(s.db, documentID)
+}
+
+func (s *postgresStore) SaveCRDTState(documentID int, state []byte) error {
+	return models.SaveCRDTState(s.db, documentID, state)
+}
+
+func (s *postgresStore) DeleteCRDTState(documentID int) error {
+	return models.DeleteCRDTState(s.db, documentID)
+}
+
+func (s *postgresStore) ShareDocument(documentID, sharedWithUserID int) error {
+	return models.ShareDocument(s.db, documentID, sharedWithUserID)
+}
+
+func (s *postgresStore) UnshareDocument(documentID, sharedWithUserID int) error {
+	return models.UnshareDocument(s.db, documentID, sharedWithUserID)
+}
+
+func (s *postgresStore) IsDocumentSharedWithUser(documentID, userID int) (bool, error) {
+	return models.IsDocumentSharedWithUser(s.db, documentID, userID)
+}
+
+func (s *postgresStore) GetSharedDocuments(userID int) ([]models.Document, error) {
+	return models.GetSharedDocuments(s.db, userID)
+}
+
+func (s *postgresStore) CreateDocumentVersion(documentID int, revision int64, title, content string, createdBy *int, reason string) (*models.DocumentVersion, error) {
+	return models.CreateDocumentVersion(s.db, documentID, revision, title, content, createdBy, reason)
+}
+
+func (s *postgresStore) GetDocumentVersions(documentID int) ([]models.DocumentVersion, error) {
+	return models.GetDocumentVersions(s.db, documentID)
+}
+
+func (s *postgresStore) GetDocumentVersion(documentID, versionID int) (*models.DocumentVersion, error) {
+	return models.GetDocumentVersion(s.db, documentID, versionID)
+}
+
+func (s *postgresStore) GetLatestDocumentVersion(documentID int) (*models.DocumentVersion, error) {
+	return models.GetLatestDocumentVersion(s.db, documentID)
+}
+
+func (s *postgresStore) GetDocumentVersionAtRevision(documentID int, revision int64) (*models.DocumentVersion, error) {
+	return models.GetDocumentVersionAtRevision(s.db, documentID, revision)
+}
+
+func (s *postgresStore) GetEarliestDocumentVersion(documentID int) (*models.DocumentVersion, error) {
+	return models.GetEarliestDocumentVersion(s.db, documentID)
+}
+
+func (s *postgresStore) AppendDocumentOperations(documentID int, operations []models.DocumentOperation) error {
+	return models.AppendDocumentOperations(s.db, documentID, operations)
+}
+
+func (s *postgresStore) GetDocumentOperations(documentID int, afterRevision, untilRevision int64) ([]models.DocumentOperation, error) {
+	return models.GetDocumentOperations(s.db, documentID, afterRevision, untilRevision)
+}
+
+func (s *postgresStore) GetLatestOperationRevision(documentID int) (int64, error) {
+	return models.GetLatestOperationRevision(s.db, documentID)
+}
+
+func (s *postgresStore) GetOperationRevisionAt(documentID int, at time.Time) (int64, error) {
+	return models.GetOperationRevisionAt(s.db, documentID, at)
+}
+
+func (s *postgresStore) CreateDocumentMessage(documentID, userID int, text string) (*models.DocumentMessage, error) {
+	return models.CreateDocumentMessage(s.db, documentID, userID, text)
+}
+
+func (s *postgresStore) GetDocumentMessages(documentID, beforeID, limit int) ([]models.DocumentMessage, error) {
+	return models.GetDocumentMessages(s.db, documentID, beforeID, limit)
+}
+
+func (s *postgresStore) GetDocumentMessage(documentID, messageID int) (*models.DocumentMessage, error) {
+	return models.GetDocumentMessage(s.db, documentID, messageID)
+}
+
+func (s *postgresStore) UpdateDocumentMessage(documentID, messageID int, text string) (*models.DocumentMessage, error) {
+	return models.UpdateDocumentMessage(s.db, documentID, messageID, text)
+}
+
+func (s *postgresStore) DeleteDocumentMessage(documentID, messageID int) error {
+	return models.DeleteDocumentMessage(s.db, documentID, messageID)
+}
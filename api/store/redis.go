@@ -0,0 +1,559 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+var ctx = context.Background()
+
+// contentTTL is how long an idle document stays cached in Redis
+const contentTTL = 24 * time.Hour
+
+// contentKey is the Redis key holding the live content of a document
+func contentKey(documentID int) string {
+	return fmt.Sprintf("doc:%d:content", documentID)
+}
+
+// revisionKey is the Redis key holding the server-authoritative revision of a document.
+// It is bumped by one for every accepted edit and always written together with contentKey.
+func revisionKey(documentID int) string {
+	return fmt.Sprintf("doc:%d:rev", documentID)
+}
+
+// historyKey is the Redis list holding the most recent accepted operations of a document, oldest first.
+// It is trimmed to HistoryLimit entries and used to transform edits made against older revisions.
+func historyKey(documentID int) string {
+	return fmt.Sprintf("doc:%d:history", documentID)
+}
+
+// pendingKey is the Redis sorted set of the accepted operations of a document not yet written to the
+// operation log in PostgreSQL, scored by revision. The flusher writes them before the content and then
+// removes them by revision, so an edit made while it runs stays queued.
+func pendingKey(documentID int) string {
+	return fmt.Sprintf("doc:%d:pending", documentID)
+}
+
+// crdtKey is the Redis key holding the serialised CRDT replica of a document in "crdt" sync mode.
+// contentKey is kept in step with its visible text so flushing and REST reads work unchanged.
+func crdtKey(documentID int) string {
+	return fmt.Sprintf("doc:%d:crdt", documentID)
+}
+
+// seenKey is the Redis hash of client message IDs a document has already processed.
+// Fields are "{userId}:{messageId}"; for edits the value is the revision they produced, for other
+// messages the revision the document was at. Fields more than HistoryLimit revisions old are pruned.
+func seenKey(documentID int) string {
+	return fmt.Sprintf("doc:%d:seen", documentID)
+}
+
+func seenField(userID int, messageID string) string {
+	return fmt.Sprintf("%d:%s", userID, messageID)
+}
+
+// dirtyKey is a Redis sorted set of documents with edits not yet written to PostgreSQL,
+// scored by when they first became dirty (unix ms). Keeping it in Redis means a restarted
+// server still knows what to flush.
+const dirtyKey = "docs:dirty"
+
+// dirtyLastEditKey scores the same documents by their most recent edit, for debouncing
+const dirtyLastEditKey = "docs:dirty:last"
+
+// clearDirtyScript removes a document from the dirty set only if no edit landed after the given
+// revision was flushed (or its cache is already gone), so a concurrent edit is never marked clean
+var clearDirtyScript = redis.NewScript(`
+local rev = redis.call('GET', KEYS[1])
+if rev == false or rev == ARGV[1] then
+	redis.call('ZREM', KEYS[2], ARGV[2])
+	redis.call('ZREM', KEYS[3], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// pruneSeenScript drops the message IDs recorded before revision ARGV[1]. An edit that old can't be
+// transformed any more, so a retransmission of it is refused as stale rather than acknowledged.
+var pruneSeenScript = redis.NewScript(`
+local fields = redis.call('HGETALL', KEYS[1])
+for i = 1, #fields, 2 do
+	if tonumber(fields[i + 1]) < tonumber(ARGV[1]) then
+		redis.call('HDEL', KEYS[1], fields[i])
+	end
+end
+return 0
+`)
+
+// fillContentScript caches a document's content and revision only if it isn't cached yet, dropping any
+// leftover history, so a reader filling the cache can never overwrite an edit made in the meantime
+var fillContentScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('DEL', KEYS[3])
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+redis.call('SET', KEYS[2], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+// redisCache is the ContentCache shared by every server through Redis
+type redisCache struct {
+	rdb *redis.Client
+}
+
+// getWithRevision reads a key along with the document's revision
+func (c *redisCache) getWithRevision(key string, documentID int) (string, int64, bool, error) {
+	values, err := c.rdb.MGet(ctx, key, revisionKey(documentID)).Result()
+	if err != nil {
+		return "", 0, false, err
+	}
+	if values[0] == nil {
+		return "", 0, false, nil
+	}
+	value, _ := values[0].(string)
+	var revision int64
+	if revStr, ok := values[1].(string); ok {
+		revision, _ = strconv.ParseInt(revStr, 10, 64)
+	}
+	return value, revision, true, nil
+}
+
+func (c *redisCache) GetContent(documentID int) (string, int64, bool, error) {
+	return c.getWithRevision(contentKey(documentID), documentID)
+}
+
+func (c *redisCache) SaveContent(documentID int, content string, revision int64, edit *CachedEdit) error {
+	_, err := c.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, contentKey(documentID), content, contentTTL)
+		pipe.Set(ctx, revisionKey(documentID), revision, contentTTL)
+		if edit != nil {
+			markDirty(pipe, documentID)
+			if edit.MessageID != "" {
+				pipe.HSet(ctx, seenKey(documentID), seenField(edit.UserID, edit.MessageID), edit.Revision)
+				pipe.Expire(ctx, seenKey(documentID), contentTTL)
+			}
+			if floor := edit.Revision - HistoryLimit; floor > 0 {
+				pruneSeenScript.Eval(ctx, pipe, []string{seenKey(documentID)}, floor)
+			}
+			pipe.RPush(ctx, historyKey(documentID), edit.Entry)
+			pipe.LTrim(ctx, historyKey(documentID), -HistoryLimit, -1)
+			pipe.Expire(ctx, historyKey(documentID), contentTTL)
+			queueOperation(pipe, documentID, edit)
+		}
+		return nil
+	})
+	return err
+}
+
+// queueOperation queues the commands adding an edit to the pending operations
+func queueOperation(pipe redis.Pipeliner, documentID int, edit *CachedEdit) {
+	pipe.ZAdd(ctx, pendingKey(documentID), redis.Z{Score: float64(edit.Revision), Member: edit.Entry})
+	pipe.Expire(ctx, pendingKey(documentID), contentTTL)
+}
+
+func (c *redisCache) GetRevision(documentID int) (int64, bool, error) {
+	revision, err := c.rdb.Get(ctx, revisionKey(documentID)).Int64()
+	if err == redis.Nil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return revision, true, nil
+}
+
+func (c *redisCache) History(documentID int, count int64) ([][]byte, error) {
+	raw, err := c.rdb.LRange(ctx, historyKey(documentID), -count, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([][]byte, len(raw))
+	for i, item := range raw {
+		entries[i] = []byte(item)
+	}
+	return entries, nil
+}
+
+func (c *redisCache) FillContent(documentID int, content string, revision int64) (bool, error) {
+	keys := []string{contentKey(documentID), revisionKey(documentID), historyKey(documentID)}
+	stored, err := fillContentScript.Run(ctx, c.rdb, keys, content, revision, contentTTL.Milliseconds()).Int()
+	return stored == 1, err
+}
+
+func (c *redisCache) GetCRDT(documentID int) ([]byte, int64, bool, error) {
+	state, revision, found, err := c.getWithRevision(crdtKey(documentID), documentID)
+	return []byte(state), revision, found, err
+}
+
+func (c *redisCache) SaveCRDT(documentID int, state []byte, text string, revision int64, edit *CachedEdit) error {
+	_, err := c.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, crdtKey(documentID), state, contentTTL)
+		pipe.Set(ctx, contentKey(documentID), text, contentTTL)
+		pipe.Set(ctx, revisionKey(documentID), revision, contentTTL)
+		if edit != nil {
+			queueOperation(pipe, documentID, edit)
+		}
+		return nil
+	})
+	return err
+}
+
+func (c *redisCache) PendingOperations(documentID int) ([][]byte, error) {
+	raw, err := c.rdb.ZRange(ctx, pendingKey(documentID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([][]byte, len(raw))
+	for i, item := range raw {
+		entries[i] = []byte(item)
+	}
+	return entries, nil
+}
+
+func (c *redisCache) ForgetOperations(documentID int, revision int64) error {
+	return c.rdb.ZRemRangeByScore(ctx, pendingKey(documentID), "-inf", strconv.FormatInt(revision, 10)).Err()
+}
+
+func (c *redisCache) Evict(documentID int) error {
+	return c.rdb.Del(ctx, contentKey(documentID), revisionKey(documentID), historyKey(documentID), crdtKey(documentID), seenKey(documentID), pendingKey(documentID)).Err()
+}
+
+// markDirty queues the commands flagging a document as having unflushed edits
+func markDirty(pipe redis.Pipeliner, documentID int) {
+	now := float64(time.Now().UnixMilli())
+	member := strconv.Itoa(documentID)
+	pipe.ZAddNX(ctx, dirtyKey, redis.Z{Score: now, Member: member})
+	pipe.ZAdd(ctx, dirtyLastEditKey, redis.Z{Score: now, Member: member})
+}
+
+func (c *redisCache) MarkDirty(documentID int) error {
+	_, err := c.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		markDirty(pipe, documentID)
+		return nil
+	})
+	return err
+}
+
+func (c *redisCache) ClearDirty(documentID int, revision int64) error {
+	keys := []string{revisionKey(documentID), dirtyKey, dirtyLastEditKey}
+	return clearDirtyScript.Run(ctx, c.rdb, keys, revision, documentID).Err()
+}
+
+func (c *redisCache) DueDocuments(idleBefore, dirtyBefore time.Time) ([]int, error) {
+	idle, err := c.rdb.ZRangeByScore(ctx, dirtyLastEditKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(idleBefore.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	overdue, err := c.rdb.ZRangeByScore(ctx, dirtyKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(dirtyBefore.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	return documentIDs(append(idle, overdue...)), nil
+}
+
+func (c *redisCache) UnflushedDocuments() ([]int, error) {
+	members, err := c.rdb.ZRange(ctx, dirtyKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// Plus cached content from before the dirty set existed
+	iter := c.rdb.Scan(ctx, 0, "doc:*:content", 100).Iterator()
+	for iter.Next(ctx) {
+		var documentID int
+		if _, err := fmt.Sscanf(iter.Val(), "doc:%d:content", &documentID); err == nil {
+			members = append(members, strconv.Itoa(documentID))
+		}
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("[Redis] Failed to scan cached documents: %v", err)
+	}
+	return documentIDs(members), nil
+}
+
+// documentIDs parses sorted set members into document IDs, dropping duplicates
+func documentIDs(members []string) []int {
+	seen := make(map[int]bool, len(members))
+	ids := make([]int, 0, len(members))
+	for _, member := range members {
+		documentID, err := strconv.Atoi(member)
+		if err != nil || seen[documentID] {
+			continue
+		}
+		seen[documentID] = true
+		ids = append(ids, documentID)
+	}
+	return ids
+}
+
+func (c *redisCache) EditRevision(documentID, userID int, messageID string) (int64, bool) {
+	revision, err := c.rdb.HGet(ctx, seenKey(documentID), seenField(userID, messageID)).Int64()
+	if err != nil {
+		return 0, false
+	}
+	return revision, true
+}
+
+func (c *redisCache) FirstDelivery(documentID, userID int, messageID string) (bool, error) {
+	// Recorded at the current revision so the ID is pruned along with the edits of its time
+	revision, _, err := c.GetRevision(documentID)
+	if err != nil {
+		return false, err
+	}
+	added, err := c.rdb.HSetNX(ctx, seenKey(documentID), seenField(userID, messageID), revision).Result()
+	if err != nil {
+		return false, err
+	}
+	c.rdb.Expire(ctx, seenKey(documentID), contentTTL)
+	return added, nil
+}
+
+func (c *redisCache) ForgetDelivery(documentID, userID int, messageID string) error {
+	return c.rdb.HDel(ctx, seenKey(documentID), seenField(userID, messageID)).Err()
+}
+
+func (c *redisCache) Degraded() bool {
+	return false
+}
+
+// restore writes back a document cached elsewhere while Redis was unreachable. A newer revision
+// already in Redis is kept; with no cached state (doc is nil) Redis's copy is dropped, since PostgreSQL
+// has been written to since.
+func (c *redisCache) restore(documentID int, doc *cachedDocument, dirty bool, seen map[string]int64) error {
+	if doc != nil {
+		revision, found, err := c.GetRevision(documentID)
+		if err != nil {
+			return err
+		}
+		if found && revision > doc.revision {
+			doc = nil
+			dirty = false
+		}
+	}
+
+	_, err := c.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if doc == nil {
+			pipe.Del(ctx, contentKey(documentID), revisionKey(documentID), historyKey(documentID), crdtKey(documentID), pendingKey(documentID))
+		} else {
+			pipe.Set(ctx, contentKey(documentID), doc.content, contentTTL)
+			pipe.Set(ctx, revisionKey(documentID), doc.revision, contentTTL)
+			pipe.Del(ctx, historyKey(documentID), crdtKey(documentID))
+			if len(doc.history) > 0 {
+				entries := make([]interface{}, len(doc.history))
+				for i, entry := range doc.history {
+					entries[i] = entry
+				}
+				pipe.RPush(ctx, historyKey(documentID), entries...)
+				pipe.Expire(ctx, historyKey(documentID), contentTTL)
+			}
+			if doc.hasCRDT {
+				pipe.Set(ctx, crdtKey(documentID), doc.crdt, contentTTL)
+			}
+			for _, pending := range doc.pending {
+				queueOperation(pipe, documentID, &CachedEdit{Revision: pending.revision, Entry: pending.entry})
+			}
+		}
+		if dirty {
+			markDirty(pipe, documentID)
+		}
+		for field, revision := range seen {
+			pipe.HSet(ctx, seenKey(documentID), field, revision)
+		}
+		if len(seen) > 0 {
+			pipe.Expire(ctx, seenKey(documentID), contentTTL)
+		}
+		return nil
+	})
+	return err
+}
+
+// documentChannel is the Redis pub/sub channel carrying a document's room events between servers
+func documentChannel(documentID int) string {
+	return fmt.Sprintf("doc:%d:events", documentID)
+}
+
+// presenceKey is the Redis sorted set of everyone connected to a document on any server.
+// Members are "{node}|{connection}|{userId}|{username}", scored by when they expire (unix ms).
+func presenceKey(documentID int) string {
+	return fmt.Sprintf("doc:%d:presence", documentID)
+}
+
+// statusKey is the Redis hash of the status of every connection to a document, by session
+func statusKey(documentID int) string {
+	return fmt.Sprintf("doc:%d:status", documentID)
+}
+
+// writeLeaseKey is the Redis key holding the token of the server currently allowed to change a document
+func writeLeaseKey(documentID int) string {
+	return fmt.Sprintf("doc:%d:lease", documentID)
+}
+
+// presenceMember is the presence set entry of a connection
+func presenceMember(entry PresenceEntry) string {
+	return fmt.Sprintf("%s|%s|%d|%s", entry.Node, entry.ConnID, entry.UserID, entry.Username)
+}
+
+// releaseLeaseScript deletes a lease only if it is still held with the given token
+var releaseLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// countUserConnections is the end of the presence scripts: it returns how many live connections the
+// user ARGV[4] has in the presence set KEYS[1]
+const countUserConnections = `
+local count = 0
+for _, member in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+	if string.match(member, '^[^|]*|[^|]*|([^|]*)|') == ARGV[4] then
+		count = count + 1
+	end
+end
+return count
+`
+
+// addPresenceScript adds a connection to the presence set, dropping expired ones, records its status
+// and returns the user's connection count, all in one step so concurrent tabs agree on who came first
+var addPresenceScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[3])
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[5], ARGV[6])
+redis.call('PEXPIRE', KEYS[2], ARGV[7])
+` + countUserConnections)
+
+// removePresenceScript removes a connection from the presence set and returns how many the user has left
+var removePresenceScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[3])
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[5])
+` + countUserConnections)
+
+// redisCluster stitches servers together through Redis pub/sub, sorted sets and keys with a TTL
+type redisCluster struct {
+	rdb    *redis.Client
+	pubsub *redis.PubSub
+
+	once   sync.Once
+	events chan ClusterEvent
+}
+
+func newRedisCluster(rdb *redis.Client) *redisCluster {
+	return &redisCluster{rdb: rdb, pubsub: rdb.Subscribe(ctx), events: make(chan ClusterEvent, 100)}
+}
+
+func (c *redisCluster) Publish(documentID int, data []byte) error {
+	return c.rdb.Publish(ctx, documentChannel(documentID), data).Err()
+}
+
+func (c *redisCluster) Subscribe(documentID int) error {
+	return c.pubsub.Subscribe(ctx, documentChannel(documentID))
+}
+
+func (c *redisCluster) Unsubscribe(documentID int) error {
+	return c.pubsub.Unsubscribe(ctx, documentChannel(documentID))
+}
+
+func (c *redisCluster) Events() <-chan ClusterEvent {
+	c.once.Do(func() {
+		go func() {
+			// The channel survives reconnects; go-redis re-subscribes for us
+			for msg := range c.pubsub.Channel() {
+				var documentID int
+				if _, err := fmt.Sscanf(msg.Channel, "doc:%d:events", &documentID); err != nil {
+					continue
+				}
+				c.events <- ClusterEvent{DocumentID: documentID, Data: []byte(msg.Payload)}
+			}
+		}()
+	})
+	return c.events
+}
+
+func (c *redisCluster) AddPresence(documentID int, entry PresenceEntry, status string, ttl time.Duration) (int, error) {
+	now := time.Now()
+	return addPresenceScript.Run(ctx, c.rdb,
+		[]string{presenceKey(documentID), statusKey(documentID)},
+		presenceMember(entry), now.Add(ttl).UnixMilli(), now.UnixMilli(), entry.UserID,
+		entry.Session(), status, ttl.Milliseconds(),
+	).Int()
+}
+
+func (c *redisCluster) RemovePresence(documentID int, entry PresenceEntry) (int, error) {
+	return removePresenceScript.Run(ctx, c.rdb,
+		[]string{presenceKey(documentID), statusKey(documentID)},
+		presenceMember(entry), "", time.Now().UnixMilli(), entry.UserID, entry.Session(), // ARGV[2] is unused
+	).Int()
+}
+
+func (c *redisCluster) RefreshPresence(entries map[int][]PresenceEntry, ttl time.Duration) error {
+	expires := float64(time.Now().Add(ttl).UnixMilli())
+	_, err := c.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for documentID, documentEntries := range entries {
+			for _, entry := range documentEntries {
+				pipe.ZAdd(ctx, presenceKey(documentID), redis.Z{Score: expires, Member: presenceMember(entry)})
+			}
+			pipe.Expire(ctx, presenceKey(documentID), ttl)
+			pipe.Expire(ctx, statusKey(documentID), ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+func (c *redisCluster) Presence(documentID int) ([]PresenceEntry, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	// Drop entries left behind by servers that died without cleaning up
+	c.rdb.ZRemRangeByScore(ctx, presenceKey(documentID), "-inf", "("+now)
+
+	members, err := c.rdb.ZRangeByScore(ctx, presenceKey(documentID), &redis.ZRangeBy{
+		Min: now,
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]PresenceEntry, 0, len(members))
+	for _, member := range members {
+		parts := strings.SplitN(member, "|", 4)
+		if len(parts) != 4 {
+			continue
+		}
+		userID, err := strconv.Atoi(parts[2])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, PresenceEntry{Node: parts[0], ConnID: parts[1], UserID: userID, Username: parts[3]})
+	}
+	return entries, nil
+}
+
+func (c *redisCluster) SetStatus(documentID int, session, status string) error {
+	return c.rdb.HSet(ctx, statusKey(documentID), session, status).Err()
+}
+
+func (c *redisCluster) Statuses(documentID int) (map[string]string, error) {
+	return c.rdb.HGetAll(ctx, statusKey(documentID)).Result()
+}
+
+func (c *redisCluster) AcquireLease(documentID int, token string, ttl time.Duration) (bool, error) {
+	return c.rdb.SetNX(ctx, writeLeaseKey(documentID), token, ttl).Result()
+}
+
+func (c *redisCluster) ReleaseLease(documentID int, token string) error {
+	return releaseLeaseScript.Run(ctx, c.rdb, []string{writeLeaseKey(documentID)}, token).Err()
+}
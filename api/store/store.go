@@ -0,0 +1,236 @@
+// Package store defines where the API keeps its data: the durable records in PostgreSQL (users,
+// documents, shares, versions, the operation log and chat) and the short-lived state that servers
+// share while documents are being edited (cached content, presence, write leases and cross-server
+// events, in Redis). Handlers only see the interfaces below, so the whole API can also run against
+// the in-memory implementation in memory.go, in tests with httptest.
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"minidocs/api/models"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// HistoryLimit is how many recent operations the content cache keeps per document
+const HistoryLimit = 500
+
+// UserStore holds user accounts
+type UserStore interface {
+	CreateUser(username, email, password string) error
+	GetUserByEmail(email string) (*models.User, error)
+	GetUserByUsername(username string) (*models.User, error) // nil, nil if nobody has it
+	GetUserByID(id int) (*models.User, error)
+}
+
+// DocumentStore holds documents and the saved CRDT replicas of those in "crdt" sync mode. Deleted
+// documents stay in the trash until they are restored or purged; only the trash methods see them.
+type DocumentStore interface {
+	CreateDocument(title, content string, ownerID int) (*models.Document, error)
+	GetDocumentsByOwner(ownerID int) ([]models.Document, error)
+	GetDocumentByID(id int) (*models.Document, error)
+	UpdateDocument(id int, title, content string) (*models.Document, error)
+	SaveDocumentContent(id int, content string) error // leaves the title as it is
+	SetDocumentSyncMode(id int, mode string) error
+	DeleteDocument(id int) error // moves the document to the trash
+
+	GetDeletedDocuments(ownerID int) ([]models.Document, error)
+	GetDeletedDocumentByID(id int) (*models.Document, error)
+	RestoreDocument(id int) (*models.Document, error)
+	PurgeDocument(id int) error
+	PurgeDeletedDocuments(deletedBefore time.Time) ([]int, error) // returns the IDs purged
+
+	GetCRDTState(documentID int) ([]byte, error) // nil, nil if the document has none
+	SaveCRDTState(documentID int, state []byte) error
+	DeleteCRDTState(documentID int) error
+}
+
+// ShareStore holds who documents are shared with
+type ShareStore interface {
+	ShareDocument(documentID, sharedWithUserID int) error
+	UnshareDocument(documentID, sharedWithUserID int) error
+	IsDocumentSharedWithUser(documentID, userID int) (bool, error)
+	GetSharedDocuments(userID int) ([]models.Document, error)
+}
+
+// VersionStore holds version history snapshots
+type VersionStore interface {
+	CreateDocumentVersion(documentID int, revision int64, title, content string, createdBy *int, reason string) (*models.DocumentVersion, error)
+	GetDocumentVersions(documentID int) ([]models.DocumentVersion, error)
+	GetDocumentVersion(documentID, versionID int) (*models.DocumentVersion, error)
+	GetLatestDocumentVersion(documentID int) (*models.DocumentVersion, error)
+	GetDocumentVersionAtRevision(documentID int, revision int64) (*models.DocumentVersion, error)
+	GetEarliestDocumentVersion(documentID int) (*models.DocumentVersion, error)
+}
+
+// OperationStore holds the append-only log of accepted edits
+type OperationStore interface {
+	AppendDocumentOperations(documentID int, operations []models.DocumentOperation) error
+	GetDocumentOperations(documentID int, afterRevision, untilRevision int64) ([]models.DocumentOperation, error)
+	GetLatestOperationRevision(documentID int) (int64, error)
+	GetOperationRevisionAt(documentID int, at time.Time) (int64, error)
+}
+
+// MessageStore holds document chat
+type MessageStore interface {
+	CreateDocumentMessage(documentID, userID int, text string) (*models.DocumentMessage, error)
+	GetDocumentMessages(documentID, beforeID, limit int) ([]models.DocumentMessage, error)
+	GetDocumentMessage(documentID, messageID int) (*models.DocumentMessage, error)
+	UpdateDocumentMessage(documentID, messageID int, text string) (*models.DocumentMessage, error)
+	DeleteDocumentMessage(documentID, messageID int) error
+}
+
+// CachedEdit is the accepted edit that produced the content being saved to the cache
+type CachedEdit struct {
+	UserID    int
+	MessageID string // client message ID, recorded so a retransmission is recognised; may be empty
+	Revision  int64
+	Entry     []byte // the operation, appended to the document's history and its pending operations
+}
+
+// ContentCache holds the live state of the documents being edited, shared by every server. Edited
+// documents are marked dirty until their content has been written back to the DocumentStore.
+type ContentCache interface {
+	// GetContent returns the cached content and revision of a document; found is false on a miss
+	GetContent(documentID int) (content string, revision int64, found bool, err error)
+	// SaveContent caches content and its revision and, if edit is set, in the same step appends the
+	// edit to the history (trimmed to HistoryLimit) and to the pending operations, records its message
+	// ID and marks the document dirty
+	SaveContent(documentID int, content string, revision int64, edit *CachedEdit) error
+	// GetRevision returns the cached revision of a document
+	GetRevision(documentID int) (revision int64, found bool, err error)
+	// History returns the last count history entries of a document, oldest first (fewer if some were lost)
+	History(documentID int, count int64) ([][]byte, error)
+	// FillContent caches content and its revision read from the database, unless the document is
+	// already cached: another server may have cached newer edits meanwhile. Any history left over from
+	// an earlier session is dropped. It reports whether the content was stored.
+	FillContent(documentID int, content string, revision int64) (bool, error)
+	// GetCRDT returns the cached CRDT replica of a document and its revision
+	GetCRDT(documentID int) (state []byte, revision int64, found bool, err error)
+	// SaveCRDT caches a CRDT replica along with its visible text (as the content) and revision and, if
+	// edit is set, appends the edit to the pending operations in the same step
+	SaveCRDT(documentID int, state []byte, text string, revision int64, edit *CachedEdit) error
+	// PendingOperations returns the entries of the edits not yet written to the OperationStore, oldest first
+	PendingOperations(documentID int) ([][]byte, error)
+	// ForgetOperations drops the pending operations up to and including revision, once they are logged
+	ForgetOperations(documentID int, revision int64) error
+	// Evict drops everything cached about a document's content
+	Evict(documentID int) error
+
+	// MarkDirty flags a document as having edits not yet written back
+	MarkDirty(documentID int) error
+	// ClearDirty marks a document clean after revision was written back, unless a later edit was
+	// cached in the meantime
+	ClearDirty(documentID int, revision int64) error
+	// DueDocuments returns the dirty documents last edited before idleBefore or dirty since before dirtyBefore
+	DueDocuments(idleBefore, dirtyBefore time.Time) ([]int, error)
+	// UnflushedDocuments returns every document that is dirty or has cached content
+	UnflushedDocuments() ([]int, error)
+
+	// EditRevision returns the revision produced by the edit a client sent with messageID, if it was applied
+	EditRevision(documentID, userID int, messageID string) (int64, bool)
+	// FirstDelivery records a non-edit message ID and reports whether it was new
+	FirstDelivery(documentID, userID int, messageID string) (bool, error)
+	// ForgetDelivery removes a message ID recorded by FirstDelivery
+	ForgetDelivery(documentID, userID int, messageID string) error
+
+	// Degraded reports whether the cache is only holding documents for this server, because the shared
+	// cache is unreachable. Edits must then be written to the database as they happen.
+	Degraded() bool
+}
+
+// PresenceEntry is one connection to a document, on any server
+type PresenceEntry struct {
+	Node     string
+	ConnID   string
+	UserID   int
+	Username string
+}
+
+// Session identifies the connection across the cluster
+func (e PresenceEntry) Session() string {
+	return e.Node + "|" + e.ConnID
+}
+
+// ClusterEvent is an event published to a document's channel by a server
+type ClusterEvent struct {
+	DocumentID int
+	Data       []byte
+}
+
+// Cluster is what API servers share to serve the same documents: a channel of events per document,
+// who is connected to each document and with what status, and a write lease per document
+type Cluster interface {
+	// Publish sends an event to every server subscribed to the document, this one included
+	Publish(documentID int, data []byte) error
+	Subscribe(documentID int) error
+	Unsubscribe(documentID int) error
+	// Events delivers the events of the documents this server is subscribed to
+	Events() <-chan ClusterEvent
+
+	// AddPresence records a connection and its status for ttl, and returns how many live
+	// connections its user now has to the document
+	AddPresence(documentID int, entry PresenceEntry, status string, ttl time.Duration) (int, error)
+	// RemovePresence withdraws a connection and returns how many its user has left
+	RemovePresence(documentID int, entry PresenceEntry) (int, error)
+	// RefreshPresence extends the connections of this server, by document, for another ttl
+	RefreshPresence(entries map[int][]PresenceEntry, ttl time.Duration) error
+	// Presence returns the live connections to a document
+	Presence(documentID int) ([]PresenceEntry, error)
+	// SetStatus stores the status of a connection, by session
+	SetStatus(documentID int, session, status string) error
+	// Statuses returns the status of every connection to a document, by session
+	Statuses(documentID int) (map[string]string, error)
+
+	// AcquireLease takes a document's write lease for ttl if nobody holds it
+	AcquireLease(documentID int, token string, ttl time.Duration) (bool, error)
+	// ReleaseLease gives the lease back if it is still held with token
+	ReleaseLease(documentID int, token string) error
+}
+
+// Store is everything the handlers read and write
+type Store struct {
+	Users      UserStore
+	Documents  DocumentStore
+	Shares     ShareStore
+	Versions   VersionStore
+	Operations OperationStore
+	Messages   MessageStore
+	Cache      ContentCache
+	Cluster    Cluster
+}
+
+// New returns the production store: records in PostgreSQL, live state in Redis (or in this process
+// while Redis is unreachable)
+func New(db *sql.DB, rdb *redis.Client) *Store {
+	records := &postgresStore{db: db}
+	health := newRedisHealth(rdb)
+	health.watch()
+	return &Store{
+		Users:      records,
+		Documents:  records,
+		Shares:     records,
+		Versions:   records,
+		Operations: records,
+		Messages:   records,
+		Cache:      newFallbackCache(&redisCache{rdb: rdb}, health),
+		Cluster:    newFallbackCluster(newRedisCluster(rdb), health),
+	}
+}
+
+// NewMemory returns a store that keeps everything in this process, for tests
+func NewMemory() *Store {
+	records := newMemoryStore()
+	return &Store{
+		Users:      records,
+		Documents:  records,
+		Shares:     records,
+		Versions:   records,
+		Operations: records,
+		Messages:   records,
+		Cache:      newMemoryCache(),
+		Cluster:    newMemoryCluster(),
+	}
+}
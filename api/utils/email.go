@@ -2,12 +2,25 @@ package utils
 
 import (
 	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"time"
 
 	"gopkg.in/gomail.v2"
 )
 
+// emailSinkDir is where emails are written instead of being sent, when set (see UseEmailSink)
+var emailSinkDir string
+
+// UseEmailSink makes emails get written to .eml files in dir instead of being sent over SMTP,
+// for running the API without an email account
+func UseEmailSink(dir string) {
+	emailSinkDir = dir
+}
+
 // SendInviteEmail sends a document invitation email
 func SendInviteEmail(recipientEmail, recipientName, documentTitle, inviteURL, senderName string) error {
 	// Email configuration from environment variables
@@ -16,12 +29,6 @@ func SendInviteEmail(recipientEmail, recipientName, documentTitle, inviteURL, se
 	smtpUser := os.Getenv("SMTP_USER")
 	smtpPass := os.Getenv("SMTP_PASS")
 
-	// Convert port to int
-	smtpPort, err := strconv.Atoi(smtpPortStr)
-	if err != nil {
-		return fmt.Errorf("invalid SMTP port: %v", err)
-	}
-
 	// Create message
 	m := gomail.NewMessage()
 	m.SetHeader("From", smtpUser)
@@ -51,6 +58,20 @@ func SendInviteEmail(recipientEmail, recipientName, documentTitle, inviteURL, se
 
 	m.SetBody("text/html", body)
 
+	if emailSinkDir != "" {
+		// There may be no SMTP account at all when emails only go to disk
+		if smtpUser == "" {
+			m.SetHeader("From", "noreply@cowrite.local")
+		}
+		return writeEmailToSink(m, recipientEmail)
+	}
+
+	// Convert port to int
+	smtpPort, err := strconv.Atoi(smtpPortStr)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP port: %v", err)
+	}
+
 	// Send email
 	d := gomail.NewDialer(smtpHost, smtpPort, smtpUser, smtpPass)
 	d.SSL = false
@@ -61,3 +82,27 @@ func SendInviteEmail(recipientEmail, recipientName, documentTitle, inviteURL, se
 
 	return nil
 }
+
+// unsafeFileChars matches what shouldn't go in a file name
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9@._-]+`)
+
+// writeEmailToSink writes an email to a new .eml file in emailSinkDir
+func writeEmailToSink(m *gomail.Message, recipientEmail string) error {
+	if err := os.MkdirAll(emailSinkDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create email sink: %v", err)
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000"), unsafeFileChars.ReplaceAllString(recipientEmail, "_"))
+	path := filepath.Join(emailSinkDir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to write email: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := m.WriteTo(file); err != nil {
+		return fmt.Errorf("failed to write email: %v", err)
+	}
+	log.Printf("[Email] Wrote email to %s to %s", recipientEmail, path)
+	return nil
+}
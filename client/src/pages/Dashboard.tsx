@@ -1,5 +1,5 @@
 import { useState, useEffect } from 'react';
-import { documentService, type Document } from '../services/documentService';
+import { documentService, type Document, type DocumentPresence } from '../services/documentService';
 import { authService } from '../services/authService';
 import './Dashboard.css';
 
@@ -10,11 +10,15 @@ function Dashboard() {
   const [showCreateModal, setShowCreateModal] = useState(false);
   const [newDocTitle, setNewDocTitle] = useState('');
   const [creating, setCreating] = useState(false);
+  const [presence, setPresence] = useState<Record<number, DocumentPresence['users']>>({});
+  const [trash, setTrash] = useState<Document[]>([]);
+  const [showTrash, setShowTrash] = useState(false);
 
   const user = authService.getUser();
 
   useEffect(() => {
     loadDocuments();
+    loadTrash();
   }, []);
 
   const loadDocuments = async () => {
@@ -25,11 +29,28 @@ function Dashboard() {
       setError(response.error);
     } else {
       setDocuments(response.data || []);
+      loadPresence(response.data || []);
     }
 
     setLoading(false);
   };
 
+  // Documents in the trash; a failure just leaves the section empty
+  const loadTrash = async () => {
+    const response = await documentService.getTrash();
+    setTrash(response.data || []);
+  };
+
+  // Who is in each document right now; a failure just leaves the indicator out
+  const loadPresence = async (docs: Document[]) => {
+    const results = await Promise.all(docs.map(doc => documentService.getPresence(doc.id)));
+    const byDocument: Record<number, DocumentPresence['users']> = {};
+    results.forEach(result => {
+      if (result.data) byDocument[result.data.document_id] = result.data.users;
+    });
+    setPresence(byDocument);
+  };
+
   const handleCreateDocument = async (e: React.FormEvent) => {
     e.preventDefault();
     setCreating(true);
@@ -51,7 +72,7 @@ function Dashboard() {
   };
 
   const handleDeleteDocument = async (id: number) => {
-    if (!confirm('Are you sure you want to delete this document?')) return;
+    if (!confirm('Move this document to the trash? Anyone editing it will be disconnected.')) return;
 
     const response = await documentService.deleteDocument(id);
 
@@ -59,6 +80,41 @@ function Dashboard() {
       alert('Failed to delete document: ' + response.error);
     } else {
       loadDocuments(); // Reload the list
+      loadTrash();
+    }
+  };
+
+  const handleToggleSyncMode = async (doc: Document) => {
+    const mode = doc.sync_mode === 'crdt' ? 'ot' : 'crdt';
+    const response = await documentService.setSyncMode(doc.id, mode);
+
+    if (response.error) {
+      alert('Failed to change sync mode: ' + response.error);
+    } else {
+      loadDocuments();
+    }
+  };
+
+  const handleRestoreDocument = async (id: number) => {
+    const response = await documentService.restoreDocument(id);
+
+    if (response.error) {
+      alert('Failed to restore document: ' + response.error);
+    } else {
+      loadDocuments();
+      loadTrash();
+    }
+  };
+
+  const handleDeleteForever = async (id: number) => {
+    if (!confirm('Delete this document forever? This cannot be undone.')) return;
+
+    const response = await documentService.deleteDocumentForever(id);
+
+    if (response.error) {
+      alert('Failed to delete document: ' + response.error);
+    } else {
+      loadTrash();
     }
   };
 
@@ -140,6 +196,14 @@ function Dashboard() {
               </p>
               <div className="doc-meta">
                 <span>Updated: {new Date(doc.updated_at).toLocaleDateString()}</span>
+                {presence[doc.id]?.length > 0 && (
+                  <span
+                    className="online-badge"
+                    title={presence[doc.id].map(u => `${u.username} (${u.status})`).join(', ')}
+                  >
+                    ● {presence[doc.id].length} online
+                  </span>
+                )}
               </div>
               <div className="doc-actions">
                 <button
@@ -148,6 +212,15 @@ function Dashboard() {
                 >
                   Open
                 </button>
+                {!doc.is_shared && (
+                  <button
+                    onClick={() => handleToggleSyncMode(doc)}
+                    className="btn-sync-mode"
+                    title="CRDT sync merges edits made while offline; OT is the default"
+                  >
+                    {doc.sync_mode === 'crdt' ? 'Sync: CRDT' : 'Sync: OT'}
+                  </button>
+                )}
                 {!doc.is_shared && (
                   <button
                     onClick={() => handleDeleteDocument(doc.id)}
@@ -161,6 +234,40 @@ function Dashboard() {
           ))}
         </div>
 
+        {trash.length > 0 && (
+          <section className="trash-section">
+            <button onClick={() => setShowTrash(!showTrash)} className="btn-trash-toggle">
+              {showTrash ? '▾' : '▸'} Trash ({trash.length})
+            </button>
+            {showTrash && (
+              <>
+                <p className="trash-note">Documents in the trash are deleted for good automatically after the retention period.</p>
+                <div className="documents-grid">
+                  {trash.map((doc) => (
+                    <div key={doc.id} className="document-card trashed">
+                      <div className="document-header">
+                        <h3>{doc.title}</h3>
+                      </div>
+                      <p className="doc-preview">{getPlainTextPreview(doc.content, 100)}</p>
+                      <div className="doc-meta">
+                        <span>Deleted: {new Date(doc.deleted_at!).toLocaleDateString()}</span>
+                      </div>
+                      <div className="doc-actions">
+                        <button onClick={() => handleRestoreDocument(doc.id)} className="btn-open">
+                          Restore
+                        </button>
+                        <button onClick={() => handleDeleteForever(doc.id)} className="btn-delete">
+                          Delete forever
+                        </button>
+                      </div>
+                    </div>
+                  ))}
+                </div>
+              </>
+            )}
+          </section>
+        )}
+
       </main>
 
       {showCreateModal && (
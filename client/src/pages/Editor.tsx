@@ -1,13 +1,25 @@
 import { useState, useEffect, useRef } from 'react';
-import { documentService, type Document } from '../services/documentService';
+import { documentService, type Document, type ChatMessage } from '../services/documentService';
 import './Editor.css';
 import ReactQuill from 'react-quill';
 import 'react-quill/dist/quill.snow.css';
-import { wsService } from '../services/websocketService';
-import DiffMatchPatch from 'diff-match-patch';
+import { wsService, newMessageId, debugLog, PROTOCOL_VERSION, type ErrorPayload, type CursorInfo, type MembersPayload, type MemberInfo, type PresenceUpdatePayload, type TypingPayload } from '../services/websocketService';
+import { fromDiff, apply, transform, isNoop, rebaseText, type Operation } from '../services/ot';
+import { CrdtDoc, applyOperation, isEmptyUpdate, type StateVector, type Update as CrdtUpdate } from '../services/crdt';
+import { contentChecksum } from '../services/checksum';
 import jsPDF from 'jspdf';
 import html2canvas from 'html2canvas';
 
+// Turns a stored chat message into an entry of the discussion feed
+const toChatEntry = (message: ChatMessage) => ({
+  type: 'chat' as const,
+  username: message.username,
+  timestamp: new Date(message.created_at),
+  text: message.text,
+  id: message.id,
+  edited: message.edited_at !== null,
+});
+
 function Editor() {
   // Get document ID from URL
   const pathParts = window.location.pathname.split('/');
@@ -26,15 +38,27 @@ function Editor() {
 
   const syncTimerRef = useRef<ReturnType<typeof setTimeout> | null>(null);
   const [activeUsers, setActiveUsers] = useState<string[]>([]);
+  // Color, tab count and status of each active user, by username
+  const [memberDetails, setMemberDetails] = useState<Record<string, Partial<MemberInfo>>>({});
+  // Other connections' cursors by session; ours is left out
+  const [remoteCursors, setRemoteCursors] = useState<Record<string, CursorInfo>>({});
+  // Who is typing where, by session; the server sends "typing" and "idle" for us
+  const [typists, setTypists] = useState<Record<string, { username: string; target: TypingPayload['target'] }>>({});
+  const sessionRef = useRef<string | null>(null);
 
   const [chatMessages, setChatMessages] = useState<Array<{
     type: 'join' | 'leave' | 'chat';
     username: string;
     timestamp: Date;
-    text?: string; // Only for chat messages
+    text?: string;      // Only for chat messages
+    id?: number;        // Stored chat message ID, once the server has it
+    clientId?: string;  // ID we sent our own chat message with, until it is acknowledged
+    edited?: boolean;
   }>>([]);
 
   const [chatInput, setChatInput] = useState('');
+  // Text of our chat messages awaiting their ack, by client ID, in case they have to be sent again
+  const chatOutboxRef = useRef<Record<string, string>>({});
 
   const [showInviteModal, setShowInviteModal] = useState(false);
   const [inviteEmail, setInviteEmail] = useState('');
@@ -49,8 +73,32 @@ function Editor() {
 
   //const [userCursors, setUserCursors] = useState<Record<string, { position: number, length: number, color: string }>>({});
 
-  const dmp = useRef(new DiffMatchPatch());
-  const previousContent = useRef('');
+  // OT client state:
+  //  - revisionRef: last server revision we know about; sent with every edit
+  //  - outstandingRef: operation sent to the server that hasn't been acked yet (at most one in flight)
+  //  - shadowRef: server content at revisionRef with the outstanding operation applied
+  //  - latestValueRef: what is currently in the editor (may contain changes not sent yet)
+  //  - confirmedRef: server content at revisionRef, without the outstanding operation
+  //  - outstandingIdRef: message ID of the outstanding edit, to recognise it after a reconnect
+  //  - syncingRef: true from (re)connecting until the server's sync-reply; nothing is sent meanwhile
+  //  - syncedRef: whether we have synced at least once, i.e. whether revisionRef means anything yet
+  const revisionRef = useRef(0);
+  const outstandingRef = useRef<Operation | null>(null);
+  const shadowRef = useRef('');
+  const latestValueRef = useRef('');
+  const confirmedRef = useRef('');
+  const outstandingIdRef = useRef<string | null>(null);
+  const syncingRef = useRef(true);
+  const syncedRef = useRef(false);
+
+  // CRDT client state, for documents in "crdt" sync mode (revisionRef, outstandingRef and shadowRef go unused):
+  //  - crdtRef: our replica, built from the server's on the first crdt-sync-reply
+  //  - replicaRef: token the server derives our replica ID from. It lives as long as the page, so edits
+  //    made while disconnected keep their ID and the server takes them once we're back.
+  // syncingRef and latestValueRef mean the same as with OT
+  const syncModeRef = useRef<'ot' | 'crdt'>('ot');
+  const crdtRef = useRef<CrdtDoc | null>(null);
+  const replicaRef = useRef(newMessageId());
 
   const quillRef = useRef<ReactQuill>(null);
 
@@ -98,6 +146,30 @@ function Editor() {
   useEffect(() => {
     const unsubJoin = wsService.on('join', (message) => {
       if (message.documentId === documentId) {
+        // Our own join means the connection is (re)established: catch up before sending anything
+        const joinPayload = message.payload as { revision?: number; protocol?: number; color?: string; session?: string } | undefined;
+        if (joinPayload?.color) {
+          setMemberDetails(prev => ({
+            ...prev,
+            [message.username]: { ...prev[message.username], color: joinPayload.color, connections: 1, status: 'active' }
+          }));
+        }
+        if (message.username === currentUser.username && joinPayload?.revision !== undefined) {
+          sessionRef.current = joinPayload.session ?? null;
+          if (joinPayload.protocol !== undefined && joinPayload.protocol !== PROTOCOL_VERSION) {
+            console.warn(`[WebSocket] Server speaks protocol ${joinPayload.protocol}, we speak ${PROTOCOL_VERSION}`);
+          }
+          if (syncModeRef.current === 'crdt') {
+            requestCrdtSync();
+          } else {
+            syncingRef.current = true;
+            wsService.send('sync', {
+              revision: syncedRef.current ? revisionRef.current : null,
+              pendingId: outstandingIdRef.current ?? undefined,
+            });
+          }
+        }
+
         // Add to activity feed (only if not current user)
         if (message.username !== currentUser.username) {
           setChatMessages(prev => {
@@ -135,12 +207,72 @@ function Editor() {
 
     const unsubMembers = wsService.on('members', (message) => {
       if (message.documentId === documentId) {
-        // Set active users from the server's list
-        const members = message.payload as string[];
-        setActiveUsers(members);
+        // Set active users, their colors and where their cursors are from the server's snapshot
+        const payload = message.payload as MembersPayload;
+        setActiveUsers(payload.members.map(member => member.username));
+        setMemberDetails(Object.fromEntries(payload.members.map(member => [member.username, member])));
+        setRemoteCursors(Object.fromEntries(
+          payload.cursors
+            .filter(cursor => cursor.session !== sessionRef.current)
+            .map(cursor => [cursor.session, cursor])
+        ));
+      }
+    });
+
+    const handleCursor = (message: { payload?: unknown }) => {
+      const cursor = message.payload as CursorInfo;
+      if (cursor.session === sessionRef.current) return;
+      setRemoteCursors(prev => ({ ...prev, [cursor.session]: cursor }));
+    };
+    const unsubCursor = wsService.on('cursor', handleCursor);
+    const unsubSelection = wsService.on('selection', handleCursor);
+
+    const forgetCursor = (message: { payload?: unknown }) => {
+      const session = (message.payload as { session?: string } | undefined)?.session;
+      if (!session) return;
+      setRemoteCursors(prev => {
+        const next = { ...prev };
+        delete next[session];
+        return next;
+      });
+    };
+    const unsubCursorExpire = wsService.on('cursor-expire', forgetCursor);
+    const unsubCursorLeave = wsService.on('leave', forgetCursor);
+
+    const unsubTyping = wsService.on('typing', (message) => {
+      const payload = message.payload as TypingPayload;
+      if (payload.session === sessionRef.current || !message.username) return;
+      setTypists(prev => ({ ...prev, [payload.session]: { username: message.username!, target: payload.target } }));
+    });
+    const forgetTypist = (message: { payload?: unknown }) => {
+      const session = (message.payload as { session?: string } | undefined)?.session;
+      if (!session) return;
+      setTypists(prev => {
+        const next = { ...prev };
+        delete next[session];
+        return next;
+      });
+    };
+    const unsubIdle = wsService.on('idle', forgetTypist);
+    const unsubTypingLeave = wsService.on('leave', forgetTypist);
+
+    // A user opened or closed another tab, or went idle, away or back
+    const unsubPresence = wsService.on('presence', (message) => {
+      const payload = message.payload as PresenceUpdatePayload;
+      setMemberDetails(prev => ({ ...prev, [payload.username]: payload }));
+      setActiveUsers(prev => prev.includes(payload.username) ? prev : [...prev, payload.username]);
+      if (payload.closedSession) {
+        forgetCursor({ payload: { session: payload.closedSession } });
+        forgetTypist({ payload: { session: payload.closedSession } });
       }
     });
 
+    // Let the others know when this tab is in the background
+    const reportVisibility = () => {
+      wsService.send('presence', { status: window.document.hidden ? 'away' : 'active' });
+    };
+    window.document.addEventListener('visibilitychange', reportVisibility);
+
     const unsubLeave = wsService.on('leave', (message) => {
       if (message.documentId === documentId) {
         // Add to activity feed (only if not current user)
@@ -171,56 +303,292 @@ function Editor() {
       }
     });
 
+    // Our copy of the server's content doesn't match the checksum it sent: ask for a snapshot
+    const requestSnapshot = (revision: number) => {
+      console.warn(`[OT] Checksum mismatch at revision ${revision}; requesting a snapshot`);
+      syncingRef.current = true;
+      wsService.send('sync', {
+        revision: revisionRef.current,
+        pendingId: outstandingIdRef.current ?? undefined,
+        reason: 'checksum-mismatch',
+      });
+    };
+
     const unsubEdit = wsService.on('edit', (message) => {
+      // The server never echoes our own edits back to this connection
+      if (message.documentId !== documentId) return;
+      // Anything before the sync-reply's revision is included in it
+      if (syncingRef.current) return;
+
+      // Edits come as the operation and the checksum of the result; only older protocols get fullContent
+      const payload = message.payload as { ops: Operation; fullContent?: string; checksum?: number; revision: number; sentAt?: number };
+      const editor = quillRef.current?.getEditor();
+      const selection = editor?.getSelection();
+
+      if (payload.sentAt) {
+        debugLog(`[OT] Round-trip latency: ${(performance.now() - payload.sentAt).toFixed(2)}ms`);
+      }
 
-      // Skip if this is our own edit
-      if (message.username !== currentUser.username && message.documentId === documentId) {
+      if (payload.revision === revisionRef.current + 1) {
+        applyRemoteOperation(payload.ops);
+        if (payload.checksum !== undefined && contentChecksum(confirmedRef.current) !== payload.checksum) {
+          revisionRef.current = payload.revision;
+          requestSnapshot(payload.revision);
+          return;
+        }
+      } else if (payload.fullContent === undefined) {
+        // We missed something and got no full copy to fall back to: catch up with a sync
+        debugLog(`[OT] Expected revision ${revisionRef.current + 1}, got ${payload.revision}; resyncing`);
+        syncingRef.current = true;
+        wsService.send('sync', {
+          revision: revisionRef.current,
+          pendingId: outstandingIdRef.current ?? undefined,
+        });
+        return;
+      } else {
+        // We missed something - fall back to the server's full copy
+        debugLog(`[OT] Expected revision ${revisionRef.current + 1}, got ${payload.revision}; using full content`);
+        outstandingRef.current = null;
+        outstandingIdRef.current = null;
+        confirmedRef.current = payload.fullContent;
+        shadowRef.current = payload.fullContent;
+        latestValueRef.current = payload.fullContent;
+      }
 
-        const payload = message.payload as any;
+      revisionRef.current = payload.revision;
+      setContent(latestValueRef.current);
 
-        if (payload.fullContent) {
-          const editor = quillRef.current?.getEditor();
-          const selection = editor?.getSelection();
-          const receiveTime = performance.now();
+      // Restore cursor position after update
+      setTimeout(() => {
+        if (selection) {
+          editor?.setSelection(selection);
+        }
+      }, 10);
+    });
 
-          if (payload.sentAt) {
-            console.log(`[DMP] Round-trip latency: ${(receiveTime - payload.sentAt).toFixed(2)}ms`);
-          }
+    // An update merged by the server (CRDT mode). Anything missed is in the reply to our next crdt-sync.
+    const unsubCrdtUpdate = wsService.on('crdt-update', (message) => {
+      if (message.documentId !== documentId || !crdtRef.current) return;
+
+      const payload = message.payload as { update: CrdtUpdate; revision: number };
+      const editor = quillRef.current?.getEditor();
+      const selection = editor?.getSelection();
+
+      applyRemoteCrdtUpdate(payload.update);
+      setContent(latestValueRef.current);
 
-          // Update content
-          setContent(payload.fullContent);
-          previousContent.current = payload.fullContent;
-
-          // Restore cursor position after update
-          setTimeout(() => {
-            if (selection) {
-              editor?.setSelection(selection);
-            }
-          }, 10);
-        } else {
-          console.log(' No fullContent in payload');
+      setTimeout(() => {
+        if (selection) {
+          editor?.setSelection(selection);
         }
+      }, 10);
+    });
+
+    // Answer to our crdt-sync: what we are missing, and the server's state vector so we can
+    // send back what it is missing (edits made while we were disconnected)
+    const unsubCrdtSyncReply = wsService.on('crdt-sync-reply', (message) => {
+      const payload = message.payload as { update: CrdtUpdate; stateVector: StateVector; revision: number; client: number };
+
+      const doc = crdtRef.current ?? new CrdtDoc(payload.client);
+      if (!crdtRef.current) {
+        // First sync: start from the server's replica and carry over whatever was typed while loading
+        crdtRef.current = doc;
+        doc.apply(payload.update);
+        latestValueRef.current = rebaseText(confirmedRef.current, latestValueRef.current, doc.text());
       } else {
-        console.log(' Skipping - this is my own edit');
+        applyRemoteCrdtUpdate(payload.update);
+      }
+      sendLocalCrdtChanges(); // still syncing: this only adds our typing to the replica
+
+      syncingRef.current = false;
+      setContent(latestValueRef.current);
+
+      // The server already has everyone else's items and only takes ours
+      const missing = doc.diff(payload.stateVector);
+      missing.items = missing.items?.filter(item => item.id.client === doc.client);
+      if (!isEmptyUpdate(missing)) {
+        wsService.send('crdt-update', { update: missing }, newMessageId());
       }
     });
 
     const unsubChat = wsService.on('chat', (message) => {
       if (message.documentId === documentId) {
-        const payload = message.payload as { text: string };
-        setChatMessages(prev => {
-          const newMessages = [...prev, {
-            type: 'chat' as const,
-            username: message.username,
-            timestamp: new Date(),
-            text: payload.text
-          }];
-          return newMessages.slice(-20);
-        });
+        const payload = message.payload as ChatMessage;
+        setChatMessages(prev => [...prev, toChatEntry(payload)].slice(-20));
+      }
+    });
+
+    // Recent chat, sent after our join: merge it with the activity we already show
+    const unsubChatHistory = wsService.on('chat-history', (message) => {
+      const history = (message.payload as ChatMessage[]).map(toChatEntry);
+      setChatMessages(prev => {
+        const stored = new Set(history.map(entry => entry.id));
+        const kept = prev.filter(entry => entry.type !== 'chat' || (entry.id === undefined ? !!entry.clientId : !stored.has(entry.id)));
+        return [...kept, ...history]
+          .sort((a, b) => a.timestamp.getTime() - b.timestamp.getTime())
+          .slice(-20);
+      });
+    });
+
+    // The server stored one of our chat messages: remember its ID so we can edit or delete it
+    const unsubChatAck = wsService.on('ack', (message) => {
+      const payload = message.payload as Partial<ChatMessage> | undefined;
+      if (!message.id || payload?.id === undefined) return;
+      delete chatOutboxRef.current[message.id];
+      setChatMessages(prev => prev.map(entry =>
+        entry.clientId === message.id ? { ...entry, id: payload.id, clientId: undefined } : entry
+      ));
+    });
+
+    const unsubChatUpdate = wsService.on('chat-update', (message) => {
+      const payload = message.payload as ChatMessage;
+      setChatMessages(prev => prev.map(entry =>
+        entry.type === 'chat' && entry.id === payload.id ? { ...entry, text: payload.text, edited: true } : entry
+      ));
+    });
+
+    const unsubChatDelete = wsService.on('chat-delete', (message) => {
+      const payload = message.payload as { id: number };
+      setChatMessages(prev => prev.filter(entry => entry.type !== 'chat' || entry.id !== payload.id));
+    });
+
+    // Server accepted our outstanding edit - send whatever was typed in the meantime
+    const unsubAck = wsService.on('ack', (message) => {
+      // Acks for chat messages (or for an edit we already gave up on) don't concern the editor
+      if (!outstandingIdRef.current || message.id !== outstandingIdRef.current) return;
+
+      const payload = message.payload as { revision: number; duplicate?: boolean };
+      // A duplicate ack carries the revision the edit originally got, which we may already be past
+      revisionRef.current = payload.duplicate
+        ? Math.max(revisionRef.current, payload.revision)
+        : payload.revision;
+      confirmedRef.current = shadowRef.current;
+      outstandingRef.current = null;
+      outstandingIdRef.current = null;
+      sendLocalChanges();
+    });
+
+    // Server rejected one of our messages - for edits, take its authoritative copy
+    const unsubNack = wsService.on('nack', (message) => {
+      const payload = message.payload as { reason: string; message?: string; revision?: number; fullContent?: string; retryAfter?: number };
+      debugLog(`[WebSocket] Nack (${payload.reason}) for message ${message.id ?? '-'}: ${payload.message ?? ''}`);
+
+      // We were sending too fast: send the same message again once the server will take it.
+      // The outstanding edit is rebased over whatever arrives meanwhile, so it goes against the latest revision.
+      if (payload.reason === 'rate-limited' && message.id) {
+        const id = message.id;
+        setTimeout(() => {
+          if (id === outstandingIdRef.current && outstandingRef.current) {
+            wsService.send('edit', {
+              ops: outstandingRef.current,
+              baseRevision: revisionRef.current,
+              sentAt: performance.now()
+            }, id);
+          } else if (chatOutboxRef.current[id] !== undefined) {
+            wsService.send('chat', { text: chatOutboxRef.current[id] }, id);
+          } else if (syncModeRef.current === 'crdt') {
+            requestCrdtSync();
+          }
+        }, payload.retryAfter || 1000);
+        return;
+      }
+
+      if (payload.reason === 'permission-denied') {
+        setError(payload.message || 'You no longer have access to this document');
+      }
+
+      // A CRDT update the server didn't take stays in our replica; a crdt-sync makes the server
+      // tell us what it is missing, so it goes again with the diff
+      if (syncModeRef.current === 'crdt' && message.id && chatOutboxRef.current[message.id] === undefined) {
+        if (payload.reason !== 'permission-denied' && payload.reason !== 'unsupported') {
+          setTimeout(requestCrdtSync, 1000);
+        }
+        return;
+      }
+
+      if (payload.fullContent === undefined) return;
+
+      setContent(payload.fullContent);
+      latestValueRef.current = payload.fullContent;
+      shadowRef.current = payload.fullContent;
+      confirmedRef.current = payload.fullContent;
+      outstandingRef.current = null;
+      outstandingIdRef.current = null;
+      revisionRef.current = payload.revision ?? 0;
+    });
+
+    // Server couldn't make sense of one of our messages. If it was our outstanding edit, drop it and
+    // resync from a snapshot: the sync reply rebases our text onto it and we send it again as a fresh edit
+    const unsubError = wsService.on('error', (message) => {
+      const payload = message.payload as ErrorPayload;
+      console.error(`[WebSocket] Server rejected message ${message.id ?? '-'} (${payload.code}): ${payload.message}`);
+
+      if (message.id && message.id === outstandingIdRef.current) {
+        outstandingRef.current = null;
+        outstandingIdRef.current = null;
+        shadowRef.current = confirmedRef.current;
+        syncingRef.current = true;
+        wsService.send('sync', { revision: null });
       }
     });
 
+    // Answer to our sync: either the operations we missed while away or a full snapshot
+    const unsubSyncReply = wsService.on('sync-reply', (message) => {
+      const payload = message.payload as {
+        revision: number;
+        ops?: Array<{ revision: number; id?: string; ops: Operation }>;
+        fullContent?: string;
+        checksum?: number;
+        pendingApplied: boolean;
+      };
+
+      if (payload.fullContent !== undefined) {
+        // No operations to transform over: patch whatever never reached the server onto the snapshot
+        const base = payload.pendingApplied ? shadowRef.current : confirmedRef.current;
+        latestValueRef.current = rebaseText(base, latestValueRef.current, payload.fullContent);
+        confirmedRef.current = payload.fullContent;
+        shadowRef.current = payload.fullContent;
+        outstandingRef.current = null;
+        outstandingIdRef.current = null;
+      } else {
+        for (const missed of payload.ops ?? []) {
+          if (outstandingIdRef.current && missed.id === outstandingIdRef.current) {
+            // Our own edit, accepted before the connection dropped
+            confirmedRef.current = shadowRef.current;
+            outstandingRef.current = null;
+            outstandingIdRef.current = null;
+          } else {
+            applyRemoteOperation(missed.ops);
+          }
+        }
+        if (payload.checksum !== undefined && contentChecksum(confirmedRef.current) !== payload.checksum) {
+          revisionRef.current = payload.revision;
+          requestSnapshot(payload.revision);
+          return;
+        }
+      }
+
+      revisionRef.current = payload.revision;
+      syncedRef.current = true;
+      syncingRef.current = false;
+      setContent(latestValueRef.current);
+
+      if (outstandingRef.current) {
+        // The server never got it; it has been transformed up to the current revision, so send it again
+        wsService.send('edit', {
+          ops: outstandingRef.current,
+          baseRevision: revisionRef.current,
+          sentAt: performance.now()
+        }, outstandingIdRef.current!);
+      } else {
+        sendLocalChanges();
+      }
+    });
 
+    const unsubAccessDenied = wsService.on('access-denied', (message) => {
+      const payload = message.payload as { reason?: string };
+      setError(payload.reason || 'You no longer have access to this document');
+    });
 
     // Cleanup all subscriptions when component unmounts
     return () => {
@@ -229,8 +597,28 @@ function Editor() {
       unsubJoin();
       unsubLeave();
       unsubEdit();
+      unsubCrdtUpdate();
+      unsubCrdtSyncReply();
       unsubMembers();
+      unsubCursor();
+      unsubSelection();
+      unsubCursorExpire();
+      unsubCursorLeave();
+      unsubPresence();
+      unsubTyping();
+      unsubIdle();
+      unsubTypingLeave();
+      window.document.removeEventListener('visibilitychange', reportVisibility);
       unsubChat();
+      unsubChatHistory();
+      unsubChatAck();
+      unsubChatUpdate();
+      unsubChatDelete();
+      unsubAck();
+      unsubNack();
+      unsubError();
+      unsubSyncReply();
+      unsubAccessDenied();
       wsService.disconnect();
     };
   }, []); // Empty array = runs once on mount, cleanup on unmount
@@ -264,9 +652,12 @@ function Editor() {
       setError(response.error);
     } else if (response.data) {
       setDocument(response.data);
+      syncModeRef.current = response.data.sync_mode ?? 'ot';
       setTitle(response.data.title);
       setContent(response.data.content);
-      previousContent.current = response.data.content;
+      shadowRef.current = response.data.content;
+      latestValueRef.current = response.data.content;
+      confirmedRef.current = response.data.content;
       wsService.connect(documentId);
 
       setActiveUsers([currentUser.username]);
@@ -280,43 +671,93 @@ function Editor() {
     setHasUnsavedChanges(true);
   };
 
+  // Apply an operation the server made at revisionRef, transforming it over our in-flight and unsent changes
+  const applyRemoteOperation = (remote: Operation) => {
+    confirmedRef.current = apply(remote, confirmedRef.current);
+
+    if (outstandingRef.current) {
+      const [outstanding, rebased] = transform(outstandingRef.current, remote);
+      outstandingRef.current = outstanding;
+      remote = rebased;
+    }
+
+    const local = fromDiff(shadowRef.current, latestValueRef.current);
+    const [, remoteForEditor] = transform(local, remote);
+
+    shadowRef.current = apply(remote, shadowRef.current);
+    latestValueRef.current = apply(remoteForEditor, latestValueRef.current);
+  };
+
+  // Ask the server what our replica is missing (CRDT mode); nothing is sent until it answers
+  const requestCrdtSync = () => {
+    syncingRef.current = true;
+    wsService.send('crdt-sync', {
+      stateVector: crdtRef.current?.stateVector() ?? {},
+      replica: replicaRef.current,
+    });
+  };
+
+  // Turn what was typed since the last call into items of our replica and send them. They need no ack:
+  // while syncing, or if one is lost, they go with the diff we send after the next crdt-sync-reply.
+  const sendLocalCrdtChanges = () => {
+    const doc = crdtRef.current;
+    if (!doc) return; // typing before the first sync is carried over by its reply
+
+    const update = applyOperation(doc, fromDiff(doc.text(), latestValueRef.current));
+    if (!isEmptyUpdate(update) && !syncingRef.current) {
+      wsService.send('crdt-update', { update }, newMessageId());
+    }
+  };
+
+  // Merge a remote CRDT update. Our typing goes into the replica first, so it is merged rather than lost.
+  const applyRemoteCrdtUpdate = (update: CrdtUpdate) => {
+    sendLocalCrdtChanges();
+    crdtRef.current!.apply(update);
+    latestValueRef.current = crdtRef.current!.text();
+  };
+
+  // Send the changes made since the last sent operation, unless one is still awaiting its ack
+  const sendLocalChanges = () => {
+    if (syncModeRef.current === 'crdt') {
+      sendLocalCrdtChanges();
+      return;
+    }
+    if (outstandingRef.current || syncingRef.current) return;
+
+    const value = latestValueRef.current;
+    const ops = fromDiff(shadowRef.current, value);
+    if (isNoop(ops)) return;
+
+    const id = newMessageId();
+    outstandingRef.current = ops;
+    outstandingIdRef.current = id;
+    shadowRef.current = value;
+    wsService.send('edit', {
+      ops,
+      baseRevision: revisionRef.current,
+      sentAt: performance.now()
+    }, id);
+  };
+
   const handleContentChange = (value: string) => {
 
     setContent(value);
+    latestValueRef.current = value;
     setHasUnsavedChanges(true);
 
     if (syncTimerRef.current) {
       clearTimeout(syncTimerRef.current);
     }
 
-    syncTimerRef.current = setTimeout(() => {
-
-      const patchStart = performance.now();
-      const patches = dmp.current.patch_make(previousContent.current, value);
-      const patchText = dmp.current.patch_toText(patches);
-      const patchEnd = performance.now();
-
-      console.log(`[DMP] Patch generation took: ${(patchEnd - patchStart).toFixed(2)}ms`);
-      console.log(`[DMP] Patch size: ${patchText.length} bytes vs full content: ${value.length} bytes`);
-      console.log(' Patches:', patchText);
-
-      const sendTime = performance.now();
-      wsService.send('edit', {
-        patches: patchText,
-        fullContent: value,
-        sentAt: sendTime
-      });
-
-      previousContent.current = value;
-    }, 300);
+    syncTimerRef.current = setTimeout(sendLocalChanges, 300);
   };
 
   const handleSelectionChange = (range: any) => {
-    if (range) {
-      wsService.send('cursor', {
-        position: range.index,
-        length: range.length
-      });
+    if (!range) return;
+    if (range.length > 0) {
+      wsService.send('selection', { position: range.index, length: range.length });
+    } else {
+      wsService.send('cursor', { position: range.index });
     }
   };
 
@@ -324,10 +765,8 @@ function Editor() {
     setSaving(true);
     setSaveStatus(isAutoSave ? 'Auto-saving...' : 'Saving...');
 
-    const response = await documentService.updateDocument(documentId, {
-      title,
-      content,
-    });
+    // Content is already saved edit by edit over the WebSocket; only the title goes through here
+    const response = await documentService.updateDocument(documentId, { title });
 
     setSaving(false);
 
@@ -407,20 +846,64 @@ function Editor() {
     if (!chatInput.trim()) return;
 
     // Add to own chat immediately
+    const clientId = newMessageId();
     setChatMessages(prev => {
       const newMessages = [...prev, {
         type: 'chat' as const,
         username: currentUser.username,
         timestamp: new Date(),
-        text: chatInput
+        text: chatInput,
+        clientId
       }];
       return newMessages.slice(-20);
     });
 
-    wsService.send('chat', { text: chatInput });
+    chatOutboxRef.current[clientId] = chatInput;
+    wsService.send('chat', { text: chatInput }, clientId);
     setChatInput('');
   };
 
+  // Everyone in the document (this tab included) hears about the change over the WebSocket
+  const editChatMessage = async (messageId: number, currentText: string) => {
+    const text = window.prompt('Edit message', currentText);
+    if (text === null || !text.trim() || text === currentText) return;
+
+    const response = await documentService.updateMessage(documentId, messageId, text);
+    if (response.error) {
+      setError(response.error);
+    }
+  };
+
+  const deleteChatMessage = async (messageId: number) => {
+    if (!window.confirm('Delete this message?')) return;
+
+    const response = await documentService.deleteMessage(documentId, messageId);
+    if (response.error) {
+      setError(response.error);
+    }
+  };
+
+  // Tooltip telling where a user's cursors are (one per tab they have open)
+  const describeCursors = (username: string): string => {
+    const cursors = Object.values(remoteCursors).filter(cursor => cursor.username === username);
+    return cursors
+      .map(cursor => cursor.length > 0
+        ? `Selecting ${cursor.length} characters at ${cursor.position}`
+        : `Cursor at character ${cursor.position}`)
+      .join('\n');
+  };
+
+  // "Alice is typing…", "Alice and Bob are typing…" for the document or the chat box, or '' if nobody is
+  const describeTypists = (target: TypingPayload['target']): string => {
+    const names = [...new Set(Object.values(typists)
+      .filter(typist => typist.target === target && typist.username !== currentUser.username)
+      .map(typist => typist.username))];
+    if (names.length === 0) return '';
+    if (names.length === 1) return `${names[0]} is typing…`;
+    if (names.length === 2) return `${names[0]} and ${names[1]} are typing…`;
+    return `${names.length} people are typing…`;
+  };
+
   const getWordCount = (htmlContent: string, titleText: string = ''): { words: number, chars: number } => {
     const plainText = htmlContent
       .replace(/<[^>]*>/g, ' ')  // replace tags with space not nothing
@@ -537,10 +1020,16 @@ function Editor() {
             </div>
             <div className="active-users-list">
               {activeUsers.map((username, idx) => (
-                <div key={idx} className="active-user">
-                  <span className="user-indicator">🟢</span>
+                <div key={idx} className="active-user" title={describeCursors(username)}>
+                  <span className="user-indicator" style={{ color: memberDetails[username]?.color }}>●</span>
                   <span className="username">{username}</span>
                   {username === currentUser.username && <span className="you-badge">(you)</span>}
+                  {(memberDetails[username]?.connections ?? 1) > 1 && (
+                    <span className="tab-count">{memberDetails[username]!.connections} tabs</span>
+                  )}
+                  {memberDetails[username]?.status && memberDetails[username]!.status !== 'active' && (
+                    <span className={`status-badge status-${memberDetails[username]!.status}`}>{memberDetails[username]!.status}</span>
+                  )}
                 </div>
               ))}
             </div>
@@ -555,6 +1044,13 @@ function Editor() {
               {msg.type === 'chat' ? (
                 <span className="chat-msg">
                   <strong>{msg.username}:</strong> {msg.text}
+                  {msg.edited && <span className="chat-edited"> (edited)</span>}
+                  {msg.id !== undefined && msg.username === currentUser.username && (
+                    <span className="chat-msg-actions">
+                      <button onClick={() => editChatMessage(msg.id!, msg.text ?? '')} title="Edit message">✏️</button>
+                      <button onClick={() => deleteChatMessage(msg.id!)} title="Delete message">🗑️</button>
+                    </span>
+                  )}
                 </span>
               ) : (
                 <span className={msg.type === 'join' ? 'join-msg' : 'leave-msg'}>
@@ -568,11 +1064,18 @@ function Editor() {
           ))}
         </div>
 
+        {describeTypists('chat') && (
+          <div className="typing-indicator">{describeTypists('chat')}</div>
+        )}
+
         <div className="chat-input-area">
           <input
             type="text"
             value={chatInput}
-            onChange={(e) => setChatInput(e.target.value)}
+            onChange={(e) => {
+              setChatInput(e.target.value);
+              if (e.target.value.trim()) wsService.send('typing', { target: 'chat' });
+            }}
             onKeyDown={(e) => e.key === 'Enter' && sendChatMessage()}
             placeholder="Send a message..."
             className="chat-input"
@@ -590,6 +1093,9 @@ function Editor() {
           {getWordCount(content, title).words} words · {getWordCount(content, title).chars} chars
         </span>
         <span className="footer-right">
+          {describeTypists('document') && (
+            <span className="typing-indicator">{describeTypists('document')}</span>
+          )}
           {hasUnsavedChanges && !saving && (
             <span className="unsaved-indicator">• Unsaved changes</span>
           )}
@@ -0,0 +1,24 @@
+// Checksum of a document's content, as computed by the server (contentChecksum in api/handlers):
+// the CRC-32 (IEEE) of its UTF-8 encoding. Edits carry the checksum of the content they produce.
+
+const CRC_TABLE = (() => {
+  const table = new Uint32Array(256);
+  for (let n = 0; n < 256; n++) {
+    let c = n;
+    for (let k = 0; k < 8; k++) {
+      c = c & 1 ? 0xedb88320 ^ (c >>> 1) : c >>> 1;
+    }
+    table[n] = c >>> 0;
+  }
+  return table;
+})();
+
+const textEncoder = new TextEncoder();
+
+export function contentChecksum(content: string): number {
+  let crc = 0xffffffff;
+  for (const byte of textEncoder.encode(content)) {
+    crc = CRC_TABLE[(crc ^ byte) & 0xff] ^ (crc >>> 8);
+  }
+  return (crc ^ 0xffffffff) >>> 0;
+}
@@ -0,0 +1,182 @@
+// Client side of the server's sequence CRDT (api/crdt), used by documents in "crdt" sync mode.
+// Every character is an item whose ID is made of the replica that typed it and a Lamport clock.
+// An item sits right after its origin (the character to its left when it was typed); items sharing
+// an origin are ordered by descending ID. Deleted characters stay in the sequence as tombstones.
+// Items and IDs use the same JSON encoding as the server, and each item holds one code point, like a Go rune.
+
+import type { Operation } from './ot';
+
+export interface ItemId {
+  client: number;
+  clock: number;
+}
+
+export interface Item {
+  id: ItemId;
+  origin?: ItemId; // item to the left when inserted; absent = start of document
+  value: string;
+  deleted?: boolean;
+}
+
+// Highest clock seen from each replica, keyed by replica ID
+export type StateVector = Record<string, number>;
+
+// Inserted items and deleted IDs exchanged between replicas; applying one twice changes nothing
+export interface Update {
+  items?: Item[];
+  deletes?: ItemId[];
+}
+
+const keyOf = (id: ItemId): string => `${id.client}:${id.clock}`;
+
+// Whether a sorts after b; concurrent siblings are ordered by descending ID
+const after = (a: ItemId, b: ItemId): boolean =>
+  a.clock !== b.clock ? a.clock > b.clock : a.client > b.client;
+
+const byId = (a: Item, b: Item): number => (after(a.id, b.id) ? 1 : after(b.id, a.id) ? -1 : 0);
+
+export const isEmptyUpdate = (update: Update): boolean =>
+  !update.items?.length && !update.deletes?.length;
+
+// One replica of a text document
+export class CrdtDoc {
+  private clock = 0; // Lamport clock: greater than every clock seen so far
+  private items: Item[] = [];
+  private index = new Map<string, Item>();
+  private sv: StateVector = {};
+
+  // Updates that arrived before the items they depend on
+  private pendingItems: Item[] = [];
+  private pendingDeletes: ItemId[] = [];
+
+  constructor(readonly client: number) {}
+
+  // The visible content of the document
+  text(): string {
+    return this.items.filter((item) => !item.deleted).map((item) => item.value).join('');
+  }
+
+  length(): number {
+    return this.items.filter((item) => !item.deleted).length;
+  }
+
+  stateVector(): StateVector {
+    return { ...this.sv };
+  }
+
+  // Type text at a visible position; returns the update to send to the server
+  insert(pos: number, text: string): Update {
+    if (pos < 0 || pos > this.length()) throw new Error('crdt: position out of range');
+
+    let origin = pos > 0 ? this.items[this.visibleItem(pos - 1)].id : undefined;
+    const items: Item[] = [];
+    for (const value of Array.from(text)) {
+      this.clock++;
+      const item: Item = { id: { client: this.client, clock: this.clock }, origin, value };
+      this.integrate({ ...item });
+      items.push(item);
+      origin = item.id;
+    }
+    return { items };
+  }
+
+  // Remove n visible characters starting at pos; returns the update to send to the server
+  delete(pos: number, n: number): Update {
+    if (pos < 0 || n < 0 || pos + n > this.length()) throw new Error('crdt: position out of range');
+
+    const deletes: ItemId[] = [];
+    for (; n > 0; n--) {
+      const item = this.items[this.visibleItem(pos)];
+      item.deleted = true;
+      deletes.push(item.id);
+    }
+    return { deletes };
+  }
+
+  // Everything a replica with the given state vector is missing, sorted so it integrates in one pass
+  diff(sv: StateVector): Update {
+    const items: Item[] = [];
+    const deletes: ItemId[] = [];
+    for (const item of this.items) {
+      if (item.id.clock > (sv[item.id.client] ?? 0)) {
+        items.push({ id: item.id, origin: item.origin, value: item.value });
+      }
+      if (item.deleted) deletes.push(item.id);
+    }
+    items.sort(byId);
+    return { items, deletes };
+  }
+
+  // Merge a remote update. Items whose origin hasn't arrived yet wait until it does.
+  apply(update: Update): void {
+    let items = [...this.pendingItems, ...(update.items ?? [])].sort(byId);
+    this.pendingItems = [];
+
+    for (let progress = true; progress;) {
+      progress = false;
+      const waiting: Item[] = [];
+      for (const item of items) {
+        if (this.index.has(keyOf(item.id))) continue;
+        if (item.origin && !this.index.has(keyOf(item.origin))) {
+          waiting.push(item);
+          continue;
+        }
+        this.integrate({ id: item.id, origin: item.origin, value: item.value });
+        progress = true;
+      }
+      items = waiting;
+    }
+    this.pendingItems = items;
+
+    const deletes = [...this.pendingDeletes, ...(update.deletes ?? [])];
+    this.pendingDeletes = [];
+    for (const id of deletes) {
+      const item = this.index.get(keyOf(id));
+      if (item) item.deleted = true;
+      else this.pendingDeletes.push(id);
+    }
+  }
+
+  // Index in this.items of the pos-th visible character
+  private visibleItem(pos: number): number {
+    let seen = 0;
+    for (let i = 0; i < this.items.length; i++) {
+      if (this.items[i].deleted) continue;
+      if (seen === pos) return i;
+      seen++;
+    }
+    return -1;
+  }
+
+  // Place a new item in the sequence; its origin must be known
+  private integrate(item: Item): void {
+    let i = item.origin ? this.items.findIndex((other) => keyOf(other.id) === keyOf(item.origin!)) + 1 : 0;
+
+    // Skip over siblings (and their descendants) with a greater ID. Descendants always have
+    // a greater clock than their ancestor, so the first smaller ID marks the insertion point.
+    while (i < this.items.length && after(this.items[i].id, item.id)) i++;
+
+    this.items.splice(i, 0, item);
+    this.index.set(keyOf(item.id), item);
+    this.clock = Math.max(this.clock, item.id.clock);
+    this.sv[item.id.client] = Math.max(this.sv[item.id.client] ?? 0, item.id.clock);
+  }
+}
+
+// Replay an operation (e.g. the diff of what was typed) on a replica; returns the update to send
+export function applyOperation(doc: CrdtDoc, op: Operation): Update {
+  const items: Item[] = [];
+  const deletes: ItemId[] = [];
+  let pos = 0;
+  for (const c of op) {
+    if (typeof c === 'string') {
+      items.push(...(doc.insert(pos, c).items ?? []));
+      pos += Array.from(c).length;
+    } else if (c > 0) {
+      pos += c;
+    } else {
+      deletes.push(...(doc.delete(pos, -c).deletes ?? []));
+    }
+  }
+  return { items, deletes };
+}
@@ -5,19 +5,45 @@ export interface Document {
   title: string;
   content: string;
   owner_id: number;
+  sync_mode?: 'ot' | 'crdt';
   created_at: string;
   updated_at: string;
+  deleted_at?: string; // set for documents in the trash
   is_shared?: boolean;
 }
 
+// A stored chat message of a document's discussion
+export interface ChatMessage {
+  id: number;
+  document_id: number;
+  user_id: number;
+  username: string;
+  text: string;
+  created_at: string;
+  edited_at: string | null;
+}
+
+// Who has a document open right now
+export interface DocumentPresence {
+  document_id: number;
+  users: Array<{
+    userId: number;
+    username: string;
+    color: string;
+    connections: number;
+    status: 'active' | 'idle' | 'away';
+  }>;
+}
+
 export interface CreateDocumentRequest {
   title: string;
   content: string;
 }
 
+// Content is optional: live edits go over the WebSocket, content sent here replaces it as one more edit
 export interface UpdateDocumentRequest {
   title: string;
-  content: string;
+  content?: string;
 }
 
 class DocumentService {
@@ -47,11 +73,68 @@ class DocumentService {
     });
   }
 
+  // Switches between OT and CRDT sync (which merges edits made offline); refused while anyone has it open
+  async setSyncMode(id: number, mode: 'ot' | 'crdt') {
+    return api.request<Document>(`/api/documents/${id}/sync-mode`, {
+      method: 'PUT',
+      body: JSON.stringify({ mode }),
+    });
+  }
+
+  // Moves the document to the trash
   async deleteDocument(id: number) {
     return api.request<{ message: string }>(`/api/documents/${id}`, {
       method: 'DELETE',
     });
   }
+
+  // Documents in the trash, most recently deleted first
+  async getTrash() {
+    return api.request<Document[]>('/api/documents/trash', {
+      method: 'GET',
+    });
+  }
+
+  async restoreDocument(id: number) {
+    return api.request<Document>(`/api/documents/${id}/restore`, {
+      method: 'POST',
+    });
+  }
+
+  async deleteDocumentForever(id: number) {
+    return api.request<{ message: string }>(`/api/documents/${id}/permanent`, {
+      method: 'DELETE',
+    });
+  }
+
+  async getPresence(id: number) {
+    return api.request<DocumentPresence>(`/api/documents/${id}/presence`, {
+      method: 'GET',
+    });
+  }
+
+  // Chat history, newest first; pass the oldest ID seen so far as `before` to page back
+  async getMessages(id: number, before?: number, limit?: number) {
+    const params = new URLSearchParams();
+    if (before) params.set('before', String(before));
+    if (limit) params.set('limit', String(limit));
+    return api.request<ChatMessage[]>(`/api/documents/${id}/messages?${params}`, {
+      method: 'GET',
+    });
+  }
+
+  async updateMessage(id: number, messageId: number, text: string) {
+    return api.request<ChatMessage>(`/api/documents/${id}/messages/${messageId}`, {
+      method: 'PUT',
+      body: JSON.stringify({ text }),
+    });
+  }
+
+  async deleteMessage(id: number, messageId: number) {
+    return api.request<{ message: string }>(`/api/documents/${id}/messages/${messageId}`, {
+      method: 'DELETE',
+    });
+  }
 }
 
 export const documentService = new DocumentService();
\ No newline at end of file
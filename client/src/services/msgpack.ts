@@ -0,0 +1,236 @@
+// Minimal MessagePack codec for the WebSocket's binary encoding (the "cowrite.msgpack" subprotocol).
+// It covers what our messages are made of: null, booleans, numbers, strings, arrays and plain objects.
+// Binary and extension types are decoded but never produced.
+
+const textEncoder = new TextEncoder();
+const textDecoder = new TextDecoder();
+
+class Writer {
+  private buffer = new Uint8Array(256);
+  private view = new DataView(this.buffer.buffer);
+  length = 0;
+
+  private reserve(n: number): void {
+    if (this.length + n <= this.buffer.length) return;
+    let size = this.buffer.length * 2;
+    while (size < this.length + n) size *= 2;
+    const grown = new Uint8Array(size);
+    grown.set(this.buffer.subarray(0, this.length));
+    this.buffer = grown;
+    this.view = new DataView(grown.buffer);
+  }
+
+  u8(value: number): void {
+    this.reserve(1);
+    this.view.setUint8(this.length, value);
+    this.length += 1;
+  }
+
+  u16(value: number): void {
+    this.reserve(2);
+    this.view.setUint16(this.length, value);
+    this.length += 2;
+  }
+
+  u32(value: number): void {
+    this.reserve(4);
+    this.view.setUint32(this.length, value);
+    this.length += 4;
+  }
+
+  f64(value: number): void {
+    this.reserve(8);
+    this.view.setFloat64(this.length, value);
+    this.length += 8;
+  }
+
+  i64(value: number): void {
+    this.reserve(8);
+    this.view.setBigInt64(this.length, BigInt(value));
+    this.length += 8;
+  }
+
+  bytes(data: Uint8Array): void {
+    this.reserve(data.length);
+    this.buffer.set(data, this.length);
+    this.length += data.length;
+  }
+
+  result(): Uint8Array {
+    return this.buffer.slice(0, this.length);
+  }
+}
+
+function encodeNumber(w: Writer, n: number): void {
+  if (!Number.isSafeInteger(n)) {
+    w.u8(0xcb);
+    w.f64(n);
+  } else if (n >= 0 && n < 0x80) {
+    w.u8(n); // positive fixint
+  } else if (n < 0 && n >= -32) {
+    w.u8(0xe0 | (n + 32)); // negative fixint
+  } else if (n >= 0 && n <= 0xffff) {
+    w.u8(0xcd);
+    w.u16(n);
+  } else if (n >= 0 && n <= 0xffffffff) {
+    w.u8(0xce);
+    w.u32(n);
+  } else if (n >= -0x80000000 && n <= 0x7fffffff) {
+    w.u8(0xd2);
+    w.u32(n >>> 0);
+  } else {
+    w.u8(0xd3);
+    w.i64(n);
+  }
+}
+
+function encodeLength(w: Writer, length: number, fix: number, fixMax: number, op16: number, op32: number): void {
+  if (length <= fixMax) {
+    w.u8(fix | length);
+  } else if (length <= 0xffff) {
+    w.u8(op16);
+    w.u16(length);
+  } else {
+    w.u8(op32);
+    w.u32(length);
+  }
+}
+
+function encodeValue(w: Writer, value: unknown): void {
+  if (value === null || value === undefined) {
+    w.u8(0xc0);
+  } else if (typeof value === 'boolean') {
+    w.u8(value ? 0xc3 : 0xc2);
+  } else if (typeof value === 'number') {
+    encodeNumber(w, value);
+  } else if (typeof value === 'string') {
+    const utf8 = textEncoder.encode(value);
+    if (utf8.length < 32) {
+      w.u8(0xa0 | utf8.length);
+    } else if (utf8.length <= 0xff) {
+      w.u8(0xd9);
+      w.u8(utf8.length);
+    } else {
+      encodeLength(w, utf8.length, 0, -1, 0xda, 0xdb);
+    }
+    w.bytes(utf8);
+  } else if (Array.isArray(value)) {
+    encodeLength(w, value.length, 0x90, 15, 0xdc, 0xdd);
+    value.forEach(item => encodeValue(w, item));
+  } else if (typeof value === 'object') {
+    // Like JSON.stringify, fields set to undefined are left out
+    const entries = Object.entries(value as Record<string, unknown>).filter(([, item]) => item !== undefined);
+    encodeLength(w, entries.length, 0x80, 15, 0xde, 0xdf);
+    entries.forEach(([key, item]) => {
+      encodeValue(w, key);
+      encodeValue(w, item);
+    });
+  } else {
+    throw new Error(`msgpack: can't encode a ${typeof value}`);
+  }
+}
+
+export function encode(value: unknown): Uint8Array {
+  const w = new Writer();
+  encodeValue(w, value);
+  return w.result();
+}
+
+class Reader {
+  private data: Uint8Array;
+  private view: DataView;
+  offset = 0;
+
+  constructor(data: Uint8Array) {
+    this.data = data;
+    this.view = new DataView(data.buffer, data.byteOffset, data.byteLength);
+  }
+
+  u8(): number { return this.view.getUint8(this.offset++); }
+  i8(): number { return this.view.getInt8(this.offset++); }
+  u16(): number { const v = this.view.getUint16(this.offset); this.offset += 2; return v; }
+  i16(): number { const v = this.view.getInt16(this.offset); this.offset += 2; return v; }
+  u32(): number { const v = this.view.getUint32(this.offset); this.offset += 4; return v; }
+  i32(): number { const v = this.view.getInt32(this.offset); this.offset += 4; return v; }
+  u64(): number { const v = Number(this.view.getBigUint64(this.offset)); this.offset += 8; return v; }
+  i64(): number { const v = Number(this.view.getBigInt64(this.offset)); this.offset += 8; return v; }
+  f32(): number { const v = this.view.getFloat32(this.offset); this.offset += 4; return v; }
+  f64(): number { const v = this.view.getFloat64(this.offset); this.offset += 8; return v; }
+
+  bytes(n: number): Uint8Array {
+    const v = this.data.subarray(this.offset, this.offset + n);
+    this.offset += n;
+    return v;
+  }
+
+  str(n: number): string { return textDecoder.decode(this.bytes(n)); }
+
+  array(n: number): unknown[] {
+    const items: unknown[] = [];
+    for (let i = 0; i < n; i++) items.push(this.value());
+    return items;
+  }
+
+  map(n: number): Record<string, unknown> {
+    const obj: Record<string, unknown> = {};
+    for (let i = 0; i < n; i++) {
+      const key = String(this.value());
+      obj[key] = this.value();
+    }
+    return obj;
+  }
+
+  value(): unknown {
+    const b = this.u8();
+    if (b < 0x80) return b;
+    if (b >= 0xe0) return b - 0x100;
+    if ((b & 0xf0) === 0x80) return this.map(b & 0x0f);
+    if ((b & 0xf0) === 0x90) return this.array(b & 0x0f);
+    if ((b & 0xe0) === 0xa0) return this.str(b & 0x1f);
+
+    switch (b) {
+      case 0xc0: return null;
+      case 0xc2: return false;
+      case 0xc3: return true;
+      case 0xc4: return this.bytes(this.u8());
+      case 0xc5: return this.bytes(this.u16());
+      case 0xc6: return this.bytes(this.u32());
+      case 0xc7: return this.ext(this.u8());
+      case 0xc8: return this.ext(this.u16());
+      case 0xc9: return this.ext(this.u32());
+      case 0xca: return this.f32();
+      case 0xcb: return this.f64();
+      case 0xcc: return this.u8();
+      case 0xcd: return this.u16();
+      case 0xce: return this.u32();
+      case 0xcf: return this.u64();
+      case 0xd0: return this.i8();
+      case 0xd1: return this.i16();
+      case 0xd2: return this.i32();
+      case 0xd3: return this.i64();
+      case 0xd4: return this.ext(1);
+      case 0xd5: return this.ext(2);
+      case 0xd6: return this.ext(4);
+      case 0xd7: return this.ext(8);
+      case 0xd8: return this.ext(16);
+      case 0xd9: return this.str(this.u8());
+      case 0xda: return this.str(this.u16());
+      case 0xdb: return this.str(this.u32());
+      case 0xdc: return this.array(this.u16());
+      case 0xdd: return this.array(this.u32());
+      case 0xde: return this.map(this.u16());
+      case 0xdf: return this.map(this.u32());
+    }
+    throw new Error(`msgpack: invalid byte 0x${b.toString(16)}`);
+  }
+
+  // Extension types carry nothing we use; skip the type byte and keep the data
+  ext(n: number): Uint8Array {
+    this.offset += 1;
+    return this.bytes(n);
+  }
+}
+
+export function decode(data: Uint8Array): unknown {
+  return new Reader(data).value();
+}
@@ -0,0 +1,176 @@
+// Client side of the server's operational transformation engine (api/ot).
+// Operations use the same JSON encoding as the server: a flat array where a positive
+// number retains, a negative number deletes and a string inserts, e.g. [5, "abc", -2].
+// All lengths are counted in Unicode code points, like Go runes.
+
+import DiffMatchPatch from 'diff-match-patch';
+
+export type OpComponent = number | string;
+export type Operation = OpComponent[];
+
+const codePoints = (s: string): string[] => Array.from(s);
+const lengthOf = (s: string): number => codePoints(s).length;
+
+const isRetain = (c: OpComponent | undefined): c is number => typeof c === 'number' && c > 0;
+const isDelete = (c: OpComponent | undefined): c is number => typeof c === 'number' && c < 0;
+const isInsert = (c: OpComponent | undefined): c is string => typeof c === 'string';
+
+// Builder helpers that merge consecutive components of the same kind
+function retain(op: Operation, n: number): void {
+  if (n <= 0) return;
+  const last = op[op.length - 1];
+  if (isRetain(last)) op[op.length - 1] = last + n;
+  else op.push(n);
+}
+
+function insert(op: Operation, s: string): void {
+  if (s === '') return;
+  const last = op[op.length - 1];
+  if (isInsert(last)) {
+    op[op.length - 1] = last + s;
+  } else if (isDelete(last)) {
+    // Keep inserts before deletes, same canonical form as the server
+    const prev = op[op.length - 2];
+    if (isInsert(prev)) op[op.length - 2] = prev + s;
+    else op.splice(op.length - 1, 0, s);
+  } else {
+    op.push(s);
+  }
+}
+
+function del(op: Operation, n: number): void {
+  if (n <= 0) return;
+  const last = op[op.length - 1];
+  if (isDelete(last)) op[op.length - 1] = last - n;
+  else op.push(-n);
+}
+
+// Build an operation turning `from` into `to`
+export function fromDiff(from: string, to: string): Operation {
+  const dmp = new DiffMatchPatch();
+  const diffs = dmp.diff_main(from, to);
+  dmp.diff_cleanupEfficiency(diffs);
+
+  const op: Operation = [];
+  for (const diff of diffs) {
+    // Diffs are array-like objects, not real arrays, so index instead of destructuring
+    const kind = diff[0];
+    const text = diff[1];
+    if (kind === DiffMatchPatch.DIFF_EQUAL) retain(op, lengthOf(text));
+    else if (kind === DiffMatchPatch.DIFF_INSERT) insert(op, text);
+    else del(op, lengthOf(text));
+  }
+  return op;
+}
+
+export function isNoop(op: Operation): boolean {
+  return op.length === 0 || (op.length === 1 && isRetain(op[0]));
+}
+
+// Apply an operation to a document
+export function apply(op: Operation, doc: string): string {
+  const chars = codePoints(doc);
+  const result: string[] = [];
+  let pos = 0;
+
+  for (const c of op) {
+    if (isRetain(c)) {
+      if (pos + c > chars.length) throw new Error('ot: operation longer than document');
+      result.push(chars.slice(pos, pos + c).join(''));
+      pos += c;
+    } else if (isInsert(c)) {
+      result.push(c);
+    } else {
+      pos -= c;
+    }
+  }
+
+  if (pos !== chars.length) throw new Error('ot: operation shorter than document');
+  return result.join('');
+}
+
+// Walks the components of an operation, allowing partial consumption
+class Iter {
+  private i = 0;
+  cur: OpComponent | undefined;
+
+  constructor(private readonly op: Operation) {
+    this.cur = op[0];
+  }
+
+  length(): number {
+    const c = this.cur;
+    if (c === undefined) return 0;
+    return isInsert(c) ? lengthOf(c) : Math.abs(c);
+  }
+
+  take(n: number): OpComponent {
+    const c = this.cur!;
+    let taken: OpComponent;
+    if (isInsert(c)) {
+      const chars = codePoints(c);
+      taken = chars.slice(0, n).join('');
+      this.cur = chars.slice(n).join('');
+    } else if (isRetain(c)) {
+      taken = n;
+      this.cur = c - n;
+    } else {
+      taken = -n;
+      this.cur = c + n;
+    }
+    if (this.length() === 0) this.cur = this.op[++this.i];
+    return taken;
+  }
+}
+
+// transform(a, b) returns [a', b'] with apply(b', apply(a, doc)) === apply(a', apply(b, doc)).
+// a's inserts win ties, matching the server which transforms the incoming operation first.
+export function transform(a: Operation, b: Operation): [Operation, Operation] {
+  const aPrime: Operation = [];
+  const bPrime: Operation = [];
+  const it1 = new Iter(a);
+  const it2 = new Iter(b);
+
+  while (it1.cur !== undefined || it2.cur !== undefined) {
+    if (isInsert(it1.cur)) {
+      const s = it1.take(it1.length()) as string;
+      insert(aPrime, s);
+      retain(bPrime, lengthOf(s));
+      continue;
+    }
+    if (isInsert(it2.cur)) {
+      const s = it2.take(it2.length()) as string;
+      retain(aPrime, lengthOf(s));
+      insert(bPrime, s);
+      continue;
+    }
+    if (it1.cur === undefined || it2.cur === undefined) {
+      throw new Error('ot: cannot transform operations of different lengths');
+    }
+
+    const n = Math.min(it1.length(), it2.length());
+    const c1 = it1.take(n);
+    const c2 = it2.take(n);
+
+    if (isRetain(c1) && isRetain(c2)) {
+      retain(aPrime, n);
+      retain(bPrime, n);
+    } else if (isDelete(c1) && isRetain(c2)) {
+      del(aPrime, n);
+    } else if (isRetain(c1) && isDelete(c2)) {
+      del(bPrime, n);
+    }
+    // delete/delete: both removed the same text, nothing to emit
+  }
+
+  return [aPrime, bPrime];
+}
+
+// Carry the edits that turned `base` into `local` over to `target`, a newer copy of the document we
+// have no operations for (e.g. a snapshot after a long disconnect). Fuzzy patching, so best effort.
+export function rebaseText(base: string, local: string, target: string): string {
+  if (base === local) return target;
+  const dmp = new DiffMatchPatch();
+  const [result] = dmp.patch_apply(dmp.patch_make(base, local), target);
+  return result;
+}
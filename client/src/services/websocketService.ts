@@ -1,18 +1,118 @@
 // Manages a single WebSocket connection to the CoWrite backend.
 // Provides typed send/receive, reconnection logic, and an event-emitter pattern
 
+import type { Operation } from './ot';
+import type { StateVector, Update as CrdtUpdate } from './crdt';
+import { encode, decode } from './msgpack';
+
 const WS_BASE_URL = import.meta.env.VITE_WS_BASE || 'ws://localhost:8080';
 
+// Close code the server uses when the user's access to the document is revoked (mirrors HTTP 403)
+const ACCESS_DENIED_CLOSE_CODE = 4403;
+
+// Close code the server uses when the document was moved to the trash (mirrors HTTP 410)
+const DOCUMENT_DELETED_CLOSE_CODE = 4410;
+
+// Close code the server uses when the connection was idle for too long (mirrors HTTP 408)
+const IDLE_TIMEOUT_CLOSE_CODE = 4408;
+
+// Close code the server uses when we kept sending faster than its rate limits (mirrors HTTP 429)
+const RATE_LIMITED_CLOSE_CODE = 4429;
+
+// User activity that brings an idle-closed connection back
+const ACTIVITY_EVENTS = ['keydown', 'pointerdown', 'focus'] as const;
+
+// Version of the message protocol this client speaks; the server confirms the one in use in our join
+export const PROTOCOL_VERSION = 3;
+
+// Message encodings, offered as WebSocket subprotocols. MessagePack is smaller and is used unless
+// VITE_WS_BINARY is "false"; the server picks it if it can, JSON otherwise.
+const MSGPACK_SUBPROTOCOL = 'cowrite.msgpack';
+const JSON_SUBPROTOCOL = 'cowrite.json';
+const SUBPROTOCOLS = import.meta.env.VITE_WS_BINARY === 'false'
+  ? [JSON_SUBPROTOCOL]
+  : [MSGPACK_SUBPROTOCOL, JSON_SUBPROTOCOL];
+
+// Connection and sync details go to the console only when VITE_WS_DEBUG is "true"
+const DEBUG = import.meta.env.VITE_WS_DEBUG === 'true';
+
+export function debugLog(...args: unknown[]): void {
+  if (DEBUG) console.log(...args);
+}
+
 
 
 export interface WebSocketMessage {
   type: string;       // "edit", "join", "leave", "cursor", …
+  id?: string;        // client-chosen ID, so we can recognise our own messages when the server echoes them
   documentId: number;
   userId: number;
   username: string;
-  payload?: unknown;  // type-specific data; will be typed per message kind later
+  payload?: unknown;  // type-specific data; see ClientPayloads for what we send
+}
+
+// Payloads of the messages the server accepts from us. It validates each one strictly
+// (no unknown fields) and answers anything malformed with an "error" message.
+export interface ClientPayloads {
+  sync: { revision: number | null; pendingId?: string; reason?: 'checksum-mismatch' };
+  edit: { ops: Operation; baseRevision: number; sentAt?: number };
+  'crdt-sync': { stateVector: StateVector; replica: string };
+  'crdt-update': { update: CrdtUpdate };
+  cursor: { position: number };
+  selection: { position: number; length: number };
+  chat: { text: string };
+  presence: { status: 'active' | 'away' };
+  typing: { target: 'chat' }; // typing in the document is worked out from our edits
+}
+
+// Payload of the "typing" and "idle" messages the server sends about another connection
+export interface TypingPayload {
+  session: string;
+  target: 'document' | 'chat';
+}
+
+// Where another connection's cursor (length 0) or selection is, as tracked by the server
+export interface CursorInfo {
+  session: string;
+  userId: number;
+  username: string;
+  color: string;
+  position: number;
+  length: number;
+}
+
+// A user with the document open, in however many tabs
+export interface MemberInfo {
+  userId: number;
+  username: string;
+  color: string;
+  connections: number;
+  status: 'active' | 'idle' | 'away'; // the most present of their tabs
+}
+
+// Snapshot of the room sent after our join
+export interface MembersPayload {
+  members: MemberInfo[];
+  cursors: CursorInfo[];
+}
+
+// A user's tabs or status changed; closedSession is set when one of their tabs closed
+export interface PresenceUpdatePayload extends MemberInfo {
+  closedSession?: string;
 }
 
+// Payload of an "error" message
+export interface ErrorPayload {
+  code: 'malformed-message' | 'unknown-type' | 'message-too-large' | 'invalid-payload';
+  message: string;
+}
+
+// Unique ID for a message we send
+export const newMessageId = (): string =>
+  typeof crypto !== 'undefined' && 'randomUUID' in crypto
+    ? crypto.randomUUID()
+    : `${Date.now()}-${Math.random().toString(36).slice(2)}`;
+
 // A callback that a component registers to hear about a particular message type.
 type MessageHandler = (message: WebSocketMessage) => void;
 
@@ -26,6 +126,7 @@ class WebSocketService {
   private readonly maxReconnectAttempts = 5;
   private readonly baseReconnectDelay = 1000; // 1 s — doubles on each retry (exponential back-off)
   private reconnectTimer: ReturnType<typeof setTimeout> | null = null;
+  private waitingForActivity = false; // closed for inactivity; reconnect on the next user action
 
   // Event system: maps message type -> array of handler functions
   private handlers: Map<string, MessageHandler[]> = new Map();
@@ -40,6 +141,7 @@ class WebSocketService {
   
   disconnect(): void {
     this.clearReconnectTimer();
+    this.stopWaitingForActivity();
     if (this.ws) {
       this.ws.close(1000, 'User left the document'); // 1000 = normal closure
       this.ws = null;
@@ -50,7 +152,7 @@ class WebSocketService {
   
    //Send a typed message to the server (which will broadcast it to the room).
    
-  send(type: string, payload?: unknown): void {
+  send<T extends keyof ClientPayloads>(type: T, payload: ClientPayloads[T], id?: string): void {
     if (!this.ws || this.ws.readyState !== WebSocket.OPEN) {
       console.warn('[WebSocket] Tried to send but connection is not open.');
       return;
@@ -58,13 +160,14 @@ class WebSocketService {
 
     const message: WebSocketMessage = {
       type,
+      id,
       documentId: this.documentId!,
       userId: 0,       // server will overwrite with the authenticated user's ID
       username: '',     // same — server stamps the real value
       payload,
     };
 
-    this.ws.send(JSON.stringify(message));
+    this.ws.send(this.ws.protocol === MSGPACK_SUBPROTOCOL ? encode(message) : JSON.stringify(message));
   }
 
   /**
@@ -106,17 +209,20 @@ class WebSocketService {
       return;
     }
 
-    const url = `${WS_BASE_URL}/ws/${this.documentId}?token=${token}`;
-    this.ws = new WebSocket(url);
+    const url = `${WS_BASE_URL}/ws/${this.documentId}?token=${token}&protocol=${PROTOCOL_VERSION}`;
+    this.ws = new WebSocket(url, SUBPROTOCOLS);
+    this.ws.binaryType = 'arraybuffer';
 
     this.ws.onopen = () => {
-      console.log(`[WebSocket] Connected to document ${this.documentId}`);
+      debugLog(`[WebSocket] Connected to document ${this.documentId}`);
       this.reconnectAttempts = 0; // successful connection resets backoff
     };
 
     this.ws.onmessage = (event: MessageEvent) => {
       try {
-        const message: WebSocketMessage = JSON.parse(event.data as string);
+        const message = (event.data instanceof ArrayBuffer
+          ? decode(new Uint8Array(event.data))
+          : JSON.parse(event.data as string)) as WebSocketMessage;
         this.dispatch(message);
       } catch (err) {
         console.error('[WebSocket] Failed to parse incoming message:', err);
@@ -129,16 +235,61 @@ class WebSocketService {
     };
 
     this.ws.onclose = (event) => {
-      console.log(`[WebSocket] Disconnected (code ${event.code}). Reason: ${event.reason}`);
+      debugLog(`[WebSocket] Disconnected (code ${event.code}). Reason: ${event.reason}`);
       this.ws = null;
 
       // Don't reconnect if the user intentionally left (code 1000)
       if (event.code === 1000) return;
 
+      // 4403 = server closed us because we no longer have access to this document
+      // 4410 = the owner moved the document to the trash
+      if (event.code === ACCESS_DENIED_CLOSE_CODE || event.code === DOCUMENT_DELETED_CLOSE_CODE) {
+        this.dispatch({
+          type: 'access-denied',
+          documentId: this.documentId!,
+          userId: 0,
+          username: '',
+          payload: { reason: event.reason },
+        });
+        return;
+      }
+
+      // 4408 = we were idle; don't hammer the server, come back when the user does something
+      if (event.code === IDLE_TIMEOUT_CLOSE_CODE) {
+        this.waitForActivity();
+        return;
+      }
+
+      // 4429 = we flooded the server; back off as after any drop, starting one step further
+      if (event.code === RATE_LIMITED_CLOSE_CODE) {
+        this.reconnectAttempts = Math.max(this.reconnectAttempts, 1);
+      }
+
       this.scheduleReconnect();
     };
   }
 
+  private waitForActivity(): void {
+    if (this.waitingForActivity) return;
+    this.waitingForActivity = true;
+    ACTIVITY_EVENTS.forEach((name) => window.addEventListener(name, this.handleActivity));
+  }
+
+  private stopWaitingForActivity(): void {
+    if (!this.waitingForActivity) return;
+    this.waitingForActivity = false;
+    ACTIVITY_EVENTS.forEach((name) => window.removeEventListener(name, this.handleActivity));
+  }
+
+  // Arrow function so it keeps `this` when used as an event listener
+  private handleActivity = (): void => {
+    this.stopWaitingForActivity();
+    this.reconnectAttempts = 0;
+    if (this.documentId !== null) {
+      this.openConnection();
+    }
+  };
+
   // Exponential back-off reconnection 
   private scheduleReconnect(): void {
     if (this.reconnectAttempts >= this.maxReconnectAttempts) {
@@ -148,7 +299,7 @@ class WebSocketService {
 
     const delay = this.baseReconnectDelay * Math.pow(2, this.reconnectAttempts);
     this.reconnectAttempts++;
-    console.log(`[WebSocket] Reconnecting in ${delay}ms (attempt ${this.reconnectAttempts})…`);
+    debugLog(`[WebSocket] Reconnecting in ${delay}ms (attempt ${this.reconnectAttempts})…`);
 
     this.reconnectTimer = setTimeout(() => {
       if (this.documentId !== null) {